@@ -0,0 +1,169 @@
+package redis
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// adminStatus is reported by admin endpoint
+type adminStatus struct {
+	Zones       []string               `json:"zones"`
+	LastRefresh *time.Time             `json:"last_refresh"`
+	Pool        *adminPoolStatus       `json:"pool,omitempty"`
+	Views       map[string]adminStatus `json:"views,omitempty"`
+}
+
+type adminPoolStatus struct {
+	Active int `json:"active"`
+	Idle   int `json:"idle"`
+}
+
+// startAdmin serves zone name cache and pool status as json on admin address
+func (redis *Redis) startAdmin() error {
+	if redis.adminAddress == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", redis.adminAddress)
+	if err != nil {
+		return err
+	}
+	redis.adminListener = ln
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zones", redis.serveAdmin)
+	mux.HandleFunc("/meta", redis.serveMeta)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func (redis *Redis) stopAdmin() error {
+	if redis.adminListener == nil {
+		return nil
+	}
+	err := redis.adminListener.Close()
+	redis.adminListener = nil
+	return err
+}
+
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (redis *Redis) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	status := redis.adminStatus()
+	if redis.Pool != nil {
+		stats := redis.Pool.Stats()
+		status.Pool = &adminPoolStatus{Active: stats.ActiveCount, Idle: stats.IdleCount}
+	}
+	for _, v := range redis.views {
+		if status.Views == nil {
+			status.Views = make(map[string]adminStatus)
+		}
+		status.Views[v.name] = v.redis.adminStatus()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (redis *Redis) adminStatus() adminStatus {
+	redis.zonesLock.RLock()
+	zones := append([]string{}, redis.Zones...)
+	refreshed := redis.LastZoneUpdate
+	redis.zonesLock.RUnlock()
+
+	sort.Strings(zones)
+	status := adminStatus{Zones: zones}
+	if !refreshed.IsZero() {
+		status.LastRefresh = &refreshed
+	}
+	return status
+}
+
+// serveMeta returns metadata stored with records of a location, location is
+// selected by zone and name query parameters
+func (redis *Redis) serveMeta(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	zone := dns.Fqdn(strings.ToLower(r.URL.Query().Get("zone")))
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "@"
+	}
+	val, err := redisCon.String(redis.read(withPrimary(context.Background()), "HGET", redis.keyPrefix+zone+redis.keySuffix, name))
+	if err == redisCon.ErrNil {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	meta, err := recordMeta(val)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// recordMeta returns "meta" fields of a location and of its records, record
+// metadata is listed by record type in the order records are stored with null
+// for records without metadata. metadata is not parsed when serving queries
+func recordMeta(val string) (map[string]interface{}, error) {
+	data, err := recordJSON(val)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	meta := make(map[string]interface{})
+	for name, raw := range fields {
+		if name == "meta" {
+			meta[name] = raw
+			continue
+		}
+		var item struct {
+			Meta json.RawMessage `json:"meta"`
+		}
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			if json.Unmarshal(raw, &item) == nil && item.Meta != nil {
+				meta[name] = item.Meta
+			}
+			continue
+		}
+		metas := make([]json.RawMessage, len(items))
+		found := false
+		for i := range items {
+			item.Meta = nil
+			if json.Unmarshal(items[i], &item) == nil && item.Meta != nil {
+				metas[i], found = item.Meta, true
+			} else {
+				metas[i] = json.RawMessage("null")
+			}
+		}
+		if found {
+			meta[name] = metas
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,209 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+type aliasEntry struct {
+	answers    []dns.RR
+	expires    time.Time
+	refreshing bool
+	// ready is closed when the first resolution of target finished, queries
+	// arriving meanwhile wait for it instead of sending their own
+	ready chan struct{}
+	err   error
+}
+
+// ALIAS returns records of type qtype of the ALIAS target, owned by name.
+// resolved records are cached for their ttl, stale entries are returned
+// while being refreshed in background
+func (redis *Redis) ALIAS(ctx context.Context, name string, z *Zone, qtype uint16, record *Record) ([]dns.RR, error) {
+	target := strings.ToLower(dns.Fqdn(record.ALIAS.Target))
+	resolved, err := redis.cachedResolve(ctx, target, qtype, aliasTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var answers []dns.RR
+	for _, rr := range resolved {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		r := dns.Copy(rr)
+		r.Header().Name = dns.Fqdn(name)
+		r.Header().Ttl = redis.recordTtl(z, record.ALIAS.Ttl)
+		if rr.Header().Ttl < r.Header().Ttl {
+			r.Header().Ttl = rr.Header().Ttl
+		}
+		answers = append(answers, r)
+	}
+	return answers, nil
+}
+
+// cachedResolve returns records of type qtype of target and CNAMEs followed by
+// resolver from alias cache, resolving target once for concurrent queries if it
+// is not cached. returned records are shared with the cache and must not be modified
+func (redis *Redis) cachedResolve(ctx context.Context, target string, qtype uint16, timeout time.Duration) ([]dns.RR, error) {
+	key := target + "/" + dns.TypeToString[qtype]
+
+	redis.aliasLock.Lock()
+	if redis.aliasCache == nil {
+		redis.aliasCache = make(map[string]*aliasEntry)
+	}
+	entry, ok := redis.aliasCache[key]
+	if !ok {
+		entry = &aliasEntry{ready: make(chan struct{})}
+		redis.aliasCache[key] = entry
+		redis.aliasLock.Unlock()
+
+		answers, ttl, err := redis.resolve(ctx, target, qtype, timeout)
+		redis.aliasLock.Lock()
+		if err != nil {
+			// failed resolutions are not cached, next query tries again
+			entry.err = err
+			delete(redis.aliasCache, key)
+		} else {
+			entry.answers = answers
+			entry.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+		close(entry.ready)
+		redis.aliasLock.Unlock()
+		return answers, err
+	}
+	redis.aliasLock.Unlock()
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	redis.aliasLock.Lock()
+	defer redis.aliasLock.Unlock()
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	if time.Now().After(entry.expires) && !entry.refreshing {
+		entry.refreshing = true
+		go redis.refreshAlias(key, target, qtype, timeout)
+	}
+	// refreshAlias replaces answers instead of modifying them
+	return entry.answers, nil
+}
+
+func (redis *Redis) refreshAlias(key string, target string, qtype uint16, timeout time.Duration) {
+	answers, ttl, err := redis.resolve(context.Background(), target, qtype, timeout)
+
+	redis.aliasLock.Lock()
+	defer redis.aliasLock.Unlock()
+	entry := redis.aliasCache[key]
+	entry.refreshing = false
+	if err != nil {
+		fmt.Println("alias refresh error : ", target, err)
+		return
+	}
+	entry.answers = answers
+	entry.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// resolve queries configured resolvers for target and returns records of
+// type qtype and CNAMEs in the answer along with their lowest ttl
+func (redis *Redis) resolve(ctx context.Context, target string, qtype uint16, timeout time.Duration) ([]dns.RR, uint32, error) {
+	resp, err := redis.exchange(ctx, target, qtype, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	var answers []dns.RR
+	ttl := uint32(aliasMaxTtl)
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != qtype && rr.Header().Rrtype != dns.TypeCNAME {
+			continue
+		}
+		answers = append(answers, rr)
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return answers, ttl, nil
+}
+
+// exchange sends a recursive query for target to configured resolvers in
+// turn and returns the first successful response, each resolver is waited for
+// timeout unless ctx is done earlier
+func (redis *Redis) exchange(ctx context.Context, target string, qtype uint16, timeout time.Duration) (*dns.Msg, error) {
+	resolvers := redis.resolvers
+	if len(resolvers) == 0 {
+		config, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range config.Servers {
+			resolvers = append(resolvers, server+":"+config.Port)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(target, qtype)
+	m.RecursionDesired = true
+
+	c := new(dns.Client)
+	err := fmt.Errorf("no resolver configured")
+	for _, resolver := range resolvers {
+		var resp *dns.Msg
+		exchangeCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, _, err = c.ExchangeContext(exchangeCtx, m, resolver)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// resolveCname returns records of type qtype of an out-of-zone CNAME target
+// resolved using configured resolvers, preceded by CNAMEs followed by resolver.
+// responses are shared with ALIAS targets in alias cache. nothing is returned
+// if resolver followed more than depth CNAMEs
+func (redis *Redis) resolveCname(ctx context.Context, target string, qtype uint16, depth int) []dns.RR {
+	resolved, err := redis.cachedResolve(ctx, target, qtype, redis.cnameTimeout)
+	if err != nil {
+		fmt.Println("cname resolve error : ", target, err)
+		return nil
+	}
+	var answers []dns.RR
+	name := target
+	for i := 0; i <= depth; i++ {
+		var cname *dns.CNAME
+		for _, rr := range resolved {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			} else if rr.Header().Rrtype == qtype {
+				answers = append(answers, dns.Copy(rr))
+			}
+		}
+		if cname == nil {
+			return answers
+		}
+		answers = append(answers, dns.Copy(cname))
+		name = cname.Target
+	}
+	return nil
+}
+
+const (
+	resolvConf   = "/etc/resolv.conf"
+	aliasTimeout = 2 * time.Second
+	aliasMaxTtl  = 3600
+)
@@ -1,9 +1,10 @@
 package redis
 
 import (
-	"testing"
 	"fmt"
 	"math/rand"
+	"strings"
+	"testing"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
@@ -28,7 +29,7 @@ var benchmarkEntries = [][]string{
 	},
 }
 
-var testCasesHit = []test.Case {
+var testCasesHit = []test.Case{
 	{
 		Qname: "example.com.", Qtype: dns.TypeA,
 		Answer: []dns.RR{
@@ -55,7 +56,7 @@ var testCasesHit = []test.Case {
 	},
 }
 
-var testCasesMiss = []test.Case {
+var testCasesMiss = []test.Case{
 	{
 		Qname: "q.example.com.", Qtype: dns.TypeA,
 		Rcode: dns.RcodeNameError,
@@ -79,7 +80,7 @@ func BenchmarkHit(b *testing.B) {
 	r := newRedisPlugin()
 	conn := r.Pool.Get()
 	defer conn.Close()
-	conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix + "*" + r.keySuffix)
+	conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix+"*"+r.keySuffix)
 	for _, cmd := range benchmarkEntries {
 		err := r.save(zone, cmd[0], cmd[1])
 		if err != nil {
@@ -87,7 +88,7 @@ func BenchmarkHit(b *testing.B) {
 		}
 	}
 	b.ResetTimer()
-	for i :=0; i<b.N; i++ {
+	for i := 0; i < b.N; i++ {
 		j := rand.Intn(len(testCasesHit))
 		m := testCasesHit[j].Msg()
 		rec := dnstest.NewRecorder(&test.ResponseWriter{})
@@ -100,7 +101,7 @@ func BenchmarkMiss(b *testing.B) {
 	r := newRedisPlugin()
 	conn := r.Pool.Get()
 	defer conn.Close()
-	conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix + "*" + r.keySuffix)
+	conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix+"*"+r.keySuffix)
 	for _, cmd := range benchmarkEntries {
 		err := r.save(zone, cmd[0], cmd[1])
 		if err != nil {
@@ -108,10 +109,117 @@ func BenchmarkMiss(b *testing.B) {
 		}
 	}
 	b.ResetTimer()
-	for i :=0; i<b.N; i++ {
+	for i := 0; i < b.N; i++ {
 		j := rand.Intn(len(testCasesMiss))
 		m := testCasesMiss[j].Msg()
 		rec := dnstest.NewRecorder(&test.ResponseWriter{})
 		r.ServeDNS(ctxt, rec, m)
 	}
 }
+
+func BenchmarkAXFR(b *testing.B) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "axfr.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.axfr.example.\",\"ns\":\"ns1.axfr.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	for i := 0; i < 10000; i++ {
+		r.save(zone, fmt.Sprintf("host%d", i), fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"10.0.%d.%d\"}]}", i/256, i%256))
+	}
+	z := r.load(zone)
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		keys = append(keys, key)
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				r.get(key, z)
+			}
+		}
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r.getMany(keys, z)
+		}
+	})
+}
+
+func BenchmarkKeyMatches(b *testing.B) {
+	z := &Zone{Name: "large.example.", Locations: make(map[string]struct{})}
+	for i := 0; i < 50000; i++ {
+		z.Locations[fmt.Sprintf("host%d.sub%d", i, i%100)] = struct{}{}
+	}
+	keys := []string{"sub42", "host123.sub23", "missing", "host1.missing"}
+
+	// linear scan of all locations, as done before the name index
+	linear := func(key string, z *Zone) bool {
+		for value := range z.Locations {
+			if value == key || strings.HasSuffix(value, "."+key) {
+				return true
+			}
+		}
+		return false
+	}
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linear(keys[i%len(keys)], z)
+		}
+	})
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			keyMatches(keys[i%len(keys)], z)
+		}
+	})
+}
+
+func BenchmarkGlue(b *testing.B) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "glue.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	var mx, targets []string
+	for i := 0; i < 10; i++ {
+		target := fmt.Sprintf("mail%d.glue.example.", i)
+		r.save(zone, fmt.Sprintf("mail%d", i), fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.%d\"}]}", i))
+		mx = append(mx, fmt.Sprintf("{\"host\":\"%s\", \"preference\":%d}", target, i))
+		targets = append(targets, target)
+	}
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.glue.example.\",\"ns\":\"ns1.glue.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"mx\":["+strings.Join(mx, ",")+"]}")
+	r.LoadZones()
+	z := r.load(zone)
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var extras []dns.RR
+			for _, target := range targets {
+				extras = appendHosts(extras, r.hosts(target, z))
+			}
+		}
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r.glue(targets, z)
+		}
+	})
+	b.Run("query", func(b *testing.B) {
+		m := new(dns.Msg)
+		m.SetQuestion(zone, dns.TypeMX)
+		for i := 0; i < b.N; i++ {
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(ctxt, w, m)
+			if len(w.Msg.Extra) != len(targets) {
+				b.Fatalf("expected %d glue records got %d", len(targets), len(w.Msg.Extra))
+			}
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package redis
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordCache keeps zones and records loaded from redis for a short time
+// to reduce round-trips to redis server under load. entries are kept by zone
+// so all entries of a zone are dropped at once
+type recordCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]map[string]cacheEntry
+	size    int
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newRecordCache(ttl time.Duration) *recordCache {
+	return &recordCache{
+		ttl:     ttl,
+		entries: make(map[string]map[string]cacheEntry),
+	}
+}
+
+// cacheZone returns zone of a cache key, keys are a zone name or a zone name
+// and location separated by a slash
+func cacheZone(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// lookup returns entry of key, lock must be held
+func (c *recordCache) lookup(key string) (cacheEntry, bool) {
+	entry, ok := c.entries[cacheZone(key)][key]
+	return entry, ok
+}
+
+func (c *recordCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok || time.Now().After(entry.expires) {
+		cacheMisses.Inc()
+		return nil, false
+	}
+	cacheHits.Inc()
+	return entry.value, true
+}
+
+// stale returns value of key if it expired less than age ago
+func (c *recordCache) stale(key string, age time.Duration) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok || time.Now().After(entry.expires.Add(age)) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *recordCache) set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.size >= recordCacheLimit {
+		c.entries = make(map[string]map[string]cacheEntry)
+		c.size = 0
+	}
+	zone := cacheZone(key)
+	entries, ok := c.entries[zone]
+	if !ok {
+		entries = make(map[string]cacheEntry)
+		c.entries[zone] = entries
+	}
+	if _, ok := entries[key]; !ok {
+		c.size++
+	}
+	entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate removes cached locations and records of zone, or a single
+// entry if key holds a location
+func (c *recordCache) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	zone := cacheZone(key)
+	entries := c.entries[zone]
+	if zone != key {
+		if _, ok := entries[key]; ok {
+			delete(entries, key)
+			c.size--
+		}
+		return
+	}
+	c.size -= len(entries)
+	delete(c.entries, zone)
+}
+
+const recordCacheLimit = 100000
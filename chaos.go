@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// isChaosQuery checks if state is a CHAOS class query for server version or
+// identity names answered by chaosResponse
+func isChaosQuery(state request.Request) bool {
+	if state.QClass() != dns.ClassCHAOS {
+		return false
+	}
+	_, ok := chaosNames[strings.ToLower(state.Name())]
+	return ok
+}
+
+// chaosResponse writes server version or id as a CHAOS TXT record, queries of
+// other types get an empty answer
+func (redis *Redis) chaosResponse(state request.Request) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.RecursionAvailable = true, false
+
+	if t := state.QType(); t == dns.TypeTXT || t == dns.TypeANY {
+		text := redis.chaosVersion
+		if chaosNames[strings.ToLower(state.Name())] == chaosKindId {
+			text = redis.chaosId
+		}
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		r.Txt = split255(text)
+		m.Answer = append(m.Answer, r)
+	}
+
+	state.SizeAndDo(m)
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+const (
+	chaosKindVersion = iota
+	chaosKindId
+)
+
+var chaosNames = map[string]int{
+	"version.bind.":   chaosKindVersion,
+	"version.server.": chaosKindVersion,
+	"hostname.bind.":  chaosKindId,
+	"id.server.":      chaosKindId,
+}
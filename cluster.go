@@ -0,0 +1,370 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// cluster routes commands to redis cluster nodes by hash slot of their key,
+// following MOVED and ASK redirections
+type cluster struct {
+	seeds   []string
+	newPool func(addr string) *redisCon.Pool
+
+	lock      sync.RWMutex
+	slots     []string
+	pools     map[string]*redisCon.Pool
+	refreshed time.Time
+}
+
+func newCluster(seeds []string, newPool func(addr string) *redisCon.Pool) *cluster {
+	return &cluster{
+		seeds:   seeds,
+		newPool: newPool,
+		slots:   make([]string, clusterSlots),
+		pools:   make(map[string]*redisCon.Pool),
+	}
+}
+
+// refresh loads slot map from the first reachable node
+func (c *cluster) refresh() error {
+	c.lock.RLock()
+	nodes := append([]string(nil), c.seeds...)
+	for addr := range c.pools {
+		nodes = append(nodes, addr)
+	}
+	c.lock.RUnlock()
+
+	err := errors.New("no cluster node available")
+	for _, node := range nodes {
+		var slots []string
+		if slots, err = c.clusterSlots(node); err == nil {
+			c.lock.Lock()
+			c.slots = slots
+			c.refreshed = time.Now()
+			c.lock.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+// refreshAfterError reloads slot map in background after a connection error,
+// a failed node may have been replaced. refreshes are at most one per
+// clusterRefreshInterval
+func (c *cluster) refreshAfterError() {
+	c.lock.Lock()
+	if time.Since(c.refreshed) < clusterRefreshInterval {
+		c.lock.Unlock()
+		return
+	}
+	c.refreshed = time.Now()
+	c.lock.Unlock()
+	go c.refresh()
+}
+
+func (c *cluster) clusterSlots(node string) ([]string, error) {
+	conn := c.pool(node).Get()
+	defer conn.Close()
+
+	ranges, err := redisCon.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, clusterSlots)
+	for _, r := range ranges {
+		info, err := redisCon.Values(r, nil)
+		if err != nil || len(info) < 3 {
+			return nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		start, _ := redisCon.Int(info[0], nil)
+		end, _ := redisCon.Int(info[1], nil)
+		master, err := redisCon.Values(info[2], nil)
+		if err != nil || len(master) < 2 || start < 0 || end >= clusterSlots {
+			return nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		host, _ := redisCon.String(master[0], nil)
+		port, _ := redisCon.Int(master[1], nil)
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+func (c *cluster) pool(addr string) *redisCon.Pool {
+	c.lock.RLock()
+	p, ok := c.pools[addr]
+	c.lock.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p, ok = c.pools[addr]; !ok {
+		p = c.newPool(addr)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// masters returns address of all nodes serving slots
+func (c *cluster) masters() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	var masters []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			masters = append(masters, addr)
+		}
+	}
+	return masters
+}
+
+func (c *cluster) node(slot int) string {
+	c.lock.RLock()
+	addr := c.slots[slot]
+	c.lock.RUnlock()
+	if addr == "" && len(c.seeds) > 0 {
+		return c.seeds[0]
+	}
+	return addr
+}
+
+// do runs a command on the node serving its key
+func (c *cluster) do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.doWithTimeout(0, cmd, args...)
+}
+
+// doWithTimeout runs a command on the node serving its key, replies are read
+// with timeout instead of the configured read timeout if it is set
+func (c *cluster) doWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(cmd) {
+	case "KEYS":
+		return c.keys(timeout, args...)
+	}
+
+	slot := -1
+	if key, ok := commandKey(cmd, args); ok {
+		slot = keySlot(key)
+	}
+	addr := ""
+	if slot >= 0 {
+		addr = c.node(slot)
+	} else if masters := c.masters(); len(masters) > 0 {
+		addr = masters[0]
+	} else if len(c.seeds) > 0 {
+		addr = c.seeds[0]
+	}
+
+	asking := false
+	for i := 0; i < clusterRedirections; i++ {
+		conn := c.pool(addr).Get()
+		if asking {
+			conn.Do("ASKING")
+		}
+		reply, err := nodeDo(conn, timeout, cmd, args...)
+		conn.Close()
+
+		redirect, ok := err.(redisCon.Error)
+		if !ok {
+			if err != nil {
+				c.refreshAfterError()
+			}
+			return reply, err
+		}
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+		addr, asking = fields[2], fields[0] == "ASK"
+		if !asking {
+			if s, err := strconv.Atoi(fields[1]); err == nil && s >= 0 && s < clusterSlots {
+				c.lock.Lock()
+				c.slots[s] = addr
+				c.lock.Unlock()
+			}
+		}
+	}
+	return nil, fmt.Errorf("too many cluster redirections for %s", cmd)
+}
+
+// keys runs KEYS on all masters and merges the results
+func (c *cluster) keys(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	var keys []interface{}
+	for _, addr := range c.masters() {
+		conn := c.pool(addr).Get()
+		reply, err := redisCon.Values(nodeDo(conn, timeout, "KEYS", args...))
+		conn.Close()
+		if err != nil {
+			if _, ok := err.(redisCon.Error); !ok {
+				c.refreshAfterError()
+			}
+			return nil, err
+		}
+		keys = append(keys, reply...)
+	}
+	return keys, nil
+}
+
+// nodeDo runs cmd on conn of a cluster node, with timeout if it is set
+func nodeDo(conn redisCon.Conn, timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if timeout > 0 {
+		return redisCon.DoWithTimeout(conn, timeout, cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+func (c *cluster) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, p := range c.pools {
+		p.Close()
+	}
+	c.pools = make(map[string]*redisCon.Pool)
+	return nil
+}
+
+// commandKey returns the key argument of cmd
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	index := 0
+	switch strings.ToUpper(cmd) {
+	case "PING", "INFO", "ECHO", "TIME", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := redisCon.Int(args[1], nil); err != nil || n == 0 {
+			return "", false
+		}
+		index = 2
+	}
+	if len(args) <= index {
+		return "", false
+	}
+	key, err := redisCon.String(args[index], nil)
+	return key, err == nil
+}
+
+// keySlot returns cluster hash slot of key, only the hash tag is hashed if key has one
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 implements CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// clusterConn implements redis.Conn on top of cluster, pipelined commands
+// are sent one by one on Flush
+type clusterConn struct {
+	cluster *cluster
+	timeout time.Duration
+	pending [][]interface{}
+	replies []clusterReply
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+func (cc *clusterConn) Close() error { return nil }
+
+func (cc *clusterConn) Err() error { return nil }
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// flush pending commands and return all replies
+		cc.Flush()
+		var (
+			replies []interface{}
+			err     error
+		)
+		for len(cc.replies) > 0 {
+			r, e := cc.Receive()
+			replies = append(replies, r)
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+		return replies, err
+	}
+	if len(cc.pending) > 0 {
+		cc.Flush()
+		cc.replies = nil
+	}
+	return cc.cluster.doWithTimeout(cc.timeout, cmd, args...)
+}
+
+// DoWithTimeout implements redis.ConnWithTimeout, timeout applies to each
+// command sent to cluster nodes
+func (cc *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	cc.timeout = timeout
+	defer func() { cc.timeout = 0 }()
+	return cc.Do(cmd, args...)
+}
+
+// ReceiveWithTimeout implements redis.ConnWithTimeout, replies are read on Flush
+func (cc *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return cc.Receive()
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	cc.pending = append(cc.pending, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (cc *clusterConn) Flush() error {
+	for _, p := range cc.pending {
+		reply, err := cc.cluster.doWithTimeout(cc.timeout, p[0].(string), p[1:]...)
+		cc.replies = append(cc.replies, clusterReply{reply, err})
+	}
+	cc.pending = nil
+	return nil
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if len(cc.replies) == 0 {
+		return nil, errors.New("no pending reply")
+	}
+	r := cc.replies[0]
+	cc.replies = cc.replies[1:]
+	return r.reply, r.err
+}
+
+const (
+	clusterSlots           = 16384
+	clusterRedirections    = 5
+	clusterRefreshInterval = time.Second
+)
@@ -0,0 +1,318 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// recordCodec reads and writes records in their stored format. decoded records
+// are validated, records which cannot be parsed are left out and returned as
+// invalidRecords error along with the rest of the location
+type recordCodec interface {
+	decode(val string) (*Record, error)
+	encode(record *Record) (string, error)
+}
+
+var recordCodecs = map[string]recordCodec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// invalidRecords lists records of a location skipped by decode
+type invalidRecords []recordError
+
+func (e invalidRecords) Error() string {
+	errs := make([]string, 0, len(e))
+	for _, r := range e {
+		errs = append(errs, r.field+": "+r.err.Error())
+	}
+	return "invalid records: " + strings.Join(errs, ", ")
+}
+
+// storedCodec returns codec of a stored record. format is detected from the
+// first byte of the value, json records are objects and msgpack records are
+// maps, so zones written in different formats are read alike
+func storedCodec(val string) recordCodec {
+	if len(val) > 0 && isMsgpackMap(val[0]) {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// encodeRecord returns record in configured record_format for writing to redis
+func (redis *Redis) encodeRecord(record *Record) (string, error) {
+	if redis.codec == nil {
+		return jsonCodec{}.encode(record)
+	}
+	return redis.codec.encode(record)
+}
+
+// recordJSON returns json of a stored record including fields not known to
+// Record, used for reading metadata
+func recordJSON(val string) ([]byte, error) {
+	if storedCodec(val) == (jsonCodec{}) {
+		return []byte(val), nil
+	}
+	var v map[string]interface{}
+	if err := msgpackUnmarshal([]byte(val), &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// editRecord applies edit to generic form of a stored record and returns it
+// in configured record_format, fields not known to Record are kept
+func (redis *Redis) editRecord(val string, edit func(fields map[string]interface{})) (string, error) {
+	fields := make(map[string]interface{})
+	if storedCodec(val) == (jsonCodec{}) {
+		dec := json.NewDecoder(strings.NewReader(val))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			return "", err
+		}
+	} else if err := msgpackUnmarshal([]byte(val), &fields); err != nil {
+		return "", err
+	}
+	edit(fields)
+	if redis.codec == (msgpackCodec{}) {
+		return msgpackMarshal(jsonNumbers(fields))
+	}
+	data, err := json.Marshal(fields)
+	return string(data), err
+}
+
+// jsonNumbers replaces json.Number values of v decoded from json with integers
+// or floats
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = jsonNumbers(v[key])
+		}
+	}
+	return v
+}
+
+// recordFields maps stored field names to field index of Record
+var recordFields = func() map[string]int {
+	t := reflect.TypeOf(Record{})
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return fields
+}()
+
+// setRecord parses a single record with unmarshal, validates it and stores it
+// in field
+func setRecord(field reflect.Value, raw []byte, unmarshal func(data []byte, v interface{}) error) error {
+	v := reflect.New(field.Type())
+	err := unmarshal(raw, v.Interface())
+	if err == nil {
+		err = validateRecord(v.Interface())
+	}
+	if err != nil {
+		return err
+	}
+	field.Set(v.Elem())
+	return nil
+}
+
+// setRecords parses a list of records into field, the list is parsed at once
+// and only split into items with split when that fails so records which can
+// not be parsed are skipped. invalid records are returned by their index
+func setRecords(field reflect.Value, name string, raw []byte, unmarshal func(data []byte, v interface{}) error, split func(data []byte) ([][]byte, error)) invalidRecords {
+	var errs invalidRecords
+	list := reflect.New(field.Type())
+	if unmarshal(raw, list.Interface()) == nil {
+		for j := 0; j < list.Elem().Len(); j++ {
+			item := list.Elem().Index(j)
+			if err := validateRecord(item.Addr().Interface()); err != nil {
+				errs = append(errs, recordError{fmt.Sprintf("%s[%d]", name, j), err})
+				continue
+			}
+			field.Set(reflect.Append(field, item))
+		}
+		return errs
+	}
+	items, err := split(raw)
+	if err != nil {
+		return invalidRecords{{name, err}}
+	}
+	for j := range items {
+		v := reflect.New(field.Type().Elem())
+		err := unmarshal(items[j], v.Interface())
+		if err == nil {
+			err = validateRecord(v.Interface())
+		}
+		if err != nil {
+			errs = append(errs, recordError{fmt.Sprintf("%s[%d]", name, j), err})
+			continue
+		}
+		field.Set(reflect.Append(field, v.Elem()))
+	}
+	return errs
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) decode(val string) (*Record, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(val), &fields); err != nil {
+		return nil, err
+	}
+
+	var errs invalidRecords
+	r := new(Record)
+	rv := reflect.ValueOf(r).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name := strings.Split(rv.Type().Field(i).Tag.Get("json"), ",")[0]
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if field.Kind() != reflect.Slice {
+			if err := setRecord(field, raw, json.Unmarshal); err != nil {
+				errs = append(errs, recordError{name, err})
+			}
+			continue
+		}
+		errs = append(errs, setRecords(field, name, raw, json.Unmarshal, jsonItems)...)
+	}
+	if len(errs) > 0 {
+		return r, errs
+	}
+	return r, nil
+}
+
+func jsonItems(data []byte) ([][]byte, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	list := make([][]byte, len(items))
+	for i := range items {
+		list[i] = items[i]
+	}
+	return list, nil
+}
+
+func (jsonCodec) encode(record *Record) (string, error) {
+	data, err := json.Marshal(record)
+	return string(data), err
+}
+
+// msgpackCodec stores records as MessagePack maps with the same field names
+// as json records
+type msgpackCodec struct{}
+
+func (msgpackCodec) decode(val string) (*Record, error) {
+	d := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(d)
+	d.Reset(strings.NewReader(val))
+	d.SetCustomStructTag("json")
+
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+	var errs invalidRecords
+	r := new(Record)
+	rv := reflect.ValueOf(r).Elem()
+	for k := 0; k < n; k++ {
+		name, err := d.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.DecodeRaw()
+		if err != nil {
+			return nil, err
+		}
+		i, ok := recordFields[name]
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if field.Kind() != reflect.Slice {
+			if err := setRecord(field, raw, msgpackUnmarshal); err != nil {
+				errs = append(errs, recordError{name, err})
+			}
+			continue
+		}
+		errs = append(errs, setRecords(field, name, raw, msgpackUnmarshal, msgpackItems)...)
+	}
+	if _, err := d.PeekCode(); err != io.EOF {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	if len(errs) > 0 {
+		return r, errs
+	}
+	return r, nil
+}
+
+func (msgpackCodec) encode(record *Record) (string, error) {
+	return msgpackMarshal(record)
+}
+
+func isMsgpackMap(b byte) bool {
+	return b&0xf0 == 0x80 || b == 0xde || b == 0xdf
+}
+
+// msgpackUnmarshal decodes data using json field names
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	d := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(d)
+	d.Reset(bytes.NewReader(data))
+	d.SetCustomStructTag("json")
+	return d.Decode(v)
+}
+
+func msgpackItems(data []byte) ([][]byte, error) {
+	var items []msgpack.RawMessage
+	if err := msgpackUnmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	list := make([][]byte, len(items))
+	for i := range items {
+		list[i] = items[i]
+	}
+	return list, nil
+}
+
+// msgpackMarshal encodes v using json field names and the smallest integer
+// forms, map keys are sorted so equal records are stored alike
+func msgpackMarshal(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	e := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(e)
+	e.Reset(&buf)
+	e.SetCustomStructTag("json")
+	e.UseCompactInts(true)
+	e.SetSortMapKeys(true)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
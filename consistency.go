@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	redisCon "github.com/gomodule/redigo/redis"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// ValidationReport lists problems found in zones stored in redis
+type ValidationReport struct {
+	Zones    []string            `json:"zones"`
+	Problems []ValidationProblem `json:"problems"`
+}
+
+// ValidationProblem is a single problem found at a location of a zone
+type ValidationProblem struct {
+	Zone     string `json:"zone"`
+	Location string `json:"location,omitempty"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+const (
+	ProblemMissingSoa      = "missing_soa"
+	ProblemCnameCollision  = "cname_collision"
+	ProblemDanglingTarget  = "dangling_target"
+	ProblemMalformedRecord = "malformed_record"
+)
+
+// ValidateAll checks all zones in redis for missing SOA records, CNAMEs with
+// other data, in-zone CNAME, MX and SRV targets which do not exist and records
+// which can not be parsed. zones are read from primary and nothing is modified
+func (redis *Redis) ValidateAll() (*ValidationReport, error) {
+	ctx := withPrimary(context.Background())
+	zones, err := redis.zoneNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(zones)
+	report := &ValidationReport{Zones: zones}
+	for _, zone := range zones {
+		problems, err := redis.validateZone(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+	return report, nil
+}
+
+func (redis *Redis) validateZone(ctx context.Context, zone string) ([]ValidationProblem, error) {
+	vals, err := redisCon.StringMap(redis.read(ctx, "HGETALL", redis.keyPrefix+zone+redis.keySuffix))
+	if err != nil {
+		return nil, err
+	}
+	z := &Zone{Name: zone, Locations: make(map[string]struct{})}
+	locations := make([]string, 0, len(vals))
+	for location := range vals {
+		z.Locations[location] = struct{}{}
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	var problems []ValidationProblem
+	problem := func(location string, kind string, format string, args ...interface{}) {
+		problems = append(problems, ValidationProblem{zone, location, kind, fmt.Sprintf(format, args...)})
+	}
+	records := make(map[string]*Record)
+	for _, location := range locations {
+		record, invalid, err := decodeRecord(vals[location])
+		if err != nil {
+			problem(location, ProblemMalformedRecord, "%v", err)
+			continue
+		}
+		for _, e := range invalid {
+			problem(location, ProblemMalformedRecord, "%s: %v", e.field, e.err)
+		}
+		records[location] = record
+	}
+
+	if apex := records["@"]; apex == nil || apex.SOA.Ns == "" {
+		problem("@", ProblemMissingSoa, "zone has no soa record")
+	}
+	for _, location := range locations {
+		record := records[location]
+		if record == nil {
+			continue
+		}
+		if len(record.CNAME) > 0 {
+			if others := otherData(record); len(others) > 0 {
+				problem(location, ProblemCnameCollision, "cname with %s records", strings.Join(others, ", "))
+			}
+		}
+		var targets []string
+		for _, cname := range record.CNAME {
+			targets = append(targets, cname.Host)
+		}
+		for _, mx := range record.MX {
+			targets = append(targets, mx.Host)
+		}
+		for _, srv := range record.SRV {
+			targets = append(targets, srv.Target)
+		}
+		for _, target := range targets {
+			if target == "" || target == "." {
+				continue
+			}
+			target = dns.Fqdn(strings.ToLower(target))
+			if dns.IsSubDomain(zone, target) && redis.findLocation(target, z) == "" {
+				problem(location, ProblemDanglingTarget, "target %s does not exist", target)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// otherData returns types of records stored with a CNAME which are not allowed
+// next to it as described in rfc2181 section 10.1, dnssec records are allowed
+func otherData(record *Record) []string {
+	var others []string
+	rv := reflect.ValueOf(record).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name := strings.Split(rv.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "ttl", "cname", "rrsig", "nsec", "nsec3":
+			continue
+		}
+		if !rv.Field(i).IsZero() {
+			others = append(others, name)
+		}
+	}
+	return others
+}
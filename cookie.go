@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// requestCookie returns cookie option of r decoded from hex, ok is false if r
+// has no cookie option
+func requestCookie(r *dns.Msg) (cookie []byte, ok bool) {
+	opt := requestOption(r, dns.EDNS0COOKIE)
+	if opt == nil {
+		return nil, false
+	}
+	cookie, _ = hex.DecodeString(opt.(*dns.EDNS0_COOKIE).Cookie)
+	return cookie, true
+}
+
+// validCookieLength checks length of a client cookie optionally followed by a
+// server cookie as described in rfc7873 section 5.2.2
+func validCookieLength(cookie []byte) bool {
+	return len(cookie) == clientCookieLength ||
+		len(cookie) >= clientCookieLength+8 && len(cookie) <= clientCookieLength+32
+}
+
+// serverCookie returns server cookie for client cookie and address at time now
+// in the interoperable format of rfc9018
+func (redis *Redis) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, 8, 16)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	msg := append(append(append([]byte{}, client...), cookie...), ip...)
+	hash := make([]byte, 8)
+	binary.LittleEndian.PutUint64(hash, siphash(redis.cookieSecret, msg))
+	return append(cookie, hash...)
+}
+
+// validCookie checks server cookie part of cookie sent by client at ip, cookies
+// are accepted for an hour after they were issued as suggested by rfc9018
+func (redis *Redis) validCookie(cookie []byte, ip net.IP, now time.Time) bool {
+	if len(cookie) != clientCookieLength+16 || cookie[clientCookieLength] != 1 {
+		return false
+	}
+	issued := int64(binary.BigEndian.Uint32(cookie[clientCookieLength+4:]))
+	if age := now.Unix() - issued; age > cookieLifetime || age < -cookieSkew {
+		return false
+	}
+	expected := redis.serverCookie(cookie[:clientCookieLength], ip, time.Unix(issued, 0))
+	return subtle.ConstantTimeCompare(expected, cookie[clientCookieLength:]) == 1
+}
+
+// siphash computes SipHash-2-4 of msg with a 128 bit key
+func siphash(key []byte, msg []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+const (
+	clientCookieLength = 8
+	cookieLifetime     = 3600
+	cookieSkew         = 300
+)
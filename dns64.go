@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dns64 returns AAAA answers of name as described in rfc6147, answers in excluded
+// ranges are dropped and if none are left AAAA records are synthesized from A
+// records of name using the nat64 prefix
+func (redis *Redis) dns64(name string, z *Zone, record *Record, answers []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range answers {
+		if aaaa, ok := rr.(*dns.AAAA); ok && redis.dns64Excluded(aaaa.AAAA) {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if len(kept) > 0 {
+		return kept
+	}
+
+	a, _ := redis.A(name, z, record)
+	if len(a) == 0 {
+		return nil
+	}
+	// synthesized records are not cached longer than a negative answer
+	ttl := redis.negativeSoa(z, false)[0].Header().Ttl
+	for _, rr := range a {
+		r := new(dns.AAAA)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA,
+			Class: dns.ClassINET, Ttl: rr.Header().Ttl}
+		if ttl < r.Hdr.Ttl {
+			r.Hdr.Ttl = ttl
+		}
+		r.AAAA = embedIPv4(redis.dns64Prefix, rr.(*dns.A).A)
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+func (redis *Redis) dns64Excluded(ip net.IP) bool {
+	for _, n := range redis.dns64Exclude {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// embedIPv4 returns ipv4 embedded in ipv6 prefix as described in rfc6052 section 2.2,
+// bits 64 to 71 are skipped
+func embedIPv4(prefix *net.IPNet, ipv4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:ones/8])
+	i := ones / 8
+	for _, b := range ipv4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// validDns64Prefix checks prefix length of a nat64 prefix as listed in rfc6052
+func validDns64Prefix(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len {
+		return false
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+const (
+	defaultDns64Prefix  = "64:ff9b::/96"
+	defaultDns64Exclude = "::ffff:0:0/96"
+)
@@ -0,0 +1,377 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func (redis *Redis) RRSIG(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, rrsig := range record.RRSIG {
+		r := redis.rrsig(name, z, rrsig)
+		if r == nil {
+			continue
+		}
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) rrsig(name string, z *Zone, rrsig RRSIG_Record) *dns.RRSIG {
+	typeCovered, ok := dns.StringToType[strings.ToUpper(rrsig.TypeCovered)]
+	if !ok || len(rrsig.Signature) == 0 {
+		return nil
+	}
+	expiration, err := dns.StringToTime(rrsig.Expiration)
+	if err != nil {
+		fmt.Println("invalid rrsig expiration : ", name, rrsig.Expiration, err)
+		return nil
+	}
+	inception, err := dns.StringToTime(rrsig.Inception)
+	if err != nil {
+		fmt.Println("invalid rrsig inception : ", name, rrsig.Inception, err)
+		return nil
+	}
+	r := new(dns.RRSIG)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeRRSIG,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, rrsig.Ttl)}
+	r.TypeCovered = typeCovered
+	r.Algorithm = rrsig.Algorithm
+	r.Labels = rrsig.Labels
+	r.OrigTtl = rrsig.OrigTtl
+	r.Expiration = expiration
+	r.Inception = inception
+	r.KeyTag = rrsig.KeyTag
+	r.SignerName = dns.Fqdn(rrsig.SignerName)
+	r.Signature = rrsig.Signature
+	return r
+}
+
+func (redis *Redis) DNSKEY(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, dnskey := range record.DNSKEY {
+		if len(dnskey.PublicKey) == 0 {
+			continue
+		}
+		r := new(dns.DNSKEY)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeDNSKEY,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, dnskey.Ttl)}
+		r.Flags = dnskey.Flags
+		r.Protocol = dnskey.Protocol
+		r.Algorithm = dnskey.Algorithm
+		r.PublicKey = dnskey.PublicKey
+		answers = append(answers, r)
+	}
+	answers = append(answers, redis.signingKeys(name, z)...)
+	return
+}
+
+// CDS returns child DS records stored at zone apex for parent to update its DS
+// records from as described in rfc7344
+func (redis *Redis) CDS(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if z == nil || dns.Fqdn(name) != dns.Fqdn(z.Name) {
+		return
+	}
+	for _, cds := range record.CDS {
+		if len(cds.Digest) == 0 {
+			continue
+		}
+		r := new(dns.CDS)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCDS,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, cds.Ttl)}
+		r.KeyTag = cds.KeyTag
+		r.Algorithm = cds.Algorithm
+		r.DigestType = cds.DigestType
+		r.Digest = strings.ToUpper(cds.Digest)
+		answers = append(answers, r)
+	}
+	return
+}
+
+// CDNSKEY returns child DNSKEY records stored at zone apex as described in rfc7344
+func (redis *Redis) CDNSKEY(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if z == nil || dns.Fqdn(name) != dns.Fqdn(z.Name) {
+		return
+	}
+	for _, cdnskey := range record.CDNSKEY {
+		if len(cdnskey.PublicKey) == 0 {
+			continue
+		}
+		r := new(dns.CDNSKEY)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCDNSKEY,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, cdnskey.Ttl)}
+		r.Flags = cdnskey.Flags
+		r.Protocol = cdnskey.Protocol
+		r.Algorithm = cdnskey.Algorithm
+		r.PublicKey = cdnskey.PublicKey
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) NSEC(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if len(record.NSEC.NextDomain) == 0 {
+		return
+	}
+	r := new(dns.NSEC)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNSEC,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, record.NSEC.Ttl)}
+	r.NextDomain = dns.Fqdn(record.NSEC.NextDomain)
+	r.TypeBitMap = typeBitMap(record.NSEC.Types)
+	answers = append(answers, r)
+	return
+}
+
+func (redis *Redis) NSEC3(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if len(record.NSEC3.NextDomain) == 0 {
+		return
+	}
+	r := new(dns.NSEC3)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNSEC3,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, record.NSEC3.Ttl)}
+	r.Hash = record.NSEC3.Hash
+	r.Flags = record.NSEC3.Flags
+	r.Iterations = record.NSEC3.Iterations
+	r.Salt = record.NSEC3.Salt
+	if r.Salt == "" {
+		r.Salt = "-"
+	}
+	r.SaltLength = uint8(len(r.Salt) / 2)
+	r.NextDomain = strings.ToUpper(record.NSEC3.NextDomain)
+	r.HashLength = 20
+	r.TypeBitMap = typeBitMap(record.NSEC3.Types)
+	answers = append(answers, r)
+	return
+}
+
+func (redis *Redis) NSEC3PARAM(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if record.NSEC3PARAM.Hash == 0 {
+		return
+	}
+	r := new(dns.NSEC3PARAM)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNSEC3PARAM,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, record.NSEC3PARAM.Ttl)}
+	r.Hash = record.NSEC3PARAM.Hash
+	r.Flags = record.NSEC3PARAM.Flags
+	r.Iterations = record.NSEC3PARAM.Iterations
+	r.Salt = record.NSEC3PARAM.Salt
+	if r.Salt == "" {
+		r.Salt = "-"
+	}
+	r.SaltLength = uint8(len(r.Salt) / 2)
+	answers = append(answers, r)
+	return
+}
+
+// signatures returns RRSIGs stored with record covering the types present in rrs
+func (redis *Redis) signatures(name string, z *Zone, record *Record, rrs []dns.RR) (sigs []dns.RR) {
+	if record == nil {
+		return
+	}
+	covered := make(map[uint16]bool)
+	for _, rr := range rrs {
+		covered[rr.Header().Rrtype] = true
+	}
+	for _, rrsig := range record.RRSIG {
+		r := redis.rrsig(name, z, rrsig)
+		if r == nil || !covered[r.TypeCovered] {
+			continue
+		}
+		sigs = append(sigs, r)
+	}
+	return
+}
+
+// signed returns rrs followed by their signatures from record
+func (redis *Redis) signed(name string, z *Zone, record *Record, rrs []dns.RR) []dns.RR {
+	return append(rrs, redis.signatures(name, z, record, rrs)...)
+}
+
+// nodata returns the NSEC or NSEC3 proving that no record of the queried type exists at location
+func (redis *Redis) nodata(name string, location string, z *Zone) []dns.RR {
+	apex := redis.get(z.Name, z)
+	if apex != nil && apex.NSEC3PARAM.Hash != 0 {
+		return redis.nsec3Match(name, apex.NSEC3PARAM, z)
+	}
+	record := redis.get(location, z)
+	if record == nil {
+		return nil
+	}
+	nsec, _ := redis.NSEC(name, z, record)
+	return redis.signed(name, z, record, nsec)
+}
+
+// nxdomain returns NSEC or NSEC3 records proving that name does not exist in zone
+func (redis *Redis) nxdomain(name string, z *Zone) []dns.RR {
+	apex := redis.get(z.Name, z)
+	if apex == nil {
+		return nil
+	}
+	if apex.NSEC3PARAM.Hash != 0 {
+		return redis.nsec3Denial(name, apex.NSEC3PARAM, z)
+	}
+
+	// covering NSEC for name itself and for the wildcard at its closest encloser
+	var rrs []dns.RR
+	owners := make(map[string]bool)
+	ce := redis.closestEncloser(name, z)
+	for _, n := range []string{name, "*." + ce} {
+		owner := redis.nsecCover(n, z)
+		if owner == "" || owners[owner] {
+			continue
+		}
+		owners[owner] = true
+		record := redis.get(redis.locationKey(owner, z), z)
+		if record == nil {
+			continue
+		}
+		nsec, _ := redis.NSEC(owner, z, record)
+		rrs = append(rrs, redis.signed(owner, z, record, nsec)...)
+	}
+	return rrs
+}
+
+// closestEncloser returns the longest existing ancestor of name in zone
+func (redis *Redis) closestEncloser(name string, z *Zone) string {
+	for {
+		i, end := dns.NextLabel(name, 0)
+		if end || name == z.Name {
+			return z.Name
+		}
+		name = name[i:]
+		if name == z.Name || keyExists(redis.locationKey(name, z), z) {
+			return name
+		}
+	}
+}
+
+// nsecCover returns owner name of the NSEC covering name, which is the
+// canonically greatest owner in zone preceding name
+func (redis *Redis) nsecCover(name string, z *Zone) string {
+	var cover string
+	for key := range z.Locations {
+		owner := redis.ownerName(key, z)
+		if !canonicalLess(owner, name) {
+			continue
+		}
+		if cover == "" || canonicalLess(cover, owner) {
+			cover = owner
+		}
+	}
+	return cover
+}
+
+// nsec3Match returns the NSEC3 matching hashed name
+func (redis *Redis) nsec3Match(name string, param NSEC3PARAM_Record, z *Zone) []dns.RR {
+	hash := strings.ToLower(dns.HashName(name, param.Hash, param.Iterations, param.Salt))
+	if !keyExists(hash, z) {
+		return nil
+	}
+	record := redis.get(hash, z)
+	if record == nil {
+		return nil
+	}
+	owner := hash + "." + z.Name
+	nsec3, _ := redis.NSEC3(owner, z, record)
+	return redis.signed(owner, z, record, nsec3)
+}
+
+// nsec3Cover returns the NSEC3 covering hashed name
+func (redis *Redis) nsec3Cover(name string, param NSEC3PARAM_Record, z *Zone) []dns.RR {
+	hash := strings.ToLower(dns.HashName(name, param.Hash, param.Iterations, param.Salt))
+	var hashes []string
+	for key := range z.Locations {
+		if len(key) == 32 && !strings.Contains(key, ".") {
+			hashes = append(hashes, strings.ToLower(key))
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	sort.Strings(hashes)
+	// last hash covers names before the first one
+	cover := hashes[len(hashes)-1]
+	for _, h := range hashes {
+		if h >= hash {
+			break
+		}
+		cover = h
+	}
+	record := redis.get(cover, z)
+	if record == nil {
+		return nil
+	}
+	owner := cover + "." + z.Name
+	nsec3, _ := redis.NSEC3(owner, z, record)
+	return redis.signed(owner, z, record, nsec3)
+}
+
+// nsec3Denial returns the closest encloser proof described in rfc5155
+func (redis *Redis) nsec3Denial(name string, param NSEC3PARAM_Record, z *Zone) []dns.RR {
+	ce := redis.closestEncloser(name, z)
+	nc := name
+	for {
+		i, end := dns.NextLabel(nc, 0)
+		if end || nc[i:] == ce {
+			break
+		}
+		nc = nc[i:]
+	}
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	for _, proof := range [][]dns.RR{
+		redis.nsec3Match(ce, param, z),
+		redis.nsec3Cover(nc, param, z),
+		redis.nsec3Cover("*."+ce, param, z),
+	} {
+		for _, rr := range proof {
+			if seen[rr.String()] {
+				continue
+			}
+			seen[rr.String()] = true
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// locationKey converts an absolute owner name in zone to its redis field key
+func (redis *Redis) locationKey(name string, z *Zone) string {
+	if name == z.Name {
+		return z.Name
+	}
+	return strings.TrimSuffix(name, "."+z.Name)
+}
+
+// ownerName converts a redis field key to an absolute owner name in zone
+func (redis *Redis) ownerName(key string, z *Zone) string {
+	if key == "@" {
+		return z.Name
+	}
+	return key + "." + z.Name
+}
+
+// canonicalLess reports whether a sorts before b in canonical dns name order (rfc4034 section 6.1)
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func typeBitMap(types []string) []uint16 {
+	var bitmap []uint16
+	for _, t := range types {
+		if rrtype, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			bitmap = append(bitmap, rrtype)
+		}
+	}
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return bitmap
+}
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// clientSubnet returns the EDNS0 client subnet option of request, if any
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	o := r.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// subnetRecord returns a copy of record with A and AAAA records of the closest subnet
+// matching ecs, or untagged records if no subnet matches. scope prefix length of the
+// answer for qtype is returned as described in rfc7871
+func subnetRecord(record *Record, qtype uint16, ecs *dns.EDNS0_SUBNET) (*Record, uint8) {
+	r := *record
+
+	subnets := make([]string, len(record.A))
+	for i := range record.A {
+		subnets[i] = record.A[i].Subnet
+	}
+	selected, scopeA := matchSubnet(subnets, ecs)
+	r.A = nil
+	for _, i := range selected {
+		r.A = append(r.A, record.A[i])
+	}
+
+	subnets = make([]string, len(record.AAAA))
+	for i := range record.AAAA {
+		subnets[i] = record.AAAA[i].Subnet
+	}
+	selected, scopeAAAA := matchSubnet(subnets, ecs)
+	r.AAAA = nil
+	for _, i := range selected {
+		r.AAAA = append(r.AAAA, record.AAAA[i])
+	}
+
+	switch qtype {
+	case dns.TypeA:
+		return &r, scopeA
+	case dns.TypeAAAA:
+		return &r, scopeAAAA
+	}
+	return &r, 0
+}
+
+// matchSubnet returns indexes of subnets with the longest prefix containing client address.
+// prefixes longer than source prefix length of ecs are not considered. if nothing matches
+// indexes of untagged entries are returned
+func matchSubnet(subnets []string, ecs *dns.EDNS0_SUBNET) (selected []int, scope uint8) {
+	prefixes := make([]int, len(subnets))
+	best := -1
+	tagged := false
+	for i, subnet := range subnets {
+		prefixes[i] = -1
+		if subnet == "" {
+			continue
+		}
+		tagged = true
+		if ecs == nil {
+			continue
+		}
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		ones, _ := network.Mask.Size()
+		if ones > int(ecs.SourceNetmask) || !network.Contains(ecs.Address) {
+			continue
+		}
+		prefixes[i] = ones
+		if ones > best {
+			best = ones
+		}
+	}
+
+	for i, subnet := range subnets {
+		if (best >= 0 && prefixes[i] == best) || (best < 0 && subnet == "") {
+			selected = append(selected, i)
+		}
+	}
+	switch {
+	case best >= 0:
+		scope = uint8(best)
+	case tagged && ecs != nil:
+		// default answer is only valid for the client subnet
+		scope = ecs.SourceNetmask
+	}
+	return
+}
+
+// subnetOpt returns an OPT record echoing ecs with scope prefix length set to scope
+func subnetOpt(ecs *dns.EDNS0_SUBNET, scope uint8) *dns.OPT {
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	e := *ecs
+	e.SourceScope = scope
+	o.Option = append(o.Option, &e)
+	return o
+}
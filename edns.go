@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"github.com/miekg/dns"
+)
+
+// requestOption returns EDNS0 option of r with code, nil if r has none
+func requestOption(r *dns.Msg, code uint16) dns.EDNS0 {
+	o := r.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if opt.Option() == code {
+			return opt
+		}
+	}
+	return nil
+}
+
+// appendOption adds option to OPT record of m if it has one, response may share
+// OPT record of the request so a copy is modified
+func appendOption(m *dns.Msg, option dns.EDNS0) {
+	for i, rr := range m.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			opt := *o
+			opt.Option = append(append([]dns.EDNS0{}, o.Option...), option)
+			m.Extra[i] = &opt
+			return
+		}
+	}
+}
+
+// optionWriter adds EDNS0 options to all responses, options of the same code
+// already in the response are replaced and an OPT record is added if the
+// response has none
+type optionWriter struct {
+	dns.ResponseWriter
+	options []dns.EDNS0
+	size    uint16
+}
+
+func (w *optionWriter) WriteMsg(m *dns.Msg) error {
+	for i, rr := range m.Extra {
+		o, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		// response may share OPT record of the request, modify a copy
+		opt := *o
+		opt.Option = nil
+		for _, option := range o.Option {
+			if !w.replaces(option) {
+				opt.Option = append(opt.Option, option)
+			}
+		}
+		opt.Option = append(opt.Option, w.options...)
+		m.Extra[i] = &opt
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(w.size)
+	o.Option = append(o.Option, w.options...)
+	// tsig record must stay the last record
+	if n := len(m.Extra); n > 0 && m.Extra[n-1].Header().Rrtype == dns.TypeTSIG {
+		m.Extra = append(append(m.Extra[:n-1:n-1], o), m.Extra[n-1])
+	} else {
+		m.Extra = append(m.Extra, o)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *optionWriter) replaces(option dns.EDNS0) bool {
+	for _, opt := range w.options {
+		if opt.Option() == option.Option() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ExportZone renders all records stored in zone as a zone file in master file
+// format, SOA first followed by records grouped by name and type
+func (redis *Redis) ExportZone(zoneName string) (string, error) {
+	z := redis.load(dns.Fqdn(strings.ToLower(zoneName)))
+	if z == nil || len(z.Locations) == 0 {
+		return "", errors.New("zone not found")
+	}
+	apex := redis.get(z.Name, z)
+	if apex == nil || apex.SOA.Ns == "" {
+		return "", errors.New("zone has no SOA record")
+	}
+
+	rrs := redis.zoneRecords(z)
+	sort.SliceStable(rrs, func(i, j int) bool {
+		a, b := rrs[i].Header(), rrs[j].Header()
+		if (a.Rrtype == dns.TypeSOA) != (b.Rrtype == dns.TypeSOA) {
+			return a.Rrtype == dns.TypeSOA
+		}
+		if !strings.EqualFold(a.Name, b.Name) {
+			return canonicalLess(a.Name, b.Name)
+		}
+		return a.Rrtype < b.Rrtype
+	})
+
+	var b strings.Builder
+	b.WriteString("$ORIGIN " + z.Name + "\n")
+	for _, rr := range rrs {
+		b.WriteString(rr.String())
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// GENERIC returns records stored in the generic format described in rfc3597
+// for types without a native handler
+func (redis *Redis) GENERIC(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, generic := range record.Generic {
+		t, err := genericType(generic.Type)
+		if err != nil {
+			continue
+		}
+		rdata, err := genericData(generic.Data)
+		if err != nil {
+			fmt.Println("invalid generic record : ", name, generic.Data, err)
+			continue
+		}
+		r := new(dns.RFC3597)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: t,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, generic.Ttl)}
+		r.Rdata = rdata
+		answers = append(answers, r)
+	}
+	return
+}
+
+// genericRecords returns generic records of name with type qtype
+func (redis *Redis) genericRecords(name string, z *Zone, record *Record, qtype uint16) (answers []dns.RR) {
+	rrs, _ := redis.GENERIC(name, z, record)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return
+}
+
+// genericType parses a type in the TYPE#### form, type mnemonics are also
+// accepted
+func genericType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if t, err := strconv.ParseUint(s[len("TYPE"):], 10, 16); err == nil && t != 0 {
+			return uint16(t), nil
+		}
+	}
+	return 0, errors.New("invalid type " + s)
+}
+
+// genericData parses rdata in the `\# length hex` form and returns it as a
+// lower case hex string
+func genericData(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || fields[0] != `\#` {
+		return "", errors.New(`rdata must start with \# and length`)
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 || length > 0xffff {
+		return "", errors.New("invalid rdata length " + fields[1])
+	}
+	rdata := strings.ToLower(strings.Join(fields[2:], ""))
+	b, err := hex.DecodeString(rdata)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != length {
+		return "", fmt.Errorf("rdata length %d does not match length %d", len(b), length)
+	}
+	return rdata, nil
+}
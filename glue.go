@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// glueZone holds targets of glue lookups served by the same zone
+type glueZone struct {
+	z       *Zone
+	names   []string
+	labels  []string
+	targets []int
+}
+
+// glue returns address records of targets in order of targets skipping
+// records already added. targets of each zone are read in a single pipeline
+// and zones are read concurrently by up to glueWorkers goroutines, each
+// using its own connection
+func (redis *Redis) glue(targets []string, z *Zone) (extras []dns.RR) {
+	if len(targets) == 1 {
+		return redis.hosts(targets[0], z)
+	}
+	var zones []*glueZone
+	byName := make(map[string]*glueZone)
+	for i, target := range targets {
+		name := dns.Fqdn(target)
+		tz := z
+		if !dns.IsSubDomain(z.Name, name) {
+			zone := redis.matchZone(name)
+			if zone == "" {
+				continue
+			}
+			if tz = redis.load(zone); tz == nil {
+				continue
+			}
+		}
+		location := redis.findLocation(name, tz)
+		if location == "" {
+			continue
+		}
+		if location == tz.Name {
+			location = "@"
+		}
+		g, ok := byName[tz.Name]
+		if !ok {
+			g = &glueZone{z: tz}
+			byName[tz.Name] = g
+			zones = append(zones, g)
+		}
+		g.names = append(g.names, name)
+		g.labels = append(g.labels, location)
+		g.targets = append(g.targets, i)
+	}
+
+	hosts := make([][]dns.RR, len(targets))
+	read := func(g *glueZone) {
+		for j, record := range redis.getMany(g.labels, g.z) {
+			if record != nil {
+				hosts[g.targets[j]] = redis.hostRecords(g.names[j], g.z, record)
+			}
+		}
+	}
+	if len(zones) == 1 {
+		read(zones[0])
+	} else {
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, glueWorkers)
+		for _, g := range zones {
+			wg.Add(1)
+			workers <- struct{}{}
+			go func(g *glueZone) {
+				defer wg.Done()
+				read(g)
+				<-workers
+			}(g)
+		}
+		wg.Wait()
+	}
+	for _, rrs := range hosts {
+		extras = appendHosts(extras, rrs)
+	}
+	return
+}
+
+const glueWorkers = 4
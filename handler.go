@@ -1,8 +1,11 @@
 package redis
 
 import (
+	"encoding/hex"
 	"fmt"
 	// "fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -14,72 +17,218 @@ import (
 // ServeDNS implements the plugin.Handler interface.
 func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	if v := redis.view(state); v != nil {
+		return v.ServeDNS(ctx, w, r)
+	}
+
+	// server version and id are only revealed to allowed clients, other
+	// clients are passed to the next plugin
+	if redis.chaosVersion != "" && isChaosQuery(state) {
+		if !clientAllowed(state, redis.chaosAllow) {
+			return plugin.NextOrFailure(state.Name(), redis.Next, ctx, w, r)
+		}
+		return redis.chaosResponse(state)
+	}
 
 	qname := state.Name()
 	qtype := state.Type()
+	do := state.Do()
 
-	if time.Since(redis.LastZoneUpdate) > zoneUpdateTime {
-		redis.LoadZones()
-	}
-
-	zone := plugin.Zones(redis.Zones).Matches(qname)
+	zone := redis.matchZone(qname)
 	// fmt.Println("zone : ", zone)
 	if zone == "" {
-		return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
+		// without fallthrough configured all names outside zones are passed on,
+		// so are all names until zones are loaded
+		redis.zonesLock.RLock()
+		loaded := !redis.LastZoneUpdate.IsZero()
+		redis.zonesLock.RUnlock()
+		if !loaded || redis.fallZones.Zones == nil || redis.fallZones.Through(qname) {
+			return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
+		}
+		// other names are outside our authority and refused
+		rw := newResponseRecorder(w)
+		state.W = rw
+		defer redis.observeRequest(rw, qtype, time.Now())
+		return redis.errorResponse(state, zone, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNotAuthoritative}, nil)
+	}
+
+	// server cookie and nsid are added to all responses
+	var options []dns.EDNS0
+	cookie, hasCookie := requestCookie(r)
+	validCookie := false
+	if redis.cookieSecret != nil && hasCookie {
+		if !validCookieLength(cookie) {
+			return redis.errorResponse(state, zone, dns.RcodeFormatError, nil, nil)
+		}
+		ip, now := net.ParseIP(state.IP()), time.Now()
+		validCookie = redis.validCookie(cookie, ip, now)
+		client := cookie[:clientCookieLength:clientCookieLength]
+		options = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(client, redis.serverCookie(client, ip, now)...))})
+	}
+	if redis.nsid != "" && requestOption(r, dns.EDNS0NSID) != nil {
+		options = append(options, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(redis.nsid))})
+	}
+	if len(options) > 0 {
+		w = &optionWriter{ResponseWriter: w, options: options, size: uint16(state.Size())}
+		state.W = w
+	}
+	// clients without a valid server cookie may be spoofed, make them retry over tcp
+	if redis.cookieRequire && !validCookie && state.Proto() == "udp" {
+		return redis.truncatedResponse(state)
 	}
 
-	z := redis.load(zone)
-	if z == nil {
-		return redis.errorResponse(state, zone, dns.RcodeServerFailure, nil)
+	// tcp clients can not be spoofed, only limit udp responses
+	if redis.rateLimiter != nil && state.Proto() == "udp" {
+		switch redis.rateLimiter.check(net.ParseIP(state.IP()), time.Now()) {
+		case rateDrop:
+			return dns.RcodeSuccess, nil
+		case rateSlip:
+			return redis.truncatedResponse(state)
+		}
 	}
 
-	if qtype == "AXFR" {
-		records := redis.AXFR(z)
+	rw := newResponseRecorder(w)
+	state.W = rw
+	defer redis.observeRequest(rw, qtype, time.Now())
+	defer redis.logQuery(rw, state, zone, time.Now())
 
-		ch := make(chan *dns.Envelope)
-		tr := new(dns.Transfer)
-		tr.TsigSecret = nil
+	if r.Opcode == dns.OpcodeUpdate {
+		return redis.handleUpdate(state, zone)
+	}
 
-		go func(ch chan *dns.Envelope) {
-			j, l := 0, 0
+	if redis.splitZone(zone) {
+		return redis.errorResponse(state, zone, dns.RcodeServerFailure, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData, ExtraText: "zone serials disagree"}, nil)
+	}
 
-			for i, r := range records {
-				l += dns.Len(r)
-				if l > transferLength {
-					ch <- &dns.Envelope{RR: records[j:i]}
-					l = 0
-					j = i
-				}
-			}
-			if j < len(records) {
-				ch <- &dns.Envelope{RR: records[j:]}
-			}
-			close(ch)
-		}(ch)
+	if !redis.qtypeAllowed(zone, state.QType()) {
+		return redis.errorResponse(state, zone, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited, ExtraText: "query type not allowed"}, nil)
+	}
 
-		err := tr.Out(w, r, ch)
-		if err != nil {
-			fmt.Println(err)
+	if redis.transferOff && (qtype == "AXFR" || qtype == "IXFR") {
+		return redis.errorResponse(state, zone, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited, ExtraText: "zone transfers disabled"}, nil)
+	}
+
+	ctx, cancel := redis.queryContext(ctx)
+	defer cancel()
+
+	// with serve_stale cached data is served while redis is unavailable
+	stale := false
+	z, err := redis.loadContext(ctx, zone)
+	if err != nil {
+		if z, stale = redis.staleZone(zone); !stale {
+			return redis.serverFailure(state, zone, err)
 		}
-		w.Hijack()
-		return dns.RcodeSuccess, nil
+		state = staleState(state)
+	}
+
+	if qtype == "AXFR" || qtype == "IXFR" {
+		return redis.handleZoneTransfer(state, z)
+	}
+
+	// names below a DNAME are redirected, follow the synthesized CNAMEs
+	// as long as they stay inside the zone
+	var chain []dns.RR
+	for i := 0; ; i++ {
+		owner, record := redis.findDname(qname, z)
+		if record == nil {
+			break
+		}
+		if i == maxChainLength {
+			return redis.errorResponse(state, zone, dns.RcodeServerFailure, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: "dname chain too long"}, nil)
+		}
+		dname, _ := redis.DNAME(owner, z, record)
+		cname := synthesizeCname(qname, dname[0].(*dns.DNAME))
+		if cname == nil {
+			return redis.errorResponse(state, zone, dns.RcodeYXDomain, nil, nil)
+		}
+		if do {
+			dname = redis.signed(owner, z, record, dname)
+		}
+		chain = append(chain, dname...)
+		chain = append(chain, cname)
+		qname = cname.Target
+		if !dns.IsSubDomain(z.Name, qname) {
+			return redis.answerResponse(state, zone, dns.RcodeSuccess, chain, nil, nil)
+		}
+	}
+
+	// names below a zone cut are referred to the child zone
+	if owner, record := redis.findDelegation(qname, z); record != nil {
+		ns, glue := redis.referral(owner, z, record)
+		return redis.referralResponse(state, zone, chain, ns, glue)
 	}
 
 	location := redis.findLocation(qname, z)
+	if len(location) == 0 && redis.replicaPool != nil {
+		// names may be missing on a lagging replica, only the queried name is
+		// looked up on the primary
+		if z, err = redis.primaryLocation(ctx, qname, z); err != nil {
+			return redis.serverFailure(state, zone, err)
+		}
+		location = redis.findLocation(qname, z)
+	}
+	if len(location) == 0 && len(redis.reversePtr(qname, z)) > 0 {
+		// names with synthesized PTR records exist without being stored
+		location = strings.TrimSuffix(qname, "."+z.Name)
+	}
+	if len(location) == 0 && len(chain) == 0 && redis.fallZones.Through(qname) {
+		// responses of next plugin are recorded with their own rcode
+		return plugin.NextOrFailure(qname, redis.Next, ctx, rw, r)
+	}
 	if len(location) == 0 { // empty, no results
-		return redis.errorResponse(state, zone, dns.RcodeNameError, nil)
+		if answers, ok := redis.redirect(qname, z, state.QType()); ok {
+			var ns []dns.RR
+			if len(answers) == 0 {
+				ns = redis.negativeSoa(z, false)
+			}
+			return redis.answerResponse(redirectState(state), zone, dns.RcodeSuccess, append(chain, answers...), ns, nil)
+		}
+		ns := redis.negativeSoa(z, do)
+		if do && redis.zoneKeys(zone) != nil {
+			// with online signing deny the name using a NODATA response instead of
+			// NXDOMAIN, this avoids the need for a covering NSEC chain
+			return redis.answerResponse(state, zone, dns.RcodeSuccess, chain, append(ns, redis.nsecLie(qname, z, nil)...), nil)
+		}
+		if do {
+			ns = append(ns, redis.nxdomain(qname, z)...)
+		}
+		return redis.answerResponse(state, zone, dns.RcodeNameError, chain, ns, nil)
 	}
 
 	answers := make([]dns.RR, 0, 10)
 	extras := make([]dns.RR, 0, 10)
 
-	record := redis.get(location, z)
+	record, err := redis.getContext(ctx, location, z)
+	if err != nil {
+		var ok bool
+		if record, ok = redis.staleRecord(z, location, err); !ok {
+			return redis.serverFailure(state, zone, err)
+		}
+		if !stale {
+			stale, state = true, staleState(state)
+		}
+	}
+	if record == nil {
+		// empty non-terminal or a record removed after zone was loaded, both
+		// are answered with NODATA
+		record = new(Record)
+	}
+	// DS queries at a zone cut are answered by the parent
+	if qtype != "DS" && !strings.HasPrefix(location, "*") && redis.delegated(qname, z, record) {
+		ns, glue := redis.referral(qname, z, record)
+		return redis.referralResponse(state, zone, chain, ns, glue)
+	}
+	ecs := clientSubnet(state.Req)
+	record, scope := subnetRecord(record, state.QType(), ecs)
 
 	switch qtype {
 	case "A":
 		answers, extras = redis.A(qname, z, record)
+		answers = redis.selectAddresses(answers, addressWeights(record, dns.TypeA))
 	case "AAAA":
 		answers, extras = redis.AAAA(qname, z, record)
+		answers = redis.selectAddresses(answers, addressWeights(record, dns.TypeAAAA))
 	case "CNAME":
 		answers, extras = redis.CNAME(qname, z, record)
 	case "TXT":
@@ -94,33 +243,433 @@ func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 		answers, extras = redis.SOA(qname, z, record)
 	case "CAA":
 		answers, extras = redis.CAA(qname, z, record)
+	case "TLSA":
+		answers, extras = redis.TLSA(qname, z, record)
+	case "SMIMEA":
+		answers, extras = redis.SMIMEA(qname, z, record)
+	case "OPENPGPKEY":
+		answers, extras = redis.OPENPGPKEY(qname, z, record)
+	case "SSHFP":
+		answers, extras = redis.SSHFP(qname, z, record)
+	case "NAPTR":
+		answers, extras = redis.NAPTR(qname, z, record)
+	case "URI":
+		answers, extras = redis.URI(qname, z, record)
+	case "HINFO":
+		answers, extras = redis.HINFO(qname, z, record)
+	case "RP":
+		answers, extras = redis.RP(qname, z, record)
+	case "AFSDB":
+		answers, extras = redis.AFSDB(qname, z, record)
+	case "APL":
+		answers, extras = redis.APL(qname, z, record)
+	case "CERT":
+		answers, extras = redis.CERT(qname, z, record)
+	case "PTR":
+		answers, extras = redis.PTR(qname, z, record)
+		if len(answers) == 0 && len(record.CNAME) == 0 {
+			answers = redis.reversePtr(qname, z)
+		}
+	case "DNAME":
+		answers, extras = redis.DNAME(qname, z, record)
+	case "LOC":
+		answers, extras = redis.LOC(qname, z, record)
+	case "SVCB":
+		answers, extras = redis.SVCB(qname, z, record)
+	case "HTTPS":
+		answers, extras = redis.HTTPS(qname, z, record)
+	case "ANY":
+		answers, extras = redis.ANY(qname, z, record)
+	case "RRSIG":
+		answers, extras = redis.RRSIG(qname, z, record)
+	case "DNSKEY":
+		answers, extras = redis.DNSKEY(qname, z, record)
+	case "DS":
+		answers, extras = redis.DS(qname, z, record)
+	case "NSEC":
+		answers, extras = redis.NSEC(qname, z, record)
+	case "NSEC3":
+		answers, extras = redis.NSEC3(qname, z, record)
+	case "NSEC3PARAM":
+		answers, extras = redis.NSEC3PARAM(qname, z, record)
+	case "CDS":
+		answers, extras = redis.CDS(qname, z, record)
+	case "CDNSKEY":
+		answers, extras = redis.CDNSKEY(qname, z, record)
+	case "ZONEMD":
+		answers, extras = redis.ZONEMD(qname, z, record)
 
 	default:
-		return redis.errorResponse(state, zone, dns.RcodeNotImplemented, nil)
+		// types without a handler are served only from generic records
+		answers = redis.genericRecords(qname, z, record, state.QType())
+		if len(answers) == 0 {
+			return redis.errorResponse(state, zone, dns.RcodeNotImplemented, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNotSupported}, nil)
+		}
+	}
+	if len(answers) == 0 && qtype != "ANY" {
+		answers = redis.genericRecords(qname, z, record, state.QType())
+	}
+
+	if (qtype == "A" || qtype == "AAAA") && len(answers) == 0 && record.ALIAS.Target != "" {
+		var err error
+		answers, err = redis.ALIAS(ctx, qname, z, state.QType(), record)
+		if err != nil {
+			fmt.Println("alias error : ", qname, err)
+			return redis.errorResponse(state, zone, dns.RcodeServerFailure, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "alias target not resolved"}, nil)
+		}
+	}
+
+	// synthesized records can not be validated by clients doing their own validation
+	if qtype == "AAAA" && redis.dns64Prefix != nil && len(record.CNAME) == 0 && !(do && r.CheckingDisabled) {
+		answers = redis.dns64(qname, z, record, answers)
+	}
+
+	if len(answers) == 0 && qtype != "CNAME" && len(record.CNAME) > 0 {
+		answers = redis.chaseCname(ctx, qname, qtype, z, record)
+	}
+
+	var ns []dns.RR
+	if len(answers) == 0 {
+		ns = redis.negativeSoa(z, do)
+	}
+	if do && qtype != "RRSIG" {
+		if len(answers) > 0 {
+			answers = redis.signed(qname, z, record, answers)
+		} else if redis.zoneKeys(zone) != nil {
+			existing, _ := redis.records(qname, z, record)
+			ns = append(ns, redis.nsecLie(qname, z, existing)...)
+		} else {
+			ns = append(ns, redis.nodata(qname, location, z)...)
+		}
+	}
+
+	if len(answers) > 0 && redis.authorityNs(zone) && !(qname == z.Name && (qtype == "NS" || qtype == "ANY")) {
+		ns = redis.apexNs(z, do)
+	}
+	if ecs != nil {
+		extras = append(extras, subnetOpt(ecs, scope))
+	}
+	if err = ctx.Err(); err != nil && !stale {
+		return redis.serverFailure(state, zone, err)
+	}
+
+	return redis.answerResponse(state, zone, dns.RcodeSuccess, append(chain, answers...), ns, extras)
+}
+
+// authorityNs checks if authority section of positive answers in zone
+// holds zone NS records
+func (redis *Redis) authorityNs(zone string) bool {
+	return redis.authorityZones[zone] || redis.authorityZones[""]
+}
+
+// apexNs returns NS records of zone apex for authority section of positive answers
+func (redis *Redis) apexNs(z *Zone, do bool) []dns.RR {
+	apex := redis.get(z.Name, z)
+	if apex == nil {
+		return nil
+	}
+	ns, _ := redis.NS(z.Name, z, apex)
+	if !do {
+		return ns
+	}
+	return redis.signed(z.Name, z, apex, ns)
+}
+
+// negativeSoa returns zone SOA for authority section of NXDOMAIN and NODATA responses,
+// ttl is set to negative_ttl or the lower of SOA ttl and minimum field as described in rfc2308
+func (redis *Redis) negativeSoa(z *Zone, do bool) []dns.RR {
+	apex := redis.get(z.Name, z)
+	if apex == nil {
+		apex = new(Record)
+	}
+	soa, _ := redis.SOA(z.Name, z, apex)
+	r := soa[0].(*dns.SOA)
+	if r.Minttl < r.Hdr.Ttl {
+		r.Hdr.Ttl = r.Minttl
+	}
+	// negative_ttl only lowers ttl, negative answers are not cached longer than
+	// the zone allows
+	if redis.negativeTtl != 0 && redis.negativeTtl < r.Hdr.Ttl {
+		r.Hdr.Ttl = redis.negativeTtl
+	}
+	if !do {
+		return soa
+	}
+	sigs := redis.signatures(z.Name, z, apex, soa)
+	for _, sig := range sigs {
+		sig.Header().Ttl = r.Hdr.Ttl
+	}
+	return append(soa, sigs...)
+}
+
+func (redis *Redis) handleZoneTransfer(state request.Request, z *Zone) (int, error) {
+	if !redis.transferAllowed(state) {
+		return redis.errorResponse(state, z.Name, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited}, nil)
+	}
+	if redis.tsigSecret != "" && !redis.tsigValid(state.Req) {
+		return redis.errorResponse(state, z.Name, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited}, nil)
+	}
+
+	if state.QType() == dns.TypeIXFR {
+		// zone history is not kept, so no incremental transfer is possible.
+		// reply with our SOA if client is up to date or the query came over udp,
+		// otherwise fall back to a full transfer as allowed by rfc1995
+		record := redis.get(z.Name, z)
+		if record == nil {
+			return redis.errorResponse(state, z.Name, dns.RcodeServerFailure, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData, ExtraText: "zone has no soa"}, nil)
+		}
+		soa, _ := redis.SOA(z.Name, z, record)
+		serial, ok := ixfrSerial(state.Req)
+		if !ok {
+			return redis.errorResponse(state, z.Name, dns.RcodeFormatError, nil, nil)
+		}
+		if state.Proto() == "udp" || !serialNewer(soa[0].(*dns.SOA).Serial, serial) {
+			return redis.answerResponse(state, z.Name, dns.RcodeSuccess, soa, nil, nil)
+		}
+	}
+
+	records := redis.clampTtl(redis.AXFR(z))
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	tr.TsigSecret = nil
+
+	go func(ch chan *dns.Envelope) {
+		for _, envelope := range splitTransfer(records, redis.transferLength) {
+			ch <- &dns.Envelope{RR: envelope}
+		}
+		close(ch)
+	}(ch)
+
+	var err error
+	if redis.tsigSecret != "" {
+		err = redis.signedTransferOut(state.W, state.Req, ch)
+	} else {
+		err = tr.Out(state.W, state.Req, ch)
+	}
+	if err != nil {
+		fmt.Println(err)
 	}
+	state.W.Hijack()
+	return dns.RcodeSuccess, nil
+}
+
+// transferAllowed checks client address against transfer_allow ranges,
+// transfers are denied if no range is configured
+func (redis *Redis) transferAllowed(state request.Request) bool {
+	return clientAllowed(state, redis.transferAllow)
+}
+
+// clientAllowed checks if client address of state is inside one of nets
+func clientAllowed(state request.Request, nets []*net.IPNet) bool {
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range nets {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ixfrSerial returns the client's current serial from authority section of an IXFR request
+func ixfrSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// serialNewer reports whether s1 is newer than s2 using rfc1982 serial number arithmetic
+func serialNewer(s1, s2 uint32) bool {
+	return s1 != s2 && int32(s1-s2) > 0
+}
+
+// splitTransfer splits records into envelopes of at most length bytes,
+// a record larger than length gets an envelope of its own
+func splitTransfer(records []dns.RR, length int) (envelopes [][]dns.RR) {
+	if length <= 0 {
+		length = defaultTransferLength
+	}
+	j, l := 0, 0
+	for i, r := range records {
+		rl := dns.Len(r)
+		if l+rl > length && i > j {
+			envelopes = append(envelopes, records[j:i])
+			l = 0
+			j = i
+		}
+		l += rl
+	}
+	if j < len(records) {
+		envelopes = append(envelopes, records[j:])
+	}
+	return
+}
+
+// tsigValid verifies request is signed with the configured tsig key
+func (redis *Redis) tsigValid(r *dns.Msg) bool {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return false
+	}
+	if !strings.EqualFold(tsig.Hdr.Name, redis.tsigName) || !strings.EqualFold(tsig.Algorithm, redis.tsigAlgorithm) {
+		return false
+	}
+	buf, err := r.Pack()
+	if err != nil {
+		return false
+	}
+	return dns.TsigVerify(buf, redis.tsigSecret, "", false) == nil
+}
+
+// signedTransferOut works like dns.Transfer.Out but signs every envelope with
+// the configured tsig key, chaining the MAC of the previous message
+func (redis *Redis) signedTransferOut(w dns.ResponseWriter, q *dns.Msg, ch chan *dns.Envelope) error {
+	requestMAC := q.IsTsig().MAC
+	timersOnly := false
+	for x := range ch {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		r.Answer = append(r.Answer, x.RR...)
+		r.SetTsig(redis.tsigName, redis.tsigAlgorithm, 300, time.Now().Unix())
+		out, mac, err := dns.TsigGenerate(r, redis.tsigSecret, requestMAC, timersOnly)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+		requestMAC, timersOnly = mac, true
+	}
+	return nil
+}
 
+// Name implements the Handler interface.
+func (redis *Redis) Name() string { return "redis" }
+
+func (redis *Redis) answerResponse(state request.Request, zone string, rcode int, answers, ns, extras []dns.RR) (int, error) {
 	m := new(dns.Msg)
-	m.SetReply(r)
+	m.SetRcode(state.Req, rcode)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
 
+	answers = redis.clampTtl(answers)
+	ns = redis.clampTtl(ns)
+	extras = redis.clampTtl(extras)
+
+	if keys := redis.zoneKeys(zone); keys != nil && state.Do() {
+		answers = redis.sign(keys, answers)
+		ns = redis.sign(keys, ns)
+	}
+	redis.jitterTtl(zone, answers, ns, extras)
+
 	m.Answer = append(m.Answer, answers...)
+	m.Ns = append(m.Ns, ns...)
 	m.Extra = append(m.Extra, extras...)
 
 	state.SizeAndDo(m)
+	redis.fitResponse(m, state.Size())
 	m = state.Scrub(m)
-	_ = w.WriteMsg(m)
+	_ = state.W.WriteMsg(m)
 	return dns.RcodeSuccess, nil
 }
 
-// Name implements the Handler interface.
-func (redis *Redis) Name() string { return "redis" }
+// fitResponse removes sections of m in the order of truncate_policy until m
+// fits in size, responses still too large are truncated by Scrub
+func (redis *Redis) fitResponse(m *dns.Msg, size int) {
+	for _, step := range redis.truncatePolicy {
+		if m.Len() <= size {
+			return
+		}
+		switch step {
+		case truncateAdditional:
+			m.Extra = optOnly(m.Extra)
+		case truncateAuthority:
+			// negative answers need their SOA
+			if len(m.Answer) > 0 {
+				m.Ns = nil
+			}
+		case truncateTc:
+			m.Answer, m.Ns, m.Extra = nil, nil, optOnly(m.Extra)
+			m.Truncated = true
+			return
+		}
+	}
+}
+
+func optOnly(extras []dns.RR) []dns.RR {
+	var opt []dns.RR
+	for _, rr := range extras {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = append(opt, rr)
+		}
+	}
+	return opt
+}
+
+// referralResponse writes a response delegating query to the name servers in
+// ns. referrals are not authoritative unless answers holds a chain of in-zone
+// aliases for the query name, aa is set for the query name as in rfc1035 section 4.1.1
+func (redis *Redis) referralResponse(state request.Request, zone string, answers, ns, extras []dns.RR) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.RecursionAvailable, m.Compress = len(answers) > 0, false, true
 
-func (redis *Redis) errorResponse(state request.Request, zone string, rcode int, err error) (int, error) {
+	answers = redis.clampTtl(answers)
+	ns = redis.clampTtl(ns)
+	extras = redis.clampTtl(extras)
+	redis.jitterTtl(zone, answers, ns, extras)
+
+	m.Answer = append(m.Answer, answers...)
+	m.Ns = append(m.Ns, ns...)
+	m.Extra = append(m.Extra, extras...)
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// truncatedResponse writes an empty truncated answer so client retries over tcp
+func (redis *Redis) truncatedResponse(state request.Request) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.Truncated = true, true
+
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// serverFailure writes SERVFAIL for an error reading zone data, records which
+// can not be parsed are reported as invalid data and other errors as network errors
+func (redis *Redis) serverFailure(state request.Request, zone string, err error) (int, error) {
+	ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError, ExtraText: "redis unavailable"}
+	if _, ok := err.(invalidRecordError); ok {
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData}
+	} else if err == context.DeadlineExceeded || err == context.Canceled {
+		ede.ExtraText = "redis timeout"
+	}
+	return redis.errorResponse(state, zone, dns.RcodeServerFailure, ede, err)
+}
+
+// errorResponse writes an empty response with rcode, only name errors and
+// dname overflows are authoritative. ede is added as an
+// extended dns error as described in rfc8914 if client sent an OPT record
+func (redis *Redis) errorResponse(state request.Request, zone string, rcode int, ede *dns.EDNS0_EDE, err error) (int, error) {
 	m := new(dns.Msg)
 	m.SetRcode(state.Req, rcode)
-	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
+	m.Authoritative = zone != "" && (rcode == dns.RcodeNameError || rcode == dns.RcodeYXDomain)
+	m.RecursionAvailable, m.Compress = false, true
 
 	state.SizeAndDo(m)
+	if ede != nil {
+		appendOption(m, ede)
+	}
 	_ = state.W.WriteMsg(m)
 	// Return success as the rcode to signal we have written to the client.
 	return dns.RcodeSuccess, err
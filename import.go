@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ImportZone replaces records of zone stored in redis with records of a zone file
+// in rfc1035 master format. the zone is written in a single script, nothing is
+// written if the file can not be parsed or has records outside of zone
+func (redis *Redis) ImportZone(zoneName string, zonefile io.Reader) error {
+	zone := dns.Fqdn(strings.ToLower(zoneName))
+	records := make(map[string]*Record)
+	var order []string
+
+	zp := dns.NewZoneParser(zonefile, zone, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if !dns.IsSubDomain(zone, name) {
+			return fmt.Errorf("record %s is outside of zone %s", name, zone)
+		}
+		if h.Class != dns.ClassINET {
+			return fmt.Errorf("unsupported class %s at %s", dns.ClassToString[h.Class], name)
+		}
+		label := "@"
+		if name != zone {
+			label = strings.TrimSuffix(name, "."+zone)
+		}
+		record, ok := records[label]
+		if !ok {
+			record = new(Record)
+			records[label] = record
+			order = append(order, label)
+		}
+		if h.Rrtype == dns.TypeSOA && (label != "@" || record.SOA.Ns != "") {
+			return fmt.Errorf("unexpected SOA record at %s", name)
+		}
+		if !addRecord(record, rr) {
+			return fmt.Errorf("unsupported record type %s at %s", dns.TypeToString[h.Rrtype], name)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if apex, ok := records["@"]; !ok || apex.SOA.Ns == "" {
+		return errors.New("zone file has no SOA record")
+	}
+
+	args := []interface{}{importScript, 1, redis.keyPrefix + zone + redis.keySuffix}
+	for _, label := range order {
+		val, err := redis.encodeRecord(records[label])
+		if err != nil {
+			return err
+		}
+		args = append(args, label, val)
+	}
+
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("EVAL", args...); err != nil {
+		return err
+	}
+	redis.invalidate(zone)
+	return redis.LoadZones()
+}
+
+// importScript replaces the zone hash with the given fields
+const importScript = `
+redis.call("DEL", KEYS[1])
+for i = 1, #ARGV, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i+1])
+end
+return #ARGV / 2
+`
@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// subscribe listens for keyspace notifications of zone keys, cached records of modified
+// zones are dropped and zone names are reloaded when a zone is added or removed.
+// subscription is retried with exponential backoff and zones are reloaded after
+// reconnecting since events may have been missed, zone update ticker keeps polling meanwhile
+func (redis *Redis) subscribe(done <-chan struct{}) {
+	backoff := retryInitialBackoff
+	reconnect := false
+	for {
+		if redis.subscribeOnce(done, func() {
+			if reconnect {
+				redis.LoadZones()
+			}
+			reconnect = true
+			backoff = retryInitialBackoff
+		}) {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// subscribeOnce receives keyspace notifications until subscription fails,
+// subscribed is called once the subscription is made. it returns true if
+// done was closed
+func (redis *Redis) subscribeOnce(done <-chan struct{}, subscribed func()) bool {
+	opts := []redisCon.DialOption{}
+	if redis.redisPassword != "" && redis.redisUsername == "" {
+		opts = append(opts, redisCon.DialPassword(redis.redisPassword))
+	}
+	if redis.connectTimeout != 0 {
+		opts = append(opts, redisCon.DialConnectTimeout(time.Duration(redis.connectTimeout)*time.Millisecond))
+	}
+	opts = append(opts, redis.tlsOptions()...)
+	addr, err := redis.dialAddress()
+	if err != nil {
+		fmt.Println("keyspace subscription error : ", err)
+		return false
+	}
+	conn, err := redis.dial(addr, opts)
+	if err != nil {
+		fmt.Println("keyspace subscription error : ", err)
+		return false
+	}
+	psc := redisCon.PubSubConn{Conn: conn}
+	if err = psc.PSubscribe(fmt.Sprintf(keyspaceChannel, redis.redisDb) + globEscape(redis.keyPrefix) + "*" + globEscape(redis.keySuffix)); err != nil {
+		fmt.Println("keyspace subscription error : ", err)
+		psc.Close()
+		return false
+	}
+	subscribed()
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-done:
+		case <-closed:
+		}
+		psc.Close()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redisCon.Message:
+			redis.keyspaceEvent(v.Channel, string(v.Data))
+		case error:
+			select {
+			case <-done:
+				return true
+			default:
+				fmt.Println("keyspace subscription error : ", v)
+			}
+			return false
+		}
+	}
+}
+
+// keyspaceEvent handles a keyspace notification for channel with event
+func (redis *Redis) keyspaceEvent(channel string, event string) {
+	i := strings.Index(channel, "__:")
+	if i < 0 {
+		return
+	}
+	key := channel[i+3:]
+	if !strings.HasPrefix(key, redis.keyPrefix) || !strings.HasSuffix(key, redis.keySuffix) {
+		return
+	}
+	zone := strings.TrimSuffix(strings.TrimPrefix(key, redis.keyPrefix), redis.keySuffix)
+
+	redis.invalidate(zone)
+	known := false
+	for _, z := range redis.zones() {
+		if z == zone {
+			known = true
+			break
+		}
+	}
+	if !known || event == "del" || event == "expired" || event == "evicted" || event == "rename_from" {
+		redis.LoadZones()
+	}
+}
+
+const keyspaceChannel = "__keyspace@%d__:"
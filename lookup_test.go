@@ -1,35 +1,73 @@
 package redis
 
 import (
+	"bytes"
 	"context"
-	"testing"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptoRand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy"
+
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/plugin/test"
 
+	redisCon "github.com/gomodule/redigo/redis"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-var zones = []string {
-	"example.com.", "example.net.",
+var zones = []string{
+	"example.com.", "example.net.", "signed.example.",
 }
 
-var lookupEntries = [][][]string {
+var lookupEntries = [][][]string{
 	{
 		{"@",
 			"{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.example.com.\",\"ns\":\"ns1.example.com.\",\"refresh\":44,\"retry\":55,\"expire\":66}}",
 		},
 		{"x",
 			"{\"a\":[{\"ttl\":300, \"ip\":\"1.2.3.4\"},{\"ttl\":300, \"ip\":\"5.6.7.8\"}]," +
-			"\"aaaa\":[{\"ttl\":300, \"ip\":\"::1\"}]," +
-			"\"txt\":[{\"ttl\":300, \"text\":\"foo\"},{\"ttl\":300, \"text\":\"bar\"}]," +
-			"\"ns\":[{\"ttl\":300, \"host\":\"ns1.example.com.\"},{\"ttl\":300, \"host\":\"ns2.example.com.\"}]," +
-			"\"mx\":[{\"ttl\":300, \"host\":\"mx1.example.com.\", \"preference\":10},{\"ttl\":300, \"host\":\"mx2.example.com.\", \"preference\":10}]}",
+				"\"aaaa\":[{\"ttl\":300, \"ip\":\"::1\"}]," +
+				"\"txt\":[{\"ttl\":300, \"text\":\"foo\"},{\"ttl\":300, \"text\":\"bar\"}]," +
+				"\"ns\":[{\"ttl\":300, \"host\":\"ns1.example.com.\"},{\"ttl\":300, \"host\":\"ns2.example.com.\"}]," +
+				"\"mx\":[{\"ttl\":300, \"host\":\"mx1.example.com.\", \"preference\":10},{\"ttl\":300, \"host\":\"mx2.example.com.\", \"preference\":10}]}",
 		},
 		{"y",
 			"{\"cname\":[{\"ttl\":300, \"host\":\"x.example.com.\"}]}",
 		},
+		{"z",
+			"{\"cname\":[{\"ttl\":300, \"host\":\"y.example.com.\"}]}",
+		},
+		{"w",
+			"{\"cname\":[{\"ttl\":300, \"host\":\"www.example.org.\"}]}",
+		},
+		{"loop1",
+			"{\"cname\":[{\"ttl\":300, \"host\":\"loop2.example.com.\"}]}",
+		},
+		{"loop2",
+			"{\"cname\":[{\"ttl\":300, \"host\":\"loop1.example.com.\"}]}",
+		},
 		{"ns1",
 			"{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}",
 		},
@@ -41,13 +79,25 @@ var lookupEntries = [][][]string {
 		},
 		{"sip",
 			"{\"a\":[{\"ttl\":300, \"ip\":\"7.7.7.7\"}]," +
-			"\"aaaa\":[{\"ttl\":300, \"ip\":\"::1\"}]}",
+				"\"aaaa\":[{\"ttl\":300, \"ip\":\"::1\"}]}",
+		},
+		{"dn",
+			"{\"dname\":{\"ttl\":300, \"target\":\"example.com.\"}}",
+		},
+		{"ext",
+			"{\"dname\":{\"ttl\":300, \"target\":\"example.org.\"}}",
+		},
+		{"loop",
+			"{\"dname\":{\"ttl\":300, \"target\":\"x.loop.example.com.\"}}",
+		},
+		{"_443._tcp.www",
+			"{\"tlsa\":[{\"ttl\":300, \"usage\":3, \"selector\":1, \"matching_type\":1, \"certificate\":\"0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a\"}]}",
 		},
 	},
 	{
 		{"@",
 			"{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.example.net.\",\"ns\":\"ns1.example.net.\",\"refresh\":44,\"retry\":55,\"expire\":66}," +
-			"\"ns\":[{\"ttl\":300, \"host\":\"ns1.example.net.\"},{\"ttl\":300, \"host\":\"ns2.example.net.\"}]}",
+				"\"ns\":[{\"ttl\":300, \"host\":\"ns1.example.net.\"},{\"ttl\":300, \"host\":\"ns2.example.net.\"}]}",
 		},
 		{"sub.*",
 			"{\"txt\":[{\"ttl\":300, \"text\":\"this is not a wildcard\"}]}",
@@ -60,7 +110,7 @@ var lookupEntries = [][][]string {
 		},
 		{"*",
 			"{\"txt\":[{\"ttl\":300, \"text\":\"this is a wildcard\"}]," +
-			"\"mx\":[{\"ttl\":300, \"host\":\"host1.example.net.\",\"preference\": 10}]}",
+				"\"mx\":[{\"ttl\":300, \"host\":\"host1.example.net.\",\"preference\": 10}]}",
 		},
 		{"_ssh._tcp.host1",
 			"{\"srv\":[{\"ttl\":300, \"target\":\"tcp.example.com.\",\"port\":123,\"priority\":10,\"weight\":100}]}",
@@ -68,6 +118,32 @@ var lookupEntries = [][][]string {
 		{"_ssh._tcp.host2",
 			"{\"srv\":[{\"ttl\":300, \"target\":\"tcp.example.com.\",\"port\":123,\"priority\":10,\"weight\":100}]}",
 		},
+		{"host.ent",
+			"{\"a\":[{\"ttl\":300, \"ip\":\"6.6.6.6\"}]}",
+		},
+		{"host2",
+			"{\"caa\":[{\"ttl\":300, \"flag\":0, \"tag\":\"issue\", \"value\":\"letsencrypt.org\"}," +
+				"{\"ttl\":300, \"flag\":0, \"tag\":\"issuewild\", \"value\":\";\"}," +
+				"{\"ttl\":300, \"flag\":128, \"tag\":\"iodef\", \"value\":\"mailto:security@example.net\"}]}",
+		},
+	},
+	{
+		{"@",
+			"{\"soa\":{\"ttl\":300, \"serial\":1, \"minttl\":100, \"mbox\":\"hostmaster.signed.example.\",\"ns\":\"ns1.signed.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}," +
+				"\"dnskey\":[{\"ttl\":300, \"flags\":257, \"protocol\":3, \"algorithm\":8, \"public_key\":\"AwEAAaGjutd8\"}]," +
+				"\"nsec\":{\"ttl\":300, \"next_domain\":\"a.signed.example.\", \"types\":[\"SOA\",\"DNSKEY\",\"NSEC\",\"RRSIG\"]}," +
+				"\"rrsig\":[" +
+				"{\"ttl\":300, \"type_covered\":\"SOA\", \"algorithm\":8, \"labels\":2, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":12345, \"signer_name\":\"signed.example.\", \"signature\":\"c29hc2ln\"}," +
+				"{\"ttl\":300, \"type_covered\":\"DNSKEY\", \"algorithm\":8, \"labels\":2, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":12345, \"signer_name\":\"signed.example.\", \"signature\":\"ZG5za2V5c2ln\"}," +
+				"{\"ttl\":300, \"type_covered\":\"NSEC\", \"algorithm\":8, \"labels\":2, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":12345, \"signer_name\":\"signed.example.\", \"signature\":\"bnNlY3NpZw==\"}]}",
+		},
+		{"a",
+			"{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]," +
+				"\"nsec\":{\"ttl\":300, \"next_domain\":\"signed.example.\", \"types\":[\"A\",\"NSEC\",\"RRSIG\"]}," +
+				"\"rrsig\":[" +
+				"{\"ttl\":300, \"type_covered\":\"A\", \"algorithm\":8, \"labels\":3, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":12345, \"signer_name\":\"signed.example.\", \"signature\":\"YXNpZw==\"}," +
+				"{\"ttl\":300, \"type_covered\":\"NSEC\", \"algorithm\":8, \"labels\":3, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":12345, \"signer_name\":\"signed.example.\", \"signature\":\"YW5zZWNzaWc=\"}]}",
+		},
 	},
 }
 
@@ -135,10 +211,50 @@ var testCases = [][]test.Case{
 				test.AAAA("sip.example.com 300 IN AAAA ::1"),
 			},
 		},
+		// ANY Test
+		{
+			Qname: "sip.example.com.", Qtype: dns.TypeANY,
+			Answer: []dns.RR{
+				test.A("sip.example.com. 300 IN A 7.7.7.7"),
+				test.AAAA("sip.example.com. 300 IN AAAA ::1"),
+			},
+		},
 		// NXDOMAIN Test
 		{
 			Qname: "notexists.example.com.", Qtype: dns.TypeA,
 			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
+			},
+		},
+		// CNAME Test
+		{
+			Qname: "z.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.example.com. 300 IN A 1.2.3.4"),
+				test.A("x.example.com. 300 IN A 5.6.7.8"),
+				test.CNAME("y.example.com. 300 IN CNAME x.example.com."),
+				test.CNAME("z.example.com. 300 IN CNAME y.example.com."),
+			},
+		},
+		{
+			Qname: "z.example.com.", Qtype: dns.TypeCNAME,
+			Answer: []dns.RR{
+				test.CNAME("z.example.com. 300 IN CNAME y.example.com."),
+			},
+		},
+		{
+			Qname: "w.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("w.example.com. 300 IN CNAME www.example.org."),
+			},
+		},
+		{
+			Qname: "loop1.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("loop1.example.com. 300 IN CNAME loop2.example.com."),
+				test.CNAME("loop2.example.com. 300 IN CNAME loop1.example.com."),
+			},
 		},
 		// SOA Test
 		{
@@ -147,6 +263,57 @@ var testCases = [][]test.Case{
 				test.SOA("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
 			},
 		},
+		// TLSA Test
+		{
+			Qname: "_443._tcp.www.example.com.", Qtype: dns.TypeTLSA,
+			Answer: []dns.RR{
+				newRR("_443._tcp.www.example.com. 300 IN TLSA 3 1 1 0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a"),
+			},
+		},
+		{
+			Qname: "x.example.com.", Qtype: dns.TypeTLSA,
+			Ns: []dns.RR{
+				test.SOA("example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
+			},
+		},
+		// DNAME Test
+		{
+			Qname: "dn.example.com.", Qtype: dns.TypeDNAME,
+			Answer: []dns.RR{
+				newRR("dn.example.com. 300 IN DNAME example.com."),
+			},
+		},
+		{
+			Qname: "x.dn.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				newRR("dn.example.com. 300 IN DNAME example.com."),
+				test.CNAME("x.dn.example.com. 300 IN CNAME x.example.com."),
+				test.A("x.example.com. 300 IN A 1.2.3.4"),
+				test.A("x.example.com. 300 IN A 5.6.7.8"),
+			},
+		},
+		{
+			Qname: "notexists.dn.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Answer: []dns.RR{
+				newRR("dn.example.com. 300 IN DNAME example.com."),
+				test.CNAME("notexists.dn.example.com. 300 IN CNAME notexists.example.com."),
+			},
+			Ns: []dns.RR{
+				test.SOA("example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "www.ext.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				newRR("ext.example.com. 300 IN DNAME example.org."),
+				test.CNAME("www.ext.example.com. 300 IN CNAME www.example.org."),
+			},
+		},
+		{
+			Qname: "y.loop.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeServerFailure,
+		},
 	},
 	// Wildcard Tests
 	{
@@ -161,6 +328,9 @@ var testCases = [][]test.Case{
 		},
 		{
 			Qname: "host3.example.net.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "foo.bar.example.net.", Qtype: dns.TypeTXT,
@@ -170,17 +340,30 @@ var testCases = [][]test.Case{
 		},
 		{
 			Qname: "host1.example.net.", Qtype: dns.TypeMX,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "sub.*.example.net.", Qtype: dns.TypeMX,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
+		// names below a delegation get a referral
 		{
 			Qname: "host.subdel.example.net.", Qtype: dns.TypeA,
-			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+				test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
+			},
 		},
 		{
 			Qname: "ghost.*.example.net.", Qtype: dns.TypeMX,
 			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "f.h.g.f.t.r.e.example.net.", Qtype: dns.TypeTXT,
@@ -188,6 +371,96 @@ var testCases = [][]test.Case{
 				test.TXT("f.h.g.f.t.r.e.example.net. 300 IN TXT \"this is a wildcard\""),
 			},
 		},
+		{
+			Qname: "a.b.example.net.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("a.b.example.net. 300 IN TXT \"this is a wildcard\""),
+			},
+		},
+		// empty non-terminal blocks wildcard
+		{
+			Qname: "a.ent.example.net.", Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "ent.example.net.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "a.nt.example.net.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("a.nt.example.net. 300 IN TXT \"this is a wildcard\""),
+			},
+		},
+		// CAA Test
+		{
+			Qname: "host2.example.net.", Qtype: dns.TypeCAA,
+			Answer: []dns.RR{
+				newRR("host2.example.net. 300 IN CAA 0 issue \"letsencrypt.org\""),
+				newRR("host2.example.net. 300 IN CAA 0 issuewild \";\""),
+				newRR("host2.example.net. 300 IN CAA 128 iodef \"mailto:security@example.net\""),
+			},
+		},
+	},
+	// DNSSEC Tests
+	{
+		{
+			Qname: "a.signed.example.", Qtype: dns.TypeA, Do: true,
+			Answer: []dns.RR{
+				test.A("a.signed.example. 300 IN A 1.1.1.1"),
+				newRR("a.signed.example. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 signed.example. YXNpZw=="),
+			},
+			Extra: []dns.RR{test.OPT(4096, true)},
+		},
+		{
+			Qname: "a.signed.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("a.signed.example. 300 IN A 1.1.1.1"),
+			},
+		},
+		{
+			Qname: "a.signed.example.", Qtype: dns.TypeTXT, Do: true,
+			Ns: []dns.RR{
+				newRR("a.signed.example. 300 IN NSEC signed.example. A RRSIG NSEC"),
+				newRR("a.signed.example. 300 IN RRSIG NSEC 8 3 300 20300101000000 20200101000000 12345 signed.example. YW5zZWNzaWc="),
+				newRR("signed.example. 100 IN RRSIG SOA 8 2 300 20300101000000 20200101000000 12345 signed.example. c29hc2ln"),
+				test.SOA("signed.example. 100 IN SOA ns1.signed.example. hostmaster.signed.example. 1 44 55 66 100"),
+			},
+			Extra: []dns.RR{test.OPT(4096, true)},
+		},
+		{
+			Qname: "signed.example.", Qtype: dns.TypeDNSKEY, Do: true,
+			Answer: []dns.RR{
+				newRR("signed.example. 300 IN DNSKEY 257 3 8 AwEAAaGjutd8"),
+				newRR("signed.example. 300 IN RRSIG DNSKEY 8 2 300 20300101000000 20200101000000 12345 signed.example. ZG5za2V5c2ln"),
+			},
+			Extra: []dns.RR{test.OPT(4096, true)},
+		},
+		{
+			Qname: "b.signed.example.", Qtype: dns.TypeA, Do: true,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				newRR("a.signed.example. 300 IN NSEC signed.example. A RRSIG NSEC"),
+				newRR("a.signed.example. 300 IN RRSIG NSEC 8 3 300 20300101000000 20200101000000 12345 signed.example. YW5zZWNzaWc="),
+				newRR("signed.example. 100 IN RRSIG SOA 8 2 300 20300101000000 20200101000000 12345 signed.example. c29hc2ln"),
+				test.SOA("signed.example. 100 IN SOA ns1.signed.example. hostmaster.signed.example. 1 44 55 66 100"),
+				newRR("signed.example. 300 IN NSEC a.signed.example. SOA RRSIG NSEC DNSKEY"),
+				newRR("signed.example. 300 IN RRSIG NSEC 8 2 300 20300101000000 20200101000000 12345 signed.example. bnNlY3NpZw=="),
+			},
+			Extra: []dns.RR{test.OPT(4096, true)},
+		},
+		{
+			Qname: "b.signed.example.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("signed.example. 100 IN SOA ns1.signed.example. hostmaster.signed.example. 1 44 55 66 100"),
+			},
+		},
 	},
 }
 
@@ -198,18 +471,20 @@ func newRedisPlugin() *Redis {
 	redis.keyPrefix = ""
 	redis.keySuffix = ""
 	redis.Ttl = 300
+	redis.cnameDepth = defaultCnameDepth
+	redis.transferOff = true
 	redis.redisAddress = "localhost:6379"
 	redis.redisPassword = ""
 	redis.Connect()
 	redis.LoadZones()
 	return redis
 	/*
-	return &Redis {
-		keyPrefix: "",
-		keySuffix:"",
-		redisc: client,
-		Ttl: 300,
-	}	redis := new(Redis)
+		return &Redis {
+			keyPrefix: "",
+			keySuffix:"",
+			redisc: client,
+			Ttl: 300,
+		}	redis := new(Redis)
 	*/
 }
 
@@ -220,7 +495,7 @@ func TestAnswer(t *testing.T) {
 	defer conn.Close()
 
 	for i, zone := range zones {
-		conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix + zone + r.keySuffix)
+		conn.Do("EVAL", "return redis.call('del', unpack(redis.call('keys', ARGV[1])))", 0, r.keyPrefix+zone+r.keySuffix)
 		for _, cmd := range lookupEntries[i] {
 			err := r.save(zone, cmd[0], cmd[1])
 			if err != nil {
@@ -228,6 +503,7 @@ func TestAnswer(t *testing.T) {
 				t.Fail()
 			}
 		}
+		r.LoadZones()
 		for _, tc := range testCases[i] {
 			m := tc.Msg()
 
@@ -245,4 +521,4636 @@ func TestAnswer(t *testing.T) {
 	}
 }
 
-var ctxt context.Context
+func newRR(s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestZoneNameCache(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	refreshZones := []string{"refresh1.example.", "refresh2.example."}
+	for _, zone := range refreshZones {
+		conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	}
+	defer func() {
+		for _, zone := range refreshZones {
+			conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+		}
+	}()
+	r.LoadZones()
+
+	tick := make(chan time.Time)
+	done := make(chan struct{})
+	go r.refreshZones(tick, done)
+
+	hasZone := func(zone string) bool {
+		for _, z := range r.zones() {
+			if z == zone {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, zone := range refreshZones {
+		if hasZone(zone) {
+			t.Fatalf("zone %s loaded before refresh", zone)
+		}
+		r.save(zone, "@", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+		tick <- time.Now()
+		// next send blocks until the reload triggered by this tick has finished
+		done <- struct{}{}
+		if !hasZone(zone) {
+			t.Errorf("zone %s not loaded after refresh", zone)
+		}
+		done = make(chan struct{})
+		go r.refreshZones(tick, done)
+	}
+	close(done)
+}
+
+func TestShutdown(t *testing.T) {
+	r := newRedisPlugin()
+	r.startZoneNameCache()
+	if err := r.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	if conn.Err() == nil {
+		t.Error("pool still usable after shutdown")
+	}
+	if err := r.OnShutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransferAllow(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := zones[0]
+	for _, cmd := range lookupEntries[0] {
+		r.save(zone, cmd[0], cmd[1])
+	}
+	r.LoadZones()
+
+	tests := []struct {
+		allow []string
+		w     dns.ResponseWriter
+		rcode int
+	}{
+		{nil, &test.ResponseWriter{}, dns.RcodeRefused},
+		{[]string{"192.168.0.0/16", "2001:db8::/32"}, &test.ResponseWriter{}, dns.RcodeRefused},
+		{[]string{"192.168.0.0/16", "10.240.0.0/16"}, &test.ResponseWriter{}, dns.RcodeSuccess},
+		{[]string{"10.240.0.0/16"}, &test.ResponseWriter6{}, dns.RcodeRefused},
+		{[]string{"fe80::/64"}, &test.ResponseWriter6{}, dns.RcodeSuccess},
+	}
+	r.transferOff = false
+	for i, tc := range tests {
+		r.transferAllow = nil
+		for _, cidr := range tc.allow {
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			r.transferAllow = append(r.transferAllow, ipNet)
+		}
+		m := new(dns.Msg)
+		m.SetAxfr(zone)
+		rec := dnstest.NewRecorder(tc.w)
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil {
+			t.Fatalf("test %d: no response", i)
+		}
+		if rec.Msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %d", i, tc.rcode, rec.Msg.Rcode)
+		}
+		if tc.rcode == dns.RcodeSuccess && len(rec.Msg.Answer) == 0 {
+			t.Errorf("test %d: expected transfer records", i)
+		}
+	}
+
+	// disabled transfers are refused for allowed clients too
+	r.transferOff = true
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		m := new(dns.Msg)
+		m.SetQuestion(zone, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused || len(rec.Msg.Answer) != 0 {
+			t.Errorf("%s: expected REFUSED with transfers disabled : %v", dns.TypeToString[qtype], rec.Msg)
+		}
+	}
+
+	for _, tc := range []struct {
+		input string
+		off   bool
+	}{
+		{"redis {\n}", true},
+		{"redis {\ntransfer disable\n}", true},
+		{"redis {\ntransfer disable\ntransfer enable\n}", false},
+	} {
+		p, err := redisParse(caddy.NewTestController("dns", tc.input))
+		if err != nil || p.transferOff != tc.off {
+			t.Errorf("%q: expected transferOff %v : %v", tc.input, tc.off, err)
+		}
+	}
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ntransfer off\n}")); err == nil {
+		t.Error("expected error for invalid transfer")
+	}
+
+	// transfers are disabled unless enabled in Corefile
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\naddress localhost:6379\ntransfer_allow 10.240.0.0/16\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.OnShutdown()
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		m := new(dns.Msg)
+		m.SetQuestion(zone, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		p.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused || len(rec.Msg.Answer) != 0 {
+			t.Errorf("%s: expected REFUSED without transfer enable : %v", dns.TypeToString[qtype], rec.Msg)
+		}
+	}
+}
+
+func TestQtypeFilter(t *testing.T) {
+	r, err := redisParse(caddy.NewTestController("dns", "redis {\naddress localhost:6379\ntransfer enable\ntransfer_allow 10.240.0.0/16\nqtype_deny Deny.example AXFR any\nqtype_allow allow.example SOA A\nqtype_allow allow.example AXFR\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.OnShutdown()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	for _, zone := range []string{"deny.example.", "allow.example."} {
+		conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+		defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+		r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster."+zone+"\",\"ns\":\"ns1."+zone+"\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+		r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}],\"txt\":[{\"ttl\":300, \"text\":\"hello\"}]}")
+	}
+	r.LoadZones()
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+	}{
+		{"deny.example.", dns.TypeAXFR, dns.RcodeRefused},
+		{"www.deny.example.", dns.TypeANY, dns.RcodeRefused},
+		{"www.deny.example.", dns.TypeA, dns.RcodeSuccess},
+		{"www.deny.example.", dns.TypeTXT, dns.RcodeSuccess},
+		{"allow.example.", dns.TypeAXFR, dns.RcodeSuccess},
+		{"www.allow.example.", dns.TypeA, dns.RcodeSuccess},
+		{"www.allow.example.", dns.TypeTXT, dns.RcodeRefused},
+		{"www.allow.example.", dns.TypeANY, dns.RcodeRefused},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), rec, m)
+		if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Errorf("%s %s: expected rcode %d : %v", tc.qname, dns.TypeToString[tc.qtype], tc.rcode, rec.Msg)
+			continue
+		}
+		if tc.rcode == dns.RcodeSuccess && len(rec.Msg.Answer) == 0 {
+			t.Errorf("%s %s: expected answers", tc.qname, dns.TypeToString[tc.qtype])
+		}
+	}
+
+	for _, input := range []string{"redis {\nqtype_deny example.com\n}", "redis {\nqtype_deny example.com XYZ\n}",
+		"redis {\nqtype_deny example.com ANY\nqtype_allow example.com A\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+type rawResponseWriter struct {
+	test.ResponseWriter
+	out [][]byte
+}
+
+func (w *rawResponseWriter) Write(buf []byte) (int, error) {
+	w.out = append(w.out, buf)
+	return len(buf), nil
+}
+
+func TestTransferTsig(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := zones[0]
+	for _, cmd := range lookupEntries[0] {
+		r.save(zone, cmd[0], cmd[1])
+	}
+	r.LoadZones()
+
+	_, allowed, _ := net.ParseCIDR("10.240.0.0/16")
+	r.transferAllow = []*net.IPNet{allowed}
+	r.transferOff = false
+	r.tsigName = "transfer.key."
+	r.tsigAlgorithm = dns.HmacSHA256
+	r.tsigSecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+
+	signed := func(name, secret string) (*dns.Msg, string) {
+		m := new(dns.Msg)
+		m.SetAxfr(zone)
+		m.SetTsig(name, dns.HmacSHA256, 300, time.Now().Unix())
+		buf, mac, err := dns.TsigGenerate(m, secret, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		return req, mac
+	}
+
+	unsigned := new(dns.Msg)
+	unsigned.SetAxfr(zone)
+	wrongSecret, _ := signed("transfer.key.", "d3Jvbmctc2VjcmV0")
+	wrongName, _ := signed("other.key.", r.tsigSecret)
+	for i, m := range []*dns.Msg{unsigned, wrongSecret, wrongName} {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+			t.Errorf("test %d: expected refused transfer", i)
+		}
+	}
+
+	m, mac := signed("transfer.key.", r.tsigSecret)
+	w := &rawResponseWriter{}
+	r.ServeDNS(ctxt, w, m)
+	if len(w.out) == 0 {
+		t.Fatal("no transfer envelopes")
+	}
+	for i, out := range w.out {
+		// TsigVerify strips the tsig from buffer, unpack first
+		resp := new(dns.Msg)
+		if err := resp.Unpack(out); err != nil || resp.IsTsig() == nil {
+			t.Fatalf("envelope %d: not signed", i)
+		}
+		if err := dns.TsigVerify(out, r.tsigSecret, mac, i > 0); err != nil {
+			t.Fatalf("envelope %d: %v", i, err)
+		}
+		mac = resp.IsTsig().MAC
+	}
+}
+
+func TestTransferLength(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := zones[0]
+	for _, cmd := range lookupEntries[0] {
+		r.save(zone, cmd[0], cmd[1])
+	}
+	z := r.load(zone)
+	records := r.AXFR(z)
+
+	var lengths []int
+	for _, length := range []int{defaultTransferLength, minTransferLength} {
+		envelopes := splitTransfer(records, length)
+		n := 0
+		for _, envelope := range envelopes {
+			size := 0
+			for _, rr := range envelope {
+				size += dns.Len(rr)
+			}
+			if size > length && len(envelope) > 1 {
+				t.Errorf("envelope of %d bytes exceeds %d", size, length)
+			}
+			n += len(envelope)
+		}
+		if n != len(records) {
+			t.Errorf("expected %d records in envelopes, got %d", len(records), n)
+		}
+		lengths = append(lengths, len(envelopes))
+	}
+	if lengths[1] <= lengths[0] {
+		t.Errorf("expected more envelopes with smaller transfer length : %v", lengths)
+	}
+}
+
+func TestIxfr(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := zones[0]
+	for _, cmd := range lookupEntries[0] {
+		r.save(zone, cmd[0], cmd[1])
+	}
+	r.LoadZones()
+	_, allowed, _ := net.ParseCIDR("10.240.0.0/16")
+	r.transferAllow = []*net.IPNet{allowed}
+	r.transferOff = false
+
+	tests := []struct {
+		serial uint32
+		tcp    bool
+		full   bool
+	}{
+		{r.serial() + 1000, true, false},
+		{1, false, false},
+		{1, true, true},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetIxfr(zone, tc.serial, "ns1.example.com.", "hostmaster.example.com.")
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("test %d: expected successful response", i)
+		}
+		answers := rec.Msg.Answer
+		if !tc.full && len(answers) != 1 {
+			t.Errorf("test %d: expected single SOA, got %d records", i, len(answers))
+		}
+		if tc.full && len(answers) < 2 {
+			t.Errorf("test %d: expected full transfer, got %d records", i, len(answers))
+		}
+		// recorder keeps the last message of a transfer, which ends with the SOA
+		if _, ok := answers[len(answers)-1].(*dns.SOA); !ok {
+			t.Errorf("test %d: expected SOA as last record", i)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "notify.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	notified := make(chan uint32, 10)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		if m.Opcode == dns.OpcodeNotify && m.Question[0].Name == zone {
+			notified <- m.Answer[0].(*dns.SOA).Serial
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	r.notify = []string{pc.LocalAddr().String()}
+
+	soa := "{\"soa\":{\"ttl\":300, \"serial\":%d, \"minttl\":100, \"mbox\":\"hostmaster.notify.example.\",\"ns\":\"ns1.notify.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}"
+	r.save(zone, "@", fmt.Sprintf(soa, 1))
+	r.LoadZones()
+	r.LoadZones()
+	r.save(zone, "@", fmt.Sprintf(soa, 2))
+	r.LoadZones()
+
+	select {
+	case serial := <-notified:
+		if serial != 2 {
+			t.Errorf("expected serial 2, got %d", serial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notify received")
+	}
+	select {
+	case serial := <-notified:
+		t.Errorf("unexpected notify for serial %d", serial)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNsec3Denial(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "nsec3.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	apexHash := strings.ToLower(dns.HashName(zone, dns.SHA1, 0, ""))
+	aHash := strings.ToLower(dns.HashName("a."+zone, dns.SHA1, 0, ""))
+	nsec3 := "{\"nsec3\":{\"ttl\":300, \"hash\":1, \"flags\":0, \"iterations\":0, \"salt\":\"\", \"next_domain\":\"%s\", \"types\":%s}}"
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.nsec3.example.\",\"ns\":\"ns1.nsec3.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},"+
+		"\"nsec3param\":{\"ttl\":300, \"hash\":1, \"flags\":0, \"iterations\":0, \"salt\":\"\"}}")
+	r.save(zone, "a", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.save(zone, apexHash, fmt.Sprintf(nsec3, aHash, "[\"SOA\",\"NSEC3PARAM\"]"))
+	r.save(zone, aHash, fmt.Sprintf(nsec3, apexHash, "[\"A\"]"))
+	r.LoadZones()
+
+	m := (&test.Case{Qname: "b." + zone, Qtype: dns.TypeA, Do: true}).Msg()
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, rec, m)
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeNameError {
+		t.Fatal("expected NXDOMAIN")
+	}
+	// closest encloser is the apex, both hashes are needed for the proof
+	owners := make(map[string]bool)
+	for _, rr := range rec.Msg.Ns[1:] {
+		if rr.Header().Rrtype != dns.TypeNSEC3 {
+			t.Errorf("unexpected record in authority : %s", rr)
+		}
+		owners[rr.Header().Name] = true
+	}
+	if !owners[apexHash+"."+zone] || !owners[aHash+"."+zone] || len(rec.Msg.Ns) != 3 {
+		t.Errorf("wrong closest encloser proof : %v", rec.Msg.Ns)
+	}
+
+	m = (&test.Case{Qname: "a." + zone, Qtype: dns.TypeTXT, Do: true}).Msg()
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, rec, m)
+	if rec.Msg == nil || len(rec.Msg.Ns) != 2 || rec.Msg.Ns[1].Header().Name != aHash+"."+zone {
+		t.Errorf("expected matching NSEC3 for NODATA : %v", rec.Msg)
+	}
+}
+
+var ctxt context.Context
+
+func TestOnlineSigning(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "online.example."
+	r.dnssecKey = "_dnssec_test"
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.dnssecKey)
+
+	keys := make(map[string]*dns.DNSKEY)
+	record := make(map[string]map[string]string)
+	for name, flags := range map[string]uint16{"ksk": 257, "zsk": 256} {
+		key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+			Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		private, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+		record[name] = map[string]string{"public": key.String(), "private": key.PrivateKeyString(private)}
+	}
+	value, _ := json.Marshal(record)
+	conn.Do("HSET", r.dnssecKey, zone, string(value))
+
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.online.example.\",\"ns\":\"ns1.online.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "a", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"},{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}")
+	r.LoadZones()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := (&test.Case{Qname: name, Qtype: qtype, Do: true}).Msg()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil {
+			t.Fatalf("no response for %s", name)
+		}
+		return rec.Msg
+	}
+	verify := func(rrs []dns.RR, key *dns.DNSKEY) {
+		signed := 0
+		for _, rr := range rrs {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+			var rrset []dns.RR
+			for _, rr := range rrs {
+				if rr.Header().Rrtype == sig.TypeCovered && rr.Header().Name == sig.Hdr.Name {
+					rrset = append(rrset, rr)
+				}
+			}
+			if err := sig.Verify(key, rrset); err != nil || !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("invalid signature %s : %v", sig, err)
+			}
+			signed++
+		}
+		if signed == 0 {
+			t.Errorf("expected signature : %v", rrs)
+		}
+	}
+
+	m := query("a."+zone, dns.TypeA)
+	if len(m.Answer) != 3 {
+		t.Errorf("expected 2 records and a signature : %v", m.Answer)
+	}
+	verify(m.Answer, keys["zsk"])
+
+	// signatures are cached
+	sig := m.Answer[2].(*dns.RRSIG)
+	m = query("a."+zone, dns.TypeA)
+	if cached, ok := m.Answer[2].(*dns.RRSIG); !ok || cached.Signature != sig.Signature {
+		t.Errorf("expected cached signature : %v", m.Answer)
+	}
+
+	m = query(zone, dns.TypeDNSKEY)
+	if len(m.Answer) != 3 {
+		t.Errorf("expected 2 keys and a signature : %v", m.Answer)
+	}
+	verify(m.Answer, keys["ksk"])
+
+	m = query(zone, dns.TypeDS)
+	if len(m.Answer) != 2 || m.Answer[0].(*dns.DS).KeyTag != keys["ksk"].KeyTag() {
+		t.Errorf("expected ksk DS record : %v", m.Answer)
+	}
+
+	m = query("b."+zone, dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Ns) != 4 || m.Ns[1].(*dns.NSEC).NextDomain != "\\000.b."+zone {
+		t.Errorf("expected NODATA with minimal NSEC : %v", m)
+	}
+	verify(m.Ns, keys["zsk"])
+
+	m = query("a."+zone, dns.TypeTXT)
+	if len(m.Ns) != 4 || m.Ns[1].(*dns.NSEC).TypeBitMap[0] != dns.TypeA {
+		t.Errorf("expected NSEC with existing types : %v", m.Ns)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "alias.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	queries := make(chan string, 10)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		queries <- m.Question[0].Name
+		// slow upstream so concurrent queries overlap
+		time.Sleep(20 * time.Millisecond)
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		switch {
+		case m.Question[0].Name != "lb.provider.net.":
+			resp.Rcode = dns.RcodeServerFailure
+		case m.Question[0].Qtype == dns.TypeA:
+			resp.Answer = append(resp.Answer, test.A("lb.provider.net. 60 IN A 9.9.9.9"))
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	r.resolvers = []string{pc.LocalAddr().String()}
+
+	r.save(zone, "@", "{\"alias\":{\"ttl\":300, \"target\":\"lb.provider.net.\"}}")
+	r.save(zone, "broken", "{\"alias\":{\"ttl\":300, \"target\":\"broken.provider.net.\"}}")
+	r.LoadZones()
+
+	tc := test.Case{
+		Qname: zone, Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("alias.example. 60 IN A 9.9.9.9"),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, tc.Msg())
+		test.SortAndCheck(t, rec.Msg, tc)
+	}
+	// second query is answered from cache
+	if len(queries) != 1 {
+		t.Errorf("expected 1 upstream query, got %d", len(queries))
+	}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, rec, (&test.Case{Qname: "broken." + zone, Qtype: dns.TypeA}).Msg())
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for failed resolution : %v", rec.Msg)
+	}
+
+	// concurrent queries for a target not cached yet share one upstream query
+	r.aliasCache = nil
+	for len(queries) > 0 {
+		<-queries
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(ctxt, rec, tc.Msg())
+			if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+				t.Errorf("expected alias answer : %v", rec.Msg)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(queries) != 1 {
+		t.Errorf("expected 1 upstream query for concurrent queries, got %d", len(queries))
+	}
+}
+
+func TestResolveCname(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "resolve.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		lock    sync.Mutex
+		queries int
+	)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		lock.Lock()
+		queries++
+		lock.Unlock()
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		switch {
+		case m.Question[0].Name == "cdn.provider.net." && m.Question[0].Qtype == dns.TypeA:
+			resp.Answer = append(resp.Answer, test.CNAME("cdn.provider.net. 120 IN CNAME edge.provider.net."),
+				test.A("edge.provider.net. 60 IN A 9.9.9.9"))
+		case m.Question[0].Name == "loop.provider.net.":
+			name := "loop.provider.net."
+			for i := 0; i < 10; i++ {
+				target := fmt.Sprintf("l%d.provider.net.", i)
+				resp.Answer = append(resp.Answer, test.CNAME(name+" 60 IN CNAME "+target))
+				name = target
+			}
+		case m.Question[0].Name != "cdn.provider.net.":
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	r.resolvers = []string{pc.LocalAddr().String()}
+
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.resolve.example.\",\"ns\":\"ns1.resolve.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "www", "{\"cname\":[{\"ttl\":300, \"host\":\"cdn.provider.net.\"}]}")
+	r.save(zone, "loop", "{\"cname\":[{\"ttl\":300, \"host\":\"loop.provider.net.\"}]}")
+	r.save(zone, "broken", "{\"cname\":[{\"ttl\":300, \"host\":\"broken.provider.net.\"}]}")
+	r.LoadZones()
+
+	query := func(tc test.Case) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, tc.Msg())
+		if rec.Msg == nil {
+			t.Fatalf("%s: no response", tc.Qname)
+		}
+		test.SortAndCheck(t, rec.Msg, tc)
+	}
+	cname := test.CNAME("www.resolve.example. 300 IN CNAME cdn.provider.net.")
+
+	// off by default
+	query(test.Case{Qname: "www.resolve.example.", Qtype: dns.TypeA, Answer: []dns.RR{cname}})
+
+	r.cnameTimeout = time.Second
+	query(test.Case{
+		Qname: "www.resolve.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.CNAME("cdn.provider.net. 120 IN CNAME edge.provider.net."),
+			test.A("edge.provider.net. 60 IN A 9.9.9.9"),
+			cname,
+		},
+	})
+	// resolved targets are cached
+	lock.Lock()
+	sent := queries
+	lock.Unlock()
+	query(test.Case{
+		Qname: "www.resolve.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.CNAME("cdn.provider.net. 120 IN CNAME edge.provider.net."),
+			test.A("edge.provider.net. 60 IN A 9.9.9.9"),
+			cname,
+		},
+	})
+	lock.Lock()
+	if queries != sent {
+		t.Errorf("expected cached cname target, got %d upstream queries", queries-sent)
+	}
+	lock.Unlock()
+	// chains longer than cname_depth and failed resolutions only return in-zone records
+	query(test.Case{
+		Qname: "loop.resolve.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{test.CNAME("loop.resolve.example. 300 IN CNAME loop.provider.net.")},
+	})
+	query(test.Case{
+		Qname: "broken.resolve.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{test.CNAME("broken.resolve.example. 300 IN CNAME broken.provider.net.")},
+	})
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nresolve_cname 0\n}")); err == nil {
+		t.Error("expected error for invalid resolve_cname timeout")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	r := newRedisPlugin()
+
+	before := testutil.ToFloat64(requestCount.WithLabelValues("A", "NXDOMAIN"))
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, rec, (&test.Case{Qname: "notexists.example.com.", Qtype: dns.TypeA}).Msg())
+	if after := testutil.ToFloat64(requestCount.WithLabelValues("A", "NXDOMAIN")); after != before+1 {
+		t.Errorf("expected request count %v, got %v", before+1, after)
+	}
+
+	r.LoadZones()
+	if n := testutil.ToFloat64(zoneCount); int(n) != len(r.zones()) {
+		t.Errorf("expected %d zones, got %v", len(r.zones()), n)
+	}
+	if ts := testutil.ToFloat64(zoneRefreshTimestamp); int64(ts) != r.LastZoneUpdate.Unix() {
+		t.Errorf("wrong refresh timestamp %v", ts)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "ecs.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"},"+
+		"{\"ttl\":300, \"ip\":\"2.2.2.2\", \"subnet\":\"10.1.0.0/16\"},"+
+		"{\"ttl\":300, \"ip\":\"3.3.3.3\", \"subnet\":\"10.1.2.0/24\"},"+
+		"{\"ttl\":300, \"ip\":\"4.4.4.4\", \"subnet\":\"10.0.0.0/8\"}]}")
+	r.LoadZones()
+
+	tests := []struct {
+		subnet string
+		ip     string
+		scope  uint8
+	}{
+		{"10.1.2.0/24", "3.3.3.3", 24},
+		{"10.1.9.0/24", "2.2.2.2", 16},
+		{"10.1.2.0/20", "2.2.2.2", 16},
+		{"10.200.0.0/24", "4.4.4.4", 8},
+		{"192.168.1.0/24", "1.1.1.1", 24},
+		{"", "1.1.1.1", 0},
+	}
+	for _, tc := range tests {
+		m := (&test.Case{Qname: "www." + zone, Qtype: dns.TypeA}).Msg()
+		if tc.subnet != "" {
+			_, network, _ := net.ParseCIDR(tc.subnet)
+			ones, _ := network.Mask.Size()
+			m.SetEdns0(4096, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1,
+				SourceNetmask: uint8(ones), Address: network.IP})
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, m)
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != tc.ip {
+			t.Errorf("%s: expected %s : %v", tc.subnet, tc.ip, rec.Msg)
+			continue
+		}
+		ecs := clientSubnet(rec.Msg)
+		if tc.subnet == "" {
+			if ecs != nil {
+				t.Errorf("unexpected client subnet in response : %v", ecs)
+			}
+			continue
+		}
+		if ecs == nil || ecs.SourceScope != tc.scope {
+			t.Errorf("%s: expected scope %d : %v", tc.subnet, tc.scope, ecs)
+		}
+	}
+}
+
+func TestRecordCache(t *testing.T) {
+	r := newRedisPlugin()
+	r.cache = newRecordCache(time.Minute)
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "cache.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	soa := "{\"soa\":{\"ttl\":300, \"serial\":%d, \"minttl\":100, \"mbox\":\"hostmaster.cache.example.\",\"ns\":\"ns1.cache.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}"
+	r.save(zone, "@", fmt.Sprintf(soa, 1))
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	query := func() string {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, (&test.Case{Qname: "www." + zone, Qtype: dns.TypeA}).Msg())
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("expected an answer : %v", rec.Msg)
+		}
+		return rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+
+	hits := testutil.ToFloat64(cacheHits)
+	query()
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}")
+	if ip := query(); ip != "1.1.1.1" {
+		t.Errorf("expected cached answer, got %s", ip)
+	}
+	if testutil.ToFloat64(cacheHits) <= hits {
+		t.Error("expected cache hits")
+	}
+
+	// serial change drops cached records
+	r.save(zone, "@", fmt.Sprintf(soa, 2))
+	r.LoadZones()
+	if ip := query(); ip != "2.2.2.2" {
+		t.Errorf("expected fresh answer after serial change, got %s", ip)
+	}
+}
+
+func TestMissingRecord(t *testing.T) {
+	r := newRedisPlugin()
+	r.cache = newRecordCache(time.Minute)
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "missing.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":1, \"minttl\":100, \"mbox\":\"hostmaster.missing.example.\",\"ns\":\"ns1.missing.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+	if z := r.load(zone); z == nil {
+		t.Fatal("expected zone to be cached")
+	}
+
+	// location is still in cached zone index but its record is gone
+	conn.Do("HDEL", r.keyPrefix+zone+r.keySuffix, "www")
+	tc := test.Case{
+		Qname: "www.missing.example.", Qtype: dns.TypeA,
+		Ns: []dns.RR{
+			test.SOA("missing.example. 100 IN SOA ns1.missing.example. hostmaster.missing.example. 1 44 55 66 100"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	if w.Msg == nil {
+		t.Fatal("no response")
+	}
+	test.SortAndCheck(t, w.Msg, tc)
+}
+
+func TestServeStale(t *testing.T) {
+	r := newRedisPlugin()
+	r.cache = newRecordCache(time.Millisecond)
+	r.serveStale = time.Minute
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "stale.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":1, \"minttl\":100, \"mbox\":\"hostmaster.stale.example.\",\"ns\":\"ns1.stale.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.save(zone, "other", "{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}")
+	r.LoadZones()
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(4096, false)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, m)
+		if w.Msg == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.Msg
+	}
+	if m := query("www.stale.example."); len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("expected fresh answer : %v", m)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// redis is down and cached entries expired
+	pool := r.Pool
+	defer func() { r.Pool = pool }()
+	r.Pool = &redisCon.Pool{Dial: func() (redisCon.Conn, error) { return nil, fmt.Errorf("connection refused") }}
+
+	m := query("www.stale.example.")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatalf("expected stale answer : %v", m)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != staleTtl {
+		t.Errorf("expected stale ttl %d, got %d", staleTtl, ttl)
+	}
+	if ede, ok := requestOption(m, dns.EDNS0EDE).(*dns.EDNS0_EDE); !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("expected stale answer extended error : %v", m)
+	}
+
+	// records never cached can not be served
+	if m := query("other.stale.example."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for uncached record : %v", m)
+	}
+
+	r.serveStale = 0
+	if m := query("www.stale.example."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL without serve_stale : %v", m)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nserve_stale\n}")); err == nil {
+		t.Error("expected error for serve_stale without cache")
+	}
+}
+
+func TestPreload(t *testing.T) {
+	r := newRedisPlugin()
+	r.cache = newRecordCache(time.Minute)
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zones := []string{"preload1.example.", "preload2.example.", "preload3.example."}
+	for _, zone := range zones {
+		conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+		defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+		r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster."+zone+"\",\"ns\":\"ns1."+zone+"\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+		r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	}
+	r.preloadZones = []string{"preload1.example.", "preload2.example.", "missing.example."}
+	// unset workers do not block preload
+	r.preloadWorkers = 0
+	r.LoadZones()
+	for i := 0; i < 50 && !r.Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !r.Ready() {
+		t.Fatal("expected ready after preload")
+	}
+
+	cached := func(key string) bool {
+		r.cache.lock.Lock()
+		defer r.cache.lock.Unlock()
+		_, ok := r.cache.lookup(key)
+		return ok
+	}
+	for _, key := range []string{"preload1.example.", "preload1.example./@", "preload1.example./www", "preload2.example./www"} {
+		if !cached(key) {
+			t.Errorf("expected %s to be preloaded", key)
+		}
+	}
+	if cached("preload3.example./www") {
+		t.Error("expected preload3.example. not to be preloaded")
+	}
+
+	// records are read from cache after preload
+	r.save("preload1.example.", "www", "{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}")
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, (&test.Case{Qname: "www.preload1.example.", Qtype: dns.TypeA}).Msg())
+	if w.Msg == nil || len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("expected preloaded answer : %v", w.Msg)
+	}
+
+	for _, input := range []string{"redis {\npreload\n}", "redis {\ncache 10\npreload_concurrency 0\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\ncache 10\npreload Preload1.example\npreload_concurrency 8\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.OnShutdown()
+	if len(p.preloadZones) != 1 || p.preloadZones[0] != "preload1.example." || p.preloadAll || p.preloadWorkers != 8 {
+		t.Errorf("unexpected preload config %v %v %d", p.preloadZones, p.preloadAll, p.preloadWorkers)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	r := newRedisPlugin()
+	r.cache = newRecordCache(time.Minute)
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone, added := "keyspace.example.", "keyspace2.example."
+	for _, z := range []string{zone, added} {
+		conn.Do("DEL", r.keyPrefix+z+r.keySuffix)
+		defer conn.Do("DEL", r.keyPrefix+z+r.keySuffix)
+	}
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	query := func() string {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, (&test.Case{Qname: "www." + zone, Qtype: dns.TypeA}).Msg())
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			return ""
+		}
+		return rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+	query()
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.subscribe(done)
+
+	// real notifications require notify-keyspace-events, publish them by hand
+	publish := func(key string, event string) {
+		for i := 0; i < 50; i++ {
+			if n, _ := redisCon.Int(conn.Do("PUBLISH", "__keyspace@0__:"+r.keyPrefix+key+r.keySuffix, event)); n > 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("no subscriber")
+	}
+	wait := func(cond func() bool) bool {
+		for i := 0; i < 50; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}]}")
+	publish(zone, "hset")
+	if !wait(func() bool { return query() == "2.2.2.2" }) {
+		t.Error("cached record not invalidated")
+	}
+
+	r.save(added, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"3.3.3.3\"}]}")
+	publish(added, "hset")
+	if !wait(func() bool { return plugin.Zones(r.zones()).Matches("www."+added) == added }) {
+		t.Error("new zone not loaded")
+	}
+}
+
+type mockResolver struct {
+	addr string
+}
+
+func (m *mockResolver) MasterAddr() (string, error) {
+	if m.addr == "" {
+		return "", fmt.Errorf("no master")
+	}
+	return m.addr, nil
+}
+
+func TestSentinel(t *testing.T) {
+	master := &mockResolver{addr: "localhost:6379"}
+	r := new(Redis)
+	r.connectTimeout = 100
+	r.master = master
+	r.Connect()
+	defer r.Pool.Close()
+	if r.Ready() {
+		t.Error("expected not ready before loading zones")
+	}
+	r.LoadZones()
+
+	if err := r.Ping(); err != nil || !r.Ready() {
+		t.Fatalf("expected master to be reachable : %v", err)
+	}
+
+	// failover to an unreachable master drops pooled connections
+	master.addr = "127.0.0.1:1"
+	if err := r.Ping(); err == nil {
+		t.Error("expected pooled connection to old master to be discarded")
+	}
+	master.addr = ""
+	if r.Ready() {
+		t.Error("expected not ready without master")
+	}
+
+	master.addr = "127.0.0.1:6379"
+	if err := r.Ping(); err != nil {
+		t.Errorf("expected reconnect to new master : %v", err)
+	}
+}
+
+func TestSentinelResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// minimal sentinel answering get-master-addr-by-name for master "mymaster"
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+				if strings.Contains(string(buf[:n]), "mymaster") {
+					conn.Write([]byte("*2\r\n$9\r\nlocalhost\r\n$4\r\n6379\r\n"))
+				} else {
+					conn.Write([]byte("*-1\r\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	s := &sentinelResolver{master: "mymaster", addrs: []string{"127.0.0.1:1", l.Addr().String()}, connectTimeout: time.Second}
+	if addr, err := s.MasterAddr(); err != nil || addr != "localhost:6379" {
+		t.Errorf("expected localhost:6379, got %s : %v", addr, err)
+	}
+	s = &sentinelResolver{master: "other", addrs: []string{l.Addr().String()}, connectTimeout: time.Second}
+	if _, err := s.MasterAddr(); err == nil {
+		t.Error("expected error for unknown master")
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	// values from redis cluster specification and CLUSTER KEYSLOT
+	tests := map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"user1000":             3443,
+		"{user1000}.following": 3443,
+		"foo{}{bar}":           8363,
+		"foo{bar}{zap}":        5061,
+		"{bar":                 4015,
+		"example.com.":         8687,
+		"{example.com.}":       8687,
+	}
+	for key, slot := range tests {
+		if s := keySlot(key); s != slot {
+			t.Errorf("%s: expected slot %d, got %d", key, slot, s)
+		}
+	}
+	if crc16("123456789") != 0x31c3 {
+		t.Errorf("wrong crc16 : %x", crc16("123456789"))
+	}
+}
+
+func TestCluster(t *testing.T) {
+	// fake node claims all slots and redirects every command to the real server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					req := string(buf[:n])
+					switch {
+					case strings.Contains(req, "CLUSTER"):
+						fmt.Fprintf(conn, "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+					case strings.Contains(req, "HKEYS"):
+						fmt.Fprintf(conn, "-ASK %d 127.0.0.1:6379\r\n", keySlot("example.com."))
+					case strings.Contains(req, "KEYS"):
+						conn.Write([]byte("*1\r\n$9\r\nfake.zone\r\n"))
+					default:
+						fmt.Fprintf(conn, "-MOVED %d 127.0.0.1:6379\r\n", keySlot("example.com."))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	r := newRedisPlugin()
+	r.clusterNodes = []string{l.Addr().String()}
+	r.Connect()
+	defer r.OnShutdown()
+
+	// MOVED updates slot map and is retried on the new node
+	record := r.get("x", &Zone{Name: "example.com."})
+	if record == nil || len(record.A) == 0 {
+		t.Fatal("expected record through MOVED redirection")
+	}
+	if addr := r.cluster.node(keySlot("example.com.")); addr != "127.0.0.1:6379" {
+		t.Errorf("expected slot to move, got %s", addr)
+	}
+	// ASK is retried on the new node without updating slot map
+	if z := r.load("example.net."); z == nil || len(z.Locations) == 0 {
+		t.Fatal("expected zone through ASK redirection")
+	}
+	if addr := r.cluster.node(keySlot("example.net.")); addr != l.Addr().String() {
+		t.Errorf("expected slot not to move on ASK, got %s", addr)
+	}
+	// KEYS is sent to all masters
+	r.LoadZones()
+	zones := make(map[string]bool)
+	for _, zone := range r.zones() {
+		zones[zone] = true
+	}
+	if !zones["fake.zone"] || !zones["example.com."] {
+		t.Errorf("expected zones of all cluster masters, got %v", r.zones())
+	}
+	if err := r.Ping(); err != nil {
+		t.Errorf("ping failed : %v", err)
+	}
+	// connection errors reload slot map
+	slot := keySlot("example.org.")
+	r.cluster.lock.Lock()
+	r.cluster.slots[slot] = "127.0.0.1:1"
+	r.cluster.refreshed = time.Time{}
+	r.cluster.lock.Unlock()
+	if _, err := r.cluster.do("HGET", "example.org.", "@"); err == nil {
+		t.Fatal("expected connection error")
+	}
+	for i := 0; i < 50 && r.cluster.node(slot) != l.Addr().String(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := r.cluster.node(slot); addr != l.Addr().String() {
+		t.Errorf("expected slot map refresh after connection error, got %s", addr)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	// self signed certificate used as ca, server and client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptoRand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptoRand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	// tls proxy in front of redis server requiring client certificate
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", "localhost:6379")
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{"tls " + certFile + " " + keyFile + " " + certFile, true},
+		{"tls " + certFile + " " + keyFile + "\ntls_insecure_skip_verify", true},
+		{"tls " + certFile, false},
+		{"tls " + certFile + " " + keyFile, false},
+		{"", false},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", "redis {\naddress "+l.Addr().String()+"\nconnect_timeout 1000\nread_timeout 1000\n"+test.config+"\n}")
+		r, err := redisParse(c)
+		if err != nil {
+			t.Fatalf("test %d: setup failed : %v", i, err)
+		}
+		if err = r.Ping(); (err == nil) != test.ok {
+			t.Errorf("test %d: expected ping success %v, got %v", i, test.ok, err)
+		}
+		if r.Ready() != test.ok {
+			t.Errorf("test %d: expected ready %v", i, test.ok)
+		}
+		r.Pool.Close()
+	}
+
+	c := caddy.NewTestController("dns", "redis {\ntls_insecure_skip_verify\n}")
+	if _, err := redisParse(c); err == nil {
+		t.Error("expected error for tls_insecure_skip_verify without tls")
+	}
+}
+
+func TestUsername(t *testing.T) {
+	// fake server accepting only ACL user reader or default user with password
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				authenticated := false
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					req := string(buf[:n])
+					switch {
+					case req == "*3\r\n$4\r\nAUTH\r\n$6\r\nreader\r\n$6\r\nsecret\r\n",
+						req == "*2\r\n$4\r\nAUTH\r\n$8\r\nfoobared\r\n":
+						authenticated = true
+						conn.Write([]byte("+OK\r\n"))
+					case strings.Contains(req, "AUTH"):
+						conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+					case !authenticated:
+						conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+					default:
+						conn.Write([]byte("+PONG\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"reader", "secret", true},
+		{"reader", "foobared", false},
+		{"", "foobared", true},
+		{"", "secret", false},
+		{"", "", false},
+	}
+	for i, test := range tests {
+		r := newRedisPlugin()
+		r.redisAddress = l.Addr().String()
+		r.redisUsername = test.username
+		r.redisPassword = test.password
+		r.Connect()
+		if err := r.Ping(); (err == nil) != test.ok {
+			t.Errorf("test %d: expected ping success %v, got %v", i, test.ok, err)
+		}
+		r.Pool.Close()
+	}
+}
+
+func TestPoolOptions(t *testing.T) {
+	c := caddy.NewTestController("dns", "redis {\naddress localhost:6379\n}")
+	r, err := redisParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pool.MaxIdle != defaultPoolMaxIdle || r.Pool.IdleTimeout != defaultPoolIdleTimeout ||
+		r.Pool.MaxActive != 0 || r.Pool.MaxConnLifetime != 0 || r.Pool.Wait {
+		t.Errorf("unexpected default pool configuration %+v", r.Pool)
+	}
+	r.OnShutdown()
+
+	c = caddy.NewTestController("dns", "redis {\naddress localhost:6379\npool_max_idle 5\npool_max_active 20\npool_idle_timeout 60\npool_max_lifetime 3600\npool_wait\n}")
+	r, err = redisParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pool.MaxIdle != 5 || r.Pool.MaxActive != 20 || r.Pool.IdleTimeout != time.Minute ||
+		r.Pool.MaxConnLifetime != time.Hour || !r.Pool.Wait {
+		t.Errorf("unexpected pool configuration %+v", r.Pool)
+	}
+	if err := r.Ping(); err != nil {
+		t.Errorf("ping failed : %v", err)
+	}
+	r.OnShutdown()
+
+	for _, option := range []string{"pool_max_idle -1", "pool_max_active -5", "pool_idle_timeout -1", "pool_max_lifetime x", "pool_max_idle"} {
+		c = caddy.NewTestController("dns", "redis {\n"+option+"\n}")
+		if _, err := redisParse(c); err == nil {
+			t.Errorf("expected error for %s", option)
+		}
+	}
+}
+
+func TestStartupRetry(t *testing.T) {
+	direct := newRedisPlugin()
+	direct.save("startup.example.", "@", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	defer direct.Pool.Close()
+	defer direct.Pool.Get().Do("DEL", direct.keyPrefix+"startup.example."+direct.keySuffix)
+
+	// redis becomes reachable after startup
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := caddy.NewTestController("dns", "redis {\naddress "+addr+"\nconnect_timeout 100\nstartup_timeout 10\n}")
+	r, err := redisParse(c)
+	if err != nil {
+		t.Fatalf("expected startup without redis : %v", err)
+	}
+	defer r.OnShutdown()
+	if r.Ready() {
+		t.Fatal("expected not ready without redis")
+	}
+
+	// queries are passed to next plugin while zones are not loaded
+	r.Next = test.ErrorHandler()
+	m := new(dns.Msg)
+	m.SetQuestion("startup.example.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := r.ServeDNS(context.Background(), w, m); rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL from next plugin, got %d", rcode)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", "localhost:6379")
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+
+	for i := 0; i < 50 && !r.Ready(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !r.Ready() {
+		t.Fatal("expected ready after redis becomes available")
+	}
+	if zone := plugin.Zones(r.zones()).Matches("startup.example."); zone != "startup.example." {
+		t.Errorf("expected zones to be loaded, got %s", zone)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// fake server never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	r := newRedisPlugin()
+	r.redisAddress = l.Addr().String()
+	r.readTimeout = 2000
+	r.queryTimeout = 100
+	r.Connect()
+	defer r.Pool.Close()
+	r.Zones = []string{"example.com."}
+
+	m := new(dns.Msg)
+	m.SetQuestion("x.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	start := time.Now()
+	if _, err := r.ServeDNS(context.Background(), w, m); err == nil {
+		t.Error("expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected query to time out, took %s", elapsed)
+	}
+	if w.Msg == nil || w.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL on timeout, got %v", w.Msg)
+	}
+
+	// request deadline is honored without query timeout
+	r.queryTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	start = time.Now()
+	r.ServeDNS(ctx, w, m)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected request deadline to be honored, took %s", elapsed)
+	}
+	if w.Msg == nil || w.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL on deadline, got %v", w.Msg)
+	}
+}
+
+func TestTransferBatches(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "batch.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.batch.example.\",\"ns\":\"ns1.batch.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	n := 2*transferBatchSize + 10
+	for i := 0; i < n; i++ {
+		r.save(zone, fmt.Sprintf("host%05d", i), fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"10.0.%d.%d\"}]}", i/256, i%256))
+	}
+
+	z := r.load(zone)
+	records := r.AXFR(z)
+	if len(records) != n+2 {
+		t.Fatalf("expected %d records, got %d", n+2, len(records))
+	}
+	if records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+		t.Error("expected transfer to start and end with SOA")
+	}
+	for i, rr := range records[1 : n+1] {
+		if name := fmt.Sprintf("host%05d.batch.example.", i); rr.Header().Name != name {
+			t.Fatalf("expected %s at position %d, got %s", name, i+1, rr.Header().Name)
+		}
+	}
+	again := r.AXFR(z)
+	for i := range records {
+		if records[i].String() != again[i].String() {
+			t.Fatalf("expected stable transfer order, got %s and %s", records[i], again[i])
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "update.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":2099123100, \"minttl\":100, \"mbox\":\"hostmaster.update.example.\",\"ns\":\"ns1.update.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"ns\":[{\"ttl\":300, \"host\":\"ns1.update.example.\"}]}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.1\"},{\"ttl\":300, \"ip\":\"10.0.0.2\"}]}")
+	r.LoadZones()
+	r.tsigName = "update.key."
+	r.tsigAlgorithm = dns.HmacSHA256
+	r.tsigSecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+	r.updateZones = []string{zone}
+
+	update := func(m *dns.Msg) int {
+		m.SetTsig(r.tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		buf, _, err := dns.TsigGenerate(m, r.tsigSecret, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		w := &rawResponseWriter{}
+		r.ServeDNS(ctxt, w, req)
+		if len(w.out) != 1 {
+			t.Fatalf("expected a single signed response, got %d", len(w.out))
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.out[0]); err != nil || resp.IsTsig() == nil {
+			t.Fatal("response not signed")
+		}
+		return resp.Rcode
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	serial := func() uint32 {
+		return r.get(zone, &Zone{Name: zone}).SOA.Serial
+	}
+
+	// unsigned updates and updates of other zones are rejected
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Insert([]dns.RR{rr("host.update.example. 300 IN A 10.0.0.3")})
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, rec, m)
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeNotAuth {
+		t.Error("expected unsigned update to be rejected")
+	}
+	r.updateZones = []string{"other.example."}
+	if rcode := update(m.Copy()); rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED for zone not allowed, got %s", dns.RcodeToString[rcode])
+	}
+	r.updateZones = []string{zone}
+
+	// add
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.NameNotUsed([]dns.RR{rr("host.update.example. 0 IN A")})
+	m.Insert([]dns.RR{rr("host.update.example. 120 IN A 10.0.0.3"), rr("_acme-challenge.update.example. 60 IN TXT \"token\"")})
+	if rcode := update(m); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected add to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if record := r.get("host", &Zone{Name: zone}); record == nil || len(record.A) != 1 || !record.A[0].Ip.Equal(net.ParseIP("10.0.0.3")) || record.A[0].Ttl != 120 {
+		t.Errorf("expected added A record, got %+v", record)
+	}
+	if record := r.get("_acme-challenge", &Zone{Name: zone}); record == nil || len(record.TXT) != 1 || record.TXT[0].Text != "token" {
+		t.Errorf("expected added TXT record, got %+v", record)
+	}
+	if s := serial(); s != 2099123101 {
+		t.Errorf("expected serial to be incremented, got %d", s)
+	}
+
+	// prerequisite failures
+	tests := []struct {
+		prereq func(m *dns.Msg)
+		rcode  int
+	}{
+		{func(m *dns.Msg) { m.RRsetUsed([]dns.RR{rr("missing.update.example. 0 IN A")}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{rr("www.update.example. 0 IN A")}) }, dns.RcodeYXRrset},
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{rr("missing.update.example. 0 IN A")}) }, dns.RcodeNameError},
+		{func(m *dns.Msg) { m.NameNotUsed([]dns.RR{rr("www.update.example. 0 IN A")}) }, dns.RcodeYXDomain},
+		{func(m *dns.Msg) { m.Used([]dns.RR{rr("www.update.example. 0 IN A 10.0.0.1")}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.Used([]dns.RR{rr("host.example.com. 0 IN A 10.0.0.1")}) }, dns.RcodeNotZone},
+	}
+	for i, test := range tests {
+		m = new(dns.Msg)
+		m.SetUpdate(zone)
+		test.prereq(m)
+		m.Insert([]dns.RR{rr("www.update.example. 300 IN A 10.0.0.9")})
+		if rcode := update(m); rcode != test.rcode {
+			t.Errorf("test %d: expected %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+	}
+	if record := r.get("www", &Zone{Name: zone}); len(record.A) != 2 {
+		t.Errorf("expected failed updates not to modify records, got %+v", record)
+	}
+	if s := serial(); s != 2099123101 {
+		t.Errorf("expected serial not to change, got %d", s)
+	}
+
+	// value dependent prerequisite and single record delete
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Used([]dns.RR{rr("www.update.example. 0 IN A 10.0.0.1"), rr("www.update.example. 0 IN A 10.0.0.2")})
+	m.Remove([]dns.RR{rr("www.update.example. 0 IN A 10.0.0.1")})
+	if rcode := update(m); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected delete to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if record := r.get("www", &Zone{Name: zone}); len(record.A) != 1 || !record.A[0].Ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected single record to be deleted, got %+v", record)
+	}
+
+	// delete rrset, names left without records are removed
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.RemoveRRset([]dns.RR{rr("host.update.example. 0 IN A"), rr("update.example. 0 IN NS")})
+	if rcode := update(m); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected rrset delete to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if exists, _ := redisCon.Bool(conn.Do("HEXISTS", key, "host")); exists {
+		t.Error("expected empty name to be removed")
+	}
+	if record := r.get(zone, &Zone{Name: zone}); len(record.NS) != 1 {
+		t.Error("expected apex NS not to be deleted")
+	}
+
+	// delete name
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.RemoveName([]dns.RR{rr("_acme-challenge.update.example. 0 IN TXT")})
+	if rcode := update(m); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected name delete to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if exists, _ := redisCon.Bool(conn.Do("HEXISTS", key, "_acme-challenge")); exists {
+		t.Error("expected deleted name to be removed")
+	}
+	if s := serial(); s != 2099123104 {
+		t.Errorf("expected serial 2099123104, got %d", s)
+	}
+}
+
+func TestIncrementSerial(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "serial.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+
+	if _, err := r.IncrementSerial(zone); err == nil {
+		t.Error("expected error for zone without SOA")
+	}
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":2000010100, \"minttl\":100, \"mbox\":\"hostmaster.serial.example.\",\"ns\":\"ns1.serial.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	y, m, d := time.Now().UTC().Date()
+	today := uint32(y*10000+int(m)*100+d) * 100
+
+	// concurrent writers all get a distinct serial
+	serials := make(chan uint32, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			serial, err := r.IncrementSerial(zone)
+			if err != nil {
+				t.Error(err)
+			}
+			serials <- serial
+		}()
+	}
+	seen := make(map[uint32]bool)
+	for i := 0; i < 5; i++ {
+		seen[<-serials] = true
+	}
+	for i := uint32(0); i < 5; i++ {
+		if !seen[today+i] {
+			t.Errorf("expected serial %d, got %v", today+i, seen)
+		}
+	}
+	record := r.get(zone, &Zone{Name: zone})
+	if record.SOA.Serial != today+4 || record.SOA.Ns != "ns1.serial.example." || len(record.A) != 1 {
+		t.Errorf("unexpected record after increment %+v", record)
+	}
+}
+
+func TestViews(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "view.example."
+	for prefix, ip := range map[string]string{"": "1.1.1.1", "internal_": "10.1.1.1", "partner_": "192.168.1.1"} {
+		conn.Do("DEL", prefix+zone)
+		defer conn.Do("DEL", prefix+zone)
+		conn.Do("HSET", prefix+zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\""+ip+"\"}]}")
+	}
+	conn.Do("HSET", "internal_"+zone, "intranet", "{\"a\":[{\"ttl\":300, \"ip\":\"10.2.2.2\"}]}")
+
+	c := caddy.NewTestController("dns", "redis {\naddress localhost:6379\nview internal internal_ 10.0.0.0/8\nview partner partner_ 192.168.0.0/16 10.240.0.0/16\n}")
+	r, err := redisParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.OnShutdown()
+	if len(r.views) != 2 {
+		t.Fatalf("expected 2 views, got %d", len(r.views))
+	}
+
+	tests := []struct {
+		client string
+		qname  string
+		answer string
+		rcode  int
+	}{
+		// first matching view wins
+		{"10.240.0.1", "www.view.example.", "www.view.example. 300 IN A 10.1.1.1", dns.RcodeSuccess},
+		{"10.240.0.1", "intranet.view.example.", "intranet.view.example. 300 IN A 10.2.2.2", dns.RcodeSuccess},
+		{"192.168.10.1", "www.view.example.", "www.view.example. 300 IN A 192.168.1.1", dns.RcodeSuccess},
+		{"192.168.10.1", "intranet.view.example.", "", dns.RcodeNameError},
+		// unmatched clients use default view
+		{"172.16.0.1", "www.view.example.", "www.view.example. 300 IN A 1.1.1.1", dns.RcodeSuccess},
+		{"172.16.0.1", "intranet.view.example.", "", dns.RcodeNameError},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.client})
+		r.ServeDNS(ctxt, w, m)
+		if w.Msg == nil || w.Msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %v", i, tc.rcode, w.Msg)
+			continue
+		}
+		if tc.answer == "" {
+			continue
+		}
+		if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].String() != test.A(tc.answer).String() {
+			t.Errorf("test %d: expected %s, got %v", i, tc.answer, w.Msg.Answer)
+		}
+	}
+}
+
+func TestTtlClamp(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "ttl.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":100, \"minttl\":10, \"mbox\":\"hostmaster.ttl.example.\",\"ns\":\"ns1.ttl.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":10, \"ip\":\"1.1.1.1\"}],\"txt\":[{\"ttl\":10, \"text\":\"hello\"}],\"mx\":[{\"ttl\":86400, \"host\":\"mx.ttl.example.\", \"preference\":10}]}")
+	r.LoadZones()
+	r.Ttl = 0
+	r.ttlMin = 30
+	r.ttlMax = 3600
+
+	tests := []test.Case{
+		{
+			Qname: "x.ttl.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.ttl.example. 30 IN A 1.1.1.1"),
+			},
+		},
+		{
+			Qname: "x.ttl.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("x.ttl.example. 30 IN TXT \"hello\""),
+			},
+		},
+		{
+			Qname: "x.ttl.example.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("x.ttl.example. 3600 IN MX 10 mx.ttl.example."),
+			},
+		},
+		{
+			Qname: "y.ttl.example.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("ttl.example. 30 IN SOA ns1.ttl.example. hostmaster.ttl.example. 100 44 55 66 10"),
+			},
+		},
+	}
+	for i, tc := range tests {
+		m := tc.Msg()
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, m)
+		if w.Msg == nil {
+			t.Fatalf("test %d: no response", i)
+		}
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
+
+func TestCanaryReady(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "canary.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+
+	if !r.Ready() {
+		t.Fatal("expected ready without canary")
+	}
+	r.canaryZone = zone
+	if r.Ready() {
+		t.Error("expected not ready with missing canary zone")
+	}
+	r.save(zone, "@", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	if !r.Ready() {
+		t.Error("expected ready with canary zone")
+	}
+	// zone data flushed while redis is still up
+	conn.Do("DEL", key)
+	if r.Ready() {
+		t.Error("expected not ready after canary zone is removed")
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "log.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	var buf bytes.Buffer
+	stdlog.SetOutput(&buf)
+	defer stdlog.SetOutput(os.Stderr)
+
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("x.log.example.", dns.TypeA)
+		r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+
+	query()
+	if buf.Len() != 0 {
+		t.Errorf("expected no query log when disabled, got %s", buf.String())
+	}
+
+	r.queryLogRate = 1
+	query()
+	line := buf.String()
+	for _, field := range []string{"client=10.240.0.1", "zone=log.example.", "name=x.log.example.", "type=A", "class=IN", "rcode=NOERROR", "answers=1", "duration="} {
+		if !strings.Contains(line, field) {
+			t.Errorf("expected %s in query log, got %s", field, line)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "redis {\nquery_log 0.5\n}")
+	if p, err := redisParse(c); err != nil || p.queryLogRate != 0.5 {
+		t.Errorf("expected query_log rate 0.5, got %v %v", p.queryLogRate, err)
+	}
+	for _, input := range []string{"redis {\nquery_log 0\n}", "redis {\nquery_log 2\n}", "redis {\nquery_log x\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "rrl.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	// 1 response per second with a burst of 3, every 2nd dropped response is truncated
+	r.rateLimiter = newRateLimiter(1, 3, 2, nil)
+	query := func(tcp bool) *dnstest.Recorder {
+		m := new(dns.Msg)
+		m.SetQuestion("x.rrl.example.", dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		r.ServeDNS(context.Background(), w, m)
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		if w := query(false); w.Msg == nil || len(w.Msg.Answer) != 1 {
+			t.Fatalf("query %d: expected answer within burst", i)
+		}
+	}
+	if w := query(false); w.Msg != nil {
+		t.Error("expected response to be dropped after bucket is exhausted")
+	}
+	if w := query(false); w.Msg == nil || !w.Msg.Truncated || len(w.Msg.Answer) != 0 {
+		t.Error("expected truncated response on slip")
+	}
+	if w := query(true); w.Msg == nil || len(w.Msg.Answer) != 1 {
+		t.Error("expected tcp query not to be limited")
+	}
+
+	l := newRateLimiter(1, 2, 0, []*net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}})
+	now := time.Now()
+	client := net.ParseIP("192.0.2.1")
+	for i, expected := range []rateAction{rateAllow, rateAllow, rateDrop, rateDrop} {
+		if action := l.check(client, now); action != expected {
+			t.Errorf("check %d: expected %d got %d", i, expected, action)
+		}
+	}
+	if action := l.check(net.ParseIP("192.0.2.200"), now); action != rateDrop {
+		t.Error("expected client in same subnet to share bucket")
+	}
+	if action := l.check(net.ParseIP("192.0.3.1"), now); action != rateAllow {
+		t.Error("expected client in other subnet to be allowed")
+	}
+	if action := l.check(client, now.Add(time.Second)); action != rateAllow {
+		t.Error("expected bucket to refill")
+	}
+	for i := 0; i < 5; i++ {
+		if action := l.check(net.ParseIP("10.1.2.3"), now); action != rateAllow {
+			t.Error("expected exempt client to be allowed")
+		}
+	}
+
+	c := caddy.NewTestController("dns", "redis {\nratelimit 10 5\nratelimit_slip 0\nratelimit_exempt 10.0.0.0/8\n}")
+	p, err := redisParse(c)
+	if err != nil || p.rateLimiter == nil || p.rateLimiter.rate != 10 || p.rateLimiter.burst != 50 ||
+		p.rateLimiter.slip != 0 || len(p.rateLimiter.exempt) != 1 {
+		t.Errorf("unexpected ratelimit config %v %v", p.rateLimiter, err)
+	}
+	for _, input := range []string{"redis {\nratelimit\n}", "redis {\nratelimit 0\n}", "redis {\nratelimit 1 x\n}", "redis {\nratelimit_exempt x\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "ent.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":100, \"minttl\":100, \"mbox\":\"hostmaster.ent.example.\",\"ns\":\"ns1.ent.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x.b.a", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.save(zone, "*.w", "{\"txt\":[{\"ttl\":300, \"text\":\"wildcard\"}]}")
+	r.LoadZones()
+
+	soa := "ent.example. 100 IN SOA ns1.ent.example. hostmaster.ent.example. 100 44 55 66 100"
+	tests := []test.Case{
+		{
+			Qname: "x.b.a.ent.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.b.a.ent.example. 300 IN A 1.1.1.1"),
+			},
+		},
+		{
+			Qname: "b.a.ent.example.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+		{
+			Qname: "a.ent.example.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+		{
+			Qname: "B.A.ent.example.", Qtype: dns.TypeANY,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+		// parent of a wildcard is an empty non-terminal too
+		{
+			Qname: "w.ent.example.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+		{
+			Qname: "c.b.a.ent.example.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+		{
+			Qname: "b.ent.example.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa),
+			},
+		},
+	}
+	for _, tc := range tests {
+		m := tc.Msg()
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
+
+func TestZoneTtl(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	for _, zone := range []string{"ttl1.example.", "ttl2.example."} {
+		key := r.keyPrefix + zone + r.keySuffix
+		conn.Do("DEL", key)
+		defer conn.Do("DEL", key)
+	}
+	r.save("ttl1.example.", "@", "{\"ttl\":600,\"soa\":{\"ttl\":3600, \"serial\":100, \"minttl\":100, \"mbox\":\"hostmaster.ttl1.example.\",\"ns\":\"ns1.ttl1.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save("ttl1.example.", "x", "{\"a\":[{\"ip\":\"1.1.1.1\"},{\"ttl\":86400, \"ip\":\"2.2.2.2\"}],\"txt\":[{\"text\":\"default\"}]}")
+	r.save("ttl2.example.", "x", "{\"a\":[{\"ip\":\"1.1.1.1\"}],\"mx\":[{\"ttl\":30, \"host\":\"mx.ttl2.example.\", \"preference\":10}]}")
+	r.LoadZones()
+	r.Ttl = 300
+
+	tests := []test.Case{
+		{
+			Qname: "x.ttl1.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.ttl1.example. 600 IN A 1.1.1.1"),
+				test.A("x.ttl1.example. 86400 IN A 2.2.2.2"),
+			},
+		},
+		{
+			Qname: "x.ttl1.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("x.ttl1.example. 600 IN TXT \"default\""),
+			},
+		},
+		{
+			Qname: "ttl1.example.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{
+				test.SOA("ttl1.example. 3600 IN SOA ns1.ttl1.example. hostmaster.ttl1.example. 100 44 55 66 100"),
+			},
+		},
+		// zone without default ttl uses configured ttl
+		{
+			Qname: "x.ttl2.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.ttl2.example. 300 IN A 1.1.1.1"),
+			},
+		},
+		{
+			Qname: "x.ttl2.example.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("x.ttl2.example. 30 IN MX 10 mx.ttl2.example."),
+			},
+		},
+	}
+	for _, tc := range tests {
+		m := tc.Msg()
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	// zone ttl is kept until zones are reloaded
+	r.save("ttl1.example.", "@", "{\"ttl\":900,\"soa\":{\"ttl\":3600, \"serial\":100, \"minttl\":100, \"mbox\":\"hostmaster.ttl1.example.\",\"ns\":\"ns1.ttl1.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	z := r.load("ttl1.example.")
+	if ttl := r.recordTtl(z, 0); ttl != 600 {
+		t.Errorf("expected stored zone ttl 600, got %d", ttl)
+	}
+	r.LoadZones()
+	if ttl := r.recordTtl(z, 0); ttl != 900 {
+		t.Errorf("expected reloaded zone ttl 900, got %d", ttl)
+	}
+
+	r.Ttl = 0
+	if ttl := r.recordTtl(nil, 0); ttl != defaultTtl {
+		t.Errorf("expected default ttl %d, got %d", defaultTtl, ttl)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "parent.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":100, \"minttl\":100, \"mbox\":\"hostmaster.parent.example.\",\"ns\":\"ns1.parent.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},"+
+		"\"ns\":[{\"ttl\":300, \"host\":\"ns1.parent.example.\"}]}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.save(zone, "child", "{\"ns\":[{\"ttl\":300, \"host\":\"ns1.child.parent.example.\"},{\"ttl\":300, \"host\":\"ns.other.example.\"}]}")
+	r.save(zone, "ns1.child", "{\"a\":[{\"ttl\":300, \"ip\":\"2.2.2.2\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"::2\"}]}")
+	r.LoadZones()
+
+	referral := test.Case{
+		Ns: []dns.RR{
+			test.NS("child.parent.example. 300 IN NS ns.other.example."),
+			test.NS("child.parent.example. 300 IN NS ns1.child.parent.example."),
+		},
+		Extra: []dns.RR{
+			test.A("ns1.child.parent.example. 300 IN A 2.2.2.2"),
+			test.AAAA("ns1.child.parent.example. 300 IN AAAA ::2"),
+		},
+	}
+	for _, name := range []string{"child.parent.example.", "www.child.parent.example.", "ns1.child.parent.example.", "a.b.child.parent.example."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeMX} {
+			tc := referral
+			tc.Qname, tc.Qtype = name, qtype
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(context.Background(), w, tc.Msg())
+			if w.Msg == nil {
+				t.Fatalf("no response for %s", name)
+			}
+			if w.Msg.Authoritative {
+				t.Errorf("expected non-authoritative referral for %s", name)
+			}
+			test.SortAndCheck(t, w.Msg, tc)
+		}
+	}
+
+	// DS at the zone cut belongs to the parent zone
+	tc := test.Case{
+		Qname: "child.parent.example.", Qtype: dns.TypeDS,
+		Ns: []dns.RR{
+			test.SOA("parent.example. 100 IN SOA ns1.parent.example. hostmaster.parent.example. 100 44 55 66 100"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, tc.Msg())
+	if !w.Msg.Authoritative {
+		t.Error("expected authoritative answer for DS at zone cut")
+	}
+	test.SortAndCheck(t, w.Msg, tc)
+
+	// names in parent zone are not affected
+	tc = test.Case{
+		Qname: "ns1.parent.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("ns1.parent.example. 300 IN A 1.1.1.1"),
+		},
+	}
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	// apex of a zone without SOA holding only NS and addresses is not a zone cut
+	r.defaultSoa = SOA_Record{Ns: "ns1.zznosoa.example.", MBox: "hostmaster", Refresh: 44, Retry: 55, Expire: 66, MinTtl: 100}
+	apex := "zznosoa.example."
+	apexKey := r.keyPrefix + apex + r.keySuffix
+	conn.Do("DEL", apexKey)
+	defer conn.Do("DEL", apexKey)
+	r.save(apex, "@", "{\"ns\":[{\"ttl\":300, \"host\":\"ns1.zznosoa.example.\"}],\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.LoadZones()
+	for _, tc := range []test.Case{
+		{
+			Qname: apex, Qtype: dns.TypeNS,
+			Answer: []dns.RR{
+				test.NS("zznosoa.example. 300 IN NS ns1.zznosoa.example."),
+			},
+		},
+		{
+			Qname: apex, Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("zznosoa.example. 300 IN A 192.0.2.1"),
+			},
+		},
+	} {
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		if !w.Msg.Authoritative {
+			t.Errorf("expected authoritative answer for %s %d", tc.Qname, tc.Qtype)
+		}
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(apex, dns.TypeSOA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if !w.Msg.Authoritative || len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.SOA).Ns != "ns1.zznosoa.example." {
+		t.Errorf("expected default soa for zone apex got %v", w.Msg)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	r, err := redisParse(caddy.NewTestController("dns", "redis {\naddress localhost:6379\nchaos 1.2.3 ns1\nchaos_allow 10.240.0.0/16\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.OnShutdown()
+	r.Next = test.ErrorHandler()
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		w     dns.ResponseWriter
+		rcode int
+		txt   string
+	}{
+		{"version.bind.", dns.TypeTXT, &test.ResponseWriter{}, dns.RcodeSuccess, "1.2.3"},
+		{"VERSION.server.", dns.TypeTXT, &test.ResponseWriter{}, dns.RcodeSuccess, "1.2.3"},
+		{"hostname.bind.", dns.TypeTXT, &test.ResponseWriter{}, dns.RcodeSuccess, "ns1"},
+		{"id.server.", dns.TypeANY, &test.ResponseWriter{}, dns.RcodeSuccess, "ns1"},
+		{"version.bind.", dns.TypeA, &test.ResponseWriter{}, dns.RcodeSuccess, ""},
+		// clients outside chaos_allow and other names are passed to next plugin
+		{"version.bind.", dns.TypeTXT, &test.ResponseWriter6{}, dns.RcodeServerFailure, ""},
+		{"authors.bind.", dns.TypeTXT, &test.ResponseWriter{}, dns.RcodeServerFailure, ""},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		w := dnstest.NewRecorder(tc.w)
+		r.ServeDNS(context.Background(), w, m)
+		if w.Msg == nil || w.Msg.Rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %d : %v", tc.qname, tc.rcode, w.Msg)
+			continue
+		}
+		if tc.txt == "" {
+			if len(w.Msg.Answer) != 0 {
+				t.Errorf("%s: expected no answers : %v", tc.qname, w.Msg.Answer)
+			}
+			continue
+		}
+		if len(w.Msg.Answer) != 1 {
+			t.Errorf("%s: expected an answer : %v", tc.qname, w.Msg)
+			continue
+		}
+		txt, ok := w.Msg.Answer[0].(*dns.TXT)
+		if !ok || txt.Hdr.Class != dns.ClassCHAOS || txt.Hdr.Name != tc.qname || len(txt.Txt) != 1 || txt.Txt[0] != tc.txt {
+			t.Errorf("%s: expected CH TXT %s : %v", tc.qname, tc.txt, w.Msg.Answer[0])
+		}
+	}
+
+	// disabled by default
+	r.chaosVersion = ""
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if w.Msg == nil || w.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected query to be passed to next plugin : %v", w.Msg)
+	}
+
+	for _, input := range []string{"redis {\nchaos\n}", "redis {\nchaos 1.0\n}", "redis {\nchaos 1.0\nchaos_allow x\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestNxdomainRedirect(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "redirect.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.redirect.example.\",\"ns\":\"ns1.redirect.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	soa := test.SOA("redirect.example. 100 IN SOA ns1.redirect.example. hostmaster.redirect.example. 1 44 55 66 100")
+	query := func(tc test.Case) *dns.Msg {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, tc.Msg())
+		if w.Msg == nil {
+			t.Fatalf("%s: no response", tc.Qname)
+		}
+		// serial is generated when not set
+		for _, rr := range w.Msg.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				s.Serial = 1
+			}
+		}
+		test.SortAndCheck(t, w.Msg, tc)
+		return w.Msg
+	}
+
+	// off by default
+	query(test.Case{Qname: "missing.redirect.example.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError, Ns: []dns.RR{soa}})
+
+	r.nxRedirect = map[string][]net.IP{zone: {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}}
+	tests := []test.Case{
+		{
+			Qname: "missing.redirect.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("missing.redirect.example. 100 IN A 10.0.0.1")},
+		},
+		{
+			Qname: "a.b.redirect.example.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{test.AAAA("a.b.redirect.example. 100 IN AAAA 2001:db8::1")},
+		},
+		// only address queries are redirected
+		{
+			Qname: "missing.redirect.example.", Qtype: dns.TypeTXT, Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{soa},
+		},
+		// existing names are not affected
+		{
+			Qname: "www.redirect.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("www.redirect.example. 300 IN A 1.1.1.1")},
+		},
+		{
+			Qname: "www.redirect.example.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{soa},
+		},
+	}
+	for _, tc := range tests {
+		m := query(tc)
+		redirected := tc.Rcode == dns.RcodeSuccess && tc.Qname != "www.redirect.example."
+		if m.Authoritative == redirected {
+			t.Errorf("%s: expected authoritative %v", tc.Qname, !redirected)
+		}
+	}
+
+	// redirect without a matching address family is an empty answer
+	r.nxRedirect[zone] = []net.IP{net.ParseIP("10.0.0.1")}
+	query(test.Case{Qname: "missing.redirect.example.", Qtype: dns.TypeAAAA, Ns: []dns.RR{soa}})
+
+	for _, input := range []string{"redis {\nnxdomain_redirect example.com\n}", "redis {\nnxdomain_redirect example.com 10.0.0\n}"} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "ede.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.ede.example.\",\"ns\":\"ns1.ede.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "bad", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1\"}]}")
+	r.LoadZones()
+	r.strictRecords = true
+	r.qtypeFilters = map[string]qtypeFilter{zone: {allow: false, types: map[uint16]bool{dns.TypeANY: true}}}
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		code  uint16
+	}{
+		{"ede.example.", dns.TypeANY, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited},
+		{"ede.example.", dns.TypeNULL, dns.RcodeNotImplemented, dns.ExtendedErrorCodeNotSupported},
+		{"bad.ede.example.", dns.TypeA, dns.RcodeServerFailure, dns.ExtendedErrorCodeInvalidData},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		m.SetEdns0(4096, false)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, m)
+		if w.Msg == nil || w.Msg.Rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %d : %v", tc.qname, tc.rcode, w.Msg)
+			continue
+		}
+		var ede *dns.EDNS0_EDE
+		if opt := w.Msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+		}
+		if ede == nil || ede.InfoCode != tc.code {
+			t.Errorf("%s: expected extended error %d : %v", tc.qname, tc.code, w.Msg)
+		}
+
+		// clients without edns get no OPT record
+		m.Extra = nil
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, m)
+		if w.Msg == nil || w.Msg.Rcode != tc.rcode || w.Msg.IsEdns0() != nil {
+			t.Errorf("%s: expected rcode %d without OPT : %v", tc.qname, tc.rcode, w.Msg)
+		}
+	}
+}
+
+func TestHeaderBits(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "bits.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.bits.example.\",\"ns\":\"ns1.bits.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.save(zone, "child", "{\"ns\":[{\"ttl\":300, \"host\":\"ns.other.example.\"}]}")
+	r.save(zone, "old", "{\"dname\":{\"ttl\":300, \"target\":\"bits.example.\"}}")
+	r.LoadZones()
+	r.fallZones.SetZonesFromArgs([]string{"other.example."})
+	r.transferOff = true
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		aa    bool
+	}{
+		{"www.bits.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"www.bits.example.", dns.TypeMX, dns.RcodeSuccess, true},
+		{"missing.bits.example.", dns.TypeA, dns.RcodeNameError, true},
+		// referrals are not authoritative
+		{"www.child.bits.example.", dns.TypeA, dns.RcodeSuccess, false},
+		// unless they follow an alias of the query name
+		{"www.child.old.bits.example.", dns.TypeA, dns.RcodeSuccess, true},
+		// names outside served zones
+		{"www.unknown.example.", dns.TypeA, dns.RcodeRefused, false},
+		{"bits.example.", dns.TypeAXFR, dns.RcodeRefused, false},
+	}
+	for _, tc := range tests {
+		for _, rd := range []bool{false, true} {
+			m := new(dns.Msg)
+			m.SetQuestion(tc.qname, tc.qtype)
+			m.RecursionDesired = rd
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(ctxt, w, m)
+			if w.Msg == nil {
+				t.Fatalf("%s: no response", tc.qname)
+			}
+			if w.Msg.Rcode != tc.rcode || w.Msg.Authoritative != tc.aa {
+				t.Errorf("%s %s: expected rcode %d aa %v, got %d %v", tc.qname, dns.TypeToString[tc.qtype], tc.rcode, tc.aa, w.Msg.Rcode, w.Msg.Authoritative)
+			}
+			if w.Msg.RecursionDesired != rd || w.Msg.RecursionAvailable {
+				t.Errorf("%s: expected rd %v and no ra, got %v %v", tc.qname, rd, w.Msg.RecursionDesired, w.Msg.RecursionAvailable)
+			}
+		}
+	}
+}
+
+func TestZoneDigest(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	// simple example zone from rfc8976 appendix A.1
+	zone := "example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	digest := "c68090d90a7aed716bc459f9340e3d7c1370d4d24b7e2fc3a1ddc0b9a87153b9a9713b3c9ae5cc27777f98b8e730044c"
+	r.save(zone, "@", "{\"soa\":{\"ttl\":86400, \"serial\":2018031900, \"minttl\":86400, \"mbox\":\"admin.example.\",\"ns\":\"ns1.example.\",\"refresh\":1800,\"retry\":900,\"expire\":604800},"+
+		"\"ns\":[{\"ttl\":86400, \"host\":\"ns1.example.\"},{\"ttl\":86400, \"host\":\"ns2.example.\"}],"+
+		"\"zonemd\":[{\"ttl\":86400, \"scheme\":1, \"hash\":1, \"digest\":\""+digest+"\"}]}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":3600, \"ip\":\"203.0.113.63\"}]}")
+	r.save(zone, "ns2", "{\"aaaa\":[{\"ttl\":3600, \"ip\":\"2001:db8::63\"}]}")
+	r.LoadZones()
+
+	zonemd, err := r.ZoneDigest(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zonemd.Digest != digest || zonemd.Serial != 2018031900 || zonemd.Scheme != 1 || zonemd.Hash != 1 {
+		t.Errorf("unexpected zone digest %s", zonemd)
+	}
+	if err = r.VerifyZoneDigest(zone); err != nil {
+		t.Error(err)
+	}
+
+	tc := test.Case{
+		Qname: "example.", Qtype: dns.TypeZONEMD,
+		Answer: []dns.RR{
+			&dns.ZONEMD{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeZONEMD, Class: dns.ClassINET, Ttl: 86400},
+				Serial: 2018031900, Scheme: 1, Hash: 1, Digest: digest},
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	// digest changes with zone content
+	r.save(zone, "ns2", "{\"aaaa\":[{\"ttl\":3600, \"ip\":\"2001:db8::64\"}]}")
+	if err = r.VerifyZoneDigest(zone); err == nil {
+		t.Error("expected digest mismatch after zone change")
+	}
+}
+
+func TestCDSNoData(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "cds.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":100, \"minttl\":100, \"mbox\":\"hostmaster.cds.example.\",\"ns\":\"ns1.cds.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.LoadZones()
+
+	for _, qtype := range []uint16{dns.TypeCDS, dns.TypeCDNSKEY} {
+		tc := test.Case{
+			Qname: zone, Qtype: qtype,
+			Ns: []dns.RR{
+				test.SOA("cds.example. 100 IN SOA ns1.cds.example. hostmaster.cds.example. 100 44 55 66 100"),
+			},
+		}
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
+
+func TestInvalidRecords(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "invalid.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"},{\"ttl\":300, \"ip\":\"1.2.3\"},{\"ttl\":300, \"ip\":\"::1\"},{\"ttl\":300, \"ip\":\"2.2.2.2\"}],"+
+		"\"txt\":[{\"ttl\":300, \"text\":\"valid\"}]}")
+	r.save(zone, "y", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}],\"mx\":[{\"ttl\":300, \"host\":\"bad host..\", \"preference\":10}]}")
+	r.save(zone, "z", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		{
+			Qname: "x.invalid.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.invalid.example. 300 IN A 1.1.1.1"),
+				test.A("x.invalid.example. 300 IN A 2.2.2.2"),
+			},
+		},
+		{
+			Qname: "x.invalid.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("x.invalid.example. 300 IN TXT \"valid\""),
+			},
+		},
+		{
+			Qname: "y.invalid.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("y.invalid.example. 300 IN A 1.1.1.1"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	record, err := r.parseRecord(zone, "x", "{\"a\":[{\"ip\":\"1.1.1.1\"},{\"ip\":\"1.2.3\"}],\"ns\":[{\"host\":\"www.example.\"}]}")
+	if err != nil || len(record.A) != 1 || len(record.NS) != 1 {
+		t.Errorf("unexpected record %v %v", record, err)
+	}
+	if _, err = r.parseRecord(zone, "x", "{\"a\":{\"ip\":\"1.1.1.1\"}"); err == nil {
+		t.Error("expected error for malformed json")
+	}
+
+	// strict mode fails queries for locations with invalid records
+	r.strictRecords = true
+	for _, name := range []string{"x.invalid.example.", "y.invalid.example.", "z.invalid.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		if w.Msg == nil || w.Msg.Rcode != dns.RcodeServerFailure {
+			t.Errorf("expected SERVFAIL for %s in strict mode", name)
+		}
+	}
+	if _, err = r.parseRecord(zone, "x", "{\"a\":[{\"ip\":\"1.2.3\"}]}"); err == nil || !strings.Contains(err.Error(), "a[0]") {
+		t.Errorf("expected error identifying invalid field, got %v", err)
+	}
+
+	c := caddy.NewTestController("dns", "redis {\nstrict_records\n}")
+	if p, err := redisParse(c); err != nil || !p.strictRecords {
+		t.Errorf("expected strict_records to be set %v", err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "admin.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+	r.adminAddress = "127.0.0.1:0"
+	if err := r.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stopAdmin()
+
+	resp, err := http.Get("http://" + r.adminListener.Addr().String() + "/zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status adminStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.LastRefresh == nil || !status.LastRefresh.Equal(r.LastZoneUpdate) {
+		t.Errorf("expected last refresh %v, got %v", r.LastZoneUpdate, status.LastRefresh)
+	}
+	if status.Pool == nil || len(status.Zones) != len(r.zones()) {
+		t.Errorf("unexpected status %+v", status)
+	}
+	found := false
+	for _, z := range status.Zones {
+		found = found || z == zone
+	}
+	if !found {
+		t.Errorf("expected zone %s in zone list", zone)
+	}
+
+	resp, err = http.Post("http://"+r.adminListener.Addr().String()+"/zones", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected admin endpoint to be read-only, got %d", resp.StatusCode)
+	}
+
+	// listener is released on restart so a reloaded instance can bind the same address
+	reloaded := newRedisPlugin()
+	reloaded.adminAddress = r.adminListener.Addr().String()
+	if err := r.stopAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.startAdmin(); err != nil {
+		t.Fatalf("expected reloaded instance to bind admin address : %v", err)
+	}
+	reloaded.stopAdmin()
+
+	if _, err = redisParse(caddy.NewTestController("dns", "redis {\nadmin localhost\n}")); err == nil {
+		t.Error("expected error for admin address without port")
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "export.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":3600, \"serial\":2019010100, \"minttl\":300, \"mbox\":\"hostmaster.export.example.\",\"ns\":\"ns1.export.example.\",\"refresh\":7200,\"retry\":900,\"expire\":1209600},"+
+		"\"ns\":[{\"ttl\":3600, \"host\":\"ns1.export.example.\"},{\"ttl\":3600, \"host\":\"ns2.export.example.\"}],"+
+		"\"mx\":[{\"ttl\":3600, \"host\":\"mail.export.example.\", \"preference\":10}],"+
+		"\"txt\":[{\"ttl\":3600, \"text\":\"v=spf1 mx -all\"}]}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":3600, \"ip\":\"192.0.2.1\"}]}")
+	r.save(zone, "ns2", "{\"a\":[{\"ttl\":3600, \"ip\":\"192.0.2.2\"}],\"aaaa\":[{\"ttl\":3600, \"ip\":\"2001:db8::2\"}]}")
+	r.save(zone, "mail", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.25\"}]}")
+	r.save(zone, "www", "{\"cname\":[{\"ttl\":300, \"host\":\"web.export.example.\"}]}")
+	r.save(zone, "web", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.80\"},{\"ttl\":300, \"ip\":\"192.0.2.81\"}]}")
+	r.save(zone, "_sip._tcp", "{\"srv\":[{\"ttl\":300, \"target\":\"sip.export.example.\",\"port\":5060,\"priority\":10,\"weight\":100}]}")
+	r.save(zone, "*", "{\"txt\":[{\"ttl\":300, \"text\":\"wildcard\"}]}")
+	r.LoadZones()
+
+	exported, err := r.ExportZone("Export.Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "export.zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != string(golden) {
+		t.Errorf("exported zone does not match golden file:\n%s", exported)
+	}
+
+	// exported zone can be parsed back
+	zp := dns.NewZoneParser(strings.NewReader(exported), "", "")
+	count := 0
+	for _, ok := zp.Next(); ok; _, ok = zp.Next() {
+		count++
+	}
+	if err = zp.Err(); err != nil || count != 14 {
+		t.Errorf("expected 14 records parsed from exported zone, got %d %v", count, err)
+	}
+
+	if _, err = r.ExportZone("missing.example."); err == nil {
+		t.Error("expected error exporting missing zone")
+	}
+}
+
+func TestImportZone(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "export.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "stale", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.99\"}]}")
+
+	golden, err := os.ReadFile(filepath.Join("testdata", "export.zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.ImportZone("export.example", bytes.NewReader(golden)); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := r.ExportZone(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != string(golden) {
+		t.Errorf("imported zone does not match zone file:\n%s", exported)
+	}
+
+	invalid := []string{
+		"$ORIGIN other.example.\n@ 3600 IN SOA ns1 hostmaster 1 7200 900 1209600 300\n",
+		"@ 3600 IN A 192.0.2.1\n",
+		"@ 3600 IN SOA ns1 hostmaster 1 7200 900 1209600 300\nhost IN A 192.0.2\n",
+		"@ 3600 IN SOA ns1 hostmaster 1 7200 900 1209600 300\nhost.other.example. IN A 192.0.2.1\n",
+	}
+	for i, zonefile := range invalid {
+		if err = r.ImportZone(zone, strings.NewReader(zonefile)); err == nil {
+			t.Errorf("test %d: expected error importing invalid zone file", i)
+		}
+	}
+	if exported, _ = r.ExportZone(zone); exported != string(golden) {
+		t.Errorf("zone modified by failed import:\n%s", exported)
+	}
+}
+
+func TestSpfFlatten(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "spf.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.spf.example.\",\"ns\":\"ns1.spf.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},"+
+		"\"txt\":[{\"ttl\":300, \"flatten\":true, \"text\":\"v=spf1 include:_spf.spf.example. a:mail.spf.example. include:_spf.other.example. -all\"}]}")
+	r.save(zone, "_spf", "{\"txt\":[{\"ttl\":300, \"text\":\"v=spf1 ip4:198.51.100.0/24 a:out.spf.example. ~all\"}]}")
+	r.save(zone, "out", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.10\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"2001:db8::10\"}]}")
+	r.save(zone, "mail", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.25\"}],"+
+		"\"txt\":[{\"ttl\":300, \"text\":\"v=spf1 include:_spf.spf.example. -all\"}]}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		{
+			Qname: "spf.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("spf.example. 300 IN TXT \"v=spf1 ip4:198.51.100.0/24 ip4:192.0.2.10 ip6:2001:db8::10 ip4:192.0.2.25 include:_spf.other.example. -all\""),
+			},
+		},
+		// records without flatten are served as stored
+		{
+			Qname: "mail.spf.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("mail.spf.example. 300 IN TXT \"v=spf1 include:_spf.spf.example. -all\""),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	// flattened records are kept until zones are reloaded
+	r.save(zone, "out", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.11\"}]}")
+	for _, answer := range []string{
+		"spf.example. 300 IN TXT \"v=spf1 ip4:198.51.100.0/24 ip4:192.0.2.10 ip6:2001:db8::10 ip4:192.0.2.25 include:_spf.other.example. -all\"",
+		"spf.example. 300 IN TXT \"v=spf1 ip4:198.51.100.0/24 ip4:192.0.2.11 ip4:192.0.2.25 include:_spf.other.example. -all\"",
+	} {
+		tc := test.Case{Qname: zone, Qtype: dns.TypeTXT, Answer: []dns.RR{test.TXT(answer)}}
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+		r.LoadZones()
+	}
+}
+
+func TestReversePtr(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	forward := "forward.example."
+	reverse4 := "2.0.192.in-addr.arpa."
+	reverse6 := "8.b.d.0.1.0.0.2.ip6.arpa."
+	for _, zone := range []string{forward, reverse4, reverse6} {
+		key := r.keyPrefix + zone + r.keySuffix
+		conn.Do("DEL", key)
+		defer conn.Do("DEL", key)
+		r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.forward.example.\",\"ns\":\"ns1.forward.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	}
+	r.save(forward, "host1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}],\"aaaa\":[{\"ttl\":600, \"ip\":\"2001:db8::1\"}]}")
+	r.save(forward, "host2", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.save(forward, "*", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.3\"}]}")
+	r.save(reverse4, "2", "{\"ptr\":[{\"ttl\":300, \"host\":\"explicit.forward.example.\"}]}")
+	r.reverseZones = []string{reverse4, reverse6}
+	r.LoadZones()
+
+	tests := []test.Case{
+		{
+			Qname: "1.2.0.192.in-addr.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{
+				test.PTR("1.2.0.192.in-addr.arpa. 300 IN PTR host1.forward.example."),
+			},
+		},
+		// explicit records take precedence
+		{
+			Qname: "2.2.0.192.in-addr.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{
+				test.PTR("2.2.0.192.in-addr.arpa. 300 IN PTR explicit.forward.example."),
+			},
+		},
+		{
+			Qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{
+				test.PTR("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 600 IN PTR host1.forward.example."),
+			},
+		},
+		// wildcard addresses are not reversed
+		{
+			Qname: "3.2.0.192.in-addr.arpa.", Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("2.0.192.in-addr.arpa. 100 IN SOA ns1.forward.example. hostmaster.forward.example. 1 44 55 66 100"),
+			},
+		},
+		// synthesized names exist for other types
+		{
+			Qname: "1.2.0.192.in-addr.arpa.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA("2.0.192.in-addr.arpa. 100 IN SOA ns1.forward.example. hostmaster.forward.example. 1 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	// forward records are read again only after their zone serial changes
+	apex := func(serial int) string {
+		return fmt.Sprintf("{\"soa\":{\"ttl\":300, \"serial\":%d, \"minttl\":100, \"mbox\":\"hostmaster.forward.example.\",\"ns\":\"ns1.forward.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}", serial)
+	}
+	ptr := func(ip string) string {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, (&test.Case{Qname: ip, Qtype: dns.TypePTR}).Msg())
+		if w.Msg == nil || len(w.Msg.Answer) != 1 {
+			return ""
+		}
+		return w.Msg.Answer[0].(*dns.PTR).Ptr
+	}
+	r.save(forward, "@", apex(10))
+	r.LoadZones()
+	r.save(forward, "host1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.5\"}]}")
+	r.LoadZones()
+	if name := ptr("1.2.0.192.in-addr.arpa."); name != "host1.forward.example." {
+		t.Errorf("expected reverse names to be kept with same serial, got %q", name)
+	}
+	r.save(forward, "@", apex(11))
+	r.LoadZones()
+	if name := ptr("5.2.0.192.in-addr.arpa."); name != "host1.forward.example." {
+		t.Errorf("expected reverse names to be rebuilt after serial change, got %q", name)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nreverse_zones example.com\n}")); err == nil {
+		t.Error("expected error for forward zone in reverse_zones")
+	}
+}
+
+func FuzzZoneTree(f *testing.F) {
+	f.Add("example.com.\nsub.example.com.\nexample.net.", "www.sub.example.com.")
+	f.Add("Example.COM.\nexample.com.", "WWW.example.com.")
+	f.Add(".\nexample.com", "www.example.com.")
+	f.Add("a\\.b.com.\nb.com.", "x.a\\.b.com.")
+	f.Add("com.\n\nexample.com.", ".")
+	f.Fuzz(func(t *testing.T, zones string, qname string) {
+		list := strings.Split(zones, "\n")
+		expected := plugin.Zones(list).Matches(qname)
+		if zone := newZoneTree(list).match(qname); zone != expected {
+			t.Errorf("zones %q name %q expected %q got %q", list, qname, expected, zone)
+		}
+	})
+}
+
+func TestReplica(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	// a second database of the same server stands in for a lagging replica
+	r.replicaPool = &redisCon.Pool{Dial: func() (redisCon.Conn, error) {
+		return redisCon.Dial("tcp", r.redisAddress, redisCon.DialDatabase(1))
+	}}
+	defer r.replicaPool.Close()
+	replica := r.replicaPool.Get()
+	defer replica.Close()
+
+	zone := "replica.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	for _, c := range []redisCon.Conn{conn, replica} {
+		c.Do("DEL", key)
+		defer c.Do("DEL", key)
+		c.Do("HSET", key, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.replica.example.\",\"ns\":\"ns1.replica.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	}
+	conn.Do("HSET", key, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.1\"}]}")
+	conn.Do("HSET", key, "y", "{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.3\"}]}")
+	replica.Do("HSET", key, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.2\"}]}")
+	if err := r.LoadZones(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []test.Case{
+		// reads are served by the replica
+		{
+			Qname: "x.replica.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.replica.example. 300 IN A 10.0.0.2"),
+			},
+		},
+		// names missing on the replica are read from the primary
+		{
+			Qname: "y.replica.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("y.replica.example. 300 IN A 10.0.0.3"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	records := r.getMany([]string{"x", "y"}, r.load(zone))
+	if records[0] == nil || !records[0].A[0].Ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected x to be read from replica, got %v", records[0])
+	}
+	if records[1] == nil || !records[1].A[0].Ip.Equal(net.ParseIP("10.0.0.3")) {
+		t.Errorf("expected y to be read from primary, got %v", records[1])
+	}
+
+	// updates work on primary data
+	x, _ := r.getContext(withPrimary(context.Background()), "x", r.load(zone))
+	if x == nil || !x.A[0].Ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected x to be read from primary, got %v", x)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nreplica localhost\ncluster localhost\n}")); err == nil {
+		t.Error("expected error for replica with cluster")
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	var plugins []*Redis
+	for i, prefix := range []string{"staging:", "prod:", "p*:"} {
+		r := newRedisPlugin()
+		r.keyPrefix = prefix
+		conn := r.Pool.Get()
+		defer conn.Close()
+
+		key := r.keyPrefix + "prefix.example." + r.keySuffix
+		conn.Do("DEL", key)
+		defer conn.Do("DEL", key)
+		r.save("prefix.example.", "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.prefix.example.\",\"ns\":\"ns1.prefix.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+		r.save("prefix.example.", "x", fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.%d\"}]}", i+1))
+		plugins = append(plugins, r)
+	}
+
+	for i, r := range plugins {
+		r.LoadZones()
+		for _, zone := range r.zones() {
+			if strings.Contains(zone, ":") {
+				t.Errorf("prefix %s: unexpected zone %s", r.keyPrefix, zone)
+			}
+		}
+		tc := test.Case{
+			Qname: "x.prefix.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("x.prefix.example. 300 IN A 10.0.0.%d", i+1)),
+			},
+		}
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
+
+func TestCookie(t *testing.T) {
+	r := newRedisPlugin()
+	r.cookieSecret, _ = hex.DecodeString("e5e973e5a6b2a43f48e7dc849e37bfcf")
+
+	// rfc9018 appendix A.1
+	client, _ := hex.DecodeString("2464c4abcf10c957")
+	cookie := r.serverCookie(client, net.ParseIP("198.51.100.100"), time.Unix(1559731985, 0))
+	if hex.EncodeToString(cookie) != "010000005cf79f111f8130c3eee29480" {
+		t.Errorf("unexpected server cookie %x", cookie)
+	}
+	// reference vector of the siphash paper
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	msg, _ := hex.DecodeString("000102030405060708090a0b0c0d0e")
+	if h := siphash(key, msg); h != 0xa129ca6149be45e5 {
+		t.Errorf("unexpected siphash %x", h)
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "cookie.example."
+	k := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", k)
+	defer conn.Do("DEL", k)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.cookie.example.\",\"ns\":\"ns1.cookie.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.1\"}]}")
+	r.LoadZones()
+
+	query := func(cookie string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("x.cookie.example.", dns.TypeA)
+		if cookie != "" {
+			m.SetEdns0(1232, false)
+			o := m.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		return w.Msg
+	}
+	responseCookie := func(m *dns.Msg) string {
+		if c, ok := requestCookie(m); ok {
+			return hex.EncodeToString(c)
+		}
+		return ""
+	}
+
+	// server cookie is returned for a client cookie
+	resp := query("2464c4abcf10c957")
+	issued := responseCookie(resp)
+	if len(resp.Answer) != 1 || len(issued) != 48 || issued[:16] != "2464c4abcf10c957" {
+		t.Errorf("expected answer with server cookie, got %v", resp)
+	}
+	if m := query("2464c4"); m.Rcode != dns.RcodeFormatError {
+		t.Errorf("expected FORMERR for malformed cookie, got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	r.cookieRequire = true
+	for _, c := range []string{"", "2464c4abcf10c957", "2464c4abcf10c957010000005cf79f111f8130c3eee29480"} {
+		if m := query(c); !m.Truncated || len(m.Answer) != 0 {
+			t.Errorf("expected truncated response for cookie %q, got %v", c, m)
+		}
+	}
+	if m := query(issued); m.Truncated || len(m.Answer) != 1 || responseCookie(m) == "" {
+		t.Errorf("expected answer for valid server cookie, got %v", m)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ncookie 0011\n}")); err == nil {
+		t.Error("expected error for short cookie secret")
+	}
+}
+
+func TestNsid(t *testing.T) {
+	r := newRedisPlugin()
+	r.nsid = "ns1.anycast"
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "nsid.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.nsid.example.\",\"ns\":\"ns1.nsid.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.LoadZones()
+
+	for _, requested := range []bool{true, false} {
+		m := new(dns.Msg)
+		m.SetQuestion("missing.nsid.example.", dns.TypeA)
+		m.SetEdns0(1232, false)
+		if requested {
+			o := m.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+
+		nsid := ""
+		if opt := requestOption(w.Msg, dns.EDNS0NSID); opt != nil {
+			id, _ := hex.DecodeString(opt.(*dns.EDNS0_NSID).Nsid)
+			nsid = string(id)
+		}
+		if requested && nsid != "ns1.anycast" {
+			t.Errorf("expected nsid ns1.anycast, got %q", nsid)
+		}
+		if !requested && nsid != "" {
+			t.Errorf("expected no nsid, got %q", nsid)
+		}
+		if w.Msg.Rcode != dns.RcodeNameError {
+			t.Errorf("expected NXDOMAIN, got %s", dns.RcodeToString[w.Msg.Rcode])
+		}
+	}
+
+	c := caddy.NewTestController("dns", "redis {\nnsid\n}")
+	hostname, _ := os.Hostname()
+	if p, err := redisParse(c); err != nil || p.nsid != hostname {
+		t.Errorf("expected hostname as nsid, got %q %v", p.nsid, err)
+	}
+}
+
+func TestDns64(t *testing.T) {
+	// rfc6052 section 2.4
+	prefixes := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	}
+	for prefix, expected := range prefixes {
+		_, n, _ := net.ParseCIDR(prefix)
+		if ip := embedIPv4(n, net.ParseIP("192.0.2.33")); !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("prefix %s: expected %s got %s", prefix, expected, ip)
+		}
+	}
+
+	r := newRedisPlugin()
+	_, r.dns64Prefix, _ = net.ParseCIDR(defaultDns64Prefix)
+	_, exclude, _ := net.ParseCIDR(defaultDns64Exclude)
+	r.dns64Exclude = []*net.IPNet{exclude}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "dns64.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.dns64.example.\",\"ns\":\"ns1.dns64.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "v4", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.33\"}]}")
+	r.save(zone, "v6", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.33\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"2001:db8::1\"}]}")
+	r.save(zone, "mapped", "{\"a\":[{\"ttl\":50, \"ip\":\"192.0.2.34\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"::ffff:192.0.2.1\"}]}")
+	r.save(zone, "txt", "{\"txt\":[{\"ttl\":300, \"text\":\"no address\"}]}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		// synthesized ttl is limited to negative ttl
+		{
+			Qname: "v4.dns64.example.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("v4.dns64.example. 100 IN AAAA 64:ff9b::c000:221"),
+			},
+		},
+		{
+			Qname: "v6.dns64.example.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("v6.dns64.example. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		// excluded addresses are replaced by synthesized records
+		{
+			Qname: "mapped.dns64.example.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("mapped.dns64.example. 50 IN AAAA 64:ff9b::c000:222"),
+			},
+		},
+		{
+			Qname: "txt.dns64.example.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{
+				test.SOA("dns64.example. 100 IN SOA ns1.dns64.example. hostmaster.dns64.example. 1 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ndns64 64:ff9b::/33\n}")); err == nil {
+		t.Error("expected error for invalid dns64 prefix")
+	}
+	if p, err := redisParse(caddy.NewTestController("dns", "redis {\ndns64\n}")); err != nil || p.dns64Prefix.String() != defaultDns64Prefix || len(p.dns64Exclude) != 1 {
+		t.Error("default dns64 prefix not set")
+	}
+}
+
+func TestTtlJitter(t *testing.T) {
+	r := newRedisPlugin()
+	r.ttlMin = 30
+	r.ttlJitter = map[string]int{"": 20}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "jitter.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.jitter.example.\",\"ns\":\"ns1.jitter.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"},{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.save(zone, "short", "{\"a\":[{\"ttl\":10, \"ip\":\"192.0.2.3\"}]}")
+	r.LoadZones()
+
+	query := func(name string) []dns.RR {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		return w.Msg.Answer
+	}
+	jittered := false
+	for i := 0; i < 100; i++ {
+		answers := query("x.jitter.example.")
+		if len(answers) != 2 {
+			t.Fatalf("expected 2 answers got %d", len(answers))
+		}
+		ttl := answers[0].Header().Ttl
+		if ttl < 240 || ttl > 300 {
+			t.Errorf("ttl %d out of bounds", ttl)
+		}
+		if answers[1].Header().Ttl != ttl {
+			t.Errorf("rrset ttls differ: %d %d", ttl, answers[1].Header().Ttl)
+		}
+		jittered = jittered || ttl != 300
+		// ttl raised to minttl is not lowered
+		if answers = query("short.jitter.example."); len(answers) != 1 || answers[0].Header().Ttl != 30 {
+			t.Errorf("expected ttl 30 got %v", answers)
+		}
+	}
+	if !jittered {
+		t.Error("ttls not jittered")
+	}
+
+	r.ttlJitter[zone] = 0
+	if answers := query("x.jitter.example."); len(answers) != 2 || answers[0].Header().Ttl != 300 {
+		t.Errorf("expected ttl 300 got %v", answers)
+	}
+
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\nttl_jitter 10\nttl_jitter 0 Example.com\n}"))
+	if err != nil || p.ttlJitter[""] != 10 || p.ttlJitter["example.com."] != 0 || len(p.ttlJitter) != 2 {
+		t.Errorf("unexpected ttl_jitter %v, %v", p.ttlJitter, err)
+	}
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nttl_jitter 100\n}")); err == nil {
+		t.Error("expected error for ttl_jitter 100")
+	}
+}
+
+func TestMinimalExtras(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "minimal.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.minimal.example.\",\"ns\":\"ns1.minimal.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"ns\":[{\"ttl\":300, \"host\":\"ns1.minimal.example.\"}],\"mx\":[{\"ttl\":300, \"host\":\"mx.minimal.example.\", \"preference\":10}]}")
+	r.save(zone, "_sip._tcp", "{\"srv\":[{\"ttl\":300, \"target\":\"sip.minimal.example.\",\"port\":555,\"priority\":10,\"weight\":100}]}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.save(zone, "mx", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.save(zone, "sip", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.3\"}]}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		{
+			Qname: "minimal.example.", Qtype: dns.TypeNS,
+			Answer: []dns.RR{
+				test.NS("minimal.example. 300 IN NS ns1.minimal.example."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.minimal.example. 300 IN A 192.0.2.1"),
+			},
+		},
+		{
+			Qname: "minimal.example.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("minimal.example. 300 IN MX 10 mx.minimal.example."),
+			},
+			Extra: []dns.RR{
+				test.A("mx.minimal.example. 300 IN A 192.0.2.2"),
+			},
+		},
+		{
+			Qname: "_sip._tcp.minimal.example.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{
+				test.SRV("_sip._tcp.minimal.example. 300 IN SRV 10 100 555 sip.minimal.example."),
+			},
+			Extra: []dns.RR{
+				test.A("sip.minimal.example. 300 IN A 192.0.2.3"),
+			},
+		},
+	}
+	for _, minimal := range []bool{false, true} {
+		r.minimalExtras = minimal
+		for _, tc := range tests {
+			if minimal {
+				tc.Extra = nil
+			}
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(context.Background(), w, tc.Msg())
+			test.SortAndCheck(t, w.Msg, tc)
+		}
+	}
+
+	if p, err := redisParse(caddy.NewTestController("dns", "redis {\nminimal_responses\n}")); err != nil || !p.minimalExtras {
+		t.Error("minimal_responses not set")
+	}
+}
+
+func TestAuthorityNs(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "authority.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"serial\":1, \"minttl\":100, \"mbox\":\"hostmaster.authority.example.\",\"ns\":\"ns1.authority.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},"+
+		"\"ns\":[{\"ttl\":300, \"host\":\"ns1.authority.example.\"},{\"ttl\":300, \"host\":\"ns2.authority.example.\"}]}")
+	r.save(zone, "www", "{\"a\":[{\"ttl\":300, \"ip\":\"1.1.1.1\"}]}")
+	r.LoadZones()
+
+	www := test.A("www.authority.example. 300 IN A 1.1.1.1")
+	ns := []dns.RR{
+		test.NS("authority.example. 300 IN NS ns1.authority.example."),
+		test.NS("authority.example. 300 IN NS ns2.authority.example."),
+	}
+	query := func(tc test.Case) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, rec, tc.Msg())
+		if rec.Msg == nil {
+			t.Fatalf("%s: no response", tc.Qname)
+		}
+		test.SortAndCheck(t, rec.Msg, tc)
+	}
+
+	// off by default
+	query(test.Case{Qname: "www.authority.example.", Qtype: dns.TypeA, Answer: []dns.RR{www}})
+
+	for _, zones := range [][]string{{""}, {zone}} {
+		r.authorityZones = make(map[string]bool)
+		for _, z := range zones {
+			r.authorityZones[z] = true
+		}
+		query(test.Case{Qname: "www.authority.example.", Qtype: dns.TypeA, Answer: []dns.RR{www}, Ns: ns})
+		// NS answers at apex are not repeated in authority section
+		query(test.Case{Qname: "authority.example.", Qtype: dns.TypeNS, Answer: ns})
+		// negative answers keep SOA only
+		query(test.Case{
+			Qname: "www.authority.example.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA("authority.example. 100 IN SOA ns1.authority.example. hostmaster.authority.example. 1 44 55 66 100"),
+			},
+		})
+	}
+
+	r.authorityZones = map[string]bool{"other.example.": true}
+	query(test.Case{Qname: "www.authority.example.", Qtype: dns.TypeA, Answer: []dns.RR{www}})
+
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\nauthority_ns Authority.example\n}"))
+	if err != nil || !p.authorityNs(zone) || p.authorityNs("other.example.") {
+		t.Errorf("expected authority_ns for %s only : %v %v", zone, p.authorityZones, err)
+	}
+}
+
+func TestTargetGlue(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	for _, zone := range []string{"glue.example.", "other.example."} {
+		key := r.keyPrefix + zone + r.keySuffix
+		conn.Do("DEL", key)
+		defer conn.Do("DEL", key)
+	}
+	r.save("glue.example.", "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.glue.example.\",\"ns\":\"ns1.glue.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"mx\":[{\"ttl\":300, \"host\":\"mx.glue.example.\", \"preference\":10},{\"ttl\":300, \"host\":\"mx.other.example.\", \"preference\":20},{\"ttl\":300, \"host\":\"mx.unknown.example.\", \"preference\":30}]}")
+	r.save("glue.example.", "_sip._tcp", "{\"srv\":[{\"ttl\":300, \"target\":\"sip.glue.example.\",\"port\":555,\"priority\":10,\"weight\":100},{\"ttl\":300, \"target\":\"sip.glue.example.\",\"port\":556,\"priority\":20,\"weight\":100}]}")
+	r.save("glue.example.", "mx", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"2001:db8::1\"}]}")
+	r.save("glue.example.", "sip", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.save("glue.example.", "*", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.3\"}]}")
+	r.save("other.example.", "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.other.example.\",\"ns\":\"ns1.other.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save("other.example.", "mx", "{\"a\":[{\"ttl\":300, \"ip\":\"198.51.100.1\"}]}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		// targets in other served zones are included, unknown targets are skipped
+		{
+			Qname: "glue.example.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("glue.example. 300 IN MX 10 mx.glue.example."),
+				test.MX("glue.example. 300 IN MX 20 mx.other.example."),
+				test.MX("glue.example. 300 IN MX 30 mx.unknown.example."),
+			},
+			Extra: []dns.RR{
+				test.A("mx.glue.example. 300 IN A 192.0.2.1"),
+				test.AAAA("mx.glue.example. 300 IN AAAA 2001:db8::1"),
+				test.A("mx.other.example. 300 IN A 198.51.100.1"),
+			},
+		},
+		// shared targets are added once
+		{
+			Qname: "_sip._tcp.glue.example.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{
+				test.SRV("_sip._tcp.glue.example. 300 IN SRV 10 100 555 sip.glue.example."),
+				test.SRV("_sip._tcp.glue.example. 300 IN SRV 20 100 556 sip.glue.example."),
+			},
+			Extra: []dns.RR{
+				test.A("sip.glue.example. 300 IN A 192.0.2.2"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
+
+func TestDefaultSoa(t *testing.T) {
+	r := newRedisPlugin()
+	r.Ttl = 300
+	r.defaultSoa = SOA_Record{Ns: "ns.example.net.", MBox: "admin", Refresh: 44, Retry: 55, Expire: 66, MinTtl: 100}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "nosoa.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.LoadZones()
+
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if len(w.Msg.Answer) != 1 {
+		t.Fatalf("expected soa answer got %v", w.Msg.Answer)
+	}
+	soa, ok := w.Msg.Answer[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != zone || soa.Ns != "ns.example.net." || soa.Mbox != "admin.nosoa.example." ||
+		soa.Refresh != 44 || soa.Retry != 55 || soa.Expire != 66 || soa.Minttl != 100 {
+		t.Errorf("unexpected soa %v", w.Msg.Answer[0])
+	}
+	if now := uint32(time.Now().Unix()); soa.Serial+60 < now || soa.Serial > now {
+		t.Errorf("expected timestamp serial got %d", soa.Serial)
+	}
+	// serial is kept until zone is modified
+	r.soaLock.Lock()
+	r.unsetSerials[zone] = soa.Serial - 100
+	r.soaLock.Unlock()
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.SOA).Serial != soa.Serial-100 {
+		t.Errorf("expected stable serial %d got %v", soa.Serial-100, w.Msg.Answer)
+	}
+	r.invalidate(zone)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.SOA).Serial < soa.Serial {
+		t.Errorf("expected new serial after zone change got %v", w.Msg.Answer)
+	}
+
+	// names below the apex have no soa
+	m.SetQuestion("x."+zone, dns.TypeSOA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if len(w.Msg.Answer) != 0 || len(w.Msg.Ns) != 1 || w.Msg.Ns[0].Header().Rrtype != dns.TypeSOA || w.Msg.Ns[0].Header().Name != zone {
+		t.Errorf("expected nodata got %v", w.Msg)
+	}
+
+	if records := r.AXFR(r.load(zone)); len(records) == 0 || records[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected transfer to start with soa")
+	}
+
+	// zones without SOA usually still have apex NS records
+	nsZone := "nsnosoa.example."
+	nsKey := r.keyPrefix + nsZone + r.keySuffix
+	conn.Do("DEL", nsKey)
+	defer conn.Do("DEL", nsKey)
+	r.save(nsZone, "@", "{\"ns\":[{\"ttl\":300, \"host\":\"ns1.nsnosoa.example.\"}]}")
+	r.save(nsZone, "ns1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.53\"}]}")
+	r.LoadZones()
+	m.SetQuestion(nsZone, dns.TypeSOA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if !w.Msg.Authoritative || len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.SOA).Mbox != "admin.nsnosoa.example." {
+		t.Errorf("expected default soa got %v", w.Msg)
+	}
+	m.SetQuestion(nsZone, dns.TypeNS)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if !w.Msg.Authoritative || len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Rrtype != dns.TypeNS {
+		t.Errorf("expected apex ns got %v", w.Msg)
+	}
+	m.SetQuestion("missing."+nsZone, dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), w, m)
+	if w.Msg.Rcode != dns.RcodeNameError || len(w.Msg.Ns) != 1 || w.Msg.Ns[0].(*dns.SOA).Ns != "ns.example.net." {
+		t.Errorf("expected nxdomain with default soa got %v", w.Msg)
+	}
+
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\ndefault_soa ns1.example.net. hostmaster 3600 600 86400 60\n}"))
+	if err != nil || p.defaultSoa.Ns != "ns1.example.net." || p.defaultSoa.MBox != "hostmaster" || p.defaultSoa.Expire != 86400 {
+		t.Errorf("unexpected default_soa %v, %v", p.defaultSoa, err)
+	}
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ndefault_soa ns1 hostmaster 3600\n}")); err == nil {
+		t.Error("expected error for default_soa with missing timers")
+	}
+}
+
+func TestFallthrough(t *testing.T) {
+	r := newRedisPlugin()
+	r.Next = test.ErrorHandler()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "fall.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.fall.example.\",\"ns\":\"ns1.fall.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.LoadZones()
+
+	tests := []struct {
+		fall  []string
+		qname string
+		rcode int
+	}{
+		// names outside zones are always passed on without fallthrough, refused with it
+		{nil, "other.example.", dns.RcodeServerFailure},
+		{nil, "missing.fall.example.", dns.RcodeNameError},
+		{[]string{}, "other.example.", dns.RcodeServerFailure},
+		{[]string{}, "missing.fall.example.", dns.RcodeServerFailure},
+		{[]string{}, "x.fall.example.", dns.RcodeSuccess},
+		{[]string{"other.example."}, "other.example.", dns.RcodeServerFailure},
+		{[]string{"other.example."}, "another.example.", dns.RcodeRefused},
+		{[]string{"other.example."}, "missing.fall.example.", dns.RcodeNameError},
+		{[]string{"fall.example."}, "missing.fall.example.", dns.RcodeServerFailure},
+		{[]string{"fall.example."}, "other.example.", dns.RcodeRefused},
+	}
+	for _, tc := range tests {
+		r.fallZones = fall.F{}
+		if tc.fall != nil {
+			r.fallZones.SetZonesFromArgs(tc.fall)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		if w.Msg.Rcode != tc.rcode {
+			t.Errorf("fallthrough %v, %s: expected rcode %d got %d", tc.fall, tc.qname, tc.rcode, w.Msg.Rcode)
+		}
+	}
+
+	// refused names and responses of next plugin are counted with their rcode
+	r.fallZones = fall.F{}
+	r.fallZones.SetZonesFromArgs([]string{"fall.example."})
+	refused := testutil.ToFloat64(requestCount.WithLabelValues("TXT", "REFUSED"))
+	failed := testutil.ToFloat64(requestCount.WithLabelValues("TXT", "SERVFAIL"))
+	for _, qname := range []string{"other.example.", "missing.fall.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeTXT)
+		r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+	if n := testutil.ToFloat64(requestCount.WithLabelValues("TXT", "REFUSED")); n != refused+1 {
+		t.Errorf("expected a refused request, got %v", n-refused)
+	}
+	if n := testutil.ToFloat64(requestCount.WithLabelValues("TXT", "SERVFAIL")); n != failed+1 {
+		t.Errorf("expected a failed request from next plugin, got %v", n-failed)
+	}
+
+	p, err := redisParse(caddy.NewTestController("dns", "redis {\nfallthrough Other.Example\n}"))
+	if err != nil || len(p.fallZones.Zones) != 1 || p.fallZones.Zones[0] != "other.example." {
+		t.Errorf("unexpected fallthrough %v, %v", p.fallZones, err)
+	}
+}
+
+func TestRecordMeta(t *testing.T) {
+	r := newRedisPlugin()
+	r.strictRecords = true
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "meta.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.meta.example.\",\"ns\":\"ns1.meta.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"meta\":{\"owner\":\"dns\"}}}")
+	r.save(zone, "x", "{\"meta\":{\"owner\":\"web\",\"ticket\":\"OPS-1\"},\"unknown\":[1,2],"+
+		"\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\", \"meta\":{\"created_at\":\"2024-01-01T00:00:00Z\"}},{\"ttl\":300, \"ip\":\"192.0.2.2\"}],"+
+		"\"txt\":[{\"ttl\":300, \"text\":\"hello\", \"owner\":\"web\"}]}")
+	r.LoadZones()
+
+	// metadata and unknown fields do not affect answers
+	tests := []test.Case{
+		{
+			Qname: "x.meta.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.meta.example. 300 IN A 192.0.2.1"),
+				test.A("x.meta.example. 300 IN A 192.0.2.2"),
+			},
+		},
+		{
+			Qname: "x.meta.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("x.meta.example. 300 IN TXT hello"),
+			},
+		},
+		{
+			Qname: "meta.example.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{
+				test.SOA("meta.example. 300 IN SOA ns1.meta.example. hostmaster.meta.example. 0 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		if tc.Qtype == dns.TypeSOA && len(w.Msg.Answer) == 1 {
+			// serial is generated
+			tc.Answer[0].(*dns.SOA).Serial = w.Msg.Answer[0].(*dns.SOA).Serial
+		}
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	r.adminAddress = "127.0.0.1:0"
+	if err := r.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stopAdmin()
+	get := func(query string) (int, string) {
+		resp, err := http.Get("http://" + r.adminListener.Addr().String() + "/meta?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+	if code, body := get("zone=meta.example&name=x"); code != http.StatusOK ||
+		body != "{\"a\":[{\"created_at\":\"2024-01-01T00:00:00Z\"},null],\"meta\":{\"owner\":\"web\",\"ticket\":\"OPS-1\"}}" {
+		t.Errorf("unexpected metadata %d %s", code, body)
+	}
+	if code, body := get("zone=meta.example."); code != http.StatusOK || body != "{\"soa\":{\"owner\":\"dns\"}}" {
+		t.Errorf("unexpected metadata %d %s", code, body)
+	}
+	if code, _ := get("zone=meta.example.&name=missing"); code != http.StatusNotFound {
+		t.Errorf("expected not found got %d", code)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	for _, zone := range []string{"valid.example.", "nosoa.valid.example."} {
+		key := r.keyPrefix + zone + r.keySuffix
+		conn.Do("DEL", key)
+		defer conn.Do("DEL", key)
+	}
+	r.save("valid.example.", "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.valid.example.\",\"ns\":\"ns1.valid.example.\",\"refresh\":44,\"retry\":55,\"expire\":66},\"mx\":[{\"ttl\":300, \"host\":\"mail.valid.example.\", \"preference\":10},{\"ttl\":300, \"host\":\"mx.example.com.\", \"preference\":20}]}")
+	r.save("valid.example.", "www", "{\"cname\":[{\"ttl\":300, \"host\":\"web.valid.example.\"}],\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.save("valid.example.", "web", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.save("valid.example.", "_sip._tcp", "{\"srv\":[{\"ttl\":300, \"target\":\"x.wild.valid.example.\",\"port\":555,\"priority\":10,\"weight\":100}]}")
+	r.save("valid.example.", "*.wild", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.3\"}]}")
+	r.save("valid.example.", "bad", "{\"a\":[{\"ttl\":300, \"ip\":\"2001:db8::1\"}]}")
+	r.save("valid.example.", "broken", "{\"a\":")
+	r.save("nosoa.valid.example.", "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.4\"}]}")
+
+	report, err := r.ValidateAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problems []string
+	for _, p := range report.Problems {
+		if dns.IsSubDomain("valid.example.", p.Zone) {
+			problems = append(problems, p.Zone+" "+p.Location+" "+p.Kind)
+		}
+	}
+	expected := []string{
+		"nosoa.valid.example. @ missing_soa",
+		"valid.example. bad malformed_record",
+		"valid.example. broken malformed_record",
+		"valid.example. @ dangling_target",
+		"valid.example. www cname_collision",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestCnameOtherData(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "collision.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.collision.example.\",\"ns\":\"ns1.collision.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1},\"cname\":[{\"ttl\":300, \"host\":\"web.collision.example.\"}]}")
+	r.save(zone, "www", "{\"cname\":[{\"ttl\":300, \"host\":\"web.collision.example.\"}],\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}],\"txt\":[{\"ttl\":300, \"text\":\"hello\"}]}")
+	r.save(zone, "web", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.LoadZones()
+
+	tests := []test.Case{
+		// only the cname is served
+		{
+			Qname: "www.collision.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("web.collision.example. 300 IN A 192.0.2.2"),
+				test.CNAME("www.collision.example. 300 IN CNAME web.collision.example."),
+			},
+		},
+		{
+			Qname: "www.collision.example.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.CNAME("www.collision.example. 300 IN CNAME web.collision.example."),
+			},
+		},
+		// cname at apex is ignored
+		{
+			Qname: "collision.example.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.SOA("collision.example. 100 IN SOA ns1.collision.example. hostmaster.collision.example. 1 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	// warning is logged once until zone is modified
+	if !r.warnings[zone]["www cname with other data"] || !r.warnings[zone]["@ cname at zone apex ignored"] {
+		t.Errorf("expected warnings for www and apex, got %v", r.warnings[zone])
+	}
+	r.invalidate(zone)
+	if len(r.warnings[zone]) != 0 {
+		t.Errorf("expected warnings to be dropped with zone, got %v", r.warnings[zone])
+	}
+}
+
+func TestStableOrder(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "stable.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.stable.example.\",\"ns\":\"ns1.stable.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1},"+
+		"\"ns\":[{\"ttl\":300, \"host\":\"ns2.stable.example.\"},{\"ttl\":300, \"host\":\"ns1.stable.example.\"}],"+
+		"\"mx\":[{\"ttl\":300, \"host\":\"x.stable.example.\", \"preference\":20},{\"ttl\":300, \"host\":\"ns1.stable.example.\", \"preference\":10}]}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.3\"},{\"ttl\":300, \"ip\":\"192.0.2.1\"},{\"ttl\":300, \"ip\":\"192.0.2.2\"}],"+
+		"\"aaaa\":[{\"ttl\":300, \"ip\":\"2001:db8::2\"},{\"ttl\":300, \"ip\":\"2001:db8::1\"}],"+
+		"\"txt\":[{\"ttl\":300, \"text\":\"zzz\"},{\"ttl\":300, \"text\":\"aaa\"}]}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.10\"}]}")
+	r.save(zone, "ns2", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.11\"}]}")
+	r.save(zone, "_sip._tcp", "{\"srv\":[{\"ttl\":300, \"target\":\"x.stable.example.\",\"port\":556,\"priority\":20,\"weight\":100},{\"ttl\":300, \"target\":\"ns1.stable.example.\",\"port\":555,\"priority\":10,\"weight\":100}]}")
+	r.LoadZones()
+
+	queries := []struct {
+		qname string
+		qtype uint16
+		first string
+	}{
+		{"x.stable.example.", dns.TypeA, "192.0.2.3"},
+		{"x.stable.example.", dns.TypeAAAA, "2001:db8::2"},
+		{"x.stable.example.", dns.TypeTXT, "zzz"},
+		{"x.stable.example.", dns.TypeANY, "192.0.2.3"},
+		{"stable.example.", dns.TypeNS, "ns2.stable.example."},
+		{"stable.example.", dns.TypeMX, "x.stable.example."},
+		{"_sip._tcp.stable.example.", dns.TypeSRV, "x.stable.example."},
+	}
+	for _, q := range queries {
+		var first []byte
+		for i := 0; i < 20; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion(q.qname, q.qtype)
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(context.Background(), w, m)
+			w.Msg.Id = 0
+			buf, err := w.Msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = buf
+				// answers are in stored order
+				if len(w.Msg.Answer) == 0 || !strings.Contains(w.Msg.Answer[0].String(), q.first) {
+					t.Errorf("%s %d: expected %s first, got %v", q.qname, q.qtype, q.first, w.Msg.Answer)
+				}
+				continue
+			}
+			if !bytes.Equal(buf, first) {
+				t.Errorf("%s %d: response changed between queries", q.qname, q.qtype)
+				break
+			}
+		}
+	}
+}
+
+func TestTruncatePolicy(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "large.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.large.example.\",\"ns\":\"ns1.large.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}")
+	var mx, txt []string
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("mail-server-%02d", i)
+		mx = append(mx, fmt.Sprintf("{\"ttl\":300, \"host\":\"%s.large.example.\", \"preference\":%d}", host, i))
+		r.save(zone, host, fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.%d\"}],\"aaaa\":[{\"ttl\":300, \"ip\":\"2001:db8::%d\"}]}", i, i))
+		txt = append(txt, fmt.Sprintf("{\"ttl\":300, \"text\":\"%s\"}", strings.Repeat("x", 100)))
+	}
+	r.save(zone, "mx", "{\"mx\":["+strings.Join(mx, ",")+"]}")
+	r.save(zone, "txt", "{\"txt\":["+strings.Join(txt, ",")+"]}")
+	r.LoadZones()
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(context.Background(), w, m)
+		if w.Msg.Len() > dns.MinMsgSize {
+			t.Errorf("%s: response of %d bytes exceeds 512", qname, w.Msg.Len())
+		}
+		return w.Msg
+	}
+
+	// by default additional records that do not fit are dropped and response is truncated
+	if m := query("mx.large.example.", dns.TypeMX); len(m.Answer) != 10 || len(m.Extra) == 0 || !m.Truncated {
+		t.Errorf("expected partial truncated additional section, got %d answers %d extras", len(m.Answer), len(m.Extra))
+	}
+
+	r.truncatePolicy = []string{truncateAdditional, truncateTc}
+	if m := query("mx.large.example.", dns.TypeMX); len(m.Answer) != 10 || len(m.Extra) != 0 || m.Truncated {
+		t.Errorf("expected answers without additional section, got %d answers %d extras", len(m.Answer), len(m.Extra))
+	}
+	if m := query("txt.large.example.", dns.TypeTXT); len(m.Answer) != 0 || !m.Truncated {
+		t.Errorf("expected empty truncated response, got %d answers", len(m.Answer))
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ntruncate_policy additional glue\n}")); err == nil {
+		t.Error("expected error for unknown truncate_policy")
+	}
+}
+
+func TestDatabase(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	c := caddy.NewTestController("dns", "redis {\naddress localhost:6379\ndb 2\n}")
+	selected, err := redisParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer selected.OnShutdown()
+	if selected.redisDb != 2 {
+		t.Fatalf("expected db 2 got %d", selected.redisDb)
+	}
+	db := selected.Pool.Get()
+	defer db.Close()
+
+	zone := "db.example."
+	key := selected.keyPrefix + zone + selected.keySuffix
+	conn.Do("DEL", key)
+	db.Do("DEL", key)
+	defer db.Do("DEL", key)
+	selected.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.db.example.\",\"ns\":\"ns1.db.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}")
+	selected.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	selected.LoadZones()
+	r.LoadZones()
+
+	if n, _ := redisCon.Int(conn.Do("EXISTS", key)); n != 0 {
+		t.Fatal("zone written to default db")
+	}
+	for _, z := range r.zones() {
+		if z == zone {
+			t.Errorf("zone of db 2 found in default db")
+		}
+	}
+	if !selected.Ready() {
+		t.Error("expected plugin with db to be ready")
+	}
+	tc := test.Case{
+		Qname: "x.db.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("x.db.example. 300 IN A 192.0.2.1"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	selected.ServeDNS(context.Background(), w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\ncluster localhost\ndb 1\n}")); err == nil {
+		t.Error("expected error for db with cluster")
+	}
+}
+
+// peerConn stands in for a serial_check peer storing the apex record of zone key
+type peerConn struct {
+	lock sync.Mutex
+	key  string
+	apex string
+}
+
+func (c *peerConn) set(apex string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.apex = apex
+}
+
+func (c *peerConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cmd == "HGET" && len(args) == 2 && args[0] == c.key && args[1] == "@" {
+		return []byte(c.apex), nil
+	}
+	if cmd == "" || cmd == "PING" {
+		return "PONG", nil
+	}
+	return nil, nil
+}
+
+func (c *peerConn) Close() error                      { return nil }
+func (c *peerConn) Err() error                        { return nil }
+func (c *peerConn) Send(string, ...interface{}) error { return nil }
+func (c *peerConn) Flush() error                      { return nil }
+func (c *peerConn) Receive() (interface{}, error)     { return nil, nil }
+
+func TestSerialCheck(t *testing.T) {
+	r := newRedisPlugin()
+	defer r.OnShutdown()
+
+	zone := "peers.example."
+	soa := "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.peers.example.\",\"ns\":\"ns1.peers.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":%d}}"
+	var peers []*peerConn
+	for i, serial := range []int{1, 8} {
+		peer := &peerConn{key: zone, apex: fmt.Sprintf(soa, serial)}
+		peers = append(peers, peer)
+		r.peerPools = append(r.peerPools, r.newPool(func() (redisCon.Conn, error) {
+			return peer, nil
+		}))
+		r.serialPeers = append(r.serialPeers, fmt.Sprintf("peer%d:6379", i))
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+	r.save(zone, "@", fmt.Sprintf(soa, 5))
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+
+	tc := test.Case{
+		Qname: "x.peers.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("x.peers.example. 300 IN A 192.0.2.1"),
+		},
+	}
+	mismatches := testutil.ToFloat64(serialMismatches)
+	r.LoadZones()
+	if n := testutil.ToFloat64(serialMismatches); n != mismatches+2 {
+		t.Errorf("expected 2 serial mismatches got %v", n-mismatches)
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	// serial 1 is 4 behind the primary
+	r.peerThreshold = 3
+	r.LoadZones()
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	if w.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for zone with disagreeing serials got %s", dns.RcodeToString[w.Msg.Rcode])
+	}
+
+	r.peerThreshold = 4
+	r.LoadZones()
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	for _, peer := range peers {
+		peer.set(fmt.Sprintf(soa, 5))
+	}
+	mismatches = testutil.ToFloat64(serialMismatches)
+	r.peerThreshold = 1
+	r.LoadZones()
+	if n := testutil.ToFloat64(serialMismatches); n != mismatches {
+		t.Errorf("expected no serial mismatches got %v", n-mismatches)
+	}
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	if serialDistance(1, 0xffffffff) != 2 || serialDistance(0xffffffff, 1) != 2 {
+		t.Error("expected serial distance to wrap around")
+	}
+	for _, input := range []string{
+		"redis {\nserial_check\n}",
+		"redis {\nserial_threshold 3\n}",
+		"redis {\ncluster localhost\nserial_check localhost:6380\n}",
+	} {
+		if _, err := redisParse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestGenericRecords(t *testing.T) {
+	r := newRedisPlugin()
+	zone := "generic.example."
+	conn := r.Pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.generic.example.\",\"ns\":\"ns1.generic.example.\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+	r.save(zone, "x", "{\"generic\":[{\"ttl\":300, \"type\":\"TYPE64\", \"data\":\"\\\\# 3 000100\"},{\"type\":\"TYPE65280\", \"data\":\"\\\\# 4 0A000001\"}]}")
+	r.save(zone, "bad", "{\"generic\":[{\"type\":\"TYPE65280\", \"data\":\"\\\\# 5 0a000001\"}]}")
+	r.LoadZones()
+
+	generic := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rr.(*dns.RFC3597); !ok {
+			g := new(dns.RFC3597)
+			if err := g.ToRFC3597(rr); err != nil {
+				t.Fatal(err)
+			}
+			return g
+		}
+		return rr
+	}
+	tcs := []test.Case{
+		{
+			Qname: "x.generic.example.", Qtype: dns.TypeSVCB,
+			Answer: []dns.RR{
+				generic("x.generic.example. 300 IN TYPE64 \\# 3 000100"),
+			},
+		},
+		{
+			Qname: "x.generic.example.", Qtype: 65280,
+			Answer: []dns.RR{
+				generic("x.generic.example. 300 IN TYPE65280 \\# 4 0a000001"),
+			},
+		},
+		{
+			Qname: "bad.generic.example.", Qtype: 65280,
+			Rcode: dns.RcodeNotImplemented,
+		},
+	}
+	for i, tc := range tcs {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, tc.Msg())
+		if w.Msg.Rcode != tc.Rcode {
+			t.Errorf("test %d: expected rcode %s got %s", i, dns.RcodeToString[tc.Rcode], dns.RcodeToString[w.Msg.Rcode])
+			continue
+		}
+		if len(w.Msg.Answer) != len(tc.Answer) {
+			t.Errorf("test %d: expected %d answers got %d", i, len(tc.Answer), len(w.Msg.Answer))
+			continue
+		}
+		for j, rr := range w.Msg.Answer {
+			if rr.String() != tc.Answer[j].String() {
+				t.Errorf("test %d: expected %s got %s", i, tc.Answer[j], rr)
+			}
+		}
+	}
+
+	for _, data := range []string{"0a000001", "\\# x 0a", "\\# 2 0a", "\\# 1 zz"} {
+		if _, err := genericData(data); err == nil {
+			t.Errorf("expected error for rdata %q", data)
+		}
+	}
+	if _, err := genericType("TYPE0"); err == nil {
+		t.Error("expected error for type 0")
+	}
+}
+
+func TestGlue(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zones := []string{"glue1.example.", "glue2.example.", "glue3.example."}
+	for i, zone := range zones {
+		conn.Do("DEL", zone)
+		defer conn.Do("DEL", zone)
+		r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster."+zone+"\",\"ns\":\"ns1."+zone+"\",\"refresh\":44,\"retry\":55,\"expire\":66}}")
+		r.save(zone, "mail", fmt.Sprintf("{\"a\":[{\"ttl\":300, \"ip\":\"10.0.0.%d\"}]}", i+1))
+	}
+	r.save(zones[0], "x", "{\"mx\":[{\"host\":\"mail.glue1.example.\", \"preference\":10},{\"host\":\"mail.glue2.example.\", \"preference\":20},{\"host\":\"mail.glue3.example.\", \"preference\":30},{\"host\":\"missing.glue2.example.\", \"preference\":40}]}")
+	r.LoadZones()
+
+	tc := test.Case{
+		Qname: "x.glue1.example.", Qtype: dns.TypeMX,
+		Answer: []dns.RR{
+			test.MX("x.glue1.example. 300 IN MX 10 mail.glue1.example."),
+			test.MX("x.glue1.example. 300 IN MX 20 mail.glue2.example."),
+			test.MX("x.glue1.example. 300 IN MX 30 mail.glue3.example."),
+			test.MX("x.glue1.example. 300 IN MX 40 missing.glue2.example."),
+		},
+		Extra: []dns.RR{
+			test.A("mail.glue1.example. 300 IN A 10.0.0.1"),
+			test.A("mail.glue2.example. 300 IN A 10.0.0.2"),
+			test.A("mail.glue3.example. 300 IN A 10.0.0.3"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+}
+
+func TestApexCname(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "apexcname.example."
+	conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+	defer conn.Do("DEL", r.keyPrefix+zone+r.keySuffix)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		if m.Question[0].Name == "lb.provider.net." && m.Question[0].Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, test.A("lb.provider.net. 60 IN A 9.9.9.9"))
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	r.resolvers = []string{pc.LocalAddr().String()}
+
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.apexcname.example.\",\"ns\":\"ns1.apexcname.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1},\"ns\":[{\"ttl\":300, \"host\":\"ns1.apexcname.example.\"}],\"cname\":[{\"ttl\":300, \"host\":\"lb.provider.net.\"}]}")
+	r.LoadZones()
+
+	soa := test.SOA("apexcname.example. 300 IN SOA ns1.apexcname.example. hostmaster.apexcname.example. 1 44 55 66 100")
+	negative := test.SOA("apexcname.example. 100 IN SOA ns1.apexcname.example. hostmaster.apexcname.example. 1 44 55 66 100")
+	for _, alias := range []bool{false, true} {
+		r.apexAlias = alias
+		tcs := []test.Case{
+			{
+				Qname: zone, Qtype: dns.TypeSOA,
+				Answer: []dns.RR{soa},
+			},
+			{
+				Qname: zone, Qtype: dns.TypeNS,
+				Answer: []dns.RR{
+					test.NS("apexcname.example. 300 IN NS ns1.apexcname.example."),
+				},
+			},
+			{
+				Qname: zone, Qtype: dns.TypeCNAME,
+				Ns: []dns.RR{negative},
+			},
+		}
+		if alias {
+			tcs = append(tcs, test.Case{
+				Qname: zone, Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("apexcname.example. 60 IN A 9.9.9.9"),
+				},
+			})
+		} else {
+			tcs = append(tcs, test.Case{
+				Qname: zone, Qtype: dns.TypeA,
+				Ns: []dns.RR{negative},
+			})
+		}
+		for _, tc := range tcs {
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			r.ServeDNS(ctxt, w, tc.Msg())
+			test.SortAndCheck(t, w.Msg, tc)
+		}
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\napex_cname follow\n}")); err == nil {
+		t.Error("expected error for invalid apex_cname")
+	}
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\napex_cname alias\n}")); err == nil {
+		t.Error("expected error for apex_cname alias without resolver")
+	}
+	c := caddy.NewTestController("dns", "redis {\napex_cname alias\nresolver 127.0.0.1\n}")
+	if r, err := redisParse(c); err != nil || !r.apexAlias {
+		t.Errorf("expected apex_cname alias to be set : %v", err)
+	}
+}
+
+func TestNegativeTtl(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "negttl.example."
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.negttl.example.\",\"ns\":\"ns1.negttl.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}")
+	r.save(zone, "x", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.LoadZones()
+	r.negativeTtl = 30
+
+	tcs := []test.Case{
+		{
+			Qname: "missing.negttl.example.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("negttl.example. 30 IN SOA ns1.negttl.example. hostmaster.negttl.example. 1 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "x.negttl.example.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{
+				test.SOA("negttl.example. 30 IN SOA ns1.negttl.example. hostmaster.negttl.example. 1 44 55 66 100"),
+			},
+		},
+		// positive answers are not affected
+		{
+			Qname: "negttl.example.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{
+				test.SOA("negttl.example. 300 IN SOA ns1.negttl.example. hostmaster.negttl.example. 1 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tcs {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	// negative_ttl does not raise ttl above soa minimum
+	r.negativeTtl = 3600
+	tc := test.Case{
+		Qname: "missing.negttl.example.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns: []dns.RR{
+			test.SOA("negttl.example. 100 IN SOA ns1.negttl.example. hostmaster.negttl.example. 1 44 55 66 100"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+}
+
+func TestRecordFormat(t *testing.T) {
+	r := newRedisPlugin()
+	r.codec = msgpackCodec{}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "msgpack.example."
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+
+	for location, val := range map[string]string{
+		"@": "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.msgpack.example.\",\"ns\":\"ns1.msgpack.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}",
+		"x": "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}",
+	} {
+		record, _, err := decodeRecord(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := msgpackCodec{}.encode(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.save(zone, location, stored)
+	}
+	// json records are read from zones holding msgpack records
+	r.save(zone, "y", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.2\"}]}")
+	r.LoadZones()
+
+	if _, err := r.IncrementSerial(zone); err != nil {
+		t.Fatal(err)
+	}
+	val, _ := redisCon.String(conn.Do("HGET", zone, "@"))
+	if !isMsgpackMap(val[0]) {
+		t.Errorf("expected apex written as msgpack : %q", val)
+	}
+	tcs := []test.Case{
+		{
+			Qname: "x.msgpack.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("x.msgpack.example. 300 IN A 192.0.2.1"),
+			},
+		},
+		{
+			Qname: "y.msgpack.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("y.msgpack.example. 300 IN A 192.0.2.2"),
+			},
+		},
+		{
+			Qname: "msgpack.example.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{
+				test.SOA("msgpack.example. 300 IN SOA ns1.msgpack.example. hostmaster.msgpack.example. 2 44 55 66 100"),
+			},
+		},
+	}
+	for _, tc := range tcs {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+
+	if _, err := redisParse(caddy.NewTestController("dns", "redis {\nrecord_format yaml\n}")); err == nil {
+		t.Error("expected error for invalid record_format")
+	}
+}
+
+// records are stored in a single hash per zone with a field per location, no
+// per-location keys are read
+func TestHashLayout(t *testing.T) {
+	r := newRedisPlugin()
+	r.keyPrefix, r.keySuffix = "dns:", ":zone"
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "hash.example."
+	key := r.keyPrefix + zone + r.keySuffix
+	conn.Do("DEL", key)
+	defer conn.Do("DEL", key)
+	if _, err := conn.Do("HSET", key,
+		"@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.hash.example.\",\"ns\":\"ns1.hash.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}",
+		"www", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}",
+		"*.wild", "{\"txt\":[{\"ttl\":300, \"text\":\"wildcard\"}]}"); err != nil {
+		t.Fatal(err)
+	}
+	r.LoadZones()
+
+	z := r.load(zone)
+	if z == nil {
+		t.Fatal("zone not loaded from hash")
+	}
+	for query, location := range map[string]string{
+		"www.hash.example.":     "www",
+		"x.wild.hash.example.":  "*.wild",
+		"hash.example.":         "hash.example.",
+		"missing.hash.example.": "",
+	} {
+		if l := r.findLocation(query, z); l != location {
+			t.Errorf("%s: expected location %q got %q", query, location, l)
+		}
+	}
+
+	tc := test.Case{
+		Qname: "www.hash.example.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("www.hash.example. 300 IN A 192.0.2.1"),
+		},
+	}
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, tc.Msg())
+	test.SortAndCheck(t, w.Msg, tc)
+
+	_, allow, _ := net.ParseCIDR("10.240.0.0/16")
+	r.transferAllow = []*net.IPNet{allow}
+	r.transferOff = false
+	m := new(dns.Msg)
+	m.SetAxfr(zone)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(ctxt, w, m)
+	// SOA, www, wildcard and closing SOA
+	if w.Msg == nil || len(w.Msg.Answer) != 4 {
+		t.Fatalf("expected 4 transfer records : %v", w.Msg)
+	}
+}
+
+func TestTransferContents(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	zone := "contents.example."
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+	conn.Do("DEL", "other.example.")
+	defer conn.Do("DEL", "other.example.")
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.contents.example.\",\"ns\":\"ns1.contents.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1},\"ns\":[{\"ttl\":300, \"host\":\"ns1.contents.example.\"}],\"mx\":[{\"ttl\":300, \"host\":\"mail.other.example.\", \"preference\":10}],"+
+		"\"dnskey\":[{\"ttl\":300, \"flags\":257, \"protocol\":3, \"algorithm\":13, \"public_key\":\"AwEAAQ==\"}],"+
+		"\"nsec3param\":{\"ttl\":300, \"hash\":1, \"flags\":0, \"iterations\":0, \"salt\":\"\"}}")
+	r.save(zone, "ns1", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}],"+
+		"\"rrsig\":[{\"ttl\":300, \"type_covered\":\"A\", \"algorithm\":13, \"labels\":3, \"original_ttl\":300, \"expiration\":\"20300101000000\", \"inception\":\"20200101000000\", \"key_tag\":1, \"signer_name\":\"contents.example.\", \"signature\":\"dGVzdA==\"}],"+
+		"\"nsec\":{\"ttl\":300, \"next_domain\":\"sub.contents.example.\", \"types\":[\"A\", \"RRSIG\", \"NSEC\"]}}")
+	r.save(zone, "*.wild", "{\"txt\":[{\"ttl\":300, \"text\":\"wildcard\"}]}")
+	r.save(zone, "sub", "{\"ns\":[{\"ttl\":300, \"host\":\"ns.sub.contents.example.\"},{\"ttl\":300, \"host\":\"ns.other.example.\"}]}")
+	r.save(zone, "ns.sub", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.53\"}]}")
+	r.save("other.example.", "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.other.example.\",\"ns\":\"ns1.other.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}")
+	r.save("other.example.", "mail", "{\"a\":[{\"ttl\":300, \"ip\":\"198.51.100.1\"}]}")
+	r.save("other.example.", "ns", "{\"a\":[{\"ttl\":300, \"ip\":\"198.51.100.2\"}]}")
+	r.LoadZones()
+
+	soa := "contents.example.	300	IN	SOA	ns1.contents.example. hostmaster.contents.example. 1 44 55 66 100"
+	expected := []string{
+		soa,
+		"contents.example.	300	IN	DNSKEY	257 3 13 AwEAAQ==",
+		"contents.example.	300	IN	NSEC3PARAM	1 0 0 -",
+		"contents.example.	300	IN	NS	ns1.contents.example.",
+		"contents.example.	300	IN	MX	10 mail.other.example.",
+		"*.wild.contents.example.	300	IN	TXT	\"wildcard\"",
+		"ns.sub.contents.example.	300	IN	A	192.0.2.53",
+		"ns1.contents.example.	300	IN	A	192.0.2.1",
+		"ns1.contents.example.	300	IN	RRSIG	A 13 3 300 20300101000000 20200101000000 1 contents.example. dGVzdA==",
+		"ns1.contents.example.	300	IN	NSEC	sub.contents.example. A RRSIG NSEC",
+		"sub.contents.example.	300	IN	NS	ns.sub.contents.example.",
+		"sub.contents.example.	300	IN	NS	ns.other.example.",
+		soa,
+	}
+	records := r.AXFR(r.load(zone))
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records got %d : %v", len(expected), len(records), records)
+	}
+	for i, rr := range records {
+		if rr.String() != expected[i] {
+			t.Errorf("record %d: expected %s got %s", i, expected[i], rr)
+		}
+	}
+}
+
+// resolvers using qname minimization (rfc9156) query NS and A of each label
+// down to the full name, intermediate labels must not be answered with NXDOMAIN
+func TestQnameMinimization(t *testing.T) {
+	r := newRedisPlugin()
+	conn := r.Pool.Get()
+	defer conn.Close()
+	zone := "qmin.example."
+	conn.Do("DEL", zone)
+	defer conn.Do("DEL", zone)
+	r.save(zone, "@", "{\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.qmin.example.\",\"ns\":\"ns1.qmin.example.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":1}}")
+	r.save(zone, "a.b.c.d", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.1\"}]}")
+	r.save(zone, "sub", "{\"ns\":[{\"ttl\":300, \"host\":\"ns.sub.qmin.example.\"}]}")
+	r.save(zone, "ns.sub", "{\"a\":[{\"ttl\":300, \"ip\":\"192.0.2.53\"}]}")
+	r.LoadZones()
+
+	soa := test.SOA("qmin.example. 100 IN SOA ns1.qmin.example. hostmaster.qmin.example. 1 44 55 66 100")
+	var tcs []test.Case
+	for _, name := range []string{"d.qmin.example.", "c.d.qmin.example.", "b.c.d.qmin.example."} {
+		for _, qtype := range []uint16{dns.TypeNS, dns.TypeA} {
+			tcs = append(tcs, test.Case{Qname: name, Qtype: qtype, Ns: []dns.RR{soa}})
+		}
+	}
+	tcs = append(tcs,
+		test.Case{Qname: "a.b.c.d.qmin.example.", Qtype: dns.TypeNS, Ns: []dns.RR{soa}},
+		test.Case{
+			Qname: "a.b.c.d.qmin.example.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("a.b.c.d.qmin.example. 300 IN A 192.0.2.1"),
+			},
+		},
+		test.Case{Qname: "x.a.b.c.d.qmin.example.", Qtype: dns.TypeNS, Rcode: dns.RcodeNameError, Ns: []dns.RR{soa}},
+	)
+	// probes at and below a delegation get a referral
+	for _, name := range []string{"sub.qmin.example.", "x.sub.qmin.example.", "y.x.sub.qmin.example."} {
+		for _, qtype := range []uint16{dns.TypeNS, dns.TypeA} {
+			tcs = append(tcs, test.Case{
+				Qname: name, Qtype: qtype,
+				Ns: []dns.RR{
+					test.NS("sub.qmin.example. 300 IN NS ns.sub.qmin.example."),
+				},
+				Extra: []dns.RR{
+					test.A("ns.sub.qmin.example. 300 IN A 192.0.2.53"),
+				},
+			})
+		}
+	}
+	for _, tc := range tcs {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		r.ServeDNS(ctxt, w, tc.Msg())
+		test.SortAndCheck(t, w.Msg, tc)
+	}
+}
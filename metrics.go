@@ -0,0 +1,122 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "requests_total",
+		Help:      "Counter of requests answered by redis plugin by query type and rcode.",
+	}, []string{"type", "rcode"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "request_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time (in seconds) each request took to be answered.",
+	}, []string{"type"})
+
+	zoneCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "zones",
+		Help:      "Number of zones in zone name cache.",
+	})
+
+	zoneRefreshTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "zone_refresh_timestamp_seconds",
+		Help:      "Unix time of the last zone name cache refresh.",
+	})
+
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "cache_hits_total",
+		Help:      "Counter of record cache hits.",
+	})
+
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "cache_misses_total",
+		Help:      "Counter of record cache misses.",
+	})
+
+	staleAnswers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "stale_answers_total",
+		Help:      "Counter of responses served from expired cache entries.",
+	})
+
+	serialMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "serial_mismatches_total",
+		Help:      "Counter of zone serials differing between primary and serial_check peers.",
+	})
+
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "rate_limited_total",
+		Help:      "Counter of responses dropped or truncated by response rate limiting.",
+	})
+
+	poolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "redis",
+		Name:      "pool_connections",
+		Help:      "Number of redis pool connections by state.",
+	}, []string{"state"})
+)
+
+// responseRecorder keeps the last response written through it for metrics
+// and query logs
+type responseRecorder struct {
+	dns.ResponseWriter
+	rcode int
+	msg   *dns.Msg
+}
+
+func newResponseRecorder(w dns.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (w *responseRecorder) WriteMsg(m *dns.Msg) error {
+	w.rcode, w.msg = m.Rcode, m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// observeRequest records rcode and duration of a request answered by the plugin
+func (redis *Redis) observeRequest(rw *responseRecorder, qtype string, start time.Time) {
+	requestDuration.WithLabelValues(qtype).Observe(time.Since(start).Seconds())
+	requestCount.WithLabelValues(qtype, dns.RcodeToString[rw.rcode]).Inc()
+	redis.observePool()
+}
+
+// observeZones records size and refresh time of zone name cache
+func (redis *Redis) observeZones(zones []string, refreshed time.Time) {
+	zoneCount.Set(float64(len(zones)))
+	zoneRefreshTimestamp.Set(float64(refreshed.Unix()))
+	redis.observePool()
+}
+
+func (redis *Redis) observePool() {
+	if redis.Pool == nil {
+		return
+	}
+	stats := redis.Pool.Stats()
+	poolConnections.WithLabelValues("in_use").Set(float64(stats.ActiveCount - stats.IdleCount))
+	poolConnections.WithLabelValues("idle").Set(float64(stats.IdleCount))
+}
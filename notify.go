@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// checkSerials compares stored SOA serial of zones with the last seen values,
+// cached records of zones with a changed serial are dropped and secondaries are notified.
+// serials are only accessed here with loadLock held
+func (redis *Redis) checkSerials(zones []string) {
+	serials := make(map[string]uint32)
+	for _, zone := range zones {
+		z := &Zone{Name: zone}
+		// always read current SOA from redis
+		if redis.cache != nil {
+			redis.cache.invalidate(zone + "/@")
+		}
+		record := redis.get(zone, z)
+		if record == nil || record.SOA.Serial == 0 {
+			continue
+		}
+		serials[zone] = record.SOA.Serial
+		if last, ok := redis.serials[zone]; ok && last != record.SOA.Serial {
+			redis.invalidate(zone)
+			soa, _ := redis.SOA(zone, z, record)
+			for _, addr := range redis.notify {
+				go redis.sendNotify(zone, soa[0], addr)
+			}
+		}
+	}
+	redis.serials = serials
+}
+
+// sendNotify sends a NOTIFY message for zone to addr, retrying with
+// exponential backoff until a response is received
+func (redis *Redis) sendNotify(zone string, soa dns.RR, addr string) {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = append(m.Answer, soa)
+
+	c := new(dns.Client)
+	c.Timeout = notifyTimeout
+	backoff := notifyBackoff
+	for i := 0; i < notifyRetries; i++ {
+		resp, _, err := c.Exchange(m, addr)
+		if err == nil && resp.Opcode == dns.OpcodeNotify && resp.Rcode == dns.RcodeSuccess {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+		}
+		fmt.Println("notify error : ", zone, addr, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	fmt.Println("notify failed : ", zone, addr)
+}
+
+const (
+	notifyRetries = 3
+	notifyTimeout = 2 * time.Second
+	notifyBackoff = 1 * time.Second
+)
@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// checkPeers compares SOA serials of zones on primary with serials stored on
+// serial_check peers, mismatches are logged and counted. with serial_threshold
+// zones whose serials differ by more than threshold are not served until the
+// next zone refresh finds them in sync
+func (redis *Redis) checkPeers(zones []string) {
+	split := make(map[string]bool)
+	for _, zone := range zones {
+		serial, err := redis.poolSerial(redis.Pool, zone)
+		if err != nil || serial == 0 {
+			continue
+		}
+		for i, pool := range redis.peerPools {
+			peer, err := redis.poolSerial(pool, zone)
+			if err != nil {
+				fmt.Println("serial check error : ", zone, redis.serialPeers[i], err)
+				continue
+			}
+			if peer == serial {
+				continue
+			}
+			serialMismatches.Inc()
+			fmt.Println("serial mismatch : ", zone, serial, redis.serialPeers[i], peer)
+			if redis.peerThreshold > 0 && serialDistance(serial, peer) > redis.peerThreshold {
+				split[zone] = true
+			}
+		}
+	}
+	redis.peerLock.Lock()
+	redis.splitZones = split
+	redis.peerLock.Unlock()
+}
+
+// splitZone checks if zone serials on primary and peers differ beyond threshold
+func (redis *Redis) splitZone(zone string) bool {
+	redis.peerLock.RLock()
+	defer redis.peerLock.RUnlock()
+	return redis.splitZones[zone]
+}
+
+// poolSerial reads SOA serial of zone from pool bypassing record cache
+func (redis *Redis) poolSerial(pool *redisCon.Pool, zone string) (uint32, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	val, err := redisCon.String(conn.Do("HGET", redis.keyPrefix+zone+redis.keySuffix, "@"))
+	if err == redisCon.ErrNil {
+		return 0, errors.New("zone has no SOA record")
+	}
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := decodeRecord(val)
+	if err != nil {
+		return 0, err
+	}
+	return r.SOA.Serial, nil
+}
+
+// serialDistance returns distance of serials a and b in serial number
+// arithmetic as described in rfc1982
+func serialDistance(a, b uint32) uint32 {
+	if d := a - b; d <= 1<<31 {
+		return d
+	}
+	return b - a
+}
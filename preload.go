@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// startPreload starts loading records of preloaded zones into record cache
+// once, plugin is not ready until all of them are loaded
+func (redis *Redis) startPreload(zones []string) {
+	if !redis.preloading() || !atomic.CompareAndSwapInt32(&redis.preloadState, preloadIdle, preloadRunning) {
+		return
+	}
+	go func() {
+		redis.preload(zones)
+		atomic.StoreInt32(&redis.preloadState, preloadDone)
+	}()
+}
+
+func (redis *Redis) preloading() bool {
+	return redis.preloadAll || len(redis.preloadZones) > 0
+}
+
+// preload reads all records of preloaded zones found in zones using
+// preloadWorkers connections at a time
+func (redis *Redis) preload(zones []string) {
+	targets := zones
+	if !redis.preloadAll {
+		found := make(map[string]bool, len(zones))
+		for _, zone := range zones {
+			found[zone] = true
+		}
+		targets = nil
+		for _, zone := range redis.preloadZones {
+			if found[zone] {
+				targets = append(targets, zone)
+			}
+		}
+	}
+
+	// instances not configured by setup have no workers set
+	workers := redis.preloadWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for zone := range work {
+				redis.preloadZone(zone)
+			}
+		}()
+	}
+	for _, zone := range targets {
+		work <- zone
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (redis *Redis) preloadZone(zone string) {
+	z := redis.load(zone)
+	if z == nil {
+		return
+	}
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		keys = append(keys, key)
+	}
+	redis.getMany(keys, z)
+}
+
+const (
+	preloadIdle = iota
+	preloadRunning
+	preloadDone
+)
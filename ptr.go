@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reverseName is a forward name owning an address, used to synthesize PTR records
+type reverseName struct {
+	name string
+	ttl  uint32
+}
+
+func (redis *Redis) PTR(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, ptr := range record.PTR {
+		if len(ptr.Host) == 0 {
+			continue
+		}
+		r := new(dns.PTR)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypePTR,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, ptr.Ttl)}
+		r.Ptr = dns.Fqdn(ptr.Host)
+		answers = append(answers, r)
+	}
+	return
+}
+
+// reversePtr returns PTR records of name in reverse zone z synthesized from
+// forward A and AAAA records
+func (redis *Redis) reversePtr(name string, z *Zone) (answers []dns.RR) {
+	if !redis.isReverseZone(z.Name) {
+		return nil
+	}
+	ip := reverseAddress(name)
+	if ip == nil {
+		return nil
+	}
+	redis.reverseLock.RLock()
+	names := redis.reverse[ip.String()]
+	redis.reverseLock.RUnlock()
+	for _, n := range names {
+		r := new(dns.PTR)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypePTR,
+			Class: dns.ClassINET, Ttl: n.ttl}
+		r.Ptr = n.name
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) isReverseZone(zone string) bool {
+	for _, z := range redis.reverseZones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardAddresses holds reverse names of addresses in a forward zone at serial
+type forwardAddresses struct {
+	serial uint32
+	names  map[string][]reverseName
+}
+
+// loadReverse rebuilds address to name index from A and AAAA records of all
+// forward zones, wildcard names are skipped. records of a zone are only read
+// again if its SOA serial changed or it has no serial
+func (redis *Redis) loadReverse(zones []string) {
+	redis.reverseLock.RLock()
+	previous := redis.forwardIndex
+	redis.reverseLock.RUnlock()
+
+	index := make(map[string]*forwardAddresses)
+	reverse := make(map[string][]reverseName)
+	for _, zone := range zones {
+		if dns.IsSubDomain("in-addr.arpa.", zone) || dns.IsSubDomain("ip6.arpa.", zone) {
+			continue
+		}
+		var serial uint32
+		if apex := redis.get(zone, &Zone{Name: zone}); apex != nil {
+			serial = apex.SOA.Serial
+		}
+		addresses, ok := previous[zone]
+		if !ok || serial == 0 || addresses.serial != serial {
+			if addresses = redis.forwardAddresses(zone); addresses == nil {
+				continue
+			}
+			addresses.serial = serial
+		}
+		index[zone] = addresses
+		for ip, names := range addresses.names {
+			reverse[ip] = append(reverse[ip], names...)
+		}
+	}
+	redis.reverseLock.Lock()
+	redis.reverse = reverse
+	redis.forwardIndex = index
+	redis.reverseLock.Unlock()
+}
+
+// forwardAddresses reads reverse names of addresses in A and AAAA records of zone
+func (redis *Redis) forwardAddresses(zone string) *forwardAddresses {
+	z := redis.load(zone)
+	if z == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		if !strings.Contains(key, "*") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	names := make(map[string][]reverseName)
+	for i, record := range redis.getMany(keys, z) {
+		if record == nil {
+			continue
+		}
+		name := z.Name
+		if keys[i] != "@" {
+			name = keys[i] + "." + z.Name
+		}
+		for _, a := range record.A {
+			if a.Ip != nil {
+				names[a.Ip.String()] = append(names[a.Ip.String()], reverseName{name, redis.recordTtl(z, a.Ttl)})
+			}
+		}
+		for _, aaaa := range record.AAAA {
+			if aaaa.Ip != nil {
+				names[aaaa.Ip.String()] = append(names[aaaa.Ip.String()], reverseName{name, redis.recordTtl(z, aaaa.Ttl)})
+			}
+		}
+	}
+	return &forwardAddresses{names: names}
+}
+
+// reverseAddress returns address of an in-addr.arpa or ip6.arpa name, nil is
+// returned if name is not a complete reverse name
+func reverseAddress(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			ip[net.IPv6len-1-i/2] |= byte(nibble) << (4 * uint(i%2))
+		}
+		return ip
+	}
+	return nil
+}
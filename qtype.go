@@ -0,0 +1,17 @@
+package redis
+
+// qtypeFilter lists query types allowed or denied in a zone
+type qtypeFilter struct {
+	allow bool
+	types map[uint16]bool
+}
+
+// qtypeAllowed checks if queries of qtype are answered in zone, zones without
+// a filter answer all types
+func (redis *Redis) qtypeAllowed(zone string, qtype uint16) bool {
+	f, ok := redis.qtypeFilters[zone]
+	if !ok {
+		return true
+	}
+	return f.types[qtype] == f.allow
+}
@@ -0,0 +1,27 @@
+package redis
+
+import (
+	"math/rand"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+var log = clog.NewWithPlugin("redis")
+
+// logQuery writes a key=value query log line for a sample of queries if
+// query log is enabled
+func (redis *Redis) logQuery(rw *responseRecorder, state request.Request, zone string, start time.Time) {
+	if redis.queryLogRate <= 0 || (redis.queryLogRate < 1 && rand.Float64() >= redis.queryLogRate) {
+		return
+	}
+	answers := 0
+	if rw.msg != nil {
+		answers = len(rw.msg.Answer)
+	}
+	log.Infof("client=%s zone=%s name=%s type=%s class=%s rcode=%s answers=%d duration=%s",
+		state.IP(), zone, state.Name(), state.Type(), state.Class(), dns.RcodeToString[rw.rcode],
+		answers, time.Since(start))
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits responses sent to each client subnet using a token bucket,
+// refilled at rate responses per second up to rate*window responses
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	slip    int
+	exempt  []*net.IPNet
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	dropped int
+}
+
+type rateAction int
+
+const (
+	rateAllow rateAction = iota
+	rateDrop
+	rateSlip
+)
+
+func newRateLimiter(rate float64, window int, slip int, exempt []*net.IPNet) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   rate * float64(window),
+		slip:    slip,
+		exempt:  exempt,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// check takes a token from bucket of client subnet. queries over the limit are
+// dropped, every slip-th of them is answered truncated so legitimate clients
+// can retry over tcp
+func (l *rateLimiter) check(ip net.IP, now time.Time) rateAction {
+	if ip == nil {
+		return rateAllow
+	}
+	for _, n := range l.exempt {
+		if n.Contains(ip) {
+			return rateAllow
+		}
+	}
+	key := rateLimitKey(ip)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitEntries {
+			l.buckets = make(map[string]*rateBucket)
+		}
+		b = &rateBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.updated = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		b.dropped = 0
+		return rateAllow
+	}
+	rateLimited.Inc()
+	b.dropped++
+	if l.slip > 0 && b.dropped%l.slip == 0 {
+		return rateSlip
+	}
+	return rateDrop
+}
+
+// rateLimitKey returns /24 network of ipv4 and /56 network of ipv6 addresses
+func rateLimitKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
+
+const (
+	defaultRateLimitWindow = 15
+	defaultRateLimitSlip   = 2
+	rateLimitEntries       = 100000
+)
@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// redirect returns A or AAAA records of name pointing to the redirect
+// addresses of z, ok is false if nxdomain redirect is not configured for z
+// or qtype is not an address type
+func (redis *Redis) redirect(name string, z *Zone, qtype uint16) (answers []dns.RR, ok bool) {
+	ips, ok := redis.nxRedirect[z.Name]
+	if !ok || qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return nil, false
+	}
+	// redirected names should not outlive the real answer once the name exists
+	ttl := redis.negativeSoa(z, false)[0].Header().Ttl
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+			r := new(dns.A)
+			r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA,
+				Class: dns.ClassINET, Ttl: ttl}
+			r.A = ip4
+			answers = append(answers, r)
+		} else if ip4 == nil && qtype == dns.TypeAAAA {
+			r := new(dns.AAAA)
+			r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA,
+				Class: dns.ClassINET, Ttl: ttl}
+			r.AAAA = ip
+			answers = append(answers, r)
+		}
+	}
+	return answers, true
+}
+
+// redirectState returns a copy of state writing responses without the AA bit,
+// redirected answers are not zone data
+func redirectState(state request.Request) request.Request {
+	state.W = &nonAuthoritativeWriter{state.W}
+	return state
+}
+
+type nonAuthoritativeWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *nonAuthoritativeWriter) WriteMsg(m *dns.Msg) error {
+	m.Authoritative = false
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -1,56 +1,267 @@
 package redis
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 
 	redisCon "github.com/gomodule/redigo/redis"
+	"golang.org/x/net/context"
 )
 
 type Redis struct {
-	Next           plugin.Handler
-	Pool           *redisCon.Pool
-	redisAddress   string
-	redisPassword  string
-	connectTimeout int
-	readTimeout    int
-	keyPrefix      string
-	keySuffix      string
-	Ttl            uint32
-	Zones          []string
-	LastZoneUpdate time.Time
-}
-
-func (redis *Redis) LoadZones() {
-	var (
-		reply interface{}
-		err error
-		zones []string
-	)
+	Next            plugin.Handler
+	Pool            *redisCon.Pool
+	replicaPool     *redisCon.Pool
+	redisAddress    string
+	replicaAddress  string
+	serialPeers     []string
+	peerPools       []*redisCon.Pool
+	peerThreshold   uint32
+	splitZones      map[string]bool
+	peerLock        sync.RWMutex
+	redisUsername   string
+	redisPassword   string
+	redisDb         int
+	tlsConfig       *tls.Config
+	master          masterResolver
+	clusterNodes    []string
+	cluster         *cluster
+	connectTimeout  int
+	readTimeout     int
+	queryTimeout    int
+	poolMaxIdle     int
+	poolMaxActive   int
+	poolIdleTimeout time.Duration
+	poolLifetime    time.Duration
+	poolWait        bool
+	startupTimeout  time.Duration
+	canaryZone      string
+	queryLogRate    float64
+	rateLimiter     *rateLimiter
+	cookieSecret    []byte
+	cookieRequire   bool
+	nsid            string
+	chaosVersion    string
+	chaosId         string
+	chaosAllow      []*net.IPNet
+	strictRecords   bool
+	warnings        map[string]map[string]bool
+	warnLock        sync.Mutex
+	codec           recordCodec
+	adminAddress    string
+	adminListener   net.Listener
+	keyPrefix       string
+	keySuffix       string
+	Ttl             uint32
+	ttlMin          uint32
+	ttlMax          uint32
+	negativeTtl     uint32
+	ttlJitter       map[string]int
+	defaultSoa      SOA_Record
+	fallZones       fall.F
+	qtypeFilters    map[string]qtypeFilter
+	truncatePolicy  []string
+	minimalAny      bool
+	minimalExtras   bool
+	authorityZones  map[string]bool
+	cnameDepth      int
+	cnameTimeout    time.Duration
+	apexAlias       bool
+	addressPolicy   string
+	dns64Prefix     *net.IPNet
+	dns64Exclude    []*net.IPNet
+	nxRedirect      map[string][]net.IP
+	spfCache        map[string]map[spfKey]string
+	spfLock         sync.Mutex
+	rotation        uint32
+	resolvers       []string
+	aliasCache      map[string]*aliasEntry
+	aliasLock       sync.Mutex
+	transferAllow   []*net.IPNet
+	transferOff     bool
+	transferLength  int
+	tsigName        string
+	tsigAlgorithm   string
+	tsigSecret      string
+	updateZones     []string
+	updateLock      sync.Mutex
+	notify          []string
+	serials         map[string]uint32
+	unsetSerials    map[string]uint32
+	soaWarned       map[string]bool
+	soaLock         sync.Mutex
+	cache           *recordCache
+	serveStale      time.Duration
+	preloadZones    []string
+	preloadAll      bool
+	preloadWorkers  int
+	preloadState    int32
+	keyspaceEvents  bool
+	dnssecKey       string
+	reverseZones    []string
+	reverse         map[string][]reverseName
+	forwardIndex    map[string]*forwardAddresses
+	reverseLock     sync.RWMutex
+	views           []*view
+	keys            map[string]*zoneKeys
+	keysLock        sync.Mutex
+	signatureCache  map[string]*dns.RRSIG
+	signatureLock   sync.Mutex
+	Zones           []string
+	zoneTree        *zoneTree
+	zoneTtls        map[string]uint32
+	LastZoneUpdate  time.Time
+	zonesLock       sync.RWMutex
+	loadZoneTicker  *time.Ticker
+	loadLock        sync.Mutex
+	done            chan struct{}
+}
 
-	conn := redis.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return
+// LoadZones reloads zone names and zone state derived from them, concurrent
+// loads from ticker, keyspace events and imports run one at a time
+func (redis *Redis) LoadZones() error {
+	redis.loadLock.Lock()
+	defer redis.loadLock.Unlock()
+
+	zones, err := redis.zoneNames(context.Background())
+	if err != nil {
+		return err
 	}
-	defer conn.Close()
+	refreshed := time.Now()
+	tree := newZoneTree(zones)
+	redis.zonesLock.Lock()
+	redis.LastZoneUpdate = refreshed
+	redis.Zones = zones
+	redis.zoneTree = tree
+	redis.zoneTtls = make(map[string]uint32)
+	redis.zonesLock.Unlock()
+	redis.observeZones(zones, refreshed)
+
+	if len(redis.notify) > 0 || redis.cache != nil {
+		redis.checkSerials(zones)
+	}
+	if len(redis.reverseZones) > 0 {
+		redis.loadReverse(zones)
+	}
+	if len(redis.peerPools) > 0 {
+		redis.checkPeers(zones)
+	}
+	redis.refreshSpf(zones)
+	redis.startPreload(zones)
+	return nil
+}
 
-	reply, err = conn.Do("KEYS", redis.keyPrefix + "*" + redis.keySuffix)
+// zoneNames lists names of all zones stored in redis
+func (redis *Redis) zoneNames(ctx context.Context) ([]string, error) {
+	reply, err := redis.read(ctx, "KEYS", globEscape(redis.keyPrefix)+"*"+globEscape(redis.keySuffix))
 	if err != nil {
-		return
+		return nil, err
 	}
-	zones, err = redisCon.Strings(reply, nil)
+	zones, err := redisCon.Strings(reply, nil)
 	for i, _ := range zones {
 		zones[i] = strings.TrimPrefix(zones[i], redis.keyPrefix)
 		zones[i] = strings.TrimSuffix(zones[i], redis.keySuffix)
 	}
-	redis.LastZoneUpdate = time.Now()
-	redis.Zones = zones
+	return zones, err
+}
+
+// startZoneNameCache loads zone names and keeps them updated in background
+// until done is closed
+func (redis *Redis) startZoneNameCache() {
+	err := redis.LoadZones()
+	redis.loadZoneTicker = time.NewTicker(zoneUpdateTime)
+	redis.done = make(chan struct{})
+	if err != nil {
+		fmt.Println("error loading zones : ", err)
+		go redis.retryLoadZones(redis.done)
+	}
+	go redis.refreshZones(redis.loadZoneTicker.C, redis.done)
+	if redis.keyspaceEvents {
+		go redis.subscribe(redis.done)
+	}
+}
+
+// retryLoadZones retries loading zone names with exponential backoff until it
+// succeeds or startupTimeout passes, zone update ticker keeps polling afterwards
+func (redis *Redis) retryLoadZones(done <-chan struct{}) {
+	deadline := time.Now().Add(redis.startupTimeout)
+	backoff := retryInitialBackoff
+	for time.Now().Add(backoff).Before(deadline) {
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		if err := redis.LoadZones(); err == nil {
+			return
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+	fmt.Println("giving up loading zones, retrying in ", zoneUpdateTime)
+}
+
+func (redis *Redis) refreshZones(tick <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-tick:
+			redis.LoadZones()
+		case <-done:
+			return
+		}
+	}
+}
+
+// OnShutdown stops zone name updates and closes redis connections
+func (redis *Redis) OnShutdown() error {
+	redis.stopZoneNameCache()
+	for _, v := range redis.views {
+		v.redis.stopZoneNameCache()
+	}
+	if redis.cluster != nil {
+		redis.cluster.close()
+	}
+	if redis.replicaPool != nil {
+		redis.replicaPool.Close()
+	}
+	for _, pool := range redis.peerPools {
+		pool.Close()
+	}
+	if redis.Pool != nil {
+		return redis.Pool.Close()
+	}
+	return nil
+}
+
+func (redis *Redis) stopZoneNameCache() {
+	if redis.loadZoneTicker != nil {
+		redis.loadZoneTicker.Stop()
+	}
+	if redis.done != nil {
+		close(redis.done)
+		redis.done = nil
+	}
+}
+
+func (redis *Redis) zones() []string {
+	redis.zonesLock.RLock()
+	defer redis.zonesLock.RUnlock()
+	return redis.Zones
 }
 
 func (redis *Redis) A(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
@@ -60,27 +271,97 @@ func (redis *Redis) A(name string, z *Zone, record *Record) (answers, extras []d
 		}
 		r := new(dns.A)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA,
-			Class: dns.ClassINET, Ttl: redis.minTtl(a.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, a.Ttl)}
 		r.A = a.Ip
 		answers = append(answers, r)
 	}
 	return
 }
 
-func (redis Redis) AAAA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+func (redis *Redis) AAAA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
 	for _, aaaa := range record.AAAA {
 		if aaaa.Ip == nil {
 			continue
 		}
 		r := new(dns.AAAA)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA,
-			Class: dns.ClassINET, Ttl: redis.minTtl(aaaa.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, aaaa.Ttl)}
 		r.AAAA = aaaa.Ip
 		answers = append(answers, r)
 	}
 	return
 }
 
+// addressWeights returns weights of A or AAAA records of record in the order
+// returned by A and AAAA handlers, missing weights default to 1
+func addressWeights(record *Record, qtype uint16) (weights []uint32) {
+	add := func(ip net.IP, weight uint32) {
+		if ip == nil {
+			return
+		}
+		if weight == 0 {
+			weight = 1
+		}
+		weights = append(weights, weight)
+	}
+	switch qtype {
+	case dns.TypeA:
+		for _, a := range record.A {
+			add(a.Ip, a.Weight)
+		}
+	case dns.TypeAAAA:
+		for _, aaaa := range record.AAAA {
+			add(aaaa.Ip, aaaa.Weight)
+		}
+	}
+	return
+}
+
+// selectAddresses applies address_policy to answers. weighted policy shuffles answers so that
+// each address comes first in proportion to its weight, random-one returns a single address
+// chosen by weight. round-robin and shuffle ignore weights and rotate or shuffle answers
+func (redis *Redis) selectAddresses(answers []dns.RR, weights []uint32) []dns.RR {
+	if len(answers) < 2 || len(answers) != len(weights) {
+		return answers
+	}
+	switch redis.addressPolicy {
+	case policyRoundRobin:
+		n := int(atomic.AddUint32(&redis.rotation, 1) % uint32(len(answers)))
+		return append(answers[n:len(answers):len(answers)], answers[:n]...)
+	case policyShuffle:
+		selected := append([]dns.RR(nil), answers...)
+		rand.Shuffle(len(selected), func(i, j int) { selected[i], selected[j] = selected[j], selected[i] })
+		return selected
+	case policyWeighted:
+		// weighted random sampling without replacement (Efraimidis-Spirakis)
+		keys := make([]float64, len(answers))
+		order := make([]int, len(answers))
+		for i := range answers {
+			keys[i] = math.Pow(rand.Float64(), 1/float64(weights[i]))
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool { return keys[order[i]] > keys[order[j]] })
+		selected := make([]dns.RR, 0, len(answers))
+		for _, i := range order {
+			selected = append(selected, answers[i])
+		}
+		return selected
+	case policyRandomOne:
+		var total uint64
+		for _, w := range weights {
+			total += uint64(w)
+		}
+		n := uint64(rand.Int63n(int64(total)))
+		for i, w := range weights {
+			if n < uint64(w) {
+				return answers[i : i+1]
+			}
+			n -= uint64(w)
+		}
+	}
+	return answers
+}
+
 func (redis *Redis) CNAME(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
 	for _, cname := range record.CNAME {
 		if len(cname.Host) == 0 {
@@ -88,7 +369,7 @@ func (redis *Redis) CNAME(name string, z *Zone, record *Record) (answers, extras
 		}
 		r := new(dns.CNAME)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCNAME,
-			Class: dns.ClassINET, Ttl: redis.minTtl(cname.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, cname.Ttl)}
 		r.Target = dns.Fqdn(cname.Host)
 		answers = append(answers, r)
 	}
@@ -100,60 +381,105 @@ func (redis *Redis) TXT(name string, z *Zone, record *Record) (answers, extras [
 		if len(txt.Text) == 0 {
 			continue
 		}
-		r:= new(dns.TXT)
+		r := new(dns.TXT)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT,
-			Class: dns.ClassINET, Ttl: redis.minTtl(txt.Ttl)}
-		r.Txt = split255(txt.Text)
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, txt.Ttl)}
+		switch {
+		case txt.Flatten:
+			r.Txt = split255(redis.flattenedSpf(name, txt.Text, z))
+		case len(txt.Strings) == 0:
+			r.Txt = split255(txt.Text)
+		default:
+			for _, text := range txt.Strings {
+				r.Txt = append(r.Txt, split255(text)...)
+			}
+		}
 		answers = append(answers, r)
 	}
 	return
 }
 
 func (redis *Redis) NS(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	answers = redis.nsRecords(name, z, record)
+	if !redis.minimalExtras && len(answers) > 0 {
+		targets := make([]string, len(answers))
+		for i, rr := range answers {
+			targets[i] = rr.(*dns.NS).Ns
+		}
+		extras = redis.glue(targets, z)
+	}
+	return
+}
+
+// nsRecords returns NS records of a location without addresses of targets
+func (redis *Redis) nsRecords(name string, z *Zone, record *Record) (answers []dns.RR) {
 	for _, ns := range record.NS {
 		if len(ns.Host) == 0 {
 			continue
 		}
 		r := new(dns.NS)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNS,
-			Class: dns.ClassINET, Ttl: redis.minTtl(ns.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, ns.Ttl)}
 		r.Ns = ns.Host
 		answers = append(answers, r)
-		extras = append(extras, redis.hosts(ns.Host, z)...)
 	}
 	return
 }
 
 func (redis *Redis) MX(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	answers = redis.mxRecords(name, z, record)
+	if !redis.minimalExtras && len(answers) > 0 {
+		targets := make([]string, len(answers))
+		for i, rr := range answers {
+			targets[i] = rr.(*dns.MX).Mx
+		}
+		extras = redis.glue(targets, z)
+	}
+	return
+}
+
+// mxRecords returns MX records of a location without addresses of targets
+func (redis *Redis) mxRecords(name string, z *Zone, record *Record) (answers []dns.RR) {
 	for _, mx := range record.MX {
 		if len(mx.Host) == 0 {
 			continue
 		}
 		r := new(dns.MX)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeMX,
-			Class: dns.ClassINET, Ttl: redis.minTtl(mx.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, mx.Ttl)}
 		r.Mx = mx.Host
 		r.Preference = mx.Preference
 		answers = append(answers, r)
-		extras = append(extras, redis.hosts(mx.Host, z)...)
 	}
 	return
 }
 
 func (redis *Redis) SRV(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	answers = redis.srvRecords(name, z, record)
+	if !redis.minimalExtras && len(answers) > 0 {
+		targets := make([]string, len(answers))
+		for i, rr := range answers {
+			targets[i] = rr.(*dns.SRV).Target
+		}
+		extras = redis.glue(targets, z)
+	}
+	return
+}
+
+// srvRecords returns SRV records of a location without addresses of targets
+func (redis *Redis) srvRecords(name string, z *Zone, record *Record) (answers []dns.RR) {
 	for _, srv := range record.SRV {
 		if len(srv.Target) == 0 {
 			continue
 		}
 		r := new(dns.SRV)
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSRV,
-			Class: dns.ClassINET, Ttl: redis.minTtl(srv.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, srv.Ttl)}
 		r.Target = srv.Target
 		r.Weight = srv.Weight
 		r.Port = srv.Port
 		r.Priority = srv.Priority
 		answers = append(answers, r)
-		extras = append(extras, redis.hosts(srv.Target, z)...)
 	}
 	return
 }
@@ -161,17 +487,13 @@ func (redis *Redis) SRV(name string, z *Zone, record *Record) (answers, extras [
 func (redis *Redis) SOA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
 	r := new(dns.SOA)
 	if record.SOA.Ns == "" {
-		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSOA,
-			Class: dns.ClassINET, Ttl: redis.Ttl}
-		r.Ns = "ns1." + name
-		r.Mbox = "hostmaster." + name
-		r.Refresh = 86400
-		r.Retry = 7200
-		r.Expire = 3600
-		r.Minttl = redis.Ttl
+		if dns.Fqdn(name) != z.Name {
+			return
+		}
+		r = redis.fallbackSoa(z)
 	} else {
 		r.Hdr = dns.RR_Header{Name: dns.Fqdn(z.Name), Rrtype: dns.TypeSOA,
-			Class: dns.ClassINET, Ttl: redis.minTtl(record.SOA.Ttl)}
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, record.SOA.Ttl)}
 		r.Ns = record.SOA.Ns
 		r.Mbox = record.SOA.MBox
 		r.Refresh = record.SOA.Refresh
@@ -179,21 +501,53 @@ func (redis *Redis) SOA(name string, z *Zone, record *Record) (answers, extras [
 		r.Expire = record.SOA.Expire
 		r.Minttl = record.SOA.MinTtl
 	}
-	r.Serial = redis.serial()
+	r.Serial = record.SOA.Serial
+	if r.Serial == 0 {
+		r.Serial = redis.unsetSerial(z.Name)
+	}
 	answers = append(answers, r)
 	return
 }
 
+// fallbackSoa returns SOA of a zone without SOA record built from configured
+// default_soa, relative names are completed with zone name
+func (redis *Redis) fallbackSoa(z *Zone) *dns.SOA {
+	redis.soaLock.Lock()
+	if !redis.soaWarned[z.Name] {
+		if redis.soaWarned == nil {
+			redis.soaWarned = make(map[string]bool)
+		}
+		redis.soaWarned[z.Name] = true
+		fmt.Println("warning : zone has no soa record, using default soa : ", z.Name)
+	}
+	redis.soaLock.Unlock()
+	soa := redis.defaultSoa
+	r := new(dns.SOA)
+	r.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeSOA,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, 0)}
+	r.Ns, r.Mbox = "ns1", "hostmaster"
+	if soa.Ns != "" {
+		r.Ns, r.Mbox = soa.Ns, soa.MBox
+	}
+	r.Ns, r.Mbox = fqdn(r.Ns, z.Name), fqdn(r.Mbox, z.Name)
+	r.Refresh, r.Retry, r.Expire, r.Minttl = 86400, 7200, 3600, redis.Ttl
+	if soa.Refresh != 0 {
+		r.Refresh, r.Retry, r.Expire, r.Minttl = soa.Refresh, soa.Retry, soa.Expire, soa.MinTtl
+	}
+	return r
+}
+
 func (redis *Redis) CAA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
 	if record == nil {
 		return
 	}
 	for _, caa := range record.CAA {
-		if caa.Value == "" || caa.Tag == ""{
+		if caa.Tag == "" {
 			continue
 		}
 		r := new(dns.CAA)
-		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCAA,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, caa.Ttl)}
 		r.Flag = caa.Flag
 		r.Tag = caa.Tag
 		r.Value = caa.Value
@@ -202,73 +556,540 @@ func (redis *Redis) CAA(name string, z *Zone, record *Record) (answers, extras [
 	return
 }
 
-func (redis *Redis) AXFR(z *Zone) (records []dns.RR) {
-	//soa, _ := redis.SOA(z.Name, z, record)
-	soa := make([]dns.RR, 0)
-	answers := make([]dns.RR, 0, 10)
-	extras := make([]dns.RR, 0, 10)
+func (redis *Redis) TLSA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, tlsa := range record.TLSA {
+		if len(tlsa.Certificate) == 0 {
+			continue
+		}
+		r := new(dns.TLSA)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTLSA,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, tlsa.Ttl)}
+		r.Usage = tlsa.Usage
+		r.Selector = tlsa.Selector
+		r.MatchingType = tlsa.MatchingType
+		r.Certificate = tlsa.Certificate
+		answers = append(answers, r)
+	}
+	return
+}
 
-	// Allocate slices for rr Records
-	records = append(records, soa...)
-	for key := range z.Locations {
-		if key == "@"  {
-			location := redis.findLocation(z.Name, z)
-			record := redis.get(location, z)
-			soa, _ = redis.SOA(z.Name, z, record)
+func (redis *Redis) SMIMEA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, smimea := range record.SMIMEA {
+		if len(smimea.Certificate) == 0 {
+			continue
+		}
+		r := new(dns.SMIMEA)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSMIMEA,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, smimea.Ttl)}
+		r.Usage = smimea.Usage
+		r.Selector = smimea.Selector
+		r.MatchingType = smimea.MatchingType
+		r.Certificate = smimea.Certificate
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) OPENPGPKEY(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, key := range record.OPENPGPKEY {
+		if len(key.PublicKey) == 0 {
+			continue
+		}
+		r := new(dns.OPENPGPKEY)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeOPENPGPKEY,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, key.Ttl)}
+		r.PublicKey = key.PublicKey
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) SSHFP(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, sshfp := range record.SSHFP {
+		if len(sshfp.Fingerprint) == 0 {
+			continue
+		}
+		r := new(dns.SSHFP)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSSHFP,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, sshfp.Ttl)}
+		r.Algorithm = sshfp.Algorithm
+		r.Type = sshfp.Type
+		r.FingerPrint = sshfp.Fingerprint
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) NAPTR(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, naptr := range record.NAPTR {
+		if len(naptr.Regexp) == 0 && len(naptr.Replacement) == 0 {
+			continue
+		}
+		r := new(dns.NAPTR)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNAPTR,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, naptr.Ttl)}
+		r.Order = naptr.Order
+		r.Preference = naptr.Preference
+		r.Flags = naptr.Flags
+		r.Service = naptr.Service
+		r.Regexp = naptr.Regexp
+		if naptr.Replacement == "" {
+			r.Replacement = "."
 		} else {
-			fqdnKey := dns.Fqdn(key) + z.Name
-			var as []dns.RR
-			var xs []dns.RR
+			r.Replacement = fqdn(naptr.Replacement, z.Name)
+		}
+		answers = append(answers, r)
+	}
+	return
+}
 
-			location := redis.findLocation(fqdnKey, z)
-			record := redis.get(location, z)
+func (redis *Redis) URI(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, uri := range record.URI {
+		if len(uri.Target) == 0 {
+			continue
+		}
+		r := new(dns.URI)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeURI,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, uri.Ttl)}
+		r.Priority = uri.Priority
+		r.Weight = uri.Weight
+		// target is a uri, not a domain name
+		r.Target = uri.Target
+		answers = append(answers, r)
+	}
+	return
+}
 
-			// Pull all zone records
-			as, xs = redis.A(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+func (redis *Redis) HINFO(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, hinfo := range record.HINFO {
+		if len(hinfo.Cpu) == 0 && len(hinfo.Os) == 0 {
+			continue
+		}
+		r := new(dns.HINFO)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeHINFO,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, hinfo.Ttl)}
+		r.Cpu = hinfo.Cpu
+		r.Os = hinfo.Os
+		answers = append(answers, r)
+	}
+	return
+}
 
-			as, xs = redis.AAAA(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+func (redis *Redis) RP(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, rp := range record.RP {
+		if len(rp.Mbox) == 0 {
+			continue
+		}
+		r := new(dns.RP)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeRP,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, rp.Ttl)}
+		r.Mbox = fqdn(rp.Mbox, z.Name)
+		// root is used if there is no TXT record as described in rfc1183 section 2.2
+		if rp.Txt == "" {
+			r.Txt = "."
+		} else {
+			r.Txt = fqdn(rp.Txt, z.Name)
+		}
+		answers = append(answers, r)
+	}
+	return
+}
 
-			as, xs = redis.CNAME(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+func (redis *Redis) AFSDB(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, afsdb := range record.AFSDB {
+		if len(afsdb.Hostname) == 0 {
+			continue
+		}
+		r := new(dns.AFSDB)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAFSDB,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, afsdb.Ttl)}
+		r.Subtype = afsdb.Subtype
+		r.Hostname = fqdn(afsdb.Hostname, z.Name)
+		answers = append(answers, r)
+		if !redis.minimalExtras {
+			extras = appendHosts(extras, redis.hosts(r.Hostname, z))
+		}
+	}
+	return
+}
+
+func (redis *Redis) APL(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, apl := range record.APL {
+		if len(apl.Prefixes) == 0 {
+			continue
+		}
+		r := new(dns.APL)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAPL,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, apl.Ttl)}
+		for _, prefix := range apl.Prefixes {
+			p, err := parseAplPrefix(prefix)
+			if err != nil {
+				fmt.Println("invalid apl : ", name, prefix, err)
+				continue
+			}
+			r.Prefixes = append(r.Prefixes, p)
+		}
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) CERT(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, cert := range record.CERT {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		r := new(dns.CERT)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCERT,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, cert.Ttl)}
+		r.Type = cert.Type
+		r.KeyTag = cert.KeyTag
+		r.Algorithm = cert.Algorithm
+		r.Certificate = cert.Certificate
+		answers = append(answers, r)
+	}
+	return
+}
+
+// parseAplPrefix parses an apl item in the text format of rfc3123 section 5,
+// "[!]family:address/prefix" where family is 1 for ipv4 and 2 for ipv6
+func parseAplPrefix(s string) (dns.APLPrefix, error) {
+	var p dns.APLPrefix
+	if strings.HasPrefix(s, "!") {
+		p.Negation, s = true, s[1:]
+	}
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return p, errors.New("missing address family")
+	}
+	_, network, err := net.ParseCIDR(s[i+1:])
+	if err != nil {
+		return p, err
+	}
+	switch s[:i] {
+	case "1":
+		if network.IP.To4() == nil || len(network.Mask) != net.IPv4len {
+			return p, errors.New("invalid ipv4 prefix " + s[i+1:])
+		}
+	case "2":
+		if len(network.Mask) != net.IPv6len {
+			return p, errors.New("invalid ipv6 prefix " + s[i+1:])
+		}
+	default:
+		return p, errors.New("unsupported address family " + s[:i])
+	}
+	p.Network = *network
+	return p, nil
+}
+
+func formatAplPrefix(p dns.APLPrefix) string {
+	s := "2:"
+	if len(p.Network.Mask) == net.IPv4len {
+		s = "1:"
+	}
+	if p.Negation {
+		s = "!" + s
+	}
+	return s + p.Network.String()
+}
 
-			as, xs = redis.MX(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+func (redis *Redis) DNAME(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if len(record.DNAME.Target) == 0 {
+		return
+	}
+	r := new(dns.DNAME)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeDNAME,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, record.DNAME.Ttl)}
+	r.Target = dns.Fqdn(record.DNAME.Target)
+	answers = append(answers, r)
+	return
+}
+
+func (redis *Redis) LOC(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, loc := range record.LOC {
+		if len(loc.Location) == 0 {
+			continue
+		}
+		// location is stored in rfc1876 text format, let the zone parser convert it
+		rr, err := dns.NewRR(dns.Fqdn(name) + " IN LOC " + loc.Location)
+		if err != nil {
+			fmt.Println("invalid loc : ", name, loc.Location, err)
+			continue
+		}
+		r, ok := rr.(*dns.LOC)
+		if !ok {
+			continue
+		}
+		r.Hdr.Ttl = redis.recordTtl(z, loc.Ttl)
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) SVCB(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, svcb := range record.SVCB {
+		r := redis.svcb(name, z, dns.TypeSVCB, svcb)
+		if r == nil {
+			continue
+		}
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (redis *Redis) HTTPS(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, https := range record.HTTPS {
+		r := redis.svcb(name, z, dns.TypeHTTPS, https)
+		if r == nil {
+			continue
+		}
+		answers = append(answers, &dns.HTTPS{SVCB: *r})
+	}
+	return
+}
+
+// svcb builds the common SVCB rdata for both SVCB and HTTPS types,
+// params are emitted in ascending key order and are omitted in alias mode
+func (redis *Redis) svcb(name string, z *Zone, rrtype uint16, svcb SVCB_Record) *dns.SVCB {
+	if len(svcb.Target) == 0 {
+		return nil
+	}
+	r := new(dns.SVCB)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, svcb.Ttl)}
+	r.Priority = svcb.Priority
+	if svcb.Target == "." {
+		r.Target = svcb.Target
+	} else {
+		r.Target = fqdn(svcb.Target, z.Name)
+	}
+	if svcb.Priority == 0 {
+		return r
+	}
+	if len(svcb.Alpn) > 0 {
+		r.Value = append(r.Value, &dns.SVCBAlpn{Alpn: svcb.Alpn})
+	}
+	if svcb.Port != 0 {
+		r.Value = append(r.Value, &dns.SVCBPort{Port: svcb.Port})
+	}
+	if len(svcb.Ipv4Hint) > 0 {
+		r.Value = append(r.Value, &dns.SVCBIPv4Hint{Hint: svcb.Ipv4Hint})
+	}
+	if len(svcb.Ech) > 0 {
+		ech, err := base64.StdEncoding.DecodeString(svcb.Ech)
+		if err != nil {
+			fmt.Println("invalid ech config : ", name, svcb.Ech, err)
+			return nil
+		}
+		r.Value = append(r.Value, &dns.SVCBECHConfig{ECH: ech})
+	}
+	if len(svcb.Ipv6Hint) > 0 {
+		r.Value = append(r.Value, &dns.SVCBIPv6Hint{Hint: svcb.Ipv6Hint})
+	}
+	return r
+}
+
+// ANY returns all records stored at a location, or a single HINFO
+// as described in rfc8482 if minimal_any is set
+func (redis *Redis) ANY(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if redis.minimalAny {
+		r := new(dns.HINFO)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeHINFO,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, 0)}
+		r.Cpu = "RFC8482"
+		answers = append(answers, r)
+		return
+	}
+	return redis.records(name, z, record)
+}
+
+// records returns records of all supported types stored at a location
+func (redis *Redis) records(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	handlers := append(redis.dataHandlers(), redis.NS, redis.MX, redis.SRV)
+	if record.SOA.Ns != "" {
+		handlers = append(handlers, redis.SOA)
+	}
+	for _, handler := range handlers {
+		as, xs := handler(name, z, record)
+		answers = append(answers, as...)
+		extras = append(extras, xs...)
+	}
+	return
+}
+
+// dataHandlers returns handlers of stored types other than SOA, NS, MX, SRV
+// and dnssec types
+func (redis *Redis) dataHandlers() []func(string, *Zone, *Record) ([]dns.RR, []dns.RR) {
+	return []func(string, *Zone, *Record) ([]dns.RR, []dns.RR){
+		redis.A, redis.AAAA, redis.CNAME, redis.TXT,
+		redis.CAA, redis.TLSA, redis.SMIMEA, redis.OPENPGPKEY, redis.SSHFP, redis.NAPTR, redis.URI, redis.HINFO, redis.RP, redis.AFSDB, redis.PTR, redis.APL, redis.CERT, redis.DNAME, redis.LOC,
+		redis.SVCB, redis.HTTPS, redis.ZONEMD, redis.CDS, redis.CDNSKEY, redis.GENERIC,
+	}
+}
+
+// transferRecords returns records stored at a location for a zone transfer.
+// stored dnssec records are included so presigned zones are transferred
+// whole, NS, MX and SRV targets are not looked up as extras are not sent
+func (redis *Redis) transferRecords(name string, z *Zone, record *Record) (answers []dns.RR) {
+	handlers := append(redis.dataHandlers(), redis.RRSIG, redis.DNSKEY, redis.NSEC, redis.NSEC3, redis.NSEC3PARAM)
+	for _, handler := range handlers {
+		as, _ := handler(name, z, record)
+		answers = append(answers, as...)
+	}
+	answers = append(answers, redis.nsRecords(name, z, record)...)
+	answers = append(answers, redis.mxRecords(name, z, record)...)
+	answers = append(answers, redis.srvRecords(name, z, record)...)
+	return
+}
+
+// AXFR returns all records of zone z for a zone transfer between two copies
+// of zone SOA. wildcard owners are sent verbatim and delegation NS records
+// are sent with glue stored in zone, addresses of targets are not added
+func (redis *Redis) AXFR(z *Zone) (records []dns.RR) {
+	answers := make([]dns.RR, 0, 10)
 
-			as, xs = redis.SRV(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+	// names are sorted to keep envelopes deterministic
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		if key != "@" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
 
-			as, xs = redis.TXT(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+	apex := redis.get(z.Name, z)
+	if apex == nil {
+		apex = new(Record)
+	}
+	soa, _ := redis.SOA(z.Name, z, apex)
+	answers = append(answers, redis.transferRecords(z.Name, z, apex)...)
+	for i, record := range redis.getMany(keys, z) {
+		if record == nil {
+			continue
 		}
+		answers = append(answers, redis.transferRecords(dns.Fqdn(keys[i])+z.Name, z, record)...)
 	}
 
 	records = soa
 	records = append(records, answers...)
-	records = append(records, extras...)
 	records = append(records, soa...)
+	return
+}
 
-	fmt.Println(records)
- 	return
+// getMany returns records of keys in zone z in the same order, missing keys
+// are nil. reads are pipelined in batches of transferBatchSize keys
+func (redis *Redis) getMany(keys []string, z *Zone) []*Record {
+	records := make([]*Record, len(keys))
+	var misses []int
+	for i, key := range keys {
+		if redis.cache != nil {
+			if r, ok := redis.cache.get(z.Name + "/" + key); ok {
+				records[i] = r.(*Record)
+				continue
+			}
+		}
+		misses = append(misses, i)
+	}
+	if len(misses) == 0 {
+		return records
+	}
+	if redis.replicaPool != nil {
+		misses = redis.fetchMany(redis.replicaPool, keys, misses, z, records)
+	}
+	redis.fetchMany(redis.Pool, keys, misses, z, records)
+	return records
 }
 
+// fetchMany reads records of keys at indexes misses from pool into records,
+// indexes of keys not found are returned
+func (redis *Redis) fetchMany(pool *redisCon.Pool, keys []string, misses []int, z *Zone, records []*Record) []int {
+	if len(misses) == 0 {
+		return nil
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	var batches [][]int
+	for start := 0; start < len(misses); start += transferBatchSize {
+		end := start + transferBatchSize
+		if end > len(misses) {
+			end = len(misses)
+		}
+		batch := misses[start:end]
+		args := []interface{}{redis.keyPrefix + z.Name + redis.keySuffix}
+		for _, i := range batch {
+			args = append(args, keys[i])
+		}
+		if err := conn.Send("HMGET", args...); err != nil {
+			fmt.Println("error reading records : ", err)
+			return misses
+		}
+		batches = append(batches, batch)
+	}
+	if err := conn.Flush(); err != nil {
+		fmt.Println("error reading records : ", err)
+		return misses
+	}
+	var missing []int
+	for n, batch := range batches {
+		vals, err := redisCon.Strings(conn.Receive())
+		if err != nil {
+			fmt.Println("error reading records : ", err)
+			for _, b := range batches[n:] {
+				missing = append(missing, b...)
+			}
+			return missing
+		}
+		for j, i := range batch {
+			if j >= len(vals) || vals[j] == "" {
+				missing = append(missing, i)
+			}
+		}
+		for j, val := range vals {
+			if val == "" || j >= len(batch) {
+				continue
+			}
+			r, err := redis.parseRecord(z.Name, keys[batch[j]], val)
+			if err != nil {
+				continue
+			}
+			records[batch[j]] = r
+			if redis.cache != nil {
+				redis.cache.set(z.Name+"/"+keys[batch[j]], r)
+			}
+		}
+	}
+	return missing
+}
+
+// hosts returns address records of name, names outside z are looked up in
+// the zone serving them and skipped if no zone does
 func (redis *Redis) hosts(name string, z *Zone) []dns.RR {
-	var (
-		record *Record
-		answers []dns.RR
-	)
+	var record *Record
+	name = dns.Fqdn(name)
+	if !dns.IsSubDomain(z.Name, name) {
+		zone := redis.matchZone(name)
+		if zone == "" {
+			return nil
+		}
+		if z = redis.load(zone); z == nil {
+			return nil
+		}
+	}
 	location := redis.findLocation(name, z)
 	if location == "" {
 		return nil
 	}
 	record = redis.get(location, z)
+	if record == nil {
+		return nil
+	}
+	return redis.hostRecords(name, z, record)
+}
+
+// hostRecords returns address and CNAME records of name stored in record
+func (redis *Redis) hostRecords(name string, z *Zone, record *Record) (answers []dns.RR) {
+	record, _ = subnetRecord(record, dns.TypeA, nil)
 	a, _ := redis.A(name, z, record)
 	answers = append(answers, a...)
 	aaaa, _ := redis.AAAA(name, z, record)
@@ -278,29 +1099,168 @@ func (redis *Redis) hosts(name string, z *Zone) []dns.RR {
 	return answers
 }
 
+// appendHosts appends hosts to extras skipping records already present, so
+// targets shared by several records are only added once
+func appendHosts(extras []dns.RR, hosts []dns.RR) []dns.RR {
+	for _, rr := range hosts {
+		duplicate := false
+		for _, x := range extras {
+			if dns.IsDuplicate(rr, x) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			extras = append(extras, rr)
+		}
+	}
+	return extras
+}
+
 func (redis *Redis) serial() uint32 {
 	return uint32(time.Now().Unix())
 }
 
-func (redis *Redis) minTtl(ttl uint32) uint32 {
-	if redis.Ttl == 0 && ttl == 0 {
-		return defaultTtl
+// unsetSerial returns serial served for zone without a stored serial, the time
+// zone is first served is used until zone is modified so secondaries do not
+// transfer unchanged zones
+func (redis *Redis) unsetSerial(zone string) uint32 {
+	redis.soaLock.Lock()
+	defer redis.soaLock.Unlock()
+	serial, ok := redis.unsetSerials[zone]
+	if !ok {
+		if redis.unsetSerials == nil {
+			redis.unsetSerials = make(map[string]uint32)
+		}
+		serial = redis.serial()
+		redis.unsetSerials[zone] = serial
 	}
-	if redis.Ttl == 0 {
+	return serial
+}
+
+// recordTtl returns ttl of a record in zone z. ttl stored with the record is used
+// if set, otherwise default ttl of the zone or configured ttl
+func (redis *Redis) recordTtl(z *Zone, ttl uint32) uint32 {
+	if ttl != 0 {
 		return ttl
 	}
-	if ttl == 0 {
-		return redis.Ttl
+	if ttl = redis.zoneTtl(z); ttl != 0 {
+		return ttl
 	}
-	if redis.Ttl < ttl {
+	if redis.Ttl != 0 {
 		return redis.Ttl
 	}
-	return  ttl
+	return defaultTtl
 }
 
+// zoneTtl returns default ttl of zone z stored with its apex record, the apex
+// is loaded only if a record without ttl is served and kept until zones are
+// reloaded or the zone is invalidated
+func (redis *Redis) zoneTtl(z *Zone) uint32 {
+	if z == nil {
+		return 0
+	}
+	if _, ok := z.Locations["@"]; !ok {
+		return 0
+	}
+	redis.zonesLock.RLock()
+	ttl, ok := redis.zoneTtls[z.Name]
+	redis.zonesLock.RUnlock()
+	if ok {
+		return ttl
+	}
+	if apex := redis.get(z.Name, z); apex != nil {
+		ttl = apex.Ttl
+	}
+	redis.zonesLock.Lock()
+	if redis.zoneTtls == nil {
+		redis.zoneTtls = make(map[string]uint32)
+	}
+	redis.zoneTtls[z.Name] = ttl
+	redis.zonesLock.Unlock()
+	return ttl
+}
+
+// invalidate drops cached records, default ttl, flattened spf records, reverse
+// names, unset serial and logged warnings of zone after it is modified
+func (redis *Redis) invalidate(zone string) {
+	if redis.cache != nil {
+		redis.cache.invalidate(zone)
+	}
+	redis.zonesLock.Lock()
+	delete(redis.zoneTtls, zone)
+	redis.zonesLock.Unlock()
+	redis.spfLock.Lock()
+	delete(redis.spfCache, zone)
+	redis.spfLock.Unlock()
+	redis.reverseLock.Lock()
+	delete(redis.forwardIndex, zone)
+	redis.reverseLock.Unlock()
+	redis.soaLock.Lock()
+	delete(redis.unsetSerials, zone)
+	redis.soaLock.Unlock()
+	redis.warnLock.Lock()
+	delete(redis.warnings, zone)
+	redis.warnLock.Unlock()
+}
+
+// clampTtl limits ttl of rrs to configured minttl and maxttl
+func (redis *Redis) clampTtl(rrs []dns.RR) []dns.RR {
+	if redis.ttlMin == 0 && redis.ttlMax == 0 {
+		return rrs
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeTSIG {
+			continue
+		}
+		if h.Ttl < redis.ttlMin {
+			h.Ttl = redis.ttlMin
+		}
+		if redis.ttlMax != 0 && h.Ttl > redis.ttlMax {
+			h.Ttl = redis.ttlMax
+		}
+	}
+	return rrs
+}
+
+// jitterTtl lowers ttl of rrs in responses from zone by a random amount up to
+// the configured percentage of ttl, so caches do not expire records at the
+// same time. one factor is used for all rrs so rrsets keep a single ttl.
+// ttls are not lowered below minttl or to zero
+func (redis *Redis) jitterTtl(zone string, rrs ...[]dns.RR) {
+	percent, ok := redis.ttlJitter[zone]
+	if !ok {
+		percent = redis.ttlJitter[""]
+	}
+	if percent == 0 {
+		return
+	}
+	floor := redis.ttlMin
+	if floor == 0 {
+		floor = 1
+	}
+	factor := rand.Float64() * float64(percent) / 100
+	for _, section := range rrs {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeTSIG || h.Ttl <= floor {
+				continue
+			}
+			h.Ttl -= uint32(float64(h.Ttl) * factor)
+			if h.Ttl < floor {
+				h.Ttl = floor
+			}
+		}
+	}
+}
+
+// findLocation returns location of query in zone z. if query does not exist, the wildcard
+// at closest encloser is used as described in rfc4592. empty non-terminals are returned
+// as is, so they block wildcards beneath them and get empty answers
 func (redis *Redis) findLocation(query string, z *Zone) string {
 	var (
-		ok bool
+		ok                                 bool
 		closestEncloser, sourceOfSynthesis string
 	)
 
@@ -309,12 +1269,17 @@ func (redis *Redis) findLocation(query string, z *Zone) string {
 		return query
 	}
 
-	query = strings.TrimSuffix(query, "." + z.Name)
+	query = strings.TrimSuffix(query, "."+z.Name)
 
 	if _, ok = z.Locations[query]; ok {
 		return query
 	}
 
+	// empty non-terminal
+	if keyMatches(query, z) {
+		return query
+	}
+
 	closestEncloser, sourceOfSynthesis, ok = splitQuery(query)
 	for ok {
 		ceExists := keyMatches(closestEncloser, z) || keyExists(closestEncloser, z)
@@ -332,19 +1297,158 @@ func (redis *Redis) findLocation(query string, z *Zone) string {
 	return ""
 }
 
+// chaseCname returns CNAME of name and follows in-zone targets up to cname_depth
+// CNAMEs, A and AAAA records of the final target are added to answers. with
+// resolve_cname targets outside served zones are resolved using resolver
+func (redis *Redis) chaseCname(ctx context.Context, name string, qtype string, z *Zone, record *Record) (answers []dns.RR) {
+	seen := make(map[string]bool)
+	for depth := 0; ; depth++ {
+		cname, _ := redis.CNAME(name, z, record)
+		if len(cname) == 0 {
+			return
+		}
+		answers = append(answers, cname[0])
+		seen[strings.ToLower(dns.Fqdn(name))] = true
+		target := strings.ToLower(cname[0].(*dns.CNAME).Target)
+		if depth >= redis.cnameDepth || seen[target] {
+			return
+		}
+		if !dns.IsSubDomain(z.Name, target) {
+			if redis.cnameTimeout > 0 && (qtype == "A" || qtype == "AAAA") && redis.matchZone(target) == "" {
+				answers = append(answers, redis.resolveCname(ctx, target, dns.StringToType[qtype], redis.cnameDepth-depth-1)...)
+			}
+			return
+		}
+		location := redis.findLocation(target, z)
+		if location == "" {
+			return
+		}
+		record = redis.get(location, z)
+		if record == nil {
+			return
+		}
+		record, _ = subnetRecord(record, dns.TypeA, nil)
+		var as []dns.RR
+		switch qtype {
+		case "A":
+			as, _ = redis.A(target, z, record)
+		case "AAAA":
+			as, _ = redis.AAAA(target, z, record)
+		}
+		if len(as) > 0 {
+			return append(answers, as...)
+		}
+		name = target
+	}
+}
+
+// findDelegation returns owner and record of the topmost zone cut between zone apex
+// and query, query itself is not checked
+func (redis *Redis) findDelegation(query string, z *Zone) (string, *Record) {
+	if query == z.Name {
+		return "", nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(query, "."+z.Name))
+	for i := len(labels) - 1; i > 0; i-- {
+		key := strings.Join(labels[i:], ".")
+		if !keyExists(key, z) {
+			continue
+		}
+		if record := redis.get(key, z); record != nil && redis.delegated(key, z, record) {
+			return key + "." + z.Name, record
+		}
+	}
+	return "", nil
+}
+
+// delegated checks whether record is a delegation to a child zone, holding NS
+// records and glue addresses but no SOA or other data. zone apex is never a
+// delegation, zones without SOA are served with default_soa
+func (redis *Redis) delegated(name string, z *Zone, record *Record) bool {
+	if name == z.Name || len(record.NS) == 0 || record.SOA.Ns != "" {
+		return false
+	}
+	r := *record
+	r.NS, r.A, r.AAAA = nil, nil, nil
+	others, _ := redis.records(name, z, &r)
+	return len(others) == 0
+}
+
+// referral returns NS records of delegation point owner and their glue addresses
+// stored in parent zone
+func (redis *Redis) referral(owner string, z *Zone, record *Record) (ns, glue []dns.RR) {
+	ns, _ = redis.NS(owner, z, record)
+	for _, rr := range ns {
+		host := rr.(*dns.NS).Ns
+		if !dns.IsSubDomain(z.Name, host) {
+			continue
+		}
+		for _, rr := range redis.hosts(host, z) {
+			if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				glue = append(glue, rr)
+			}
+		}
+	}
+	return
+}
+
+// findDname returns owner and record of the topmost DNAME above query in zone z
+func (redis *Redis) findDname(query string, z *Zone) (string, *Record) {
+	if query == z.Name {
+		return "", nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(query, "."+z.Name))
+	for i := len(labels); i > 0; i-- {
+		var key, owner string
+		if i == len(labels) {
+			key, owner = "@", z.Name
+		} else {
+			key = strings.Join(labels[i:], ".")
+			owner = key + "." + z.Name
+		}
+		if !keyExists(key, z) {
+			continue
+		}
+		var record *Record
+		if key == "@" {
+			record = redis.get(z.Name, z)
+		} else {
+			record = redis.get(key, z)
+		}
+		if record != nil && record.DNAME.Target != "" {
+			return owner, record
+		}
+	}
+	return "", nil
+}
+
+// synthesizeCname builds the CNAME for query under dname as described in rfc6672,
+// nil is returned if the resulting name is too long
+func synthesizeCname(query string, dname *dns.DNAME) *dns.CNAME {
+	target := strings.TrimSuffix(query, dname.Hdr.Name) + dname.Target
+	if _, ok := dns.IsDomainName(target); !ok {
+		return nil
+	}
+	r := new(dns.CNAME)
+	r.Hdr = dns.RR_Header{Name: query, Rrtype: dns.TypeCNAME,
+		Class: dns.ClassINET, Ttl: dname.Hdr.Ttl}
+	r.Target = target
+	return r
+}
+
 func (redis *Redis) get(key string, z *Zone) *Record {
+	r, _ := redis.getContext(context.Background(), key, z)
+	return r
+}
+
+// getContext returns record of key in zone z, nil record without error is
+// returned if key does not exist
+func (redis *Redis) getContext(ctx context.Context, key string, z *Zone) (*Record, error) {
 	var (
-		err error
+		err   error
 		reply interface{}
-		val string
+		val   string
 	)
-	conn := redis.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return nil
-	}
-	defer conn.Close()
-
 	var label string
 	if key == z.Name {
 		label = "@"
@@ -352,21 +1456,114 @@ func (redis *Redis) get(key string, z *Zone) *Record {
 		label = key
 	}
 
-	reply, err = conn.Do("HGET", redis.keyPrefix + z.Name + redis.keySuffix, label)
+	if redis.cache != nil {
+		if r, ok := redis.cache.get(z.Name + "/" + label); ok {
+			return r.(*Record), nil
+		}
+	}
+
+	reply, err = redis.read(ctx, "HGET", redis.keyPrefix+z.Name+redis.keySuffix, label)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	val, err = redisCon.String(reply, nil)
 	if err != nil {
-		return nil
+		// zone index may be older than records, e.g. a cached zone
+		if _, ok := z.Locations[label]; ok {
+			fmt.Println("missing record : ", z.Name, label)
+		}
+		return nil, nil
 	}
-	r := new(Record)
-	err = json.Unmarshal([]byte(val), r)
+	r, err := redis.parseRecord(z.Name, label, val)
 	if err != nil {
-		fmt.Println("parse error : ", val, err)
-		return nil
+		if redis.strictRecords {
+			return nil, invalidRecordError{err}
+		}
+		return nil, nil
 	}
-	return r
+	if redis.cache != nil {
+		redis.cache.set(z.Name+"/"+label, r)
+	}
+	return r, nil
+}
+
+// do runs a command on a pooled connection, if ctx is done before the reply
+// arrives the command is abandoned and ctx error is returned
+func (redis *Redis) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.doPool(ctx, redis.Pool, cmd, args...)
+}
+
+// read runs a read-only command on the replica if one is configured. replicas
+// may lag behind, commands are retried on the primary if the replica fails or
+// has no data
+func (redis *Redis) read(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if redis.replicaPool == nil || ctx.Value(primaryKey{}) != nil {
+		return redis.do(ctx, cmd, args...)
+	}
+	reply, err := redis.doPool(ctx, redis.replicaPool, cmd, args...)
+	if ctx.Err() != nil {
+		return reply, err
+	}
+	if values, ok := reply.([]interface{}); err == nil && reply != nil && (!ok || len(values) > 0) {
+		return reply, nil
+	}
+	return redis.do(ctx, cmd, args...)
+}
+
+// primaryKey marks contexts of reads that must see latest data
+type primaryKey struct{}
+
+// withPrimary returns ctx routing reads to the primary
+func withPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// doPool runs a command on a connection of pool. reply is read with the time
+// left until deadline of ctx as read timeout, the configured read timeout is
+// used if ctx has no deadline
+func (redis *Redis) doPool(ctx context.Context, pool *redisCon.Pool, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn.Do(cmd, args...)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	reply, err := redisCon.DoWithTimeout(conn, timeout, cmd, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+// queryContext returns ctx limited to query timeout if configured
+func (redis *Redis) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if redis.queryTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(redis.queryTimeout)*time.Millisecond)
+}
+
+// globEscape escapes special characters of a redis KEYS pattern so prefixes
+// and suffixes are matched literally
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune("*?[]\\", c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
 }
 
 func keyExists(key string, z *Zone) bool {
@@ -374,13 +1571,36 @@ func keyExists(key string, z *Zone) bool {
 	return ok
 }
 
+// keyMatches checks whether key or a name beneath it exists in zone z, names
+// beneath key share its reversed labels as prefix in the sorted name index
 func keyMatches(key string, z *Zone) bool {
-	for value := range z.Locations {
-		if strings.HasSuffix(value, key) {
-			return true
+	if key == "" || keyExists(key, z) {
+		return true
+	}
+	names := z.reversedNames()
+	prefix := reverseLabels(key) + "."
+	i := sort.SearchStrings(names, prefix)
+	return i < len(names) && strings.HasPrefix(names[i], prefix)
+}
+
+// reversedNames returns the sorted name index of z, built on first use
+func (z *Zone) reversedNames() []string {
+	z.namesOnce.Do(func() {
+		z.names = make([]string, 0, len(z.Locations))
+		for key := range z.Locations {
+			z.names = append(z.names, reverseLabels(key))
 		}
+		sort.Strings(z.names)
+	})
+	return z.names
+}
+
+func reverseLabels(name string) string {
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
 	}
-	return false
+	return strings.Join(labels, ".")
 }
 
 func splitQuery(query string) (string, string, bool) {
@@ -388,8 +1608,8 @@ func splitQuery(query string) (string, string, bool) {
 		return "", "", false
 	}
 	var (
-		splits []string
-		closestEncloser string
+		splits            []string
+		closestEncloser   string
 		sourceOfSynthesis string
 	)
 	splits = strings.SplitAfterN(query, ".", 2)
@@ -404,22 +1624,126 @@ func splitQuery(query string) (string, string, bool) {
 }
 
 func (redis *Redis) Connect() {
-	redis.Pool = &redisCon.Pool{
-		Dial: func () (redisCon.Conn, error) {
-			opts := []redisCon.DialOption{}
-			if redis.redisPassword != "" {
-				opts = append(opts, redisCon.DialPassword(redis.redisPassword))
-			}
-			if redis.connectTimeout != 0 {
-				opts = append(opts, redisCon.DialConnectTimeout(time.Duration(redis.connectTimeout)*time.Millisecond))
-			}
-			if redis.readTimeout != 0 {
-				opts = append(opts, redisCon.DialReadTimeout(time.Duration(redis.readTimeout)*time.Millisecond))
-			}
+	if len(redis.clusterNodes) > 0 {
+		redis.cluster = newCluster(redis.clusterNodes, func(addr string) *redisCon.Pool {
+			return redis.newPool(func() (redisCon.Conn, error) {
+				return redis.dial(addr, redis.dialOptions())
+			})
+		})
+		if err := redis.cluster.refresh(); err != nil {
+			fmt.Println("cluster error : ", err)
+		}
+		redis.Pool = &redisCon.Pool{
+			Dial: func() (redisCon.Conn, error) {
+				return &clusterConn{cluster: redis.cluster}, nil
+			},
+		}
+		return
+	}
+	redis.Pool = redis.newPool(func() (redisCon.Conn, error) {
+		addr, err := redis.dialAddress()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := redis.dial(addr, redis.dialOptions())
+		if err != nil || redis.master == nil {
+			return conn, err
+		}
+		return &masterConn{Conn: conn, addr: addr}, nil
+	})
+	redis.Pool.TestOnBorrow = redis.testMaster
+	if redis.replicaAddress != "" {
+		redis.replicaPool = redis.newPool(func() (redisCon.Conn, error) {
+			return redis.dial(redis.replicaAddress, redis.dialOptions())
+		})
+	}
+	for _, addr := range redis.serialPeers {
+		addr := addr
+		redis.peerPools = append(redis.peerPools, redis.newPool(func() (redisCon.Conn, error) {
+			return redis.dial(addr, redis.dialOptions())
+		}))
+	}
+}
+
+// newPool returns a connection pool using configured pool limits
+func (redis *Redis) newPool(dial func() (redisCon.Conn, error)) *redisCon.Pool {
+	return &redisCon.Pool{
+		Dial:            dial,
+		MaxIdle:         redis.poolMaxIdle,
+		MaxActive:       redis.poolMaxActive,
+		IdleTimeout:     redis.poolIdleTimeout,
+		MaxConnLifetime: redis.poolLifetime,
+		Wait:            redis.poolWait,
+	}
+}
+
+// dial connects to addr and authenticates as ACL user redisUsername when it is set,
+// database is selected after authentication
+func (redis *Redis) dial(addr string, opts []redisCon.DialOption) (redisCon.Conn, error) {
+	conn, err := redisCon.Dial("tcp", addr, opts...)
+	if err != nil || redis.redisUsername == "" {
+		return conn, err
+	}
+	if _, err = conn.Do("AUTH", redis.redisUsername, redis.redisPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if redis.redisDb != 0 {
+		if _, err = conn.Do("SELECT", redis.redisDb); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (redis *Redis) dialOptions() []redisCon.DialOption {
+	opts := []redisCon.DialOption{}
+	if redis.redisPassword != "" && redis.redisUsername == "" {
+		opts = append(opts, redisCon.DialPassword(redis.redisPassword))
+	}
+	if redis.redisDb != 0 && redis.redisUsername == "" {
+		opts = append(opts, redisCon.DialDatabase(redis.redisDb))
+	}
+	if redis.connectTimeout != 0 {
+		opts = append(opts, redisCon.DialConnectTimeout(time.Duration(redis.connectTimeout)*time.Millisecond))
+	}
+	if redis.readTimeout != 0 {
+		opts = append(opts, redisCon.DialReadTimeout(time.Duration(redis.readTimeout)*time.Millisecond))
+	}
+	return append(opts, redis.tlsOptions()...)
+}
+
+func (redis *Redis) tlsOptions() []redisCon.DialOption {
+	if redis.tlsConfig == nil {
+		return nil
+	}
+	return []redisCon.DialOption{redisCon.DialUseTLS(true), redisCon.DialTLSConfig(redis.tlsConfig)}
+}
+
+// Ping checks connectivity to redis server
+func (redis *Redis) Ping() error {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
 
-			return redisCon.Dial("tcp", redis.redisAddress, opts...)
-		},
+// Ready implements the ready.Readiness interface, plugin is ready once zone
+// names and preloaded zones are loaded and redis is reachable. if a canary
+// zone is configured it must also exist in redis
+func (redis *Redis) Ready() bool {
+	redis.zonesLock.RLock()
+	loaded := !redis.LastZoneUpdate.IsZero()
+	redis.zonesLock.RUnlock()
+	if !loaded || redis.preloading() && atomic.LoadInt32(&redis.preloadState) != preloadDone {
+		return false
+	}
+	if redis.canaryZone == "" {
+		return redis.Ping() == nil
 	}
+	n, err := redisCon.Int(redis.do(context.Background(), "HLEN", redis.keyPrefix+redis.canaryZone+redis.keySuffix))
+	return err == nil && n > 0
 }
 
 func (redis *Redis) save(zone string, subdomain string, value string) error {
@@ -432,65 +1756,118 @@ func (redis *Redis) save(zone string, subdomain string, value string) error {
 	}
 	defer conn.Close()
 
-	_, err = conn.Do("HSET", redis.keyPrefix + zone + redis.keySuffix, subdomain, value)
+	_, err = conn.Do("HSET", redis.keyPrefix+zone+redis.keySuffix, subdomain, value)
 	return err
 }
 
 func (redis *Redis) load(zone string) *Zone {
+	z, _ := redis.loadContext(context.Background(), zone)
+	return z
+}
+
+// loadContext returns zone with its list of locations
+func (redis *Redis) loadContext(ctx context.Context, zone string) (*Zone, error) {
 	var (
 		reply interface{}
-		err error
-		vals []string
+		err   error
+		vals  []string
 	)
 
-	conn := redis.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return nil
+	if redis.cache != nil && ctx.Value(primaryKey{}) == nil {
+		if z, ok := redis.cache.get(zone); ok {
+			return z.(*Zone), nil
+		}
 	}
-	defer conn.Close()
 
-	reply, err = conn.Do("HKEYS", redis.keyPrefix + zone + redis.keySuffix)
+	reply, err = redis.read(ctx, "HKEYS", redis.keyPrefix+zone+redis.keySuffix)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	z := new(Zone)
 	z.Name = zone
 	vals, err = redisCon.Strings(reply, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	z.Locations = make(map[string]struct{})
 	for _, val := range vals {
 		z.Locations[val] = struct{}{}
 	}
+	z.reversedNames()
+	if redis.cache != nil {
+		redis.cache.set(zone, z)
+	}
 
-	return z
+	return z, nil
 }
 
+// primaryLocation returns z with location of qname added if it is missing from
+// z but stored on the primary, z itself is returned otherwise
+func (redis *Redis) primaryLocation(ctx context.Context, qname string, z *Zone) (*Zone, error) {
+	label := "@"
+	if qname != z.Name {
+		label = strings.TrimSuffix(qname, "."+z.Name)
+	}
+	exists, err := redisCon.Bool(redis.read(withPrimary(ctx), "HEXISTS", redis.keyPrefix+z.Name+redis.keySuffix, label))
+	if err != nil || !exists {
+		return z, err
+	}
+	locations := make(map[string]struct{}, len(z.Locations)+1)
+	for key := range z.Locations {
+		locations[key] = struct{}{}
+	}
+	locations[label] = struct{}{}
+	primary := &Zone{Name: z.Name, Locations: locations}
+	primary.reversedNames()
+	return primary, nil
+}
+
+// fqdn returns name as a fully qualified name, names which are not
+// already fully qualified are considered relative to zone
+func fqdn(name string, zone string) string {
+	if dns.IsFqdn(name) {
+		return name
+	}
+	return name + "." + zone
+}
+
+// split255 splits s into character-strings of at most 255 bytes
 func split255(s string) []string {
-	if len(s) < 255 {
+	if len(s) <= 255 {
 		return []string{s}
 	}
 	sx := []string{}
-	p, i := 0, 255
-	for {
-		if i <= len(s) {
-			sx = append(sx, s[p:i])
-		} else {
-			sx = append(sx, s[p:])
-			break
-
-		}
-		p, i = p+255, i+255
+	for len(s) > 255 {
+		sx = append(sx, s[:255])
+		s = s[255:]
+	}
+	if len(s) > 0 {
+		sx = append(sx, s)
 	}
-
 	return sx
 }
 
 const (
-	defaultTtl = 360
-	hostmaster = "hostmaster"
-	zoneUpdateTime = 10*time.Minute
-	transferLength = 1000
-)
\ No newline at end of file
+	defaultTtl             = 360
+	hostmaster             = "hostmaster"
+	zoneUpdateTime         = 10 * time.Minute
+	defaultTransferLength  = 1000
+	minTransferLength      = 512
+	maxChainLength         = 8
+	defaultCnameDepth      = 8
+	defaultPoolMaxIdle     = 10
+	defaultPoolIdleTimeout = 240 * time.Second
+	defaultStartupTimeout  = time.Minute
+	retryInitialBackoff    = 100 * time.Millisecond
+	retryMaxBackoff        = 10 * time.Second
+	transferBatchSize      = 1000
+	defaultPreloadWorkers  = 4
+	policyAll              = "all"
+	policyWeighted         = "weighted"
+	policyRandomOne        = "random-one"
+	policyRoundRobin       = "round-robin"
+	policyShuffle          = "shuffle"
+	truncateAdditional     = "additional"
+	truncateAuthority      = "authority"
+	truncateTc             = "tc"
+)
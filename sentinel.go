@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// masterResolver returns address of current redis master
+type masterResolver interface {
+	MasterAddr() (string, error)
+}
+
+// sentinelResolver asks redis sentinels for address of master. results are cached
+// for a short time to avoid a round-trip to sentinel on every connection borrow
+type sentinelResolver struct {
+	master         string
+	addrs          []string
+	connectTimeout time.Duration
+	tlsConfig      *tls.Config
+
+	lock     sync.Mutex
+	addr     string
+	resolved time.Time
+}
+
+func (s *sentinelResolver) MasterAddr() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.addr != "" && time.Since(s.resolved) < sentinelCacheTime {
+		return s.addr, nil
+	}
+	var err error
+	for _, sentinel := range s.addrs {
+		var addr string
+		addr, err = s.query(sentinel)
+		if err != nil {
+			continue
+		}
+		s.addr, s.resolved = addr, time.Now()
+		return addr, nil
+	}
+	return "", fmt.Errorf("no sentinel available for master %s: %v", s.master, err)
+}
+
+func (s *sentinelResolver) query(sentinel string) (string, error) {
+	opts := []redisCon.DialOption{}
+	if s.connectTimeout != 0 {
+		opts = append(opts, redisCon.DialConnectTimeout(s.connectTimeout))
+		opts = append(opts, redisCon.DialReadTimeout(s.connectTimeout))
+	}
+	if s.tlsConfig != nil {
+		opts = append(opts, redisCon.DialUseTLS(true), redisCon.DialTLSConfig(s.tlsConfig))
+	}
+	conn, err := redisCon.Dial("tcp", sentinel, opts...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redisCon.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", errors.New("unexpected sentinel reply")
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// masterConn is a connection to the master at addr
+type masterConn struct {
+	redisCon.Conn
+	addr string
+}
+
+func (mc *masterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return redisCon.DoWithTimeout(mc.Conn, timeout, cmd, args...)
+}
+
+func (mc *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redisCon.ReceiveWithTimeout(mc.Conn, timeout)
+}
+
+// dialAddress returns address of redis server to connect to, resolving current
+// master if sentinels are configured
+func (redis *Redis) dialAddress() (string, error) {
+	if redis.master == nil {
+		return redis.redisAddress, nil
+	}
+	return redis.master.MasterAddr()
+}
+
+// testMaster rejects pooled connections to a former master after failover
+func (redis *Redis) testMaster(c redisCon.Conn, t time.Time) error {
+	mc, ok := c.(*masterConn)
+	if !ok {
+		return nil
+	}
+	addr, err := redis.master.MasterAddr()
+	if err != nil {
+		// keep using current connection if sentinels are unreachable
+		return nil
+	}
+	if addr != mc.addr {
+		return fmt.Errorf("redis master changed from %s to %s", mc.addr, addr)
+	}
+	return nil
+}
+
+const sentinelCacheTime = 1 * time.Second
@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"errors"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// IncrementSerial increments SOA serial of zone stored in redis and returns the
+// new serial. the apex is replaced by a single key script only if it is still
+// the value read so concurrent writers are retried instead of overwriting each
+// other, the script is routed by key slot with cluster
+func (redis *Redis) IncrementSerial(zone string) (uint32, error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	key := redis.keyPrefix + zone + redis.keySuffix
+	for i := 0; i < serialRetries; i++ {
+		val, err := redisCon.String(conn.Do("HGET", key, "@"))
+		if err != nil {
+			if err == redisCon.ErrNil {
+				return 0, errors.New("zone has no SOA record")
+			}
+			return 0, err
+		}
+		r, _, err := decodeRecord(val)
+		if err != nil {
+			return 0, err
+		}
+		if r.SOA.Ns == "" {
+			return 0, errors.New("zone has no SOA record")
+		}
+		serial := nextSerial(r.SOA.Serial, time.Now())
+		// edit the stored form so fields unknown to Record are kept
+		out, err := redis.editRecord(val, func(fields map[string]interface{}) {
+			soa, ok := fields["soa"].(map[string]interface{})
+			if !ok {
+				soa = make(map[string]interface{})
+			}
+			soa["serial"] = serial
+			fields["soa"] = soa
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		replaced, err := redisCon.Bool(conn.Do("EVAL", serialScript, 1, key, "@", val, out))
+		if err != nil {
+			return 0, err
+		}
+		if !replaced {
+			// zone modified since it was read, retry
+			continue
+		}
+		redis.invalidate(zone)
+		return serial, nil
+	}
+	return 0, errors.New("too many concurrent serial updates")
+}
+
+// serialScript sets hash field ARGV[1] to ARGV[3] if it still holds ARGV[2]
+const serialScript = `
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return 1
+`
+
+// nextSerial returns the serial following serial at time now. serials in
+// YYYYMMDDnn format move to sequence 00 of the current day when possible,
+// other serials are treated as unix timestamps. unset serial is served as
+// current time so it is continued as a timestamp
+func nextSerial(serial uint32, now time.Time) uint32 {
+	next := serial + 1
+	if isDateSerial(serial) {
+		y, m, d := now.UTC().Date()
+		today := uint32(y*10000+int(m)*100+d) * 100
+		if today > serial {
+			next = today
+		}
+		return next
+	}
+	if ts := uint32(now.Unix()); ts > serial {
+		next = ts
+	}
+	return next
+}
+
+// isDateSerial checks whether serial is a valid YYYYMMDDnn date serial
+func isDateSerial(serial uint32) bool {
+	date := serial / 100
+	y, m, d := int(date/10000), time.Month(date/100%100), int(date%100)
+	if y < 1990 || y > 2100 {
+		return false
+	}
+	t := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return t.Year() == y && t.Month() == m && t.Day() == d
+}
+
+const serialRetries = 10
@@ -1,11 +1,20 @@
 package redis
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/miekg/dns"
 )
 
 func init() {
@@ -21,8 +30,22 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("redis", err)
 	}
 
+	c.OnShutdown(r.OnShutdown)
+	c.OnStartup(func() error {
+		metrics.MustRegister(c, requestCount, requestDuration, zoneCount, zoneRefreshTimestamp, poolConnections,
+			cacheHits, cacheMisses, staleAnswers, serialMismatches, rateLimited)
+		return r.startAdmin()
+	})
+	// admin listener is closed before a reload so the new instance can bind it
+	c.OnRestart(r.stopAdmin)
+	c.OnFinalShutdown(r.stopAdmin)
+	c.OnRestartFailed(r.startAdmin)
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		r.Next = next
+		for _, v := range r.views {
+			v.redis.Next = next
+		}
 		return r
 	})
 
@@ -30,13 +53,27 @@ func setup(c *caddy.Controller) error {
 }
 
 func redisParse(c *caddy.Controller) (*Redis, error) {
-	redis := Redis {
-		keyPrefix:"",
-		keySuffix:"",
-		Ttl:300,
+	redis := Redis{
+		keyPrefix:       "",
+		keySuffix:       "",
+		Ttl:             300,
+		transferLength:  defaultTransferLength,
+		cnameDepth:      defaultCnameDepth,
+		poolMaxIdle:     defaultPoolMaxIdle,
+		poolIdleTimeout: defaultPoolIdleTimeout,
+		startupTimeout:  defaultStartupTimeout,
+		preloadWorkers:  defaultPreloadWorkers,
+		transferOff:     true,
 	}
 	var (
-		err            error
+		err        error
+		sentinel   *sentinelResolver
+		skipVerify bool
+		views      []viewConfig
+		rateLimit  float64
+		rateWindow = defaultRateLimitWindow
+		rateSlip   = defaultRateLimitSlip
+		rateExempt []*net.IPNet
 	)
 
 	for c.Next() {
@@ -48,11 +85,165 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 						return &Redis{}, c.ArgErr()
 					}
 					redis.redisAddress = c.Val()
+				case "username":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.redisUsername = c.Val()
 				case "password":
 					if !c.NextArg() {
 						return &Redis{}, c.ArgErr()
 					}
 					redis.redisPassword = c.Val()
+				case "db":
+					if redis.redisDb, err = nonNegativeArg(c); err != nil {
+						return &Redis{}, err
+					}
+				case "tls":
+					args := c.RemainingArgs()
+					if len(args) > 3 {
+						return &Redis{}, c.ArgErr()
+					}
+					tlsConfig, err := tls.NewTLSConfigFromArgs(args...)
+					if err != nil {
+						return &Redis{}, c.Errf("invalid tls configuration: %s", err)
+					}
+					redis.tlsConfig = tlsConfig
+				case "tls_insecure_skip_verify":
+					skipVerify = true
+				case "cookie":
+					args := c.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 || len(args) == 2 && args[1] != "require" {
+						return &Redis{}, c.ArgErr()
+					}
+					secret, err := hex.DecodeString(args[0])
+					if err != nil || len(secret) != 16 {
+						return &Redis{}, c.Errf("invalid cookie secret '%s'", args[0])
+					}
+					redis.cookieSecret = secret
+					redis.cookieRequire = len(args) == 2
+				case "nsid":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return &Redis{}, c.ArgErr()
+					}
+					if len(args) == 1 {
+						redis.nsid = args[0]
+					} else if redis.nsid, err = os.Hostname(); err != nil {
+						return &Redis{}, c.Errf("can not get hostname for nsid : %s", err)
+					}
+				case "chaos":
+					args := c.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.chaosVersion = args[0]
+					if len(args) == 2 {
+						redis.chaosId = args[1]
+					} else if redis.chaosId, err = os.Hostname(); err != nil {
+						return &Redis{}, c.Errf("can not get hostname for chaos : %s", err)
+					}
+				case "chaos_allow":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						_, ipNet, err := net.ParseCIDR(arg)
+						if err != nil {
+							return &Redis{}, c.Errf("invalid chaos_allow range '%s'", arg)
+						}
+						redis.chaosAllow = append(redis.chaosAllow, ipNet)
+					}
+				case "dns64":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return &Redis{}, c.ArgErr()
+					}
+					prefix := defaultDns64Prefix
+					if len(args) == 1 {
+						prefix = args[0]
+					}
+					_, n, err := net.ParseCIDR(prefix)
+					if err != nil || !validDns64Prefix(n) {
+						return &Redis{}, c.Errf("invalid dns64 prefix '%s'", prefix)
+					}
+					redis.dns64Prefix = n
+				case "dns64_exclude":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						_, n, err := net.ParseCIDR(arg)
+						if err != nil || len(n.Mask) != net.IPv6len {
+							return &Redis{}, c.Errf("invalid dns64_exclude range '%s'", arg)
+						}
+						redis.dns64Exclude = append(redis.dns64Exclude, n)
+					}
+				case "replica":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					addr := c.Val()
+					if _, _, err := net.SplitHostPort(addr); err != nil {
+						addr = net.JoinHostPort(addr, "6379")
+					}
+					redis.replicaAddress = addr
+				case "serial_check":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, addr := range args {
+						if _, _, err := net.SplitHostPort(addr); err != nil {
+							addr = net.JoinHostPort(addr, "6379")
+						}
+						redis.serialPeers = append(redis.serialPeers, addr)
+					}
+				case "serial_threshold":
+					threshold, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.peerThreshold = uint32(threshold)
+				case "cluster":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						if _, _, err := net.SplitHostPort(arg); err != nil {
+							arg = net.JoinHostPort(arg, "6379")
+						}
+						redis.clusterNodes = append(redis.clusterNodes, arg)
+					}
+				case "sentinel":
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					sentinel = &sentinelResolver{master: args[0]}
+					for _, arg := range args[1:] {
+						if _, _, err := net.SplitHostPort(arg); err != nil {
+							arg = net.JoinHostPort(arg, "26379")
+						}
+						sentinel.addrs = append(sentinel.addrs, arg)
+					}
+				case "query_log":
+					redis.queryLogRate = 1
+					if c.NextArg() {
+						rate, err := strconv.ParseFloat(c.Val(), 64)
+						if err != nil || rate <= 0 || rate > 1 {
+							return &Redis{}, c.Errf("invalid query_log rate '%s'", c.Val())
+						}
+						redis.queryLogRate = rate
+					}
+				case "canary":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.canaryZone = dns.Fqdn(strings.ToLower(c.Val()))
 				case "prefix":
 					if !c.NextArg() {
 						return &Redis{}, c.ArgErr()
@@ -77,7 +268,144 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 					}
 					redis.readTimeout, err = strconv.Atoi(c.Val())
 					if err != nil {
-						redis.readTimeout = 0;
+						redis.readTimeout = 0
+					}
+				case "pool_max_idle":
+					if redis.poolMaxIdle, err = nonNegativeArg(c); err != nil {
+						return &Redis{}, err
+					}
+				case "pool_max_active":
+					if redis.poolMaxActive, err = nonNegativeArg(c); err != nil {
+						return &Redis{}, err
+					}
+				case "pool_idle_timeout":
+					seconds, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.poolIdleTimeout = time.Duration(seconds) * time.Second
+				case "pool_max_lifetime":
+					seconds, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.poolLifetime = time.Duration(seconds) * time.Second
+				case "pool_wait":
+					redis.poolWait = true
+				case "startup_timeout":
+					seconds, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.startupTimeout = time.Duration(seconds) * time.Second
+				case "query_timeout":
+					if redis.queryTimeout, err = nonNegativeArg(c); err != nil {
+						return &Redis{}, err
+					}
+				case "minttl":
+					val, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.ttlMin = uint32(val)
+				case "maxttl":
+					val, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.ttlMax = uint32(val)
+				case "negative_ttl":
+					val, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.negativeTtl = uint32(val)
+				case "truncate_policy":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						switch arg {
+						case truncateAdditional, truncateAuthority, truncateTc:
+							redis.truncatePolicy = append(redis.truncatePolicy, arg)
+						default:
+							return &Redis{}, c.Errf("unknown truncate_policy '%s'", arg)
+						}
+					}
+				case "fallthrough":
+					redis.fallZones.SetZonesFromArgs(c.RemainingArgs())
+				case "default_soa":
+					args := c.RemainingArgs()
+					if len(args) != 2 && len(args) != 6 {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.defaultSoa.Ns, redis.defaultSoa.MBox = strings.ToLower(args[0]), strings.ToLower(args[1])
+					timers := []*uint32{&redis.defaultSoa.Refresh, &redis.defaultSoa.Retry, &redis.defaultSoa.Expire, &redis.defaultSoa.MinTtl}
+					for i, arg := range args[2:] {
+						val, err := strconv.ParseUint(arg, 10, 32)
+						if err != nil || i == 0 && val == 0 {
+							return &Redis{}, c.Errf("invalid default_soa '%s'", arg)
+						}
+						*timers[i] = uint32(val)
+					}
+				case "ttl_jitter":
+					percent, err := nonNegativeArg(c)
+					if err != nil {
+						return &Redis{}, err
+					}
+					if percent >= 100 {
+						return &Redis{}, c.Errf("invalid ttl_jitter '%s'", c.Val())
+					}
+					if redis.ttlJitter == nil {
+						redis.ttlJitter = make(map[string]int)
+					}
+					zones := c.RemainingArgs()
+					if len(zones) == 0 {
+						redis.ttlJitter[""] = percent
+					}
+					for _, zone := range zones {
+						redis.ttlJitter[dns.Fqdn(strings.ToLower(zone))] = percent
+					}
+				case "qtype_allow", "qtype_deny":
+					allow := c.Val() == "qtype_allow"
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					zone := dns.Fqdn(strings.ToLower(args[0]))
+					if redis.qtypeFilters == nil {
+						redis.qtypeFilters = make(map[string]qtypeFilter)
+					}
+					f, ok := redis.qtypeFilters[zone]
+					if !ok {
+						f = qtypeFilter{allow: allow, types: make(map[uint16]bool)}
+					} else if f.allow != allow {
+						return &Redis{}, c.Errf("qtype_allow and qtype_deny both set for zone '%s'", args[0])
+					}
+					for _, arg := range args[1:] {
+						qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+						if !ok {
+							return &Redis{}, c.Errf("unknown query type '%s'", arg)
+						}
+						f.types[qtype] = true
+					}
+					redis.qtypeFilters[zone] = f
+				case "nxdomain_redirect":
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					if redis.nxRedirect == nil {
+						redis.nxRedirect = make(map[string][]net.IP)
+					}
+					zone := dns.Fqdn(strings.ToLower(args[0]))
+					for _, arg := range args[1:] {
+						ip := net.ParseIP(arg)
+						if ip == nil {
+							return &Redis{}, c.Errf("invalid nxdomain_redirect address '%s'", arg)
+						}
+						redis.nxRedirect[zone] = append(redis.nxRedirect[zone], ip)
 					}
 				case "ttl":
 					if !c.NextArg() {
@@ -89,6 +417,261 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 						val = defaultTtl
 					}
 					redis.Ttl = uint32(val)
+				case "admin":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+						return &Redis{}, c.Errf("invalid admin address '%s'", c.Val())
+					}
+					redis.adminAddress = c.Val()
+				case "strict_records":
+					redis.strictRecords = true
+				case "record_format":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					codec, ok := recordCodecs[c.Val()]
+					if !ok {
+						return &Redis{}, c.Errf("invalid record_format '%s'", c.Val())
+					}
+					redis.codec = codec
+				case "minimal_any":
+					redis.minimalAny = true
+				case "minimal_responses":
+					redis.minimalExtras = true
+				case "authority_ns":
+					if redis.authorityZones == nil {
+						redis.authorityZones = make(map[string]bool)
+					}
+					zones := c.RemainingArgs()
+					if len(zones) == 0 {
+						redis.authorityZones[""] = true
+					}
+					for _, zone := range zones {
+						redis.authorityZones[dns.Fqdn(strings.ToLower(zone))] = true
+					}
+				case "transfer":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					switch c.Val() {
+					case "enable":
+						redis.transferOff = false
+					case "disable":
+						redis.transferOff = true
+					default:
+						return &Redis{}, c.Errf("invalid transfer '%s'", c.Val())
+					}
+				case "transfer_allow":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						_, ipNet, err := net.ParseCIDR(arg)
+						if err != nil {
+							return &Redis{}, c.Errf("invalid transfer_allow range '%s'", arg)
+						}
+						redis.transferAllow = append(redis.transferAllow, ipNet)
+					}
+				case "transfer_length":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.transferLength, err = strconv.Atoi(c.Val())
+					if err != nil || redis.transferLength < minTransferLength {
+						return &Redis{}, c.Errf("invalid transfer_length '%s', minimum is %d", c.Val(), minTransferLength)
+					}
+				case "cname_depth":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.cnameDepth, err = strconv.Atoi(c.Val())
+					if err != nil || redis.cnameDepth < 0 {
+						return &Redis{}, c.Errf("invalid cname_depth '%s'", c.Val())
+					}
+				case "apex_cname":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					switch c.Val() {
+					case "ignore":
+						redis.apexAlias = false
+					case "alias":
+						redis.apexAlias = true
+					default:
+						return &Redis{}, c.Errf("invalid apex_cname '%s'", c.Val())
+					}
+				case "resolve_cname":
+					redis.cnameTimeout = aliasTimeout
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return &Redis{}, c.ArgErr()
+					}
+					if len(args) == 1 {
+						timeout, err := strconv.Atoi(args[0])
+						if err != nil || timeout <= 0 {
+							return &Redis{}, c.Errf("invalid resolve_cname timeout '%s'", args[0])
+						}
+						redis.cnameTimeout = time.Duration(timeout) * time.Millisecond
+					}
+				case "notify":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						if _, _, err := net.SplitHostPort(arg); err != nil {
+							arg = net.JoinHostPort(arg, "53")
+						}
+						redis.notify = append(redis.notify, arg)
+					}
+				case "cache":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					ttl, err := strconv.Atoi(c.Val())
+					if err != nil || ttl <= 0 {
+						return &Redis{}, c.Errf("invalid cache ttl '%s'", c.Val())
+					}
+					redis.cache = newRecordCache(time.Duration(ttl) * time.Second)
+				case "serve_stale":
+					redis.serveStale = defaultServeStale * time.Second
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return &Redis{}, c.ArgErr()
+					}
+					if len(args) == 1 {
+						age, err := strconv.Atoi(args[0])
+						if err != nil || age <= 0 {
+							return &Redis{}, c.Errf("invalid serve_stale '%s'", args[0])
+						}
+						redis.serveStale = time.Duration(age) * time.Second
+					}
+				case "preload":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						redis.preloadAll = true
+					}
+					for _, arg := range args {
+						redis.preloadZones = append(redis.preloadZones, dns.Fqdn(strings.ToLower(arg)))
+					}
+				case "preload_concurrency":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.preloadWorkers, err = strconv.Atoi(c.Val())
+					if err != nil || redis.preloadWorkers <= 0 {
+						return &Redis{}, c.Errf("invalid preload_concurrency '%s'", c.Val())
+					}
+				case "keyspace_notifications":
+					redis.keyspaceEvents = true
+				case "address_policy":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					switch c.Val() {
+					case policyAll, policyWeighted, policyRandomOne, policyRoundRobin, policyShuffle:
+						redis.addressPolicy = c.Val()
+					default:
+						return &Redis{}, c.Errf("unknown address_policy '%s'", c.Val())
+					}
+				case "resolver":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						if _, _, err := net.SplitHostPort(arg); err != nil {
+							arg = net.JoinHostPort(arg, "53")
+						}
+						redis.resolvers = append(redis.resolvers, arg)
+					}
+				case "tsig_key":
+					args := c.RemainingArgs()
+					if len(args) < 2 || len(args) > 3 {
+						return &Redis{}, c.ArgErr()
+					}
+					if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+						return &Redis{}, c.Errf("invalid tsig secret for key '%s'", args[0])
+					}
+					redis.tsigName = dns.Fqdn(strings.ToLower(args[0]))
+					redis.tsigSecret = args[1]
+					redis.tsigAlgorithm = dns.HmacSHA256
+					if len(args) == 3 {
+						redis.tsigAlgorithm = dns.Fqdn(strings.ToLower(args[2]))
+					}
+				case "view":
+					args := c.RemainingArgs()
+					if len(args) < 3 {
+						return &Redis{}, c.ArgErr()
+					}
+					v := viewConfig{name: args[0], prefix: args[1]}
+					for _, arg := range args[2:] {
+						_, n, err := net.ParseCIDR(arg)
+						if err != nil {
+							return &Redis{}, c.Errf("invalid view range '%s'", arg)
+						}
+						v.nets = append(v.nets, n)
+					}
+					views = append(views, v)
+				case "ratelimit":
+					args := c.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					rateLimit, err = strconv.ParseFloat(args[0], 64)
+					if err != nil || rateLimit <= 0 {
+						return &Redis{}, c.Errf("invalid ratelimit rate '%s'", args[0])
+					}
+					if len(args) == 2 {
+						rateWindow, err = strconv.Atoi(args[1])
+						if err != nil || rateWindow <= 0 {
+							return &Redis{}, c.Errf("invalid ratelimit window '%s'", args[1])
+						}
+					}
+				case "ratelimit_slip":
+					if rateSlip, err = nonNegativeArg(c); err != nil {
+						return &Redis{}, err
+					}
+				case "ratelimit_exempt":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						_, n, err := net.ParseCIDR(arg)
+						if err != nil {
+							return &Redis{}, c.Errf("invalid ratelimit_exempt range '%s'", arg)
+						}
+						rateExempt = append(rateExempt, n)
+					}
+				case "update":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						redis.updateZones = append(redis.updateZones, dns.Fqdn(strings.ToLower(arg)))
+					}
+				case "reverse_zones":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+					for _, arg := range args {
+						zone := dns.Fqdn(strings.ToLower(arg))
+						if !dns.IsSubDomain("in-addr.arpa.", zone) && !dns.IsSubDomain("ip6.arpa.", zone) {
+							return &Redis{}, c.Errf("invalid reverse zone '%s'", arg)
+						}
+						redis.reverseZones = append(redis.reverseZones, zone)
+					}
+				case "dnssec":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.dnssecKey = c.Val()
 				default:
 					if c.Val() != "}" {
 						return &Redis{}, c.Errf("unknown property '%s'", c.Val())
@@ -102,10 +685,82 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 
 		}
 
+		if redis.ttlMax != 0 && redis.ttlMin > redis.ttlMax {
+			return &Redis{}, c.Errf("minttl is greater than maxttl")
+		}
+		if len(redis.updateZones) > 0 && redis.tsigSecret == "" {
+			return &Redis{}, c.Errf("update requires tsig_key")
+		}
+		if redis.serveStale != 0 && redis.cache == nil {
+			return &Redis{}, c.Errf("serve_stale requires cache")
+		}
+		if redis.preloading() && redis.cache == nil {
+			return &Redis{}, c.Errf("preload requires cache")
+		}
+		if redis.apexAlias && len(redis.resolvers) == 0 {
+			return &Redis{}, c.Errf("apex_cname alias requires resolver")
+		}
+		if redis.chaosVersion != "" && len(redis.chaosAllow) == 0 {
+			return &Redis{}, c.Errf("chaos requires chaos_allow")
+		}
+		if skipVerify {
+			if redis.tlsConfig == nil {
+				return &Redis{}, c.Errf("tls_insecure_skip_verify requires tls")
+			}
+			redis.tlsConfig.InsecureSkipVerify = true
+		}
+		if redis.dns64Prefix != nil && redis.dns64Exclude == nil {
+			_, exclude, _ := net.ParseCIDR(defaultDns64Exclude)
+			redis.dns64Exclude = []*net.IPNet{exclude}
+		}
+		if redis.replicaAddress != "" && len(redis.clusterNodes) > 0 {
+			return &Redis{}, c.Errf("replica can not be used with cluster")
+		}
+		if len(redis.serialPeers) > 0 && len(redis.clusterNodes) > 0 {
+			return &Redis{}, c.Errf("serial_check can not be used with cluster")
+		}
+		if redis.peerThreshold > 0 && len(redis.serialPeers) == 0 {
+			return &Redis{}, c.Errf("serial_threshold requires serial_check")
+		}
+		if redis.redisDb != 0 && len(redis.clusterNodes) > 0 {
+			return &Redis{}, c.Errf("db can not be used with cluster")
+		}
+		if rateLimit > 0 {
+			redis.rateLimiter = newRateLimiter(rateLimit, rateWindow, rateSlip, rateExempt)
+		}
+		if sentinel != nil {
+			sentinel.connectTimeout = time.Duration(redis.connectTimeout) * time.Millisecond
+			sentinel.tlsConfig = redis.tlsConfig
+			redis.master = sentinel
+		}
 		redis.Connect()
-		redis.LoadZones()
+		redis.startZoneNameCache()
+		for _, v := range views {
+			view := &view{name: v.name, nets: v.nets, redis: redis.newView(v.prefix)}
+			view.redis.startZoneNameCache()
+			redis.views = append(redis.views, view)
+		}
 
 		return &redis, nil
 	}
 	return &Redis{}, nil
 }
+
+// nonNegativeArg parses next argument as a non-negative integer
+func nonNegativeArg(c *caddy.Controller) (int, error) {
+	name := c.Val()
+	if !c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	n, err := strconv.Atoi(c.Val())
+	if err != nil || n < 0 {
+		return 0, c.Errf("invalid %s '%s'", name, c.Val())
+	}
+	return n, nil
+}
+
+type viewConfig struct {
+	name   string
+	prefix string
+	nets   []*net.IPNet
+}
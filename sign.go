@@ -0,0 +1,238 @@
+package redis
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+	"github.com/miekg/dns"
+)
+
+const (
+	signatureValidity   = 7 * 24 * time.Hour
+	signatureRefresh    = 2 * 24 * time.Hour
+	signatureInception  = 3 * time.Hour
+	signatureCacheLimit = 10000
+)
+
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+type zoneKeys struct {
+	ksk    *signingKey
+	zsk    *signingKey
+	loaded time.Time
+}
+
+type signingKey_Record struct {
+	Public  string `json:"public,omitempty"`
+	Private string `json:"private,omitempty"`
+}
+
+type zoneKeys_Record struct {
+	KSK signingKey_Record `json:"ksk,omitempty"`
+	ZSK signingKey_Record `json:"zsk,omitempty"`
+}
+
+// zoneKeys returns signing keys of a zone, or nil if zone is not signed online.
+// keys are cached and reloaded from redis every zoneUpdateTime
+func (redis *Redis) zoneKeys(zone string) *zoneKeys {
+	if redis.dnssecKey == "" {
+		return nil
+	}
+	redis.keysLock.Lock()
+	defer redis.keysLock.Unlock()
+
+	if redis.keys == nil {
+		redis.keys = make(map[string]*zoneKeys)
+	}
+	keys, ok := redis.keys[zone]
+	if !ok || time.Since(keys.loaded) > zoneUpdateTime {
+		keys = redis.loadKeys(zone)
+		redis.keys[zone] = keys
+	}
+	if keys.ksk == nil || keys.zsk == nil {
+		return nil
+	}
+	return keys
+}
+
+func (redis *Redis) loadKeys(zone string) *zoneKeys {
+	keys := &zoneKeys{loaded: time.Now()}
+
+	conn := redis.Pool.Get()
+	if conn == nil {
+		fmt.Println("error connecting to redis")
+		return keys
+	}
+	defer conn.Close()
+
+	val, err := redisCon.String(conn.Do("HGET", redis.dnssecKey, zone))
+	if err != nil {
+		return keys
+	}
+	r := new(zoneKeys_Record)
+	if err = json.Unmarshal([]byte(val), r); err != nil {
+		fmt.Println("parse error : ", val, err)
+		return keys
+	}
+	ksk, err := parseKey(zone, r.KSK)
+	if err != nil {
+		fmt.Println("invalid ksk : ", zone, err)
+		return keys
+	}
+	zsk, err := parseKey(zone, r.ZSK)
+	if err != nil {
+		fmt.Println("invalid zsk : ", zone, err)
+		return keys
+	}
+	keys.ksk, keys.zsk = ksk, zsk
+	return keys
+}
+
+func parseKey(zone string, r signingKey_Record) (*signingKey, error) {
+	rr, err := dns.NewRR(r.Public)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("not a DNSKEY record: %s", r.Public)
+	}
+	dnskey.Hdr.Name = dns.Fqdn(zone)
+	private, err := dnskey.NewPrivateKey(r.Private)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key")
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// DS returns delegation signer of zone's key signing key at zone apex
+func (redis *Redis) DS(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	keys := redis.zoneKeys(z.Name)
+	if keys == nil || dns.Fqdn(name) != dns.Fqdn(z.Name) {
+		return
+	}
+	ds := keys.ksk.dnskey.ToDS(dns.SHA256)
+	if ds == nil {
+		return
+	}
+	ds.Hdr.Ttl = redis.recordTtl(z, keys.ksk.dnskey.Hdr.Ttl)
+	answers = append(answers, ds)
+	return
+}
+
+// signingKeys returns DNSKEY records of online signing keys at zone apex
+func (redis *Redis) signingKeys(name string, z *Zone) (answers []dns.RR) {
+	keys := redis.zoneKeys(z.Name)
+	if keys == nil || dns.Fqdn(name) != dns.Fqdn(z.Name) {
+		return
+	}
+	for _, key := range []*signingKey{keys.ksk, keys.zsk} {
+		r := dns.Copy(key.dnskey).(*dns.DNSKEY)
+		r.Hdr.Ttl = redis.recordTtl(z, key.dnskey.Hdr.Ttl)
+		answers = append(answers, r)
+	}
+	return
+}
+
+// sign appends a signature for every rrset in rrs, DNSKEY rrset is signed with
+// key signing key and everything else with zone signing key
+func (redis *Redis) sign(keys *zoneKeys, rrs []dns.RR) []dns.RR {
+	var (
+		order []string
+		sets  = make(map[string][]dns.RR)
+	)
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == dns.TypeRRSIG || t == dns.TypeOPT {
+			continue
+		}
+		k := strings.ToLower(rr.Header().Name) + "/" + strconv.Itoa(int(t))
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	for _, k := range order {
+		key := keys.zsk
+		if sets[k][0].Header().Rrtype == dns.TypeDNSKEY {
+			key = keys.ksk
+		}
+		if sig := redis.signature(key, sets[k]); sig != nil {
+			rrs = append(rrs, sig)
+		}
+	}
+	return rrs
+}
+
+// signature returns a cached signature for rrset, signatures are regenerated
+// when they are about to expire
+func (redis *Redis) signature(key *signingKey, rrset []dns.RR) dns.RR {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(key.dnskey.KeyTag())))
+	for _, rr := range rrset {
+		b.WriteString("\n")
+		b.WriteString(rr.String())
+	}
+	k := b.String()
+	now := time.Now()
+
+	redis.signatureLock.Lock()
+	defer redis.signatureLock.Unlock()
+
+	if sig, ok := redis.signatureCache[k]; ok {
+		if time.Unix(int64(sig.Expiration), 0).Sub(now) > signatureRefresh {
+			return dns.Copy(sig)
+		}
+	}
+
+	sig := new(dns.RRSIG)
+	sig.Hdr = dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG,
+		Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl}
+	sig.Algorithm = key.dnskey.Algorithm
+	sig.KeyTag = key.dnskey.KeyTag()
+	sig.SignerName = key.dnskey.Hdr.Name
+	sig.Inception = uint32(now.Add(-signatureInception).Unix())
+	sig.Expiration = uint32(now.Add(signatureValidity).Unix())
+	if err := sig.Sign(key.signer, rrset); err != nil {
+		fmt.Println("signing error : ", rrset[0].Header().Name, err)
+		return nil
+	}
+
+	if redis.signatureCache == nil || len(redis.signatureCache) >= signatureCacheLimit {
+		redis.signatureCache = make(map[string]*dns.RRSIG)
+	}
+	redis.signatureCache[k] = sig
+	return dns.Copy(sig)
+}
+
+// nsecLie returns a minimal NSEC record denying every type not in existing,
+// as described in rfc4470. for non-existent names it is used to answer NODATA
+// instead of NXDOMAIN
+func (redis *Redis) nsecLie(name string, z *Zone, existing []dns.RR) []dns.RR {
+	types := []string{"NSEC", "RRSIG"}
+	seen := make(map[uint16]bool)
+	for _, rr := range existing {
+		if t := rr.Header().Rrtype; !seen[t] {
+			seen[t] = true
+			types = append(types, dns.TypeToString[t])
+		}
+	}
+	r := new(dns.NSEC)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNSEC,
+		Class: dns.ClassINET, Ttl: redis.recordTtl(z, 0)}
+	r.NextDomain = "\\000." + dns.Fqdn(name)
+	r.TypeBitMap = typeBitMap(types)
+	return []dns.RR{r}
+}
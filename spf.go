@@ -0,0 +1,219 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// spfKey identifies a flattened spf record by owner name and stored text
+type spfKey struct {
+	name string
+	text string
+}
+
+// flattenedSpf returns flattened text of the spf record of name in z. records
+// stored at a location of z are flattened once and kept per zone, they are
+// flattened again when zones are reloaded and dropped when zone is modified
+func (redis *Redis) flattenedSpf(name string, text string, z *Zone) string {
+	if z == nil {
+		return text
+	}
+	label := "@"
+	if name != z.Name {
+		label = strings.TrimSuffix(name, "."+z.Name)
+	}
+	if _, ok := z.Locations[label]; !ok {
+		// names synthesized from wildcards are not kept
+		return redis.flattenSpf(name, text, z)
+	}
+	key := spfKey{name: name, text: text}
+	redis.spfLock.Lock()
+	flat, ok := redis.spfCache[z.Name][key]
+	redis.spfLock.Unlock()
+	if ok {
+		return flat
+	}
+	flat = redis.flattenSpf(name, text, z)
+	redis.spfLock.Lock()
+	if redis.spfCache == nil {
+		redis.spfCache = make(map[string]map[spfKey]string)
+	}
+	if redis.spfCache[z.Name] == nil {
+		redis.spfCache[z.Name] = make(map[spfKey]string)
+	}
+	redis.spfCache[z.Name][key] = flat
+	redis.spfLock.Unlock()
+	return flat
+}
+
+// refreshSpf flattens kept spf records of zones again so changes of addresses
+// and included records are picked up, records of removed zones are dropped
+func (redis *Redis) refreshSpf(zones []string) {
+	kept := make(map[string][]spfKey)
+	redis.spfLock.Lock()
+	for zone, records := range redis.spfCache {
+		for key := range records {
+			kept[zone] = append(kept[zone], key)
+		}
+	}
+	redis.spfLock.Unlock()
+	if len(kept) == 0 {
+		return
+	}
+
+	loaded := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		loaded[zone] = true
+	}
+	spfCache := make(map[string]map[spfKey]string)
+	for zone, keys := range kept {
+		if !loaded[zone] {
+			continue
+		}
+		z := redis.load(zone)
+		if z == nil {
+			continue
+		}
+		spfCache[zone] = make(map[spfKey]string, len(keys))
+		for _, key := range keys {
+			spfCache[zone][key] = redis.flattenSpf(key.name, key.text, z)
+		}
+	}
+	redis.spfLock.Lock()
+	redis.spfCache = spfCache
+	redis.spfLock.Unlock()
+}
+
+// flattenSpf replaces a and include mechanisms of spf record text pointing at
+// names in z with ip4 and ip6 mechanisms of their addresses, so clients need
+// fewer lookups to evaluate the record. mechanisms that can not be resolved in
+// zone are kept as they are
+func (redis *Redis) flattenSpf(name string, text string, z *Zone) string {
+	fields := strings.Fields(text)
+	if z == nil || len(fields) == 0 || strings.ToLower(fields[0]) != "v=spf1" {
+		return text
+	}
+	terms := []string{fields[0]}
+	seen := make(map[string]bool)
+	for _, field := range fields[1:] {
+		for _, term := range redis.flattenTerm(name, field, z, spfFlattenDepth) {
+			if !seen[strings.ToLower(term)] {
+				seen[strings.ToLower(term)] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// flattenTerm returns mechanisms replacing term of the spf record of name, term
+// itself is returned if it can not be flattened
+func (redis *Redis) flattenTerm(name string, term string, z *Zone, depth int) []string {
+	qualifier, mechanism := "", term
+	if strings.ContainsAny(term[:1], "+-~?") {
+		qualifier, mechanism = term[:1], term[1:]
+	}
+	kind, domain := strings.ToLower(mechanism), name
+	if i := strings.IndexByte(mechanism, ':'); i >= 0 {
+		kind, domain = strings.ToLower(mechanism[:i]), mechanism[i+1:]
+	}
+	if strings.ContainsAny(domain, "%/") {
+		// macros and cidr lengths are not expanded
+		return []string{term}
+	}
+	switch kind {
+	case "a":
+		if ips := redis.spfAddresses(domain, z); len(ips) > 0 {
+			var terms []string
+			for _, ip := range ips {
+				terms = append(terms, qualifier+ip)
+			}
+			return terms
+		}
+	case "include":
+		if (qualifier == "" || qualifier == "+") && depth > 0 {
+			if terms, ok := redis.spfInclude(domain, z, depth); ok {
+				return terms
+			}
+		}
+	}
+	return []string{term}
+}
+
+// spfAddresses returns ip4 and ip6 mechanisms for addresses of domain in z
+func (redis *Redis) spfAddresses(domain string, z *Zone) []string {
+	record := redis.spfRecord(domain, z)
+	if record == nil {
+		return nil
+	}
+	var ips []string
+	for _, a := range record.A {
+		if a.Ip != nil {
+			ips = append(ips, "ip4:"+a.Ip.String())
+		}
+	}
+	for _, aaaa := range record.AAAA {
+		if aaaa.Ip != nil {
+			ips = append(ips, "ip6:"+aaaa.Ip.String())
+		}
+	}
+	return ips
+}
+
+// spfInclude returns mechanisms of the spf record of domain in z to be used in
+// place of an include. an include only matches if the included record passes,
+// so only records made of passing ip4, ip6 and include mechanisms followed by a
+// non-passing all can be inlined
+func (redis *Redis) spfInclude(domain string, z *Zone, depth int) ([]string, bool) {
+	record := redis.spfRecord(domain, z)
+	if record == nil {
+		return nil, false
+	}
+	var spf []string
+	for _, txt := range record.TXT {
+		if fields := strings.Fields(txt.Text); len(fields) > 0 && strings.ToLower(fields[0]) == "v=spf1" {
+			if spf != nil {
+				return nil, false
+			}
+			spf = fields[1:]
+		}
+	}
+	if spf == nil {
+		return nil, false
+	}
+
+	var terms []string
+	for _, term := range spf {
+		lower := strings.ToLower(term)
+		if strings.ContainsAny(lower[:1], "-~?") {
+			if lower[1:] == "all" {
+				continue
+			}
+			return nil, false
+		}
+		for _, t := range redis.flattenTerm(domain, term, z, depth-1) {
+			m := strings.TrimPrefix(strings.ToLower(t), "+")
+			if !strings.HasPrefix(m, "ip4:") && !strings.HasPrefix(m, "ip6:") && !strings.HasPrefix(m, "include:") {
+				return nil, false
+			}
+			terms = append(terms, t)
+		}
+	}
+	return terms, true
+}
+
+func (redis *Redis) spfRecord(domain string, z *Zone) *Record {
+	domain = dns.Fqdn(strings.ToLower(domain))
+	if !dns.IsSubDomain(z.Name, domain) {
+		return nil
+	}
+	location := redis.findLocation(domain, z)
+	if location == "" {
+		return nil
+	}
+	return redis.get(location, z)
+}
+
+// spfFlattenDepth is the maximum depth of nested includes flattened
+const spfFlattenDepth = 3
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// staleZone returns zone from record cache after loading it failed,
+// expired zones are returned within serve_stale
+func (redis *Redis) staleZone(zone string) (*Zone, bool) {
+	if redis.serveStale == 0 || redis.cache == nil {
+		return nil, false
+	}
+	z, ok := redis.cache.stale(zone, redis.serveStale)
+	if !ok {
+		return nil, false
+	}
+	return z.(*Zone), true
+}
+
+// staleRecord returns record of location from record cache after reading it
+// failed with err, invalid records are never served stale
+func (redis *Redis) staleRecord(z *Zone, location string, err error) (*Record, bool) {
+	if redis.serveStale == 0 || redis.cache == nil {
+		return nil, false
+	}
+	if _, ok := err.(invalidRecordError); ok {
+		return nil, false
+	}
+	label := location
+	if location == z.Name {
+		label = "@"
+	}
+	r, ok := redis.cache.stale(z.Name+"/"+label, redis.serveStale)
+	if !ok {
+		return nil, false
+	}
+	return r.(*Record), true
+}
+
+// staleState returns a copy of state writing stale responses
+func staleState(state request.Request) request.Request {
+	staleAnswers.Inc()
+	state.W = &staleWriter{state.W}
+	return state
+}
+
+// staleWriter lowers ttl of records to staleTtl and marks responses with a
+// Stale Answer extended error as described in rfc8767
+type staleWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *staleWriter) WriteMsg(m *dns.Msg) error {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Ttl <= staleTtl {
+				continue
+			}
+			// records may be shared with signature cache, modify a copy
+			section[i] = dns.Copy(rr)
+			section[i].Header().Ttl = staleTtl
+		}
+	}
+	appendOption(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+const (
+	staleTtl          = 30
+	defaultServeStale = 86400
+)
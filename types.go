@@ -1,37 +1,164 @@
 package redis
 
-import "net"
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
 
 type Zone struct {
 	Name      string
 	Locations map[string]struct{}
+
+	// names holds locations with labels reversed in sorted order
+	namesOnce sync.Once
+	names     []string
 }
 
 type Record struct {
-	A     []A_Record `json:"a,omitempty"`
-	AAAA  []AAAA_Record `json:"aaaa,omitempty"`
-	TXT   []TXT_Record `json:"txt,omitempty"`
-	CNAME []CNAME_Record `json:"cname,omitempty"`
-	NS    []NS_Record `json:"ns,omitempty"`
-	MX    []MX_Record `json:"mx,omitempty"`
-	SRV   []SRV_Record `json:"srv,omitempty"`
-	CAA   []CAA_Record `json:"caa,omitempty"`
-	SOA   SOA_Record `json:"soa,omitempty"`
+	// Ttl is default ttl of records in zone, only used with the apex record
+	Ttl        uint32              `json:"ttl,omitempty"`
+	A          []A_Record          `json:"a,omitempty"`
+	AAAA       []AAAA_Record       `json:"aaaa,omitempty"`
+	TXT        []TXT_Record        `json:"txt,omitempty"`
+	CNAME      []CNAME_Record      `json:"cname,omitempty"`
+	NS         []NS_Record         `json:"ns,omitempty"`
+	MX         []MX_Record         `json:"mx,omitempty"`
+	SRV        []SRV_Record        `json:"srv,omitempty"`
+	CAA        []CAA_Record        `json:"caa,omitempty"`
+	SOA        SOA_Record          `json:"soa,omitempty"`
+	TLSA       []TLSA_Record       `json:"tlsa,omitempty"`
+	SSHFP      []SSHFP_Record      `json:"sshfp,omitempty"`
+	SMIMEA     []TLSA_Record       `json:"smimea,omitempty"`
+	OPENPGPKEY []OPENPGPKEY_Record `json:"openpgpkey,omitempty"`
+	NAPTR      []NAPTR_Record      `json:"naptr,omitempty"`
+	URI        []URI_Record        `json:"uri,omitempty"`
+	HINFO      []HINFO_Record      `json:"hinfo,omitempty"`
+	RP         []RP_Record         `json:"rp,omitempty"`
+	AFSDB      []AFSDB_Record      `json:"afsdb,omitempty"`
+	PTR        []PTR_Record        `json:"ptr,omitempty"`
+	APL        []APL_Record        `json:"apl,omitempty"`
+	CERT       []CERT_Record       `json:"cert,omitempty"`
+	DNAME      DNAME_Record        `json:"dname,omitempty"`
+	LOC        []LOC_Record        `json:"loc,omitempty"`
+	SVCB       []SVCB_Record       `json:"svcb,omitempty"`
+	HTTPS      []SVCB_Record       `json:"https,omitempty"`
+	RRSIG      []RRSIG_Record      `json:"rrsig,omitempty"`
+	DNSKEY     []DNSKEY_Record     `json:"dnskey,omitempty"`
+	CDS        []CDS_Record        `json:"cds,omitempty"`
+	CDNSKEY    []DNSKEY_Record     `json:"cdnskey,omitempty"`
+	NSEC       NSEC_Record         `json:"nsec,omitempty"`
+	NSEC3      NSEC3_Record        `json:"nsec3,omitempty"`
+	NSEC3PARAM NSEC3PARAM_Record   `json:"nsec3param,omitempty"`
+	ALIAS      ALIAS_Record        `json:"alias,omitempty"`
+	ZONEMD     []ZONEMD_Record     `json:"zonemd,omitempty"`
+	Generic    []GENERIC_Record    `json:"generic,omitempty"`
 }
 
 type A_Record struct {
-	Ttl uint32 `json:"ttl,omitempty"`
-	Ip  net.IP `json:"ip"`
+	Ttl    uint32 `json:"ttl,omitempty"`
+	Ip     net.IP `json:"ip"`
+	Weight uint32 `json:"weight,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
 }
 
 type AAAA_Record struct {
-	Ttl uint32 `json:"ttl,omitempty"`
-	Ip  net.IP `json:"ip"`
+	Ttl    uint32 `json:"ttl,omitempty"`
+	Ip     net.IP `json:"ip"`
+	Weight uint32 `json:"weight,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
 }
 
 type TXT_Record struct {
 	Ttl  uint32 `json:"ttl,omitempty"`
 	Text string `json:"text"`
+	// Strings keeps character-strings of a text stored as an array, Text is
+	// their concatenation
+	Strings []string `json:"-"`
+	// Flatten resolves in-zone a and include mechanisms of an spf text
+	Flatten bool `json:"flatten,omitempty"`
+}
+
+// UnmarshalJSON accepts text as a single string or an array of strings
+func (t *TXT_Record) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Ttl     uint32          `json:"ttl,omitempty"`
+		Text    json.RawMessage `json:"text"`
+		Flatten bool            `json:"flatten,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	t.Ttl, t.Text, t.Strings, t.Flatten = raw.Ttl, "", nil, raw.Flatten
+	if len(raw.Text) > 0 && raw.Text[0] == '[' {
+		if err := json.Unmarshal(raw.Text, &t.Strings); err != nil {
+			return err
+		}
+		t.Text = strings.Join(t.Strings, "")
+		return nil
+	}
+	if len(raw.Text) > 0 && string(raw.Text) != "null" {
+		return json.Unmarshal(raw.Text, &t.Text)
+	}
+	return nil
+}
+
+func (t TXT_Record) MarshalJSON() ([]byte, error) {
+	var text interface{} = t.Text
+	if len(t.Strings) > 0 {
+		text = t.Strings
+	}
+	return json.Marshal(struct {
+		Ttl     uint32      `json:"ttl,omitempty"`
+		Text    interface{} `json:"text"`
+		Flatten bool        `json:"flatten,omitempty"`
+	}{t.Ttl, text, t.Flatten})
+}
+
+// DecodeMsgpack accepts text as a single string or an array of strings
+func (t *TXT_Record) DecodeMsgpack(d *msgpack.Decoder) error {
+	var raw struct {
+		Ttl     uint32      `json:"ttl,omitempty"`
+		Text    interface{} `json:"text"`
+		Flatten bool        `json:"flatten,omitempty"`
+	}
+	if err := d.Decode(&raw); err != nil {
+		return err
+	}
+	t.Ttl, t.Text, t.Strings, t.Flatten = raw.Ttl, "", nil, raw.Flatten
+	switch text := raw.Text.(type) {
+	case nil:
+	case string:
+		t.Text = text
+	case []interface{}:
+		for _, s := range text {
+			s, ok := s.(string)
+			if !ok {
+				return errors.New("txt text is not a string")
+			}
+			t.Strings = append(t.Strings, s)
+		}
+		t.Text = strings.Join(t.Strings, "")
+	default:
+		return errors.New("txt text is not a string")
+	}
+	return nil
+}
+
+func (t TXT_Record) EncodeMsgpack(e *msgpack.Encoder) error {
+	var text interface{} = t.Text
+	if len(t.Strings) > 0 {
+		text = t.Strings
+	}
+	return e.Encode(struct {
+		Ttl     uint32      `json:"ttl,omitempty"`
+		Text    interface{} `json:"text"`
+		Flatten bool        `json:"flatten,omitempty"`
+	}{t.Ttl, text, t.Flatten})
 }
 
 type CNAME_Record struct {
@@ -60,6 +187,7 @@ type SRV_Record struct {
 
 type SOA_Record struct {
 	Ttl     uint32 `json:"ttl,omitempty"`
+	Serial  uint32 `json:"serial,omitempty"`
 	Ns      string `json:"ns"`
 	MBox    string `json:"MBox"`
 	Refresh uint32 `json:"refresh"`
@@ -69,7 +197,173 @@ type SOA_Record struct {
 }
 
 type CAA_Record struct {
-	Flag  uint8 `json:"flag"`
+	Ttl   uint32 `json:"ttl,omitempty"`
+	Flag  uint8  `json:"flag"`
 	Tag   string `json:"tag"`
 	Value string `json:"value"`
-}
\ No newline at end of file
+}
+
+type TLSA_Record struct {
+	Ttl          uint32 `json:"ttl,omitempty"`
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+type OPENPGPKEY_Record struct {
+	Ttl       uint32 `json:"ttl,omitempty"`
+	PublicKey string `json:"public_key"`
+}
+
+type SSHFP_Record struct {
+	Ttl         uint32 `json:"ttl,omitempty"`
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type NAPTR_Record struct {
+	Ttl         uint32 `json:"ttl,omitempty"`
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags"`
+	Service     string `json:"service"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+}
+
+type URI_Record struct {
+	Ttl      uint32 `json:"ttl,omitempty"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target"`
+}
+
+type HINFO_Record struct {
+	Ttl uint32 `json:"ttl,omitempty"`
+	Cpu string `json:"cpu"`
+	Os  string `json:"os"`
+}
+
+type RP_Record struct {
+	Ttl  uint32 `json:"ttl,omitempty"`
+	Mbox string `json:"mbox"`
+	Txt  string `json:"txt"`
+}
+
+type AFSDB_Record struct {
+	Ttl      uint32 `json:"ttl,omitempty"`
+	Subtype  uint16 `json:"subtype"`
+	Hostname string `json:"hostname"`
+}
+
+type PTR_Record struct {
+	Ttl  uint32 `json:"ttl,omitempty"`
+	Host string `json:"host"`
+}
+
+type APL_Record struct {
+	Ttl      uint32   `json:"ttl,omitempty"`
+	Prefixes []string `json:"prefixes"`
+}
+
+type CERT_Record struct {
+	Ttl         uint32 `json:"ttl,omitempty"`
+	Type        uint16 `json:"type"`
+	KeyTag      uint16 `json:"key_tag"`
+	Algorithm   uint8  `json:"algorithm"`
+	Certificate string `json:"certificate"`
+}
+
+type DNAME_Record struct {
+	Ttl    uint32 `json:"ttl,omitempty"`
+	Target string `json:"target"`
+}
+
+type ALIAS_Record struct {
+	Ttl    uint32 `json:"ttl,omitempty"`
+	Target string `json:"target"`
+}
+
+type LOC_Record struct {
+	Ttl      uint32 `json:"ttl,omitempty"`
+	Location string `json:"location"`
+}
+
+type SVCB_Record struct {
+	Ttl      uint32   `json:"ttl,omitempty"`
+	Priority uint16   `json:"priority"`
+	Target   string   `json:"target"`
+	Alpn     []string `json:"alpn,omitempty"`
+	Port     uint16   `json:"port,omitempty"`
+	Ipv4Hint []net.IP `json:"ipv4hint,omitempty"`
+	Ech      string   `json:"ech,omitempty"`
+	Ipv6Hint []net.IP `json:"ipv6hint,omitempty"`
+}
+
+type RRSIG_Record struct {
+	Ttl         uint32 `json:"ttl,omitempty"`
+	TypeCovered string `json:"type_covered"`
+	Algorithm   uint8  `json:"algorithm"`
+	Labels      uint8  `json:"labels"`
+	OrigTtl     uint32 `json:"original_ttl"`
+	Expiration  string `json:"expiration"`
+	Inception   string `json:"inception"`
+	KeyTag      uint16 `json:"key_tag"`
+	SignerName  string `json:"signer_name"`
+	Signature   string `json:"signature"`
+}
+
+type DNSKEY_Record struct {
+	Ttl       uint32 `json:"ttl,omitempty"`
+	Flags     uint16 `json:"flags"`
+	Protocol  uint8  `json:"protocol"`
+	Algorithm uint8  `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+type CDS_Record struct {
+	Ttl        uint32 `json:"ttl,omitempty"`
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+}
+
+type NSEC_Record struct {
+	Ttl        uint32   `json:"ttl,omitempty"`
+	NextDomain string   `json:"next_domain"`
+	Types      []string `json:"types"`
+}
+
+type NSEC3_Record struct {
+	Ttl        uint32   `json:"ttl,omitempty"`
+	Hash       uint8    `json:"hash"`
+	Flags      uint8    `json:"flags"`
+	Iterations uint16   `json:"iterations"`
+	Salt       string   `json:"salt"`
+	NextDomain string   `json:"next_domain"`
+	Types      []string `json:"types"`
+}
+
+type NSEC3PARAM_Record struct {
+	Ttl        uint32 `json:"ttl,omitempty"`
+	Hash       uint8  `json:"hash"`
+	Flags      uint8  `json:"flags"`
+	Iterations uint16 `json:"iterations"`
+	Salt       string `json:"salt"`
+}
+
+type ZONEMD_Record struct {
+	Ttl    uint32 `json:"ttl,omitempty"`
+	Scheme uint8  `json:"scheme"`
+	Hash   uint8  `json:"hash"`
+	Digest string `json:"digest"`
+}
+
+type GENERIC_Record struct {
+	Ttl  uint32 `json:"ttl,omitempty"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
@@ -0,0 +1,464 @@
+package redis
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func parseRecord(t *testing.T, val string) *Record {
+	r := new(Record)
+	if err := json.Unmarshal([]byte(val), r); err != nil {
+		t.Fatalf("parse error : %s %v", val, err)
+	}
+	return r
+}
+
+func checkRecords(t *testing.T, rrs []dns.RR, expected []string) {
+	if len(rrs) != len(expected) {
+		t.Fatalf("expected %d records, got %d : %v", len(expected), len(rrs), rrs)
+	}
+	for i := range rrs {
+		want, err := dns.NewRR(expected[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rrs[i].String() != want.String() {
+			t.Errorf("expected %s, got %s", want, rrs[i])
+		}
+	}
+}
+
+func TestTXT(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 19)[:582]
+	record := parseRecord(t, "{\"txt\":["+
+		"{\"ttl\":300, \"text\":\""+dkim+"\"},"+
+		"{\"ttl\":300, \"text\":[\"v=spf1 \", \"include:_spf.example.com ~all\"]}]}")
+	if len(dkim) != 600 {
+		t.Fatalf("expected 600 byte key, got %d", len(dkim))
+	}
+	answers, _ := r.TXT("x.example.com.", nil, record)
+	if len(answers) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(answers))
+	}
+	segments := answers[0].(*dns.TXT).Txt
+	if len(segments) != 3 || len(segments[0]) != 255 || len(segments[1]) != 255 || len(segments[2]) != 90 {
+		t.Errorf("expected 255 byte segments, got %v", segments)
+	}
+	if strings.Join(segments, "") != dkim {
+		t.Error("reassembled text does not match stored value")
+	}
+	// segments must survive wire format
+	buf := make([]byte, 1024)
+	off, err := dns.PackRR(answers[0], buf, 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, _, err := dns.UnpackRR(buf[:off], 0)
+	if err != nil || strings.Join(rr.(*dns.TXT).Txt, "") != dkim {
+		t.Errorf("reassembled text does not match stored value after packing: %v", err)
+	}
+	if txt := answers[1].(*dns.TXT).Txt; len(txt) != 2 || txt[0] != "v=spf1 " || txt[1] != "include:_spf.example.com ~all" {
+		t.Errorf("expected stored strings as segments, got %v", txt)
+	}
+	if record.TXT[1].Text != "v=spf1 include:_spf.example.com ~all" {
+		t.Errorf("expected concatenated text, got %s", record.TXT[1].Text)
+	}
+
+	out, err := json.Marshal(record.TXT)
+	if err != nil || string(out) != "[{\"ttl\":300,\"text\":\""+dkim+"\"},{\"ttl\":300,\"text\":[\"v=spf1 \",\"include:_spf.example.com ~all\"]}]" {
+		t.Errorf("unexpected json %s %v", out, err)
+	}
+	for _, n := range []int{255, 510} {
+		if sx := split255(strings.Repeat("a", n)); len(sx) != n/255 {
+			t.Errorf("expected %d segments for %d bytes, got %d", n/255, n, len(sx))
+		}
+	}
+}
+
+func TestCDS(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "example.com."}
+	record := parseRecord(t, "{\"cds\":[{\"ttl\":3600, \"key_tag\":12345, \"algorithm\":13, \"digest_type\":2, "+
+		"\"digest\":\"3fb7d3f1e0b8f5a8c5d0c7d3a1e2f4b6c8d0e2f4a6b8c0d2e4f6a8b0c2d4e6f8\"}],"+
+		"\"cdnskey\":[{\"ttl\":3600, \"flags\":257, \"protocol\":3, \"algorithm\":13, "+
+		"\"public_key\":\"mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==\"}]}")
+	answers, _ := r.CDS("example.com.", z, record)
+	checkRecords(t, answers, []string{
+		"example.com. 3600 IN CDS 12345 13 2 3FB7D3F1E0B8F5A8C5D0C7D3A1E2F4B6C8D0E2F4A6B8C0D2E4F6A8B0C2D4E6F8",
+	})
+	answers, _ = r.CDNSKEY("example.com.", z, record)
+	checkRecords(t, answers, []string{
+		"example.com. 3600 IN CDNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+	})
+	// only served at zone apex
+	answers, _ = r.CDS("www.example.com.", z, record)
+	checkRecords(t, answers, nil)
+	answers, _ = r.CDNSKEY("www.example.com.", z, record)
+	checkRecords(t, answers, nil)
+}
+
+func TestTLSA(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"tlsa\":[{\"ttl\":300, \"usage\":3, \"selector\":1, \"matching_type\":1, "+
+		"\"certificate\":\"0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a\"}]}")
+	answers, _ := r.TLSA("_443._tcp.www.example.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"_443._tcp.www.example.com. 300 IN TLSA 3 1 1 0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a",
+	})
+}
+
+func TestSMIMEA(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"smimea\":[{\"ttl\":300, \"usage\":3, \"selector\":0, \"matching_type\":1, "+
+		"\"certificate\":\"0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a\"},{\"ttl\":300}]}")
+	answers, _ := r.SMIMEA("c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.example.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.example.com. 300 IN SMIMEA 3 0 1 0d6fce3320a0ab85fe9d90d1c3c6d6f3a8c8a1a4db4fbd3aee6e37ecd5cd4b3a",
+	})
+}
+
+func TestOPENPGPKEY(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record, err := r.parseRecord("example.com.", "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey",
+		"{\"openpgpkey\":[{\"ttl\":300, \"public_key\":\"mQENBFVHm5sBCADGmlUc\"},{\"ttl\":300, \"public_key\":\"not base64!\"}]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, _ := r.OPENPGPKEY("c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com. 300 IN OPENPGPKEY mQENBFVHm5sBCADGmlUc",
+	})
+}
+
+func TestSSHFP(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	// fingerprints which are not hex are rejected when records are parsed
+	record, invalid, err := decodeRecord("{\"sshfp\":[" +
+		"{\"ttl\":300, \"algorithm\":4, \"type\":2, \"fingerprint\":\"e8e1bd5bc3ec5d8de2ad0e4e6b3bfcacc7a3c6a0c02b1adfa4b5b0a2f2c9d1a7\"}," +
+		"{\"ttl\":300, \"algorithm\":4, \"type\":2, \"fingerprint\":\"not-hex\"}]}")
+	if err != nil || len(invalid) != 1 || invalid[0].field != "sshfp[1]" {
+		t.Fatalf("expected invalid fingerprint to be rejected : %v %v", invalid, err)
+	}
+	answers, _ := r.SSHFP("host1.example.net.", nil, record)
+	checkRecords(t, answers, []string{
+		"host1.example.net. 300 IN SSHFP 4 2 e8e1bd5bc3ec5d8de2ad0e4e6b3bfcacc7a3c6a0c02b1adfa4b5b0a2f2c9d1a7",
+	})
+}
+
+func TestNAPTR(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "1.e164.arpa."}
+	record := parseRecord(t, "{\"naptr\":["+
+		"{\"ttl\":300, \"order\":100, \"preference\":10, \"flags\":\"u\", \"service\":\"E2U+sip\", "+
+		"\"regexp\":\"!^.*$!sip:info@example.com!\", \"replacement\":\".\"},"+
+		"{\"ttl\":300, \"order\":102, \"preference\":10, \"flags\":\"\", \"service\":\"\", "+
+		"\"regexp\":\"\", \"replacement\":\"sip\"}]}")
+	answers, _ := r.NAPTR("4.3.2.1.5.5.5.0.0.8.1.e164.arpa.", z, record)
+	checkRecords(t, answers, []string{
+		"4.3.2.1.5.5.5.0.0.8.1.e164.arpa. 300 IN NAPTR 100 10 \"u\" \"E2U+sip\" \"!^.*$!sip:info@example.com!\" .",
+		"4.3.2.1.5.5.5.0.0.8.1.e164.arpa. 300 IN NAPTR 102 10 \"\" \"\" \"\" sip.1.e164.arpa.",
+	})
+}
+
+func TestURI(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "example.com."}
+	record := parseRecord(t, "{\"uri\":["+
+		"{\"ttl\":300, \"priority\":10, \"weight\":1, \"target\":\"http://www.example.com/path\"},"+
+		"{\"ttl\":300, \"priority\":20, \"weight\":0, \"target\":\"\"}]}")
+	answers, _ := r.URI("_http._tcp.example.com.", z, record)
+	checkRecords(t, answers, []string{
+		"_http._tcp.example.com. 300 IN URI 10 1 \"http://www.example.com/path\"",
+	})
+	if target := answers[0].(*dns.URI).Target; target != "http://www.example.com/path" {
+		t.Errorf("expected target to be kept verbatim, got %s", target)
+	}
+}
+
+func TestHINFO(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"hinfo\":[{\"ttl\":300, \"cpu\":\"x86_64\", \"os\":\"Linux\"},{\"ttl\":300}]}")
+	answers, _ := r.HINFO("host1.example.net.", nil, record)
+	checkRecords(t, answers, []string{
+		"host1.example.net. 300 IN HINFO \"x86_64\" \"Linux\"",
+	})
+	out, err := json.Marshal(record.HINFO[0])
+	if err != nil || string(out) != "{\"ttl\":300,\"cpu\":\"x86_64\",\"os\":\"Linux\"}" {
+		t.Errorf("unexpected json %s %v", out, err)
+	}
+}
+
+func TestRP(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "example.net."}
+	record := parseRecord(t, "{\"rp\":[{\"ttl\":300, \"mbox\":\"admin.example.com.\", \"txt\":\"info\"},{\"ttl\":300, \"mbox\":\"ops\"},{\"ttl\":300}]}")
+	answers, _ := r.RP("host1.example.net.", z, record)
+	checkRecords(t, answers, []string{
+		"host1.example.net. 300 IN RP admin.example.com. info.example.net.",
+		"host1.example.net. 300 IN RP ops.example.net. .",
+	})
+}
+
+func TestAFSDB(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "example.net.", Locations: map[string]struct{}{}}
+	record, err := r.parseRecord("example.net.", "@", "{\"afsdb\":[{\"ttl\":300, \"subtype\":1, \"hostname\":\"afs1\"},"+
+		"{\"ttl\":300, \"subtype\":2, \"hostname\":\"dce.example.com.\"},{\"ttl\":300, \"subtype\":3, \"hostname\":\"afs2\"}]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, _ := r.AFSDB("example.net.", z, record)
+	checkRecords(t, answers, []string{
+		"example.net. 300 IN AFSDB 1 afs1.example.net.",
+		"example.net. 300 IN AFSDB 2 dce.example.com.",
+	})
+}
+
+func TestAPL(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"apl\":[{\"ttl\":300, \"prefixes\":[\"1:192.168.0.0/16\", \"!1:10.0.0.0/8\", \"2:2001:db8::/32\"]},{\"ttl\":300}]}")
+	answers, _ := r.APL("host1.example.net.", nil, record)
+	checkRecords(t, answers, []string{
+		"host1.example.net. 300 IN APL 1:192.168.0.0/16 !1:10.0.0.0/8 2:2001:db8::/32",
+	})
+
+	// wire format and zone update round trip
+	m := new(dns.Msg)
+	m.SetQuestion("host1.example.net.", dns.TypeAPL)
+	m.Answer = answers
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	stored := new(Record)
+	if !addRecord(stored, m.Answer[0]) {
+		t.Fatal("apl not added")
+	}
+	out, err := json.Marshal(stored.APL)
+	if err != nil || string(out) != "[{\"ttl\":300,\"prefixes\":[\"1:192.168.0.0/16\",\"!1:10.0.0.0/8\",\"2:2001:db8::/32\"]}]" {
+		t.Errorf("unexpected json %s %v", out, err)
+	}
+
+	for _, prefix := range []string{"192.168.0.0/16", "3:192.168.0.0/16", "1:2001:db8::/32", "2:192.168.0.0/16", "1:192.168.0.0/33"} {
+		if _, err := parseAplPrefix(prefix); err == nil {
+			t.Errorf("expected error for %s", prefix)
+		}
+	}
+}
+
+func TestCERT(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record, err := r.parseRecord("example.net.", "host1", "{\"cert\":[{\"ttl\":300, \"type\":1, \"key_tag\":12345, \"algorithm\":8, \"certificate\":\"MIIBIjANBgkqhkiG9w0BAQEFAAOC\"},{\"ttl\":300, \"type\":1, \"certificate\":\"not base64!\"}]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, _ := r.CERT("host1.example.net.", nil, record)
+	checkRecords(t, answers, []string{
+		"host1.example.net. 300 IN CERT PKIX 12345 RSASHA256 MIIBIjANBgkqhkiG9w0BAQEFAAOC",
+	})
+}
+
+func TestCAA(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"caa\":["+
+		"{\"ttl\":300, \"flag\":0, \"tag\":\"issue\", \"value\":\"letsencrypt.org\"},"+
+		"{\"ttl\":300, \"flag\":0, \"tag\":\"issuewild\", \"value\":\";\"},"+
+		"{\"ttl\":300, \"flag\":128, \"tag\":\"iodef\", \"value\":\"mailto:security@example.net\"}]}")
+	answers, _ := r.CAA("host2.example.net.", nil, record)
+	checkRecords(t, answers, []string{
+		"host2.example.net. 300 IN CAA 0 issue \"letsencrypt.org\"",
+		"host2.example.net. 300 IN CAA 0 issuewild \";\"",
+		"host2.example.net. 300 IN CAA 128 iodef \"mailto:security@example.net\"",
+	})
+}
+
+func TestLOC(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"loc\":["+
+		"{\"ttl\":300, \"location\":\"42 21 54 N 71 06 18 W -24m 30m\"},"+
+		"{\"ttl\":300, \"location\":\"somewhere\"}]}")
+	answers, _ := r.LOC("cambridge-net.kei.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"cambridge-net.kei.com. 300 IN LOC 42 21 54.000 N 71 06 18.000 W -24.00m 30m 10000m 10m",
+	})
+	loc := answers[0].(*dns.LOC)
+	if loc.Latitude != 2299997648 || loc.Longitude != 1891505648 || loc.Altitude != 9997600 {
+		t.Errorf("wrong wire encoding : %d %d %d", loc.Latitude, loc.Longitude, loc.Altitude)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	z := &Zone{Name: "example.com."}
+	record := parseRecord(t, "{\"https\":["+
+		"{\"ttl\":300, \"priority\":1, \"target\":\".\", \"alpn\":[\"h2\",\"h3\"], \"port\":443, "+
+		"\"ipv4hint\":[\"1.2.3.4\",\"5.6.7.8\"], \"ech\":\"AEX+DQBB\", \"ipv6hint\":[\"::1\",\"2001:db8::1\"]}],"+
+		"\"svcb\":["+
+		"{\"ttl\":300, \"priority\":0, \"target\":\"svc\", \"port\":8443}]}")
+	answers, _ := r.HTTPS("example.com.", z, record)
+	checkRecords(t, answers, []string{
+		"example.com. 300 IN HTTPS 1 . alpn=\"h2,h3\" port=\"443\" ipv4hint=\"1.2.3.4,5.6.7.8\" ech=\"AEX+DQBB\" ipv6hint=\"::1,2001:db8::1\"",
+	})
+	answers, _ = r.SVCB("_8443._foo.example.com.", z, record)
+	checkRecords(t, answers, []string{
+		"_8443._foo.example.com. 300 IN SVCB 0 svc.example.com.",
+	})
+}
+
+func TestANY(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := parseRecord(t, "{\"a\":[{\"ttl\":300, \"ip\":\"1.2.3.4\"}], \"txt\":[{\"ttl\":300, \"text\":\"foo\"}]}")
+	answers, _ := r.ANY("x.example.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"x.example.com. 300 IN A 1.2.3.4",
+		"x.example.com. 300 IN TXT \"foo\"",
+	})
+	r.minimalAny = true
+	answers, _ = r.ANY("x.example.com.", nil, record)
+	checkRecords(t, answers, []string{
+		"x.example.com. 300 IN HINFO \"RFC8482\" \"\"",
+	})
+}
+
+func TestAddressPolicy(t *testing.T) {
+	record := parseRecord(t, "{\"a\":["+
+		"{\"ttl\":300, \"ip\":\"1.1.1.1\", \"weight\":1},"+
+		"{\"ttl\":300, \"ip\":\"2.2.2.2\", \"weight\":3},"+
+		"{\"ttl\":300, \"ip\":\"3.3.3.3\"}]}")
+	weights := []float64{0.2, 0.6, 0.2}
+	const queries = 20000
+
+	for _, policy := range []string{policyWeighted, policyRandomOne} {
+		r := &Redis{Ttl: 300, addressPolicy: policy}
+		counts := make(map[string]int)
+		for i := 0; i < queries; i++ {
+			answers, _ := r.A("x.example.com.", nil, record)
+			answers = r.selectAddresses(answers, addressWeights(record, dns.TypeA))
+			if policy == policyRandomOne && len(answers) != 1 {
+				t.Fatalf("expected a single address, got %v", answers)
+			}
+			if policy == policyWeighted && len(answers) != 3 {
+				t.Fatalf("expected all addresses, got %v", answers)
+			}
+			counts[answers[0].(*dns.A).A.String()]++
+		}
+		for i, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+			ratio := float64(counts[ip]) / queries
+			if ratio < weights[i]-0.03 || ratio > weights[i]+0.03 {
+				t.Errorf("%s: expected %s first in %.2f of answers, got %.2f", policy, ip, weights[i], ratio)
+			}
+		}
+	}
+
+	r := &Redis{Ttl: 300, addressPolicy: policyAll}
+	answers, _ := r.A("x.example.com.", nil, record)
+	checkRecords(t, r.selectAddresses(answers, addressWeights(record, dns.TypeA)), []string{
+		"x.example.com. 300 IN A 1.1.1.1",
+		"x.example.com. 300 IN A 2.2.2.2",
+		"x.example.com. 300 IN A 3.3.3.3",
+	})
+}
+
+func TestAddressRotation(t *testing.T) {
+	record := parseRecord(t, "{\"a\":["+
+		"{\"ttl\":300, \"ip\":\"1.1.1.1\"},"+
+		"{\"ttl\":300, \"ip\":\"2.2.2.2\"},"+
+		"{\"ttl\":300, \"ip\":\"3.3.3.3\"}]}")
+
+	for _, policy := range []string{policyRoundRobin, policyShuffle} {
+		r := &Redis{Ttl: 300, addressPolicy: policy}
+		first := make(map[string]bool)
+		for i := 0; i < 30; i++ {
+			answers, _ := r.A("x.example.com.", nil, record)
+			answers = r.selectAddresses(answers, addressWeights(record, dns.TypeA))
+			if len(answers) != 3 {
+				t.Fatalf("%s: expected all addresses, got %v", policy, answers)
+			}
+			first[answers[0].(*dns.A).A.String()] = true
+		}
+		if len(first) != 3 {
+			t.Errorf("%s: expected first address to vary, got %v", policy, first)
+		}
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	day := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		serial uint32
+		now    time.Time
+		next   uint32
+	}{
+		{2026101305, day, 2026101400},
+		{2026101400, day, 2026101401},
+		{2026101405, day, 2026101406},
+		{2026101499, day, 2026101500},
+		{2026101405, day.Add(24 * time.Hour), 2026101500},
+		{2026123199, day, 2026123200},
+		{1700000000, day, uint32(day.Unix())},
+		{0, day, uint32(day.Unix())},
+		{uint32(day.Unix()) + 10, day, uint32(day.Unix()) + 11},
+	}
+	for i, test := range tests {
+		if next := nextSerial(test.serial, test.now); next != test.next {
+			t.Errorf("test %d: expected %d, got %d", i, test.next, next)
+		}
+	}
+}
+
+func TestRecordCodecs(t *testing.T) {
+	val := "{\"ttl\":600," +
+		"\"a\":[{\"ttl\":300, \"ip\":\"1.2.3.4\", \"weight\":70000}]," +
+		"\"aaaa\":[{\"ip\":\"::1\"}]," +
+		"\"txt\":[{\"text\":\"" + strings.Repeat("x", 300) + "\"},{\"text\":[\"a\", \"b\"]}]," +
+		"\"mx\":[{\"host\":\"mx.example.com.\", \"preference\":10}]," +
+		"\"soa\":{\"ttl\":300, \"minttl\":100, \"mbox\":\"hostmaster.example.com.\",\"ns\":\"ns1.example.com.\",\"refresh\":44,\"retry\":55,\"expire\":66,\"serial\":4294967295}," +
+		"\"loc\":[{\"location\":\"52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000m 10m\"}]}"
+	expected, _, err := decodeRecord(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, codec := range recordCodecs {
+		r := &Redis{codec: codec}
+		stored, err := r.encodeRecord(expected)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		record, invalid, err := decodeRecord(stored)
+		if err != nil || len(invalid) > 0 {
+			t.Fatalf("%s: %v %v", name, err, invalid)
+		}
+		if !reflect.DeepEqual(record, expected) {
+			t.Errorf("%s: expected %+v got %+v", name, expected, record)
+		}
+	}
+	js, _ := (&Redis{codec: jsonCodec{}}).encodeRecord(expected)
+	if mp, _ := (&Redis{codec: msgpackCodec{}}).encodeRecord(expected); len(mp) >= len(js) {
+		t.Errorf("expected msgpack record shorter than json, %d >= %d", len(mp), len(js))
+	}
+
+	// {"a":[{"ip":"1.2.3.4","ttl":300}]}
+	record, _, err := decodeRecord("\x81\xa1a\x91\x82\xa2ip\xa71.2.3.4\xa3ttl\xcd\x01\x2c")
+	if err != nil || len(record.A) != 1 || record.A[0].Ttl != 300 || record.A[0].Ip.String() != "1.2.3.4" {
+		t.Errorf("unexpected msgpack record %+v %v", record, err)
+	}
+	for _, val := range []string{"\x81\xa1a", "\x81\x01\x02", "\x80\x00"} {
+		if _, _, err := decodeRecord(val); err == nil {
+			t.Errorf("expected error for msgpack record %q", val)
+		}
+	}
+	// records which can not be parsed are skipped like json records
+	record, invalid, err := decodeRecord("\x82\xa1a\xc7\x01\x01\x00\xa4aaaa\x91\x81\xa2ip\xa3::1")
+	if err != nil || len(invalid) != 1 || invalid[0].field != "a" || len(record.AAAA) != 1 {
+		t.Errorf("unexpected msgpack record %+v %v %v", record, invalid, err)
+	}
+}
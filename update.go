@@ -0,0 +1,536 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// handleUpdate applies a dynamic update as described in rfc2136 to zone.
+// updates must be signed with the configured tsig key and zone must be
+// listed in update zones
+func (redis *Redis) handleUpdate(state request.Request, zone string) (int, error) {
+	if len(redis.updateZones) == 0 {
+		return redis.errorResponse(state, zone, dns.RcodeRefused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited}, nil)
+	}
+	if !redis.tsigValid(state.Req) {
+		return redis.errorResponse(state, zone, dns.RcodeNotAuth, nil, nil)
+	}
+	if !redis.updateAllowed(zone) {
+		return redis.updateResponse(state, dns.RcodeRefused)
+	}
+	if len(state.Req.Question) != 1 || state.QType() != dns.TypeSOA {
+		return redis.updateResponse(state, dns.RcodeFormatError)
+	}
+	if state.Name() != zone {
+		return redis.updateResponse(state, dns.RcodeNotAuth)
+	}
+
+	redis.updateLock.Lock()
+	defer redis.updateLock.Unlock()
+
+	// always work on current zone data, replicas may lag behind
+	redis.invalidate(zone)
+	z, _ := redis.loadContext(withPrimary(context.Background()), zone)
+	if z == nil {
+		return redis.updateResponse(state, dns.RcodeServerFailure)
+	}
+	u := &zoneUpdate{redis: redis, z: z, records: make(map[string]*Record)}
+	if rcode := u.prerequisites(state.Req.Answer); rcode != dns.RcodeSuccess {
+		return redis.updateResponse(state, rcode)
+	}
+	if rcode := u.prescan(state.Req.Ns); rcode != dns.RcodeSuccess {
+		return redis.updateResponse(state, rcode)
+	}
+	for _, rr := range state.Req.Ns {
+		u.apply(rr)
+	}
+	if !u.changed {
+		return redis.updateResponse(state, dns.RcodeSuccess)
+	}
+	if err := u.commit(); err != nil {
+		fmt.Println("update error : ", zone, err)
+		return redis.updateResponse(state, dns.RcodeServerFailure)
+	}
+	return redis.updateResponse(state, dns.RcodeSuccess)
+}
+
+func (redis *Redis) updateAllowed(zone string) bool {
+	for _, z := range redis.updateZones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// updateResponse writes a tsig signed response to an update request
+func (redis *Redis) updateResponse(state request.Request, rcode int) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, rcode)
+	m.SetTsig(redis.tsigName, redis.tsigAlgorithm, 300, time.Now().Unix())
+	out, _, err := dns.TsigGenerate(m, redis.tsigSecret, state.Req.IsTsig().MAC, false)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if _, err = state.W.Write(out); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// zoneUpdate keeps records modified by an update until they are committed
+type zoneUpdate struct {
+	redis   *Redis
+	z       *Zone
+	records map[string]*Record
+	order   []string
+	changed bool
+}
+
+// record returns record of name, loaded from redis on first use. empty record
+// is returned for names not in zone
+func (u *zoneUpdate) record(name string) *Record {
+	key := u.key(name)
+	if r, ok := u.records[key]; ok {
+		return r
+	}
+	r, _ := u.redis.getContext(withPrimary(context.Background()), key, u.z)
+	if r == nil {
+		r = new(Record)
+	}
+	u.records[key] = r
+	u.order = append(u.order, key)
+	return r
+}
+
+func (u *zoneUpdate) key(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == u.z.Name {
+		return u.z.Name
+	}
+	return strings.TrimSuffix(name, "."+u.z.Name)
+}
+
+func (u *zoneUpdate) label(key string) string {
+	if key == u.z.Name {
+		return "@"
+	}
+	return key
+}
+
+func (u *zoneUpdate) inZone(name string) bool {
+	return dns.IsSubDomain(u.z.Name, strings.ToLower(dns.Fqdn(name)))
+}
+
+// rrset returns records of type t stored at name
+func (u *zoneUpdate) rrset(name string, t uint16) []dns.RR {
+	handler, ok := u.redis.updateHandler(t)
+	if !ok {
+		return nil
+	}
+	rrs, _ := handler(name, u.z, u.record(name))
+	return rrs
+}
+
+// prerequisites checks prerequisite section as described in rfc2136 section 3.2
+func (u *zoneUpdate) prerequisites(prereqs []dns.RR) int {
+	// value dependent prerequisites are compared as whole rrsets
+	sets := make(map[string][]dns.RR)
+	var keys []string
+	for _, rr := range prereqs {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !u.inZone(h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if !isEmptyRR(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if !u.inUse(h.Name) {
+					return dns.RcodeNameError
+				}
+			} else if len(u.rrset(h.Name, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if !isEmptyRR(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if u.inUse(h.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if len(u.rrset(h.Name, h.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			k := strings.ToLower(dns.Fqdn(h.Name)) + "/" + dns.TypeToString[h.Rrtype]
+			if _, ok := sets[k]; !ok {
+				keys = append(keys, k)
+			}
+			sets[k] = append(sets[k], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, k := range keys {
+		expected := sets[k]
+		h := expected[0].Header()
+		if !sameRRset(expected, u.rrset(h.Name, h.Rrtype)) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescan validates update section as described in rfc2136 section 3.4.1
+func (u *zoneUpdate) prescan(updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !u.inZone(h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || !isEmptyRR(rr) || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		if _, ok := u.redis.updateHandler(h.Rrtype); !ok && h.Rrtype != dns.TypeANY {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// apply performs a single update as described in rfc2136 section 3.4.2,
+// SOA and apex NS records are never deleted
+func (u *zoneUpdate) apply(rr dns.RR) {
+	h := rr.Header()
+	record := u.record(h.Name)
+	apex := u.key(h.Name) == u.z.Name
+	switch h.Class {
+	case dns.ClassINET:
+		existing := u.rrset(h.Name, h.Rrtype)
+		for _, e := range existing {
+			if sameRR(e, rr) {
+				return
+			}
+		}
+		if h.Rrtype == dns.TypeCNAME {
+			// a name with a CNAME can not own other data
+			if i, _ := u.redis.records(h.Name, u.z, record); len(i) > len(existing) {
+				return
+			}
+			record.CNAME = nil
+		} else if len(record.CNAME) > 0 {
+			return
+		}
+		addRecord(record, rr)
+		u.changed = true
+	case dns.ClassANY:
+		for t := range updateTypes {
+			if (h.Rrtype == dns.TypeANY || h.Rrtype == t) && (!apex || t != dns.TypeNS) {
+				u.remove(h.Name, t, func(*Record) bool { return true })
+			}
+		}
+	case dns.ClassNONE:
+		if apex && h.Rrtype == dns.TypeNS && len(u.rrset(h.Name, dns.TypeNS)) <= 1 {
+			return
+		}
+		handler, _ := u.redis.updateHandler(h.Rrtype)
+		u.remove(h.Name, h.Rrtype, func(single *Record) bool {
+			rrs, _ := handler(h.Name, u.z, single)
+			return len(rrs) == 1 && sameRR(rrs[0], rr)
+		})
+	}
+}
+
+func (u *zoneUpdate) remove(name string, t uint16, match func(*Record) bool) {
+	removeRecords(u.record(name), t, func(single *Record) bool {
+		if match(single) {
+			u.changed = true
+			return true
+		}
+		return false
+	})
+}
+
+// commit increments zone serial and writes modified records to redis in a
+// single script, records left empty are removed
+func (u *zoneUpdate) commit() error {
+	if apex := u.record(u.z.Name); apex.SOA.Ns != "" {
+		apex.SOA.Serial = nextSerial(apex.SOA.Serial, time.Now())
+	}
+
+	args := []interface{}{updateScript, 1, u.redis.keyPrefix + u.z.Name + u.redis.keySuffix}
+	empty, _ := json.Marshal(new(Record))
+	for _, key := range u.order {
+		val, err := json.Marshal(u.records[key])
+		if err != nil {
+			return err
+		}
+		var out string
+		if string(val) != string(empty) {
+			if out, err = u.redis.encodeRecord(u.records[key]); err != nil {
+				return err
+			}
+		}
+		args = append(args, u.label(key), out)
+	}
+
+	conn := u.redis.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("EVAL", args...)
+	u.redis.invalidate(u.z.Name)
+	return err
+}
+
+func (u *zoneUpdate) inUse(name string) bool {
+	if _, ok := u.z.Locations[u.label(u.key(name))]; !ok {
+		return false
+	}
+	rrs, _ := u.redis.records(name, u.z, u.record(name))
+	return len(rrs) > 0
+}
+
+// updateTypes are record types that can be modified by dynamic updates
+var updateTypes = map[uint16]bool{
+	dns.TypeA: true, dns.TypeAAAA: true, dns.TypeTXT: true, dns.TypeCNAME: true,
+	dns.TypeNS: true, dns.TypeMX: true, dns.TypeSRV: true, dns.TypeCAA: true,
+}
+
+func (redis *Redis) updateHandler(t uint16) (func(string, *Zone, *Record) ([]dns.RR, []dns.RR), bool) {
+	if !updateTypes[t] {
+		return nil, false
+	}
+	return map[uint16]func(string, *Zone, *Record) ([]dns.RR, []dns.RR){
+		dns.TypeA: redis.A, dns.TypeAAAA: redis.AAAA, dns.TypeTXT: redis.TXT, dns.TypeCNAME: redis.CNAME,
+		dns.TypeNS: redis.NS, dns.TypeMX: redis.MX, dns.TypeSRV: redis.SRV, dns.TypeCAA: redis.CAA,
+	}[t], true
+}
+
+// addRecord adds rr to record, false is returned if record type can not be stored
+func addRecord(record *Record, rr dns.RR) bool {
+	ttl := rr.Header().Ttl
+	switch rr := rr.(type) {
+	case *dns.A:
+		record.A = append(record.A, A_Record{Ttl: ttl, Ip: rr.A})
+	case *dns.AAAA:
+		record.AAAA = append(record.AAAA, AAAA_Record{Ttl: ttl, Ip: rr.AAAA})
+	case *dns.TXT:
+		txt := TXT_Record{Ttl: ttl, Text: strings.Join(rr.Txt, "")}
+		if len(rr.Txt) > 1 {
+			txt.Strings = rr.Txt
+		}
+		record.TXT = append(record.TXT, txt)
+	case *dns.CNAME:
+		record.CNAME = append(record.CNAME, CNAME_Record{Ttl: ttl, Host: rr.Target})
+	case *dns.NS:
+		record.NS = append(record.NS, NS_Record{Ttl: ttl, Host: rr.Ns})
+	case *dns.MX:
+		record.MX = append(record.MX, MX_Record{Ttl: ttl, Host: rr.Mx, Preference: rr.Preference})
+	case *dns.SRV:
+		record.SRV = append(record.SRV, SRV_Record{Ttl: ttl, Priority: rr.Priority, Weight: rr.Weight,
+			Port: rr.Port, Target: rr.Target})
+	case *dns.CAA:
+		record.CAA = append(record.CAA, CAA_Record{Ttl: ttl, Flag: rr.Flag, Tag: rr.Tag, Value: rr.Value})
+	case *dns.SOA:
+		record.SOA = SOA_Record{Ttl: ttl, Serial: rr.Serial, Ns: rr.Ns, MBox: rr.Mbox, Refresh: rr.Refresh,
+			Retry: rr.Retry, Expire: rr.Expire, MinTtl: rr.Minttl}
+	case *dns.TLSA:
+		record.TLSA = append(record.TLSA, TLSA_Record{Ttl: ttl, Usage: rr.Usage, Selector: rr.Selector,
+			MatchingType: rr.MatchingType, Certificate: rr.Certificate})
+	case *dns.SSHFP:
+		record.SSHFP = append(record.SSHFP, SSHFP_Record{Ttl: ttl, Algorithm: rr.Algorithm, Type: rr.Type,
+			Fingerprint: rr.FingerPrint})
+	case *dns.NAPTR:
+		record.NAPTR = append(record.NAPTR, NAPTR_Record{Ttl: ttl, Order: rr.Order, Preference: rr.Preference,
+			Flags: rr.Flags, Service: rr.Service, Regexp: rr.Regexp, Replacement: rr.Replacement})
+	case *dns.URI:
+		record.URI = append(record.URI, URI_Record{Ttl: ttl, Priority: rr.Priority, Weight: rr.Weight, Target: rr.Target})
+	case *dns.HINFO:
+		record.HINFO = append(record.HINFO, HINFO_Record{Ttl: ttl, Cpu: rr.Cpu, Os: rr.Os})
+	case *dns.PTR:
+		record.PTR = append(record.PTR, PTR_Record{Ttl: ttl, Host: rr.Ptr})
+	case *dns.SMIMEA:
+		record.SMIMEA = append(record.SMIMEA, TLSA_Record{Ttl: ttl, Usage: rr.Usage, Selector: rr.Selector,
+			MatchingType: rr.MatchingType, Certificate: rr.Certificate})
+	case *dns.OPENPGPKEY:
+		record.OPENPGPKEY = append(record.OPENPGPKEY, OPENPGPKEY_Record{Ttl: ttl, PublicKey: rr.PublicKey})
+	case *dns.CERT:
+		record.CERT = append(record.CERT, CERT_Record{Ttl: ttl, Type: rr.Type, KeyTag: rr.KeyTag,
+			Algorithm: rr.Algorithm, Certificate: rr.Certificate})
+	case *dns.RP:
+		record.RP = append(record.RP, RP_Record{Ttl: ttl, Mbox: rr.Mbox, Txt: rr.Txt})
+	case *dns.AFSDB:
+		record.AFSDB = append(record.AFSDB, AFSDB_Record{Ttl: ttl, Subtype: rr.Subtype, Hostname: rr.Hostname})
+	case *dns.APL:
+		apl := APL_Record{Ttl: ttl}
+		for _, p := range rr.Prefixes {
+			apl.Prefixes = append(apl.Prefixes, formatAplPrefix(p))
+		}
+		record.APL = append(record.APL, apl)
+	case *dns.DNAME:
+		record.DNAME = DNAME_Record{Ttl: ttl, Target: rr.Target}
+	case *dns.LOC:
+		record.LOC = append(record.LOC, LOC_Record{Ttl: ttl,
+			Location: strings.TrimPrefix(rr.String(), rr.Hdr.String())})
+	case *dns.DNSKEY:
+		record.DNSKEY = append(record.DNSKEY, DNSKEY_Record{Ttl: ttl, Flags: rr.Flags, Protocol: rr.Protocol,
+			Algorithm: rr.Algorithm, PublicKey: rr.PublicKey})
+	case *dns.CDNSKEY:
+		record.CDNSKEY = append(record.CDNSKEY, DNSKEY_Record{Ttl: ttl, Flags: rr.Flags, Protocol: rr.Protocol,
+			Algorithm: rr.Algorithm, PublicKey: rr.PublicKey})
+	case *dns.CDS:
+		record.CDS = append(record.CDS, CDS_Record{Ttl: ttl, KeyTag: rr.KeyTag, Algorithm: rr.Algorithm,
+			DigestType: rr.DigestType, Digest: rr.Digest})
+	case *dns.ZONEMD:
+		record.ZONEMD = append(record.ZONEMD, ZONEMD_Record{Ttl: ttl, Scheme: rr.Scheme, Hash: rr.Hash, Digest: rr.Digest})
+	default:
+		return false
+	}
+	return true
+}
+
+// removeRecords removes records of type t for which remove returns true,
+// remove is called with a record holding a single entry
+func removeRecords(record *Record, t uint16, remove func(*Record) bool) {
+	switch t {
+	case dns.TypeA:
+		var kept []A_Record
+		for _, r := range record.A {
+			if !remove(&Record{A: []A_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.A = kept
+	case dns.TypeAAAA:
+		var kept []AAAA_Record
+		for _, r := range record.AAAA {
+			if !remove(&Record{AAAA: []AAAA_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.AAAA = kept
+	case dns.TypeTXT:
+		var kept []TXT_Record
+		for _, r := range record.TXT {
+			if !remove(&Record{TXT: []TXT_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.TXT = kept
+	case dns.TypeCNAME:
+		var kept []CNAME_Record
+		for _, r := range record.CNAME {
+			if !remove(&Record{CNAME: []CNAME_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.CNAME = kept
+	case dns.TypeNS:
+		var kept []NS_Record
+		for _, r := range record.NS {
+			if !remove(&Record{NS: []NS_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.NS = kept
+	case dns.TypeMX:
+		var kept []MX_Record
+		for _, r := range record.MX {
+			if !remove(&Record{MX: []MX_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.MX = kept
+	case dns.TypeSRV:
+		var kept []SRV_Record
+		for _, r := range record.SRV {
+			if !remove(&Record{SRV: []SRV_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.SRV = kept
+	case dns.TypeCAA:
+		var kept []CAA_Record
+		for _, r := range record.CAA {
+			if !remove(&Record{CAA: []CAA_Record{r}}) {
+				kept = append(kept, r)
+			}
+		}
+		record.CAA = kept
+	}
+}
+
+// isEmptyRR checks whether rr has no rdata, as used by rfc2136 for rrset and name checks
+func isEmptyRR(rr dns.RR) bool {
+	switch rr.(type) {
+	case *dns.RR_Header, *dns.ANY:
+		return true
+	}
+	return rr.Header().Rdlength == 0
+}
+
+// sameRR compares rdata of stored record a with rr of an update message, class
+// of update records is ignored
+func sameRR(a, rr dns.RR) bool {
+	rr = dns.Copy(rr)
+	rr.Header().Class = a.Header().Class
+	return dns.IsDuplicate(a, rr)
+}
+
+// sameRRset compares two rrsets ignoring ttl and order
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if sameRR(y, x) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// updateScript sets hash fields to the given values atomically, fields with
+// empty values are deleted
+const updateScript = `
+for i = 1, #ARGV, 2 do
+	if ARGV[i+1] == "" then
+		redis.call("HDEL", KEYS[1], ARGV[i])
+	else
+		redis.call("HSET", KEYS[1], ARGV[i], ARGV[i+1])
+	end
+end
+return #ARGV / 2
+`
@@ -0,0 +1,174 @@
+package redis
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// parseRecord parses records stored at location of zone. records which can not
+// be parsed or are invalid are logged and skipped so the rest of location is
+// still served, with strict_records the first error is returned instead
+func (redis *Redis) parseRecord(zone string, location string, val string) (*Record, error) {
+	r, invalid, err := decodeRecord(val)
+	if err != nil {
+		fmt.Println("parse error : ", zone, location, err)
+		return nil, fmt.Errorf("invalid location %s in %s: %v", location, zone, err)
+	}
+	for _, e := range invalid {
+		fmt.Println("invalid record : ", zone, location, e.field, e.err)
+	}
+	if len(invalid) > 0 && redis.strictRecords {
+		return nil, fmt.Errorf("invalid record %s at %s in %s: %v", invalid[0].field, location, zone, invalid[0].err)
+	}
+	if len(r.CNAME) > 0 && location == "@" {
+		r = redis.apexCname(zone, r)
+	} else if len(r.CNAME) > 0 {
+		if others := otherData(r); len(others) > 0 {
+			redis.warn(zone, location, "cname with other data", others)
+			r = cnameOnly(r)
+		}
+	}
+	return r, nil
+}
+
+// warn logs a warning about records at location of zone once, records are
+// parsed each time they are read so warnings are repeated only after zone is
+// modified
+func (redis *Redis) warn(zone string, location string, warning string, args ...interface{}) {
+	key := location + " " + warning
+	redis.warnLock.Lock()
+	defer redis.warnLock.Unlock()
+	if redis.warnings[zone][key] {
+		return
+	}
+	if redis.warnings == nil {
+		redis.warnings = make(map[string]map[string]bool)
+	}
+	if redis.warnings[zone] == nil {
+		redis.warnings[zone] = make(map[string]bool)
+	}
+	redis.warnings[zone][key] = true
+	fmt.Println(append([]interface{}{"warning : " + warning + " : ", zone, location}, args...)...)
+}
+
+// apexCname removes a CNAME stored at zone apex which would hide SOA and NS
+// records of zone, with apex_cname alias its target is served as ALIAS
+func (redis *Redis) apexCname(zone string, r *Record) *Record {
+	if redis.apexAlias && r.ALIAS.Target == "" {
+		redis.warn(zone, "@", "cname at zone apex served as alias", r.CNAME[0].Host)
+		r.ALIAS = ALIAS_Record{Target: r.CNAME[0].Host, Ttl: r.CNAME[0].Ttl}
+	} else {
+		redis.warn(zone, "@", "cname at zone apex ignored", r.CNAME[0].Host)
+	}
+	r.CNAME = nil
+	return r
+}
+
+// invalidRecordError is returned for locations which can not be served with
+// strict_records
+type invalidRecordError struct {
+	error
+}
+
+// cnameOnly returns records of a location holding a CNAME and other data as
+// served, only the CNAME is kept as described in rfc1034 section 3.6.2
+func cnameOnly(r *Record) *Record {
+	return &Record{Ttl: r.Ttl, CNAME: r.CNAME, RRSIG: r.RRSIG, NSEC: r.NSEC, NSEC3: r.NSEC3}
+}
+
+// recordError is a record of a location which could not be parsed
+type recordError struct {
+	field string
+	err   error
+}
+
+// decodeRecord parses records of a location, invalid records are skipped and
+// returned with their field
+func decodeRecord(val string) (*Record, []recordError, error) {
+	r, err := storedCodec(val).decode(val)
+	if errs, ok := err.(invalidRecords); ok {
+		return r, errs, nil
+	}
+	return r, nil, err
+}
+
+// validateRecord checks addresses and host names of a parsed record, empty
+// values are left to handlers which skip them
+func validateRecord(record interface{}) error {
+	switch r := record.(type) {
+	case *A_Record:
+		if r.Ip != nil && r.Ip.To4() == nil {
+			return errors.New("invalid ipv4 address " + r.Ip.String())
+		}
+	case *AAAA_Record:
+		if r.Ip != nil && r.Ip.To4() != nil {
+			return errors.New("invalid ipv6 address " + r.Ip.String())
+		}
+	case *CNAME_Record:
+		return validateHost(r.Host)
+	case *NS_Record:
+		return validateHost(r.Host)
+	case *MX_Record:
+		return validateHost(r.Host)
+	case *SRV_Record:
+		return validateHost(r.Target)
+	case *PTR_Record:
+		return validateHost(r.Host)
+	case *RP_Record:
+		if err := validateHost(r.Mbox); err != nil {
+			return err
+		}
+		return validateHost(r.Txt)
+	case *AFSDB_Record:
+		// afs volume location servers and dce authenticated name servers
+		// as described in rfc1183 section 1
+		if r.Subtype != 1 && r.Subtype != 2 {
+			return fmt.Errorf("invalid afsdb subtype %d", r.Subtype)
+		}
+		return validateHost(r.Hostname)
+	case *APL_Record:
+		for _, prefix := range r.Prefixes {
+			if _, err := parseAplPrefix(prefix); err != nil {
+				return err
+			}
+		}
+	case *CERT_Record:
+		if _, err := base64.StdEncoding.DecodeString(r.Certificate); err != nil {
+			return errors.New("invalid certificate " + err.Error())
+		}
+	case *SSHFP_Record:
+		if _, err := hex.DecodeString(r.Fingerprint); err != nil {
+			return errors.New("invalid sshfp fingerprint " + err.Error())
+		}
+	case *OPENPGPKEY_Record:
+		if _, err := base64.StdEncoding.DecodeString(r.PublicKey); err != nil {
+			return errors.New("invalid public key " + err.Error())
+		}
+	case *DNAME_Record:
+		return validateHost(r.Target)
+	case *ALIAS_Record:
+		return validateHost(r.Target)
+	case *GENERIC_Record:
+		if _, err := genericType(r.Type); err != nil {
+			return err
+		}
+		if _, err := genericData(r.Data); err != nil {
+			return errors.New("invalid generic rdata " + err.Error())
+		}
+	}
+	return nil
+}
+
+func validateHost(host string) error {
+	if host == "" {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(host); !ok {
+		return errors.New("invalid host name " + host)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+)
+
+// view serves zones stored with a different key prefix to clients in nets
+type view struct {
+	name  string
+	nets  []*net.IPNet
+	redis *Redis
+}
+
+// newView returns a plugin instance serving zones stored with prefix, sharing
+// connections and configuration of redis. zone names and cached records are
+// kept separately for each view
+func (redis *Redis) newView(prefix string) *Redis {
+	v := &Redis{
+		Next:           redis.Next,
+		Pool:           redis.Pool,
+		replicaPool:    redis.replicaPool,
+		redisAddress:   redis.redisAddress,
+		replicaAddress: redis.replicaAddress,
+		serialPeers:    redis.serialPeers,
+		peerPools:      redis.peerPools,
+		peerThreshold:  redis.peerThreshold,
+		redisUsername:  redis.redisUsername,
+		redisPassword:  redis.redisPassword,
+		redisDb:        redis.redisDb,
+		tlsConfig:      redis.tlsConfig,
+		master:         redis.master,
+		clusterNodes:   redis.clusterNodes,
+		cluster:        redis.cluster,
+		connectTimeout: redis.connectTimeout,
+		readTimeout:    redis.readTimeout,
+		queryTimeout:   redis.queryTimeout,
+		startupTimeout: redis.startupTimeout,
+		canaryZone:     redis.canaryZone,
+		queryLogRate:   redis.queryLogRate,
+		rateLimiter:    redis.rateLimiter,
+		cookieSecret:   redis.cookieSecret,
+		cookieRequire:  redis.cookieRequire,
+		nsid:           redis.nsid,
+		chaosVersion:   redis.chaosVersion,
+		chaosId:        redis.chaosId,
+		chaosAllow:     redis.chaosAllow,
+		strictRecords:  redis.strictRecords,
+		codec:          redis.codec,
+		keyPrefix:      prefix,
+		keySuffix:      redis.keySuffix,
+		Ttl:            redis.Ttl,
+		ttlMin:         redis.ttlMin,
+		ttlMax:         redis.ttlMax,
+		negativeTtl:    redis.negativeTtl,
+		ttlJitter:      redis.ttlJitter,
+		defaultSoa:     redis.defaultSoa,
+		fallZones:      redis.fallZones,
+		qtypeFilters:   redis.qtypeFilters,
+		truncatePolicy: redis.truncatePolicy,
+		minimalAny:     redis.minimalAny,
+		minimalExtras:  redis.minimalExtras,
+		authorityZones: redis.authorityZones,
+		cnameDepth:     redis.cnameDepth,
+		cnameTimeout:   redis.cnameTimeout,
+		apexAlias:      redis.apexAlias,
+		addressPolicy:  redis.addressPolicy,
+		dns64Prefix:    redis.dns64Prefix,
+		dns64Exclude:   redis.dns64Exclude,
+		nxRedirect:     redis.nxRedirect,
+		resolvers:      redis.resolvers,
+		transferAllow:  redis.transferAllow,
+		transferOff:    redis.transferOff,
+		transferLength: redis.transferLength,
+		tsigName:       redis.tsigName,
+		tsigAlgorithm:  redis.tsigAlgorithm,
+		tsigSecret:     redis.tsigSecret,
+		updateZones:    redis.updateZones,
+		notify:         redis.notify,
+		serveStale:     redis.serveStale,
+		preloadZones:   redis.preloadZones,
+		preloadAll:     redis.preloadAll,
+		preloadWorkers: redis.preloadWorkers,
+		keyspaceEvents: redis.keyspaceEvents,
+		dnssecKey:      redis.dnssecKey,
+		reverseZones:   redis.reverseZones,
+	}
+	if redis.cache != nil {
+		v.cache = newRecordCache(redis.cache.ttl)
+	}
+	return v
+}
+
+// view returns plugin instance of the first view matching client address,
+// or nil if client should be served by the default view
+func (redis *Redis) view(state request.Request) *Redis {
+	if len(redis.views) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return nil
+	}
+	for _, v := range redis.views {
+		for _, n := range v.nets {
+			if n.Contains(ip) {
+				return v.redis
+			}
+		}
+	}
+	return nil
+}
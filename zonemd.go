@@ -0,0 +1,208 @@
+package redis
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ZONEMD returns message digests of zone stored at zone apex, serial is taken
+// from zone SOA as required by rfc8976
+func (redis *Redis) ZONEMD(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if z == nil || name != z.Name {
+		return
+	}
+	for _, zonemd := range record.ZONEMD {
+		if len(zonemd.Digest) == 0 {
+			continue
+		}
+		r := new(dns.ZONEMD)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeZONEMD,
+			Class: dns.ClassINET, Ttl: redis.recordTtl(z, zonemd.Ttl)}
+		r.Serial = record.SOA.Serial
+		r.Scheme = zonemd.Scheme
+		r.Hash = zonemd.Hash
+		r.Digest = strings.ToLower(zonemd.Digest)
+		answers = append(answers, r)
+	}
+	return
+}
+
+// ZoneDigest computes ZONEMD record of zone using SIMPLE scheme and SHA-384 over
+// all records stored in redis except apex ZONEMD and its signatures
+func (redis *Redis) ZoneDigest(zone string) (*dns.ZONEMD, error) {
+	z := redis.load(zone)
+	if z == nil || len(z.Locations) == 0 {
+		return nil, errors.New("zone not found")
+	}
+	apex := redis.get(z.Name, z)
+	if apex == nil || apex.SOA.Ns == "" {
+		return nil, errors.New("zone has no SOA record")
+	}
+	var rrs []dns.RR
+	for _, rr := range redis.zoneRecords(z) {
+		if rr.Header().Name == z.Name && coversZonemd(rr) {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	digest, err := zoneDigest(rrs)
+	if err != nil {
+		return nil, err
+	}
+	soa, _ := redis.SOA(z.Name, z, apex)
+	r := new(dns.ZONEMD)
+	r.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeZONEMD,
+		Class: dns.ClassINET, Ttl: soa[0].Header().Ttl}
+	r.Serial = apex.SOA.Serial
+	r.Scheme = zonemdSchemeSimple
+	r.Hash = zonemdHashSHA384
+	r.Digest = digest
+	return r, nil
+}
+
+// VerifyZoneDigest checks SHA-384 ZONEMD record stored at zone apex against
+// digest of records currently stored in redis
+func (redis *Redis) VerifyZoneDigest(zone string) error {
+	computed, err := redis.ZoneDigest(zone)
+	if err != nil {
+		return err
+	}
+	apex := redis.get(zone, &Zone{Name: zone})
+	for _, zonemd := range apex.ZONEMD {
+		if zonemd.Scheme != zonemdSchemeSimple || zonemd.Hash != zonemdHashSHA384 {
+			continue
+		}
+		if !strings.EqualFold(zonemd.Digest, computed.Digest) {
+			return errors.New("zone digest mismatch")
+		}
+		return nil
+	}
+	return errors.New("zone has no supported ZONEMD record")
+}
+
+// zoneRecords returns all records stored in zone z
+func (redis *Redis) zoneRecords(z *Zone) (rrs []dns.RR) {
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	handlers := []func(string, *Zone, *Record) ([]dns.RR, []dns.RR){
+		redis.records, redis.RRSIG, redis.DNSKEY, redis.NSEC, redis.NSEC3, redis.NSEC3PARAM,
+	}
+	for i, record := range redis.getMany(keys, z) {
+		if record == nil {
+			continue
+		}
+		name := redis.ownerName(keys[i], z)
+		for _, handler := range handlers {
+			as, _ := handler(name, z, record)
+			rrs = append(rrs, as...)
+		}
+	}
+	return
+}
+
+func coversZonemd(rr dns.RR) bool {
+	switch r := rr.(type) {
+	case *dns.ZONEMD:
+		return true
+	case *dns.RRSIG:
+		return r.TypeCovered == dns.TypeZONEMD
+	}
+	return false
+}
+
+type digestEntry struct {
+	name  string
+	typ   uint16
+	rdata []byte
+	wire  []byte
+}
+
+// zoneDigest returns hex encoded SHA-384 digest of rrs in canonical form and
+// order as described in rfc8976 section 3.3.1, duplicate records are ignored
+func zoneDigest(rrs []dns.RR) (string, error) {
+	entries := make([]digestEntry, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = canonicalRR(rr)
+		name := rr.Header().Name
+		buf := make([]byte, dns.Len(rr)+len(name)+16)
+		off, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			return "", err
+		}
+		header, err := dns.PackDomainName(name, buf[off:], 0, nil, false)
+		if err != nil {
+			return "", err
+		}
+		header += 10
+		entries = append(entries, digestEntry{name: name, typ: rr.Header().Rrtype,
+			rdata: buf[header:off], wire: buf[:off]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.name != b.name {
+			return canonicalLess(a.name, b.name)
+		}
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		return bytes.Compare(a.rdata, b.rdata) < 0
+	})
+
+	h := sha512.New384()
+	for i, e := range entries {
+		if i > 0 && bytes.Equal(e.wire, entries[i-1].wire) {
+			continue
+		}
+		h.Write(e.wire)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonicalRR returns a copy of rr with owner and embedded domain names in
+// lower case as described in rfc4034 section 6.2
+func canonicalRR(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	switch r := rr.(type) {
+	case *dns.NS:
+		r.Ns = strings.ToLower(r.Ns)
+	case *dns.CNAME:
+		r.Target = strings.ToLower(r.Target)
+	case *dns.SOA:
+		r.Ns = strings.ToLower(r.Ns)
+		r.Mbox = strings.ToLower(r.Mbox)
+	case *dns.PTR:
+		r.Ptr = strings.ToLower(r.Ptr)
+	case *dns.AFSDB:
+		r.Hostname = strings.ToLower(r.Hostname)
+	case *dns.RP:
+		r.Mbox = strings.ToLower(r.Mbox)
+		r.Txt = strings.ToLower(r.Txt)
+	case *dns.MX:
+		r.Mx = strings.ToLower(r.Mx)
+	case *dns.SRV:
+		r.Target = strings.ToLower(r.Target)
+	case *dns.NAPTR:
+		r.Replacement = strings.ToLower(r.Replacement)
+	case *dns.DNAME:
+		r.Target = strings.ToLower(r.Target)
+	case *dns.RRSIG:
+		r.SignerName = strings.ToLower(r.SignerName)
+	}
+	return rr
+}
+
+const (
+	zonemdSchemeSimple = 1
+	zonemdHashSHA384   = 1
+)
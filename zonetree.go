@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// zoneTree finds the longest zone containing a name, zones are stored in a
+// tree of labels starting from the root. labels are compared the same way as
+// dns.IsSubDomain so matches are identical to plugin.Zones.Matches
+type zoneTree struct {
+	zones    []string
+	zone     string
+	index    int
+	children map[string]*zoneTree
+}
+
+func newZoneTree(zones []string) *zoneTree {
+	root := &zoneTree{zones: zones, index: -1}
+	for i, zone := range zones {
+		node := root
+		labels := zoneLabels(zone)
+		for j := len(labels) - 1; j >= 0; j-- {
+			if node.children == nil {
+				node.children = make(map[string]*zoneTree)
+			}
+			child, ok := node.children[labels[j]]
+			if !ok {
+				child = &zoneTree{index: -1}
+				node.children[labels[j]] = child
+			}
+			node = child
+		}
+		if node.index < 0 || len(zone) > len(node.zone) {
+			node.zone, node.index = zone, i
+		}
+	}
+	return root
+}
+
+// match returns the longest zone containing qname, ties are resolved in
+// favor of the zone listed first
+func (t *zoneTree) match(qname string) string {
+	zone, index := "", -1
+	node := t
+	labels := zoneLabels(qname)
+	for j := len(labels); ; j-- {
+		if node.index >= 0 && (len(node.zone) > len(zone) || len(node.zone) == len(zone) && node.index < index) {
+			zone, index = node.zone, node.index
+		}
+		if j == 0 {
+			break
+		}
+		if node = node.children[labels[j-1]]; node == nil {
+			break
+		}
+	}
+	return zone
+}
+
+// zoneLabels splits name at label boundaries as dns.CompareDomainName does,
+// labels keep their trailing dot and are lowercased
+func zoneLabels(name string) []string {
+	idx := dns.Split(name)
+	labels := make([]string, len(idx))
+	for i := range idx {
+		end := len(name)
+		if i+1 < len(idx) {
+			end = idx[i+1]
+		}
+		labels[i] = asciiLower(name[idx[i]:end])
+	}
+	return labels
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// matchZone returns the zone serving qname, the zone tree is rebuilt on each
+// zone update. zones not loaded by LoadZones are matched one by one
+func (redis *Redis) matchZone(qname string) string {
+	redis.zonesLock.RLock()
+	defer redis.zonesLock.RUnlock()
+	if t := redis.zoneTree; t == nil || len(t.zones) != len(redis.Zones) ||
+		len(t.zones) > 0 && &t.zones[0] != &redis.Zones[0] {
+		return plugin.Zones(redis.Zones).Matches(qname)
+	}
+	return redis.zoneTree.match(qname)
+}